@@ -0,0 +1,72 @@
+// Package audit records the sessions carried by vnet conns, one JSON line per session.
+//
+// A Sink receives a Record when a session ends. Writer is a Sink encoding records as JSON Lines
+// to an io.Writer such as a File, which rotates by size.
+package audit
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// Record describes a session once it is closed.
+type Record struct {
+	Opened time.Time `json:"opened"`
+	Closed time.Time `json:"closed"`
+	// Duration is Closed - Opened in seconds.
+	Duration float64 `json:"duration"`
+	// Reason is why the session ended, see Reason.
+	Reason string `json:"reason"`
+	// Side is errs.SideDialer or errs.SideListener.
+	Side       string `json:"side"`
+	LocalAddr  string `json:"local_addr"`
+	RemoteAddr string `json:"remote_addr"`
+	// Source and Destination are the addresses of the proxied client, set with vnet.NewProxyContext.
+	Source      string `json:"source,omitempty"`
+	Destination string `json:"destination,omitempty"`
+	// Agent identifies the agent by its public key in hex or by its IP, AgentLabels are its labels.
+	Agent       string            `json:"agent,omitempty"`
+	AgentLabels map[string]string `json:"agent_labels,omitempty"`
+	// BytesIn and BytesOut are the bytes read from and written to the conn.
+	BytesIn  uint64 `json:"bytes_in"`
+	BytesOut uint64 `json:"bytes_out"`
+}
+
+// Sink receives the records of the sessions.
+// Write is called by the goroutine closing the conn, it must not block for long.
+type Sink interface {
+	Write(r Record)
+}
+
+// SinkFunc is a Sink calling itself.
+type SinkFunc func(r Record)
+
+func (f SinkFunc) Write(r Record) {
+	f(r)
+}
+
+// Reason describes the first error met by a session, or its absence:
+// `closed` if the session was closed without error, `eof` if the peer closed it,
+// `timeout` if a deadline expired, the error message otherwise.
+func Reason(err error) string {
+	if err == nil || errors.Is(err, net.ErrClosed) {
+		return `closed`
+	} else if errors.Is(err, io.EOF) {
+		return `eof`
+	} else if errors.Is(err, os.ErrDeadlineExceeded) {
+		return `timeout`
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return `timeout`
+	}
+	return err.Error()
+}
+
+// Close completes r as closed now because of err.
+func (r *Record) Close(err error) {
+	r.Closed = time.Now()
+	r.Duration = r.Closed.Sub(r.Opened).Seconds()
+	r.Reason = Reason(err)
+}
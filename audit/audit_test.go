@@ -0,0 +1,146 @@
+package audit_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/powerpuffpenguin/vnet"
+	"github.com/powerpuffpenguin/vnet/audit"
+)
+
+type syncBuffer struct {
+	m sync.Mutex
+	bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.Buffer.Write(p)
+}
+
+func TestWriter(t *testing.T) {
+	var buf syncBuffer
+	w := audit.NewWriter(&buf, 16, -1)
+	for i := 0; i < 100; i++ {
+		w.Write(audit.Record{
+			Side:    `dialer`,
+			BytesIn: uint64(i),
+		})
+	}
+	if e := w.Close(); e != nil {
+		t.Fatal(e)
+	}
+	w.Write(audit.Record{})
+	if w.Dropped() != 1 {
+		t.Fatalf("expect 1 dropped after close, got %v", w.Dropped())
+	}
+	scanner := bufio.NewScanner(&buf.Buffer)
+	var i uint64
+	for ; scanner.Scan(); i++ {
+		var r audit.Record
+		e := json.Unmarshal(scanner.Bytes(), &r)
+		if e != nil {
+			t.Fatal(e)
+		} else if r.BytesIn != i || r.Side != `dialer` {
+			t.Fatalf("unexpected record %+v", r)
+		}
+	}
+	if i != 100 {
+		t.Fatalf("expect 100 records, got %v", i)
+	}
+}
+
+type blockedWriter chan struct{}
+
+func (w blockedWriter) Write(p []byte) (int, error) {
+	<-w
+	return len(p), nil
+}
+func TestWriterBackPressure(t *testing.T) {
+	blocked := make(blockedWriter)
+	w := audit.NewWriter(blocked, 1, time.Millisecond*10)
+	start := time.Now()
+	// at most two records are being written and one is queued, the others wait then are dropped
+	for i := 0; i < 4; i++ {
+		w.Write(audit.Record{})
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("Write blocked")
+	} else if n := w.Dropped(); n < 1 || n > 3 {
+		t.Fatalf("expect dropped records, got %v", n)
+	}
+	close(blocked)
+	w.Close()
+}
+func TestFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), `audit.jsonl`)
+	f, e := audit.OpenFile(name, 10, 2)
+	if e != nil {
+		t.Fatal(e)
+	}
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, e := f.Write([]byte(line)); e != nil {
+			t.Fatal(e)
+		}
+	}
+	f.Close()
+	for suffix, expect := range map[string]string{
+		``:   "fourth\n",
+		`.1`: "third\n",
+		`.2`: "second\n",
+	} {
+		b, e := os.ReadFile(name + suffix)
+		if e != nil {
+			t.Fatal(e)
+		} else if string(b) != expect {
+			t.Fatalf("expect %q in %v, got %q", expect, suffix, b)
+		}
+	}
+	if _, e := os.Stat(name + `.3`); !os.IsNotExist(e) {
+		t.Fatal("expect 2 backups")
+	}
+}
+func TestWrapListener(t *testing.T) {
+	records := make(chan audit.Record, 1)
+	p := vnet.ListenPipe()
+	l := audit.WrapListener(p, audit.SinkFunc(func(r audit.Record) {
+		records <- r
+	}))
+	defer l.Close()
+	go func() {
+		c, e := p.Dial(`pipe`, ``)
+		if e != nil {
+			return
+		}
+		c.Write([]byte(`hello`))
+		io.Copy(io.Discard, c)
+		c.Close()
+	}()
+	c, e := l.Accept()
+	if e != nil {
+		t.Fatal(e)
+	}
+	b := make([]byte, 5)
+	io.ReadFull(c, b)
+	c.Write([]byte(`abc`))
+	c.Close()
+	r := <-records
+	if r.Side != `listener` || r.BytesIn != 5 || r.BytesOut != 3 || r.Reason != `closed` ||
+		r.RemoteAddr != `pipe` || !r.Closed.After(r.Opened) || r.Duration <= 0 {
+		t.Fatalf("unexpected record %+v", r)
+	}
+	if s := audit.Reason(io.EOF); s != `eof` {
+		t.Fatalf("unexpected reason %v", s)
+	} else if s := audit.Reason(os.ErrDeadlineExceeded); !strings.Contains(s, `timeout`) {
+		t.Fatalf("unexpected reason %v", s)
+	}
+}
@@ -0,0 +1,160 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/powerpuffpenguin/vnet"
+	"github.com/powerpuffpenguin/vnet/errs"
+)
+
+var errCloseWrite = errors.New(`close write not supported`)
+
+// Conn is a conn whose session is written to a Sink when it is closed.
+type Conn struct {
+	net.Conn
+	sink   Sink
+	record Record
+
+	read    atomic.Uint64
+	written atomic.Uint64
+
+	m   sync.Mutex
+	err error
+
+	closeOnce sync.Once
+}
+
+// NewConn starts the session of c, record holds what is known of it at open.
+// Opened and the addresses are set from c if they are empty.
+func NewConn(c net.Conn, sink Sink, record Record) *Conn {
+	if record.Opened.IsZero() {
+		record.Opened = time.Now()
+	}
+	if record.LocalAddr == `` {
+		record.LocalAddr = c.LocalAddr().String()
+	}
+	if record.RemoteAddr == `` {
+		record.RemoteAddr = c.RemoteAddr().String()
+	}
+	return &Conn{
+		Conn:   c,
+		sink:   sink,
+		record: record,
+	}
+}
+
+// Unwrap returns the underlying conn.
+func (c *Conn) Unwrap() net.Conn {
+	return c.Conn
+}
+
+// SpliceConn returns the underlying conn, the bytes moved around the conn are counted by Spliced.
+func (c *Conn) SpliceConn() net.Conn {
+	return c.Conn
+}
+
+// Spliced counts bytes read from or written to the underlying conn without the conn.
+func (c *Conn) Spliced(read, written int64) {
+	c.read.Add(uint64(read))
+	c.written.Add(uint64(written))
+}
+func (c *Conn) Read(b []byte) (n int, e error) {
+	n, e = c.Conn.Read(b)
+	c.read.Add(uint64(n))
+	if e != nil {
+		c.fail(e)
+	}
+	return
+}
+func (c *Conn) Write(b []byte) (n int, e error) {
+	n, e = c.Conn.Write(b)
+	c.written.Add(uint64(n))
+	if e != nil {
+		c.fail(e)
+	}
+	return
+}
+
+// fail keeps the first error of the session as its close reason.
+func (c *Conn) fail(e error) {
+	c.m.Lock()
+	if c.err == nil {
+		c.err = e
+	}
+	c.m.Unlock()
+}
+
+// Close closes the conn, the session is recorded the first time it is called.
+func (c *Conn) Close() error {
+	e := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		c.m.Lock()
+		err := c.err
+		c.m.Unlock()
+		r := c.record
+		r.BytesIn = c.read.Load()
+		r.BytesOut = c.written.Load()
+		r.Close(err)
+		c.sink.Write(r)
+	})
+	return e
+}
+
+// CloseWrite shuts down the writing side of the underlying conn if it supports it.
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return &net.OpError{
+		Op:     `close`,
+		Net:    c.Conn.LocalAddr().Network(),
+		Source: c.Conn.LocalAddr(),
+		Addr:   c.Conn.RemoteAddr(),
+		Err:    errCloseWrite,
+	}
+}
+
+// WrapListener returns a Listener recording the sessions of the conns accepted on l, which are *Conn.
+// Source and Destination are set from the PROXY header if l is a vnet.ProxyListener.
+func WrapListener(l net.Listener, sink Sink) vnet.Listener {
+	return &listener{
+		Listener: vnet.WrapListener(l),
+		sink:     sink,
+	}
+}
+
+type listener struct {
+	vnet.Listener
+	sink Sink
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	return l.AcceptContext(context.Background())
+}
+func (l *listener) AcceptContext(ctx context.Context) (c net.Conn, e error) {
+	c, e = l.Listener.AcceptContext(ctx)
+	if e != nil {
+		return
+	}
+	record := Record{
+		Side: errs.SideListener,
+	}
+	if pc, ok := c.(*vnet.ProxyConn); ok {
+		h := pc.Header()
+		record.Source = addrString(h.Source)
+		record.Destination = addrString(h.Destination)
+	}
+	c = NewConn(c, l.sink, record)
+	return
+}
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ``
+	}
+	return addr.String()
+}
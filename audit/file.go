@@ -0,0 +1,99 @@
+package audit
+
+import (
+	"os"
+	"strconv"
+	"sync"
+)
+
+// File is a file rotated once it would grow beyond a maximum size.
+// The rotated files are name.1, name.2 ... name.1 being the most recent.
+type File struct {
+	name       string
+	maxSize    int64
+	maxBackups int
+
+	m    sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// OpenFile opens name for appending, rotating it before a write makes it larger than maxSize,
+// and keeping maxBackups rotated files. A maxSize < 1 never rotates.
+//
+// Writes are never split, so a File written by a Writer only holds whole records.
+func OpenFile(name string, maxSize int64, maxBackups int) (*File, error) {
+	file := &File{
+		name:       name,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	e := file.open()
+	if e != nil {
+		return nil, e
+	}
+	return file, nil
+}
+func (f *File) open() error {
+	file, e := os.OpenFile(f.name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if e != nil {
+		return e
+	}
+	info, e := file.Stat()
+	if e != nil {
+		file.Close()
+		return e
+	}
+	f.f = file
+	f.size = info.Size()
+	return nil
+}
+func (f *File) Write(b []byte) (n int, e error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	if f.f == nil {
+		e = os.ErrClosed
+		return
+	}
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(b)) > f.maxSize {
+		e = f.rotate()
+		if e != nil {
+			return
+		}
+	}
+	n, e = f.f.Write(b)
+	f.size += int64(n)
+	return
+}
+
+// rotate shifts the rotated files, f.m must be held.
+// If the file can't be moved it is reopened and keeps growing, rather than losing records.
+func (f *File) rotate() error {
+	f.f.Close()
+	f.f = nil
+	if f.maxBackups < 1 {
+		os.Remove(f.name)
+	} else {
+		os.Remove(f.backup(f.maxBackups))
+		for i := f.maxBackups - 1; i > 0; i-- {
+			os.Rename(f.backup(i), f.backup(i+1))
+		}
+		os.Rename(f.name, f.backup(1))
+	}
+	return f.open()
+}
+func (f *File) backup(i int) string {
+	return f.name + `.` + strconv.Itoa(i)
+}
+
+// Close closes the file.
+func (f *File) Close() error {
+	f.m.Lock()
+	defer f.m.Unlock()
+	if f.f == nil {
+		return os.ErrClosed
+	}
+	e := f.f.Close()
+	f.f = nil
+	return e
+}
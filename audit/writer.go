@@ -0,0 +1,125 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// batchSize is the size above which a batch of lines is written without waiting for more records.
+const batchSize = 64 * 1024
+
+// Writer is a Sink writing records as JSON Lines to an io.Writer.
+// Records are queued and written by a single goroutine, in batches of whole lines.
+type Writer struct {
+	w       io.Writer
+	ch      chan Record
+	timeout time.Duration
+	done    chan struct{}
+
+	m      sync.RWMutex
+	closed bool
+
+	dropped atomic.Uint64
+	errm    sync.Mutex
+	err     error
+}
+
+// NewWriter returns a Writer queuing up to size records.
+// When the queue is full Write waits up to timeout for room, then drops the record and counts it.
+// A timeout of 0 drops at once, a negative timeout waits as long as needed, slowing the closing of conns down to the speed of w.
+func NewWriter(w io.Writer, size int, timeout time.Duration) *Writer {
+	if size < 1 {
+		size = 1
+	}
+	writer := &Writer{
+		w:       w,
+		ch:      make(chan Record, size),
+		timeout: timeout,
+		done:    make(chan struct{}),
+	}
+	go writer.run()
+	return writer
+}
+
+// Write queues r.
+func (w *Writer) Write(r Record) {
+	w.m.RLock()
+	defer w.m.RUnlock()
+	if w.closed {
+		w.dropped.Add(1)
+		return
+	}
+	select {
+	case w.ch <- r:
+		return
+	default:
+	}
+	if w.timeout == 0 {
+		w.dropped.Add(1)
+		return
+	} else if w.timeout < 0 {
+		w.ch <- r
+		return
+	}
+	t := time.NewTimer(w.timeout)
+	select {
+	case w.ch <- r:
+		t.Stop()
+	case <-t.C:
+		w.dropped.Add(1)
+	}
+}
+
+// Dropped returns the number of records dropped because the queue was full, w failed or the Writer was closed.
+func (w *Writer) Dropped() uint64 {
+	return w.dropped.Load()
+}
+
+// Err returns the last error returned by the underlying writer.
+func (w *Writer) Err() error {
+	w.errm.Lock()
+	e := w.err
+	w.errm.Unlock()
+	return e
+}
+
+// Close writes the queued records and stops the Writer, records written later are dropped.
+// It does not close the underlying writer.
+func (w *Writer) Close() error {
+	w.m.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.ch)
+	}
+	w.m.Unlock()
+	<-w.done
+	return w.Err()
+}
+func (w *Writer) run() {
+	defer close(w.done)
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	var n uint64
+	for r := range w.ch {
+		if enc.Encode(&r) == nil {
+			n++
+		} else {
+			w.dropped.Add(1)
+		}
+		if len(w.ch) != 0 && buf.Len() < batchSize {
+			continue
+		}
+		if _, e := w.w.Write(buf.Bytes()); e != nil {
+			w.errm.Lock()
+			w.err = e
+			w.errm.Unlock()
+			w.dropped.Add(n)
+		}
+		buf.Reset()
+		n = 0
+	}
+}
@@ -0,0 +1,388 @@
+package vnet
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrCompress = errors.New(`invalid compressed record`)
+var errCloseWrite = errors.New(`close write not supported`)
+
+// maxCompressChunk is the largest plaintext compressed into one record.
+const maxCompressChunk = 16 * 1024
+
+// maxCompressRecord is the largest record on the wire, its length is written in 2 bytes.
+const maxCompressRecord = 0xffff
+
+// compressWindow is the flate window, the history a record may refer to.
+const compressWindow = 32 * 1024
+
+// closeFlushTimeout bounds the flush of pending data on Close.
+const closeFlushTimeout = time.Second * 5
+
+// compressTail terminates a sync flushed record so that the decompressor ends cleanly.
+var compressTail = []byte{0x01, 0x00, 0x00, 0xff, 0xff}
+
+// CompressConn is a net.Conn whose stream is compressed with flate.
+//
+// Written data is flushed in records at most delay after it was written, so interactive traffic is never held back
+// while small writes made close together are coalesced, and the window is kept across records so that the stream compresses as a whole.
+// A Read interrupted by a deadline can be retried, a failed Write or flush breaks the CompressConn.
+type CompressConn struct {
+	net.Conn
+
+	rm    sync.Mutex
+	fr    io.ReadCloser
+	src   bytes.Reader
+	raw   []byte // partial record read from Conn
+	plain []byte // decompressed bytes not read yet
+	hist  []byte // the window of the decompressed stream
+	rerr  error
+
+	wm      sync.Mutex
+	fw      *flate.Writer
+	wbuf    bytes.Buffer
+	pending int // bytes written to fw since the last flush
+	delay   time.Duration
+	timer   *time.Timer
+	armed   bool
+	werr    error
+}
+
+// Compress returns a CompressConn over c, level is a compress/flate level.
+// delay bounds how long written data waits for more writes before it is flushed, 0 flushes every Write before it returns.
+// Small writes only compress well at levels above 6 or when a delay coalesces them.
+// The peer must wrap its end of c the same way, levels and delays may differ.
+func Compress(c net.Conn, level int, delay time.Duration) (cc *CompressConn, e error) {
+	cc = &CompressConn{
+		Conn:  c,
+		delay: delay,
+	}
+	cc.wbuf.Write([]byte{0, 0})
+	cc.fw, e = flate.NewWriter(&cc.wbuf, level)
+	if e != nil {
+		cc = nil
+		return
+	}
+	cc.fr = flate.NewReader(&cc.src)
+	return
+}
+
+// NetConn returns the underlying conn.
+func (c *CompressConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// Read reads and decompresses data from the conn.
+func (c *CompressConn) Read(b []byte) (n int, e error) {
+	c.rm.Lock()
+	defer c.rm.Unlock()
+	for len(c.plain) == 0 {
+		if c.rerr != nil {
+			e = c.rerr
+			return
+		} else if len(b) == 0 {
+			return
+		}
+		e = c.readRecord()
+		if e != nil {
+			return
+		}
+	}
+	n = copy(b, c.plain)
+	c.plain = c.plain[n:]
+	return
+}
+
+// readRecord reads and decompresses the next record,
+// the bytes of a record interrupted by an error are kept so that the next call resumes it.
+func (c *CompressConn) readRecord() (e error) {
+	for {
+		need := 2
+		if len(c.raw) >= 2 {
+			need += int(binary.BigEndian.Uint16(c.raw))
+			if len(c.raw) == need {
+				break
+			}
+		}
+		if cap(c.raw) < need+len(compressTail) {
+			raw := make([]byte, len(c.raw), 2+maxCompressRecord+len(compressTail))
+			copy(raw, c.raw)
+			c.raw = raw
+		}
+		var n int
+		n, e = c.Conn.Read(c.raw[len(c.raw):need])
+		c.raw = c.raw[:len(c.raw)+n]
+		if e != nil {
+			if e == io.EOF && len(c.raw) != 0 {
+				e = io.ErrUnexpectedEOF
+			}
+			if e != io.EOF {
+				if ne, ok := e.(net.Error); !ok || !ne.Timeout() {
+					c.rerr = e
+				}
+			}
+			return
+		}
+	}
+	e = c.decompress(append(c.raw[2:], compressTail...))
+	c.raw = c.raw[:0]
+	if e != nil {
+		e = fmt.Errorf(`%w: %v`, ErrCompress, e)
+		c.rerr = e
+	}
+	return
+}
+
+// decompress inflates record with the window of the previous records and appends the result to the window.
+func (c *CompressConn) decompress(record []byte) (e error) {
+	c.src.Reset(record)
+	e = c.fr.(flate.Resetter).Reset(&c.src, c.hist)
+	if e != nil {
+		return
+	}
+	start := len(c.hist)
+	if cap(c.hist) < start+maxCompressChunk+1 {
+		hist := make([]byte, start, compressWindow+maxCompressChunk+1)
+		copy(hist, c.hist)
+		c.hist = hist
+	}
+	// a record never carries more than a chunk, anything larger is refused before it is inflated
+	var n int
+	for e == nil && len(c.hist) < cap(c.hist) {
+		n, e = c.fr.Read(c.hist[len(c.hist):cap(c.hist)])
+		c.hist = c.hist[:len(c.hist)+n]
+	}
+	if e != io.EOF {
+		if e == nil {
+			e = errors.New(`record too large`)
+		}
+		return
+	}
+	e = nil
+	if len(c.hist)-start > maxCompressChunk {
+		e = errors.New(`record too large`)
+		return
+	}
+	c.plain = c.hist[start:]
+	if len(c.hist) > compressWindow {
+		// keep the window at the front, plain stays valid as it refers to the old array
+		hist := make([]byte, compressWindow, cap(c.hist))
+		copy(hist, c.hist[len(c.hist)-compressWindow:])
+		c.hist = hist
+	}
+	return
+}
+
+// Write compresses b and writes it in records.
+// With a delay, the last record of b may be written after Write returns, a failure is returned by the next call.
+func (c *CompressConn) Write(b []byte) (n int, e error) {
+	c.wm.Lock()
+	defer c.wm.Unlock()
+	if c.werr != nil {
+		e = c.werr
+		return
+	}
+	for len(b) != 0 {
+		size := len(b)
+		if size > maxCompressChunk-c.pending {
+			size = maxCompressChunk - c.pending
+		}
+		_, e = c.fw.Write(b[:size])
+		if e != nil {
+			c.werr = e
+			return
+		}
+		c.pending += size
+		n += size
+		b = b[size:]
+		if c.pending == maxCompressChunk || (len(b) == 0 && c.delay <= 0) {
+			buffered := c.pending
+			e = c.flush()
+			if e != nil {
+				if buffered > n {
+					buffered = n
+				}
+				n -= buffered
+				return
+			}
+		}
+	}
+	if c.pending != 0 && !c.armed {
+		c.armed = true
+		if c.timer == nil {
+			c.timer = time.AfterFunc(c.delay, c.onTimer)
+		} else {
+			c.timer.Reset(c.delay)
+		}
+	}
+	return
+}
+
+// Flush writes the data not flushed yet.
+func (c *CompressConn) Flush() (e error) {
+	c.wm.Lock()
+	defer c.wm.Unlock()
+	if c.werr != nil {
+		e = c.werr
+	} else if c.pending != 0 {
+		e = c.flush()
+	}
+	return
+}
+func (c *CompressConn) onTimer() {
+	c.wm.Lock()
+	c.armed = false
+	if c.werr == nil && c.pending != 0 {
+		c.flush()
+	}
+	c.wm.Unlock()
+}
+
+// flush writes the pending data as a record, c.wm must be held.
+func (c *CompressConn) flush() (e error) {
+	e = c.fw.Flush()
+	if e == nil {
+		record := c.wbuf.Bytes()
+		if len(record)-2 > maxCompressRecord {
+			e = errors.New(`compressed record too large`)
+		} else {
+			binary.BigEndian.PutUint16(record, uint16(len(record)-2))
+			_, e = c.Conn.Write(record)
+		}
+	}
+	if e != nil {
+		// a record may be partly written, the stream can't be used any more
+		c.werr = e
+		return
+	}
+	c.pending = 0
+	c.wbuf.Reset()
+	c.wbuf.Write([]byte{0, 0})
+	return
+}
+
+// Close flushes the data not flushed yet and closes the conn.
+// A Write blocked meanwhile is not waited for, its data is dropped.
+func (c *CompressConn) Close() error {
+	if c.wm.TryLock() {
+		if c.timer != nil {
+			c.timer.Stop()
+		}
+		if c.werr == nil && c.pending != 0 {
+			// like tls close notify, don't let a peer that stopped reading block Close
+			c.Conn.SetWriteDeadline(time.Now().Add(closeFlushTimeout))
+			c.flush()
+		}
+		c.werr = ErrClosed
+		c.wm.Unlock()
+	}
+	return c.Conn.Close()
+}
+
+// CloseWrite flushes the data not flushed yet and shuts down the writing side of the underlying conn
+// if it supports it, as *net.TCPConn does.
+func (c *CompressConn) CloseWrite() (e error) {
+	cw, ok := c.Conn.(interface{ CloseWrite() error })
+	if !ok {
+		e = &net.OpError{
+			Op:     `close`,
+			Net:    c.Conn.LocalAddr().Network(),
+			Source: c.Conn.LocalAddr(),
+			Addr:   c.Conn.RemoteAddr(),
+			Err:    errCloseWrite,
+		}
+		return
+	}
+	c.wm.Lock()
+	defer c.wm.Unlock()
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	if c.werr != nil {
+		e = c.werr
+		return
+	} else if c.pending != 0 {
+		e = c.flush()
+		if e != nil {
+			return
+		}
+	}
+	c.werr = ErrClosed
+	e = cw.CloseWrite()
+	return
+}
+
+// CompressDialer returns a Dialer whose conns are compressed by Compress at level with delay.
+func CompressDialer(d Dialer, level int, delay time.Duration) Dialer {
+	return &compressDialer{
+		Dialer: d,
+		level:  level,
+		delay:  delay,
+	}
+}
+
+type compressDialer struct {
+	Dialer
+	level int
+	delay time.Duration
+}
+
+func (d *compressDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+func (d *compressDialer) DialContext(ctx context.Context, network, addr string) (c net.Conn, e error) {
+	c, e = d.Dialer.DialContext(ctx, network, addr)
+	if e != nil {
+		return
+	}
+	cc, e := Compress(c, d.level, d.delay)
+	if e != nil {
+		c.Close()
+		c = nil
+		return
+	}
+	c = cc
+	return
+}
+
+// CompressListener returns a Listener whose conns are compressed by Compress at level with delay.
+func CompressListener(l net.Listener, level int, delay time.Duration) Listener {
+	return &compressListener{
+		Listener: WrapListener(l),
+		level:    level,
+		delay:    delay,
+	}
+}
+
+type compressListener struct {
+	Listener
+	level int
+	delay time.Duration
+}
+
+func (l *compressListener) Accept() (net.Conn, error) {
+	return l.AcceptContext(context.Background())
+}
+func (l *compressListener) AcceptContext(ctx context.Context) (c net.Conn, e error) {
+	c, e = l.Listener.AcceptContext(ctx)
+	if e != nil {
+		return
+	}
+	cc, e := Compress(c, l.level, l.delay)
+	if e != nil {
+		c.Close()
+		c = nil
+		return
+	}
+	c = cc
+	return
+}
@@ -0,0 +1,138 @@
+package vnet_test
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/powerpuffpenguin/vnet"
+)
+
+// countConn counts the bytes written to the underlying conn.
+type countConn struct {
+	net.Conn
+	n int
+}
+
+func (c *countConn) Write(b []byte) (n int, e error) {
+	n, e = c.Conn.Write(b)
+	c.n += n
+	return
+}
+
+func TestCompress(t *testing.T) {
+	p := vnet.ListenPipe()
+	defer p.Close()
+	var (
+		l = vnet.CompressListener(p, flate.BestSpeed, 0)
+		d = vnet.CompressDialer(p, flate.DefaultCompression, time.Millisecond)
+	)
+	go func() {
+		c, e := l.Accept()
+		if e != nil {
+			return
+		}
+		io.Copy(c, c)
+		c.Close()
+	}()
+	c, e := d.Dial(`pipe`, ``)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer c.Close()
+
+	random := make([]byte, 100*1024)
+	rand.Read(random)
+	for _, data := range [][]byte{
+		[]byte(`{"ping":1}`),
+		[]byte(strings.Repeat(`{"level":"info","msg":"compressible"}`, 4096)),
+		random,
+	} {
+		go c.Write(data)
+		b := make([]byte, len(data))
+		_, e = io.ReadFull(c, b)
+		if e != nil {
+			t.Fatal(e)
+		} else if !bytes.Equal(b, data) {
+			t.Fatal("data mismatch")
+		}
+	}
+}
+func TestCompressRatio(t *testing.T) {
+	c0, c1 := net.Pipe()
+	counter := &countConn{Conn: c0}
+	w, e := vnet.Compress(counter, flate.DefaultCompression, time.Millisecond*10)
+	if e != nil {
+		t.Fatal(e)
+	}
+	r, e := vnet.Compress(c1, flate.DefaultCompression, 0)
+	if e != nil {
+		t.Fatal(e)
+	}
+	line := []byte(`{"level":"info","msg":"agent heartbeat","load":3}` + "\n")
+	go func() {
+		for i := 0; i < 1000; i++ {
+			w.Write(line)
+		}
+		w.Close()
+	}()
+	b, e := io.ReadAll(r)
+	if !errors.Is(e, io.ErrClosedPipe) && e != nil {
+		t.Fatal(e)
+	} else if !bytes.Equal(b, bytes.Repeat(line, 1000)) {
+		t.Fatal("data mismatch")
+	}
+	// small writes made close together are coalesced
+	if counter.n > len(b)/4 {
+		t.Fatalf("expect compressed, wrote %v of %v bytes", counter.n, len(b))
+	}
+}
+func TestCompressDeadline(t *testing.T) {
+	c0, c1 := net.Pipe()
+	defer c0.Close()
+	w, e := vnet.Compress(c0, flate.DefaultCompression, 0)
+	if e != nil {
+		t.Fatal(e)
+	}
+	r, e := vnet.Compress(c1, flate.DefaultCompression, 0)
+	if e != nil {
+		t.Fatal(e)
+	}
+	r.SetReadDeadline(time.Now().Add(time.Millisecond * 50))
+	b := make([]byte, 4)
+	_, e = r.Read(b)
+	if ne, ok := e.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("expect timeout, got %v", e)
+	}
+	// a read interrupted by a deadline can be retried
+	r.SetReadDeadline(time.Time{})
+	go w.Write([]byte(`ping`))
+	_, e = io.ReadFull(r, b)
+	if e != nil || string(b) != `ping` {
+		t.Fatal(e, string(b))
+	}
+}
+func TestCompressInvalid(t *testing.T) {
+	c0, c1 := net.Pipe()
+	defer c0.Close()
+	r, e := vnet.Compress(c1, flate.DefaultCompression, 0)
+	if e != nil {
+		t.Fatal(e)
+	}
+	go c0.Write([]byte{0, 3, 0xff, 0xff, 0xff})
+	_, e = r.Read(make([]byte, 4))
+	if !errors.Is(e, vnet.ErrCompress) {
+		t.Fatalf("expect ErrCompress, got %v", e)
+	}
+
+	_, e = vnet.Compress(c0, 100, 0)
+	if e == nil {
+		t.Fatal("expect invalid level to fail")
+	}
+}
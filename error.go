@@ -1,11 +1,12 @@
 package vnet
 
 import (
-	"errors"
+	"net"
 
 	"github.com/powerpuffpenguin/vnet/errs"
 )
 
-var ErrClosed = errors.New(`already closed`)
+// ErrClosed wraps net.ErrClosed, so errors.Is(e, net.ErrClosed) holds for every closed error.
+var ErrClosed = errs.WrapError(net.ErrClosed, `already closed`)
 var ErrListenerClosed = errs.WrapError(ErrClosed, `listener already closed`)
 var ErrDialerClosed = errs.WrapError(ErrClosed, `dialer already closed`)
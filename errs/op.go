@@ -0,0 +1,92 @@
+package errs
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+)
+
+const (
+	SideDialer   = `dialer`
+	SideListener = `listener`
+)
+
+// OpError is the error type returned by vnet dialers and listeners, it works like net.OpError.
+type OpError struct {
+	// Op is the operation which caused the error, such as "dial", "accept" or "handshake".
+	Op string
+	// Side is SideDialer or SideListener.
+	Side string
+	// Addr is the remote address of the operation, it may be nil.
+	Addr net.Addr
+	// Version is the protocol version in use, zero if unknown.
+	Version uint8
+	// Event is the protocol event being exchanged, zero if unknown.
+	Event uint8
+	// Err is the error that occurred during the operation.
+	Err error
+}
+
+// NewOpError returns e wrapped in an OpError.
+// It returns nil if e is nil and returns e unchanged if it already is an OpError.
+// Version and Event are taken from a ProtocolError found in the chain of e.
+func NewOpError(op, side string, addr net.Addr, e error) error {
+	if e == nil {
+		return nil
+	}
+	var oe *OpError
+	if errors.As(e, &oe) {
+		return e
+	}
+	oe = &OpError{
+		Op:   op,
+		Side: side,
+		Addr: addr,
+		Err:  e,
+	}
+	var pe *ProtocolError
+	if errors.As(e, &pe) {
+		oe.Version = pe.Version
+		oe.Event = pe.Event
+	}
+	return oe
+}
+
+func (e *OpError) Error() string {
+	var sb strings.Builder
+	if e.Side != `` {
+		sb.WriteString(e.Side)
+		sb.WriteByte(' ')
+	}
+	sb.WriteString(e.Op)
+	if e.Addr != nil {
+		sb.WriteByte(' ')
+		sb.WriteString(e.Addr.Network())
+		sb.WriteByte(' ')
+		sb.WriteString(e.Addr.String())
+	}
+	if e.Err != nil {
+		sb.WriteString(`: `)
+		sb.WriteString(e.Err.Error())
+	}
+	return sb.String()
+}
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout implements net.Error, context.DeadlineExceeded is a timeout too.
+func (e *OpError) Timeout() bool {
+	if errors.Is(e.Err, context.DeadlineExceeded) {
+		return true
+	}
+	ne, ok := e.Err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// Temporary implements net.Error.
+func (e *OpError) Temporary() bool {
+	ne, ok := e.Err.(net.Error)
+	return ok && ne.Temporary()
+}
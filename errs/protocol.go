@@ -0,0 +1,35 @@
+package errs
+
+// ProtocolError reports a frame that violates the protocol.
+type ProtocolError struct {
+	// Err is the protocol sentinel, such as reverse.ErrProtocol.
+	Err error
+	// Flag is the flag of the offending frame, zero if unknown.
+	Flag uint16
+	// Version is the version of the offending frame, zero if unknown.
+	Version uint8
+	// Event is the event of the offending frame, zero if unknown.
+	Event uint8
+	// Msg describes the violation.
+	Msg string
+}
+
+func (e *ProtocolError) Error() string {
+	if e.Err == nil {
+		return e.Msg
+	}
+	return e.Err.Error() + `: ` + e.Msg
+}
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout implements net.Error, a protocol error is never a timeout.
+func (e *ProtocolError) Timeout() bool {
+	return false
+}
+
+// Temporary implements net.Error, a protocol error is never temporary.
+func (e *ProtocolError) Temporary() bool {
+	return false
+}
@@ -1,5 +1,7 @@
 package errs
 
+import "net"
+
 func WrapError(e error, msg string) error {
 	return &wrapError{
 		err: e,
@@ -18,3 +20,15 @@ func (e *wrapError) Error() string {
 func (e *wrapError) Unwrap() error {
 	return e.err
 }
+
+// Timeout implements net.Error, it reports whether the wrapped error is a timeout.
+func (e *wrapError) Timeout() bool {
+	ne, ok := e.err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// Temporary implements net.Error, it reports whether the wrapped error is temporary.
+func (e *wrapError) Temporary() bool {
+	ne, ok := e.err.(net.Error)
+	return ok && ne.Temporary()
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"log"
 	"net"
 	grpc_math "reverse_grpc/math"
@@ -39,7 +40,7 @@ func runClient(addr string) {
 	}()
 
 	e = dialer.Serve()
-	if e != vnet.ErrDialerClosed {
+	if !errors.Is(e, vnet.ErrDialerClosed) {
 		log.Fatalln(e)
 	}
 }
@@ -1,3 +1,3 @@
 module github.com/powerpuffpenguin/vnet
 
-go 1.16
+go 1.20
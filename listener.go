@@ -0,0 +1,151 @@
+package vnet
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// maxPreparing bounds the conns being prepared or waiting for an Accept,
+// once reached no conn is accepted until one of them is done, the others wait in the backlog.
+const maxPreparing = 256
+
+type acceptResult struct {
+	c net.Conn
+	e error
+}
+
+// WrapListener returns a Listener accepting on l.
+// If l is already a Listener it is returned as is.
+//
+// A single goroutine accepts on l, a conn accepted after its AcceptContext gave up is returned by the next call.
+func WrapListener(l net.Listener) Listener {
+	if listener, ok := l.(Listener); ok {
+		return listener
+	}
+	return newWrapListener(l, nil)
+}
+func newWrapListener(l net.Listener, prepare func(c net.Conn) net.Conn) *wrapListener {
+	return &wrapListener{
+		Listener:  l,
+		prepare:   prepare,
+		preparing: make(chan struct{}, maxPreparing),
+		ch:        make(chan acceptResult),
+		close:     make(chan struct{}),
+		failed:    make(chan struct{}),
+	}
+}
+
+type wrapListener struct {
+	net.Listener
+	// prepare, if set, is run by a goroutine per accepted conn,
+	// it returns the conn to return from Accept or nil if it closed the conn
+	prepare func(c net.Conn) net.Conn
+	// preparing holds a token per conn being prepared
+	preparing chan struct{}
+	ch        chan acceptResult
+	once      sync.Once
+	close     chan struct{}
+	done      uint32
+	m         sync.Mutex
+
+	failed chan struct{}
+	err    error
+}
+
+func (l *wrapListener) Accept() (net.Conn, error) {
+	return l.AcceptContext(context.Background())
+}
+func (l *wrapListener) AcceptContext(ctx context.Context) (c net.Conn, e error) {
+	if atomic.LoadUint32(&l.done) != 0 {
+		e = ErrListenerClosed
+		return
+	}
+	l.once.Do(func() {
+		go l.run()
+	})
+	select {
+	case result := <-l.ch:
+		c = result.c
+		e = result.e
+	case <-l.failed:
+		e = l.err
+	case <-l.close:
+		e = ErrListenerClosed
+	case <-ctx.Done():
+		e = ctx.Err()
+	}
+	return
+}
+func (l *wrapListener) run() {
+	for {
+		if l.prepare != nil {
+			select {
+			case l.preparing <- struct{}{}:
+			case <-l.close:
+				return
+			}
+		}
+		c, e := l.Listener.Accept()
+		if e != nil {
+			if l.prepare != nil {
+				<-l.preparing
+			}
+			if ne, ok := e.(net.Error); !ok || !ne.Temporary() {
+				// the error is returned to every call from now on
+				l.err = e
+				close(l.failed)
+				return
+			}
+		} else if l.prepare != nil {
+			go l.prepared(c)
+			continue
+		}
+		if !l.deliver(acceptResult{
+			c: c,
+			e: e,
+		}) {
+			return
+		}
+	}
+}
+func (l *wrapListener) prepared(c net.Conn) {
+	defer func() {
+		<-l.preparing
+	}()
+	c = l.prepare(c)
+	if c != nil {
+		l.deliver(acceptResult{c: c})
+	}
+}
+
+// deliver hands result to an AcceptContext call, it returns false if the listener is closed meanwhile.
+func (l *wrapListener) deliver(result acceptResult) bool {
+	select {
+	case l.ch <- result:
+		return true
+	case <-l.close:
+		if result.c != nil {
+			result.c.Close()
+		}
+		return false
+	}
+}
+
+// Close closes the listener.
+// Any blocked Accept operations will be unblocked and return errors.
+func (l *wrapListener) Close() (e error) {
+	if atomic.LoadUint32(&l.done) == 0 {
+		l.m.Lock()
+		defer l.m.Unlock()
+		if l.done == 0 {
+			defer atomic.StoreUint32(&l.done, 1)
+			close(l.close)
+			e = l.Listener.Close()
+			return
+		}
+	}
+	e = ErrListenerClosed
+	return
+}
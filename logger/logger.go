@@ -0,0 +1,102 @@
+// Package logger is the minimal leveled structured logger through which vnet reports the failures it recovers from.
+//
+// Std adapts a *log.Logger of the standard library, Slog adapts a *slog.Logger.
+package logger
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// Level is the importance of a record, its values are the values of the slog levels.
+type Level int8
+
+const (
+	LevelDebug Level = -4
+	LevelInfo  Level = 0
+	LevelWarn  Level = 4
+	LevelError Level = 8
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return `DEBUG`
+	case LevelInfo:
+		return `INFO`
+	case LevelWarn:
+		return `WARN`
+	case LevelError:
+		return `ERROR`
+	}
+	return `LEVEL(` + strconv.Itoa(int(l)) + `)`
+}
+
+// Logger logs records made of a level, a message and attributes.
+type Logger interface {
+	// Enabled reports whether records at level are logged, so that building costly attributes can be skipped.
+	Enabled(level Level) bool
+	// Log logs msg with keyvals, alternating string keys and values.
+	Log(level Level, msg string, keyvals ...interface{})
+}
+
+// Discard is a Logger that logs nothing.
+var Discard Logger = discard{}
+
+type discard struct{}
+
+func (discard) Enabled(level Level) bool {
+	return false
+}
+func (discard) Log(level Level, msg string, keyvals ...interface{}) {}
+
+// Std returns a Logger writing the records at min or above to l,
+// formatted as the level, the message and key=value pairs, values being quoted if needed.
+func Std(l *log.Logger, min Level) Logger {
+	return &stdLogger{
+		l:   l,
+		min: min,
+	}
+}
+
+type stdLogger struct {
+	l   *log.Logger
+	min Level
+}
+
+func (s *stdLogger) Enabled(level Level) bool {
+	return level >= s.min
+}
+func (s *stdLogger) Log(level Level, msg string, keyvals ...interface{}) {
+	if level < s.min {
+		return
+	}
+	var b strings.Builder
+	b.WriteString(level.String())
+	b.WriteByte(' ')
+	b.WriteString(msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		b.WriteByte(' ')
+		if i+1 == len(keyvals) {
+			b.WriteString(`!BADKEY=`)
+			b.WriteString(quote(fmt.Sprint(keyvals[i])))
+			break
+		}
+		b.WriteString(fmt.Sprint(keyvals[i]))
+		b.WriteByte('=')
+		b.WriteString(quote(fmt.Sprint(keyvals[i+1])))
+	}
+	s.l.Output(2, b.String())
+}
+
+// quote quotes s if it is empty or contains spaces, quotes, equal signs or control characters.
+func quote(s string) string {
+	if s == `` || strings.IndexFunc(s, func(r rune) bool {
+		return r <= ' ' || r == '"' || r == '=' || r == 0x7f
+	}) != -1 {
+		return strconv.Quote(s)
+	}
+	return s
+}
@@ -0,0 +1,30 @@
+package logger_test
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"testing"
+
+	"github.com/powerpuffpenguin/vnet/logger"
+)
+
+func TestStd(t *testing.T) {
+	var buf bytes.Buffer
+	l := logger.Std(log.New(&buf, ``, 0), logger.LevelInfo)
+	if l.Enabled(logger.LevelDebug) || !l.Enabled(logger.LevelWarn) {
+		t.Fatal("unexpected enabled levels")
+	}
+	l.Log(logger.LevelDebug, `hidden`)
+	l.Log(logger.LevelWarn, `heart failed`, `remote`, `127.0.0.1:80`, `err`, errors.New(`broken pipe`), `empty`, ``, `odd`)
+	expect := "WARN heart failed remote=127.0.0.1:80 err=\"broken pipe\" empty=\"\" !BADKEY=odd\n"
+	if s := buf.String(); s != expect {
+		t.Fatalf("expect %q, got %q", expect, s)
+	}
+	if s := logger.Level(2).String(); s != `LEVEL(2)` {
+		t.Fatalf("unexpected level %v", s)
+	}
+	if logger.Discard.Enabled(logger.LevelError) {
+		t.Fatal("expect Discard disabled")
+	}
+}
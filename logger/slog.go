@@ -0,0 +1,26 @@
+//go:build go1.21
+
+package logger
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Slog returns a Logger logging to l.
+func Slog(l *slog.Logger) Logger {
+	return slogLogger{
+		l: l,
+	}
+}
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+func (s slogLogger) Enabled(level Level) bool {
+	return s.l.Enabled(context.Background(), slog.Level(level))
+}
+func (s slogLogger) Log(level Level, msg string, keyvals ...interface{}) {
+	s.l.Log(context.Background(), slog.Level(level), msg, keyvals...)
+}
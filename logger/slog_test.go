@@ -0,0 +1,33 @@
+//go:build go1.21
+
+package logger_test
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+
+	"github.com/powerpuffpenguin/vnet/logger"
+)
+
+func TestSlog(t *testing.T) {
+	var buf bytes.Buffer
+	l := logger.Slog(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		Level: slog.LevelWarn,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})))
+	if l.Enabled(logger.LevelInfo) || !l.Enabled(logger.LevelError) {
+		t.Fatal("unexpected enabled levels")
+	}
+	l.Log(logger.LevelInfo, `hidden`)
+	l.Log(logger.LevelError, `protocol violation`, `remote`, `127.0.0.1:80`)
+	expect := "level=ERROR msg=\"protocol violation\" remote=127.0.0.1:80\n"
+	if s := buf.String(); s != expect {
+		t.Fatalf("expect %q, got %q", expect, s)
+	}
+}
@@ -0,0 +1,97 @@
+package metrics
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+var errCloseWrite = errors.New(`close write not supported`)
+
+// ConnMetrics are the metrics of the conns of a listener or a dialer.
+type ConnMetrics struct {
+	Read    Counter
+	Written Counter
+	Active  Gauge
+}
+
+// NewConnMetrics creates prefix+"bytes_read_total", prefix+"bytes_written_total" and prefix+"active_conns" in r.
+func NewConnMetrics(r Registry, prefix string) *ConnMetrics {
+	return &ConnMetrics{
+		Read:    r.Counter(prefix+`bytes_read_total`, `Bytes read through the conns.`),
+		Written: r.Counter(prefix+`bytes_written_total`, `Bytes written through the conns.`),
+		Active:  r.Gauge(prefix+`active_conns`, `Conns open.`),
+	}
+}
+
+// Wrap counts c as active until it is closed, and the bytes read and written through it.
+func (m *ConnMetrics) Wrap(c net.Conn) *Conn {
+	m.Active.Add(1)
+	return &Conn{
+		Conn:    c,
+		metrics: m,
+	}
+}
+
+// Conn is a conn updating ConnMetrics.
+type Conn struct {
+	net.Conn
+	metrics   *ConnMetrics
+	closeOnce sync.Once
+}
+
+// Unwrap returns the underlying conn.
+func (c *Conn) Unwrap() net.Conn {
+	return c.Conn
+}
+
+// SpliceConn returns the underlying conn, the bytes moved around the conn are counted by Spliced.
+func (c *Conn) SpliceConn() net.Conn {
+	return c.Conn
+}
+
+// Spliced counts bytes read from or written to the underlying conn without the conn.
+func (c *Conn) Spliced(read, written int64) {
+	if read > 0 {
+		c.metrics.Read.Add(float64(read))
+	}
+	if written > 0 {
+		c.metrics.Written.Add(float64(written))
+	}
+}
+func (c *Conn) Read(b []byte) (n int, e error) {
+	n, e = c.Conn.Read(b)
+	if n > 0 {
+		c.metrics.Read.Add(float64(n))
+	}
+	return
+}
+func (c *Conn) Write(b []byte) (n int, e error) {
+	n, e = c.Conn.Write(b)
+	if n > 0 {
+		c.metrics.Written.Add(float64(n))
+	}
+	return
+}
+
+// Close closes the underlying conn, the conn stops being active the first time it is called.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		c.metrics.Active.Add(-1)
+	})
+	return c.Conn.Close()
+}
+
+// CloseWrite shuts down the writing side of the underlying conn if it supports it.
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return &net.OpError{
+		Op:     `close`,
+		Net:    c.Conn.LocalAddr().Network(),
+		Source: c.Conn.LocalAddr(),
+		Addr:   c.Conn.RemoteAddr(),
+		Err:    errCloseWrite,
+	}
+}
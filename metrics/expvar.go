@@ -0,0 +1,65 @@
+package metrics
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+)
+
+var expvars = struct {
+	sync.Mutex
+	m map[string]*Expvar
+}{
+	m: make(map[string]*Expvar),
+}
+
+// Expvar is a Registry publishing its metrics with package expvar, so they are served by /debug/vars.
+// The metrics are published in one expvar.Map named after the registry.
+// Counters and gauges are numbers, histograms are objects holding the count, the sum and the cumulative count of every bucket.
+type Expvar struct {
+	set set
+	m   *expvar.Map
+}
+
+// NewExpvar returns the registry published as name, creating it the first time name is asked for,
+// so instances asking for the same name aggregate their metrics as with any shared registry.
+// It panics if name is already published by another package, as expvar.Publish does.
+func NewExpvar(name string) *Expvar {
+	expvars.Lock()
+	defer expvars.Unlock()
+	if x, ok := expvars.m[name]; ok {
+		return x
+	} else if expvar.Get(name) != nil {
+		panic(fmt.Sprintf(`metrics: expvar %s already published`, name))
+	}
+	x := &Expvar{
+		m: new(expvar.Map),
+	}
+	expvar.Publish(name, x.m)
+	expvars.m[name] = x
+	return x
+}
+func (x *Expvar) Counter(name, help string) Counter {
+	return x.get(name, kindCounter, help, func() interface{} {
+		return &value{}
+	}).(*value)
+}
+func (x *Expvar) Gauge(name, help string) Gauge {
+	return x.get(name, kindGauge, help, func() interface{} {
+		return &value{}
+	}).(*value)
+}
+func (x *Expvar) Histogram(name, help string, buckets []float64) Histogram {
+	return x.get(name, kindHistogram, help, func() interface{} {
+		return newHistogram(buckets)
+	}).(*histogram)
+}
+
+// get adds a metric created the first time name is asked for to the map of the registry.
+func (x *Expvar) get(name, kind, help string, create func() interface{}) interface{} {
+	return x.set.get(name, kind, help, func() interface{} {
+		metric := create()
+		x.m.Set(name, metric.(expvar.Var))
+		return metric
+	})
+}
@@ -0,0 +1,158 @@
+// Package metrics is the small metrics interface through which vnet publishes the health of pipes and reverse tunnels.
+//
+// Prometheus serves metrics in the Prometheus text format and Expvar publishes them with package expvar,
+// other backends only have to implement Registry.
+package metrics
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Counter is a value that only goes up.
+type Counter interface {
+	Add(delta float64)
+}
+
+// Gauge is a value that goes up and down.
+// Instances sharing a registry add to the same gauges, so gauges are only changed by Add.
+type Gauge interface {
+	Add(delta float64)
+}
+
+// Histogram counts observed values in buckets.
+type Histogram interface {
+	Observe(v float64)
+}
+
+// Registry creates metrics.
+// Asking twice for the same name returns the same metric, so instances sharing a registry aggregate their metrics.
+type Registry interface {
+	Counter(name, help string) Counter
+	Gauge(name, help string) Gauge
+	// Histogram creates a histogram with buckets, the upper bounds of the buckets in increasing order.
+	Histogram(name, help string, buckets []float64) Histogram
+}
+
+// DefaultBuckets are the buckets of latency histograms, in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Discard is a Registry whose metrics are dropped.
+var Discard Registry = discard{}
+
+type discard struct{}
+
+func (discard) Counter(name, help string) Counter {
+	return nop{}
+}
+func (discard) Gauge(name, help string) Gauge {
+	return nop{}
+}
+func (discard) Histogram(name, help string, buckets []float64) Histogram {
+	return nop{}
+}
+
+type nop struct{}
+
+func (nop) Add(delta float64) {}
+func (nop) Observe(v float64) {}
+
+// Prefix returns a Registry that creates the metrics of r with names starting with prefix,
+// so that several instances publish apart.
+func Prefix(r Registry, prefix string) Registry {
+	return prefixRegistry{
+		r:      r,
+		prefix: prefix,
+	}
+}
+
+type prefixRegistry struct {
+	r      Registry
+	prefix string
+}
+
+func (p prefixRegistry) Counter(name, help string) Counter {
+	return p.r.Counter(p.prefix+name, help)
+}
+func (p prefixRegistry) Gauge(name, help string) Gauge {
+	return p.r.Gauge(p.prefix+name, help)
+}
+func (p prefixRegistry) Histogram(name, help string, buckets []float64) Histogram {
+	return p.r.Histogram(p.prefix+name, help, buckets)
+}
+
+// value is a float64 updated atomically, it implements Counter, Gauge and expvar.Var.
+type value struct {
+	bits atomic.Uint64
+}
+
+func (v *value) Add(delta float64) {
+	for {
+		old := v.bits.Load()
+		if v.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+delta)) {
+			return
+		}
+	}
+}
+func (v *value) Value() float64 {
+	return math.Float64frombits(v.bits.Load())
+}
+func (v *value) String() string {
+	return strconv.FormatFloat(v.Value(), 'g', -1, 64)
+}
+
+// histogram implements Histogram and expvar.Var.
+type histogram struct {
+	m       sync.Mutex
+	buckets []float64
+	counts  []uint64 // not cumulative, the last one counts values above every bucket
+	count   uint64
+	sum     float64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	return &histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)+1),
+	}
+}
+func (h *histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.m.Lock()
+	h.counts[i]++
+	h.count++
+	h.sum += v
+	h.m.Unlock()
+}
+
+// snapshot returns the cumulative counts of the buckets, the count and the sum.
+func (h *histogram) snapshot() (cumulative []uint64, count uint64, sum float64) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	cumulative = make([]uint64, len(h.buckets))
+	var n uint64
+	for i := range h.buckets {
+		n += h.counts[i]
+		cumulative[i] = n
+	}
+	return cumulative, h.count, h.sum
+}
+func (h *histogram) String() string {
+	cumulative, count, sum := h.snapshot()
+	buckets := make(map[string]uint64, len(cumulative))
+	for i, n := range cumulative {
+		buckets[strconv.FormatFloat(h.buckets[i], 'g', -1, 64)] = n
+	}
+	b, _ := json.Marshal(struct {
+		Count   uint64            `json:"count"`
+		Sum     float64           `json:"sum"`
+		Buckets map[string]uint64 `json:"buckets"`
+	}{count, sum, buckets})
+	return string(b)
+}
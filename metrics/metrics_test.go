@@ -0,0 +1,119 @@
+package metrics_test
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/powerpuffpenguin/vnet/metrics"
+)
+
+func TestPrometheus(t *testing.T) {
+	p := metrics.NewPrometheus()
+	r := metrics.Prefix(p, `test_`)
+	r.Counter(`dials_total`, `Dials.`).Add(3)
+	r.Counter(`dials_total`, ``).Add(1)
+	gauge := r.Gauge(`idle_conns`, "Idle\nconns.")
+	gauge.Add(2)
+	gauge.Add(-1)
+	h := r.Histogram(`handshake_seconds`, ``, []float64{1, 0.1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(2)
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(`GET`, `/metrics`, nil))
+	expect := `# HELP test_dials_total Dials.
+# TYPE test_dials_total counter
+test_dials_total 4
+# TYPE test_handshake_seconds histogram
+test_handshake_seconds_bucket{le="0.1"} 1
+test_handshake_seconds_bucket{le="1"} 2
+test_handshake_seconds_bucket{le="+Inf"} 3
+test_handshake_seconds_sum 2.55
+test_handshake_seconds_count 3
+# HELP test_idle_conns Idle\nconns.
+# TYPE test_idle_conns gauge
+test_idle_conns 1
+`
+	if s := w.Body.String(); s != expect {
+		t.Fatalf("expect\n%s\ngot\n%s", expect, s)
+	}
+	if ct := w.Header().Get(`Content-Type`); !strings.HasPrefix(ct, `text/plain`) {
+		t.Fatalf("unexpected content type %v", ct)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expect a panic registering a gauge as a counter")
+		}
+	}()
+	p.Counter(`test_idle_conns`, ``)
+}
+
+// expvarSeq makes the expvar names unique, so the tests can be run again in the same process.
+var expvarSeq int
+
+func TestExpvar(t *testing.T) {
+	expvarSeq++
+	name := fmt.Sprintf(`metrics_test_%d`, expvarSeq)
+	x := metrics.NewExpvar(name)
+	x.Counter(`test_total`, ``).Add(2)
+	// another instance asking for the same name shares the registry
+	metrics.NewExpvar(name).Counter(`test_total`, ``).Add(1)
+	x.Histogram(`test_seconds`, ``, []float64{1}).Observe(0.5)
+
+	m := expvar.Get(name).(*expvar.Map)
+	if s := m.Get(`test_total`).String(); s != `3` {
+		t.Fatalf("expect 3, got %v", s)
+	}
+	var h struct {
+		Count   uint64
+		Sum     float64
+		Buckets map[string]uint64
+	}
+	e := json.Unmarshal([]byte(m.Get(`test_seconds`).String()), &h)
+	if e != nil {
+		t.Fatal(e)
+	} else if h.Count != 1 || h.Sum != 0.5 || h.Buckets[`1`] != 1 {
+		t.Fatalf("unexpected histogram %+v", h)
+	}
+}
+func TestConn(t *testing.T) {
+	p := metrics.NewPrometheus()
+	m := metrics.NewConnMetrics(p, `test_`)
+	c0, c1 := net.Pipe()
+	c := m.Wrap(c0)
+	go func() {
+		c1.Write([]byte(`hello`))
+		io.Copy(io.Discard, c1)
+	}()
+	b := make([]byte, 5)
+	_, e := io.ReadFull(c, b)
+	if e != nil {
+		t.Fatal(e)
+	}
+	c.Write([]byte(`abc`))
+	if c.Unwrap() != c0 {
+		t.Fatal("unexpected unwrap")
+	}
+	c.Close()
+	c.Close()
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(`GET`, `/metrics`, nil))
+	for _, line := range []string{
+		"test_active_conns 0\n",
+		"test_bytes_read_total 5\n",
+		"test_bytes_written_total 3\n",
+	} {
+		if !strings.Contains(w.Body.String(), line) {
+			t.Fatalf("expect %q in\n%s", line, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	kindCounter   = `counter`
+	kindGauge     = `gauge`
+	kindHistogram = `histogram`
+)
+
+type entry struct {
+	kind   string
+	help   string
+	metric interface{}
+}
+
+// set holds metrics by name.
+type set struct {
+	m       sync.Mutex
+	entries map[string]*entry
+}
+
+// get returns the metric name, created by create if it does not exist yet.
+// It panics if name exists with another kind, like registering a metric twice.
+func (s *set) get(name, kind, help string, create func() interface{}) interface{} {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if found, ok := s.entries[name]; ok {
+		if found.kind != kind {
+			panic(fmt.Sprintf(`metrics: %s already registered as a %s`, name, found.kind))
+		}
+		return found.metric
+	}
+	if s.entries == nil {
+		s.entries = make(map[string]*entry)
+	}
+	metric := create()
+	s.entries[name] = &entry{
+		kind:   kind,
+		help:   help,
+		metric: metric,
+	}
+	return metric
+}
+
+// Prometheus is a Registry serving its metrics over HTTP in the Prometheus text format.
+type Prometheus struct {
+	set set
+}
+
+func NewPrometheus() *Prometheus {
+	return &Prometheus{}
+}
+func (p *Prometheus) Counter(name, help string) Counter {
+	metric := p.set.get(name, kindCounter, help, func() interface{} {
+		return &value{}
+	})
+	return metric.(*value)
+}
+func (p *Prometheus) Gauge(name, help string) Gauge {
+	metric := p.set.get(name, kindGauge, help, func() interface{} {
+		return &value{}
+	})
+	return metric.(*value)
+}
+func (p *Prometheus) Histogram(name, help string, buckets []float64) Histogram {
+	metric := p.set.get(name, kindHistogram, help, func() interface{} {
+		return newHistogram(buckets)
+	})
+	return metric.(*histogram)
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format, sorted by name.
+func (p *Prometheus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(`Content-Type`, `text/plain; version=0.0.4; charset=utf-8`)
+	p.set.m.Lock()
+	names := make([]string, 0, len(p.set.entries))
+	entries := make(map[string]*entry, len(p.set.entries))
+	for name, e := range p.set.entries {
+		names = append(names, name)
+		entries[name] = e
+	}
+	p.set.m.Unlock()
+	sort.Strings(names)
+
+	bw := bufio.NewWriter(w)
+	for _, name := range names {
+		e := entries[name]
+		if e.help != `` {
+			fmt.Fprintf(bw, "# HELP %s %s\n", name, escapeHelp(e.help))
+		}
+		fmt.Fprintf(bw, "# TYPE %s %s\n", name, e.kind)
+		switch metric := e.metric.(type) {
+		case *value:
+			fmt.Fprintf(bw, "%s %s\n", name, formatFloat(metric.Value()))
+		case *histogram:
+			cumulative, count, sum := metric.snapshot()
+			for i, n := range cumulative {
+				fmt.Fprintf(bw, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(metric.buckets[i]), n)
+			}
+			fmt.Fprintf(bw, "%s_bucket{le=\"+Inf\"} %d\n", name, count)
+			fmt.Fprintf(bw, "%s_sum %s\n", name, formatFloat(sum))
+			fmt.Fprintf(bw, "%s_count %d\n", name, count)
+		}
+	}
+	bw.Flush()
+}
+
+var helpReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeHelp(help string) string {
+	return helpReplacer.Replace(help)
+}
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return `+Inf`
+	case math.IsInf(v, -1):
+		return `-Inf`
+	case math.IsNaN(v):
+		return `NaN`
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
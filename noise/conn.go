@@ -0,0 +1,284 @@
+// Package noise secures net.Conn with the Noise protocol, Noise_XX_25519_AESGCM_SHA256.
+//
+// Each side owns a static X25519 key pair instead of a certificate.
+// The XX pattern exchanges both static keys, so no key has to be known in advance,
+// and WithPeerKeys or WithAuthorize restrict which peers are accepted.
+// Without them any key completes the handshake: the conn is encrypted but the peer is not authenticated,
+// and a man in the middle can't be told from the expected peer.
+package noise
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// KeyLen is the length of public and private keys.
+const KeyLen = 32
+
+// MaxRecordLen is the largest record on the wire, its length is written in 2 bytes.
+const MaxRecordLen = 0xffff
+
+// maxPlaintextLen is the largest plaintext carried by a record.
+const maxPlaintextLen = MaxRecordLen - tagLen
+
+// GenerateKey returns a new static key pair.
+func GenerateKey() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// NewPrivateKey returns the static key pair of a 32 bytes private key.
+func NewPrivateKey(key []byte) (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().NewPrivateKey(key)
+}
+
+// Conn is a net.Conn secured by the Noise protocol.
+// The handshake runs on the first Read or Write, or when Handshake is called.
+// Deadlines apply to the handshake too.
+//
+// A Read interrupted by a deadline can be retried, a failed Write breaks the Conn.
+type Conn struct {
+	net.Conn
+	initiator bool
+	key       *ecdh.PrivateKey
+	opts      options
+
+	hm      sync.Mutex
+	hsDone  bool
+	hsErr   error
+	peerKey []byte
+
+	rm    sync.Mutex
+	recv  cipherState
+	raw   []byte // partial record read from Conn
+	plain []byte // decrypted bytes not read yet
+	rbuf  []byte
+	rerr  error
+
+	wm   sync.Mutex
+	send cipherState
+	wbuf []byte
+	werr error
+}
+
+// Client returns a Conn running the initiator side of the handshake over c.
+// Without WithPeerKeys or WithAuthorize the server is not authenticated.
+func Client(c net.Conn, key *ecdh.PrivateKey, opt ...Option) *Conn {
+	return newConn(c, key, true, opt)
+}
+
+// Server returns a Conn running the responder side of the handshake over c.
+// Without WithPeerKeys or WithAuthorize the client is not authenticated.
+func Server(c net.Conn, key *ecdh.PrivateKey, opt ...Option) *Conn {
+	return newConn(c, key, false, opt)
+}
+func newConn(c net.Conn, key *ecdh.PrivateKey, initiator bool, opt []Option) *Conn {
+	opts := defaultOptions
+	for _, o := range opt {
+		o.apply(&opts)
+	}
+	return &Conn{
+		Conn:      c,
+		initiator: initiator,
+		key:       key,
+		opts:      opts,
+	}
+}
+
+// PeerKey returns the static public key of the peer, nil before the handshake has completed.
+func (c *Conn) PeerKey() []byte {
+	c.hm.Lock()
+	defer c.hm.Unlock()
+	return c.peerKey
+}
+
+// Authenticated reports whether the handshake has completed and the peer key was accepted by WithAuthorize or WithPeerKeys.
+// Without them any peer key is accepted, the conn is encrypted but the peer is not authenticated.
+func (c *Conn) Authenticated() bool {
+	c.hm.Lock()
+	defer c.hm.Unlock()
+	return c.peerKey != nil && c.opts.authorize != nil
+}
+
+// LocalKey returns the static public key of this side.
+func (c *Conn) LocalKey() []byte {
+	return c.key.PublicKey().Bytes()
+}
+
+// NetConn returns the underlying conn.
+func (c *Conn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// Handshake runs the handshake if it has not run yet.
+func (c *Conn) Handshake() error {
+	c.hm.Lock()
+	defer c.hm.Unlock()
+	if !c.hsDone {
+		c.hsDone = true
+		c.hsErr = c.handshake()
+	}
+	return c.hsErr
+}
+func (c *Conn) handshake() (e error) {
+	h := handshakeState{
+		c:   c.Conn,
+		s:   c.key,
+		ops: &c.opts,
+	}
+	h.ss.init(c.opts.prologue)
+	var send, recv cipherState
+	if c.initiator {
+		send, recv, e = h.initiate()
+	} else {
+		recv, send, e = h.respond()
+	}
+	if e != nil {
+		return
+	}
+	c.peerKey = h.rs.Bytes()
+	c.send = send
+	c.recv = recv
+	return
+}
+
+// Read reads decrypted bytes.
+func (c *Conn) Read(b []byte) (n int, e error) {
+	e = c.Handshake()
+	if e != nil {
+		return
+	}
+	c.rm.Lock()
+	defer c.rm.Unlock()
+	for len(c.plain) == 0 {
+		if c.rerr != nil {
+			e = c.rerr
+			return
+		} else if len(b) == 0 {
+			return
+		}
+		e = c.readRecord()
+		if e != nil {
+			return
+		}
+	}
+	n = copy(b, c.plain)
+	c.plain = c.plain[n:]
+	return
+}
+
+// Buffered returns the number of decrypted bytes that can be read without reading the underlying conn.
+func (c *Conn) Buffered() int {
+	c.rm.Lock()
+	defer c.rm.Unlock()
+	return len(c.plain)
+}
+
+// readRecord reads and decrypts the next record,
+// the bytes of a record interrupted by an error are kept so that the next call resumes it.
+func (c *Conn) readRecord() (e error) {
+	for {
+		need := 2
+		if len(c.raw) >= 2 {
+			need += int(binary.BigEndian.Uint16(c.raw))
+			if len(c.raw) == need {
+				break
+			}
+		}
+		if cap(c.raw) < need {
+			raw := make([]byte, len(c.raw), 2+MaxRecordLen)
+			copy(raw, c.raw)
+			c.raw = raw
+		}
+		var n int
+		n, e = c.Conn.Read(c.raw[len(c.raw):need])
+		c.raw = c.raw[:len(c.raw)+n]
+		if e != nil {
+			if e == io.EOF && len(c.raw) != 0 {
+				e = io.ErrUnexpectedEOF
+			}
+			if e != io.EOF {
+				if ne, ok := e.(net.Error); !ok || !ne.Timeout() {
+					c.rerr = e
+				}
+			}
+			return
+		}
+	}
+	c.rbuf, e = c.recv.decrypt(c.rbuf[:0], nil, c.raw[2:])
+	c.raw = c.raw[:0]
+	if e != nil {
+		e = fmt.Errorf(`%w: %v`, ErrRecord, e)
+		c.rerr = e
+		return
+	}
+	c.plain = c.rbuf
+	return
+}
+
+// Write encrypts b and writes it in records.
+func (c *Conn) Write(b []byte) (n int, e error) {
+	e = c.Handshake()
+	if e != nil {
+		return
+	}
+	c.wm.Lock()
+	defer c.wm.Unlock()
+	if c.werr != nil {
+		e = c.werr
+		return
+	}
+	for len(b) != 0 {
+		size := len(b)
+		if size > maxPlaintextLen {
+			size = maxPlaintextLen
+		}
+		c.wbuf = append(c.wbuf[:0], 0, 0)
+		c.wbuf, e = c.send.encrypt(c.wbuf, nil, b[:size])
+		if e == nil {
+			binary.BigEndian.PutUint16(c.wbuf, uint16(len(c.wbuf)-2))
+			_, e = c.Conn.Write(c.wbuf)
+		}
+		if e != nil {
+			// a record may be partly written, the stream can't be used any more
+			c.werr = e
+			return
+		}
+		n += size
+		b = b[size:]
+	}
+	return
+}
+
+// CloseWrite shuts down the writing side of the underlying conn if it supports it, as *net.TCPConn does.
+// Records end on write boundaries, so the peer reads io.EOF after the last record.
+func (c *Conn) CloseWrite() (e error) {
+	cw, ok := c.Conn.(interface{ CloseWrite() error })
+	if !ok {
+		e = &net.OpError{
+			Op:     `close`,
+			Net:    c.Conn.LocalAddr().Network(),
+			Source: c.Conn.LocalAddr(),
+			Addr:   c.Conn.RemoteAddr(),
+			Err:    errCloseWrite,
+		}
+		return
+	}
+	e = c.Handshake()
+	if e != nil {
+		return
+	}
+	c.wm.Lock()
+	defer c.wm.Unlock()
+	if c.werr != nil {
+		e = c.werr
+		return
+	}
+	c.werr = net.ErrClosed
+	e = cw.CloseWrite()
+	return
+}
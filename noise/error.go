@@ -0,0 +1,9 @@
+package noise
+
+import "errors"
+
+var ErrUnauthorized = errors.New(`noise: peer key not authorized`)
+var ErrHandshake = errors.New(`noise: handshake failed`)
+var ErrRecord = errors.New(`noise: invalid record`)
+
+var errCloseWrite = errors.New(`noise: close write not supported`)
@@ -0,0 +1,233 @@
+package noise
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// handshakeState runs the XX pattern:
+//
+//	-> e
+//	<- e, ee, s, es
+//	-> s, se
+//
+// Each message is written with a 2 bytes length prefix and carries an empty payload.
+type handshakeState struct {
+	c  net.Conn
+	ss symmetricState
+	s  *ecdh.PrivateKey
+	// e is generated by writeE unless set, as the test vectors do
+	e  *ecdh.PrivateKey
+	rs *ecdh.PublicKey
+	re *ecdh.PublicKey
+	// payloads are the payloads of the three messages, only the test vectors set them
+	payloads [3][]byte
+	ops      *options
+	buf      []byte
+}
+
+func (h *handshakeState) initiate() (send, recv cipherState, e error) {
+	// -> e
+	msg, e := h.writeE(nil)
+	if e == nil {
+		msg, e = h.ss.encryptAndHash(msg, h.payloads[0])
+	}
+	if e == nil {
+		e = h.writeMessage(msg)
+	}
+	if e != nil {
+		return
+	}
+
+	// <- e, ee, s, es
+	msg, e = h.readMessage()
+	if e != nil {
+		return
+	}
+	msg, e = h.readE(msg)
+	if e == nil {
+		e = h.mixDH(h.e, h.re)
+	}
+	if e == nil {
+		msg, e = h.readS(msg)
+	}
+	if e == nil {
+		e = h.mixDH(h.e, h.rs)
+	}
+	if e == nil {
+		e = h.readPayload(msg, h.payloads[1])
+	}
+	if e != nil {
+		return
+	}
+
+	// -> s, se
+	msg, e = h.ss.encryptAndHash(nil, h.s.PublicKey().Bytes())
+	if e == nil {
+		e = h.mixDH(h.s, h.re)
+	}
+	if e == nil {
+		msg, e = h.ss.encryptAndHash(msg, h.payloads[2])
+	}
+	if e == nil {
+		e = h.writeMessage(msg)
+	}
+	if e != nil {
+		return
+	}
+	send, recv = h.ss.split()
+	return
+}
+func (h *handshakeState) respond() (recv, send cipherState, e error) {
+	// -> e
+	msg, e := h.readMessage()
+	if e != nil {
+		return
+	}
+	msg, e = h.readE(msg)
+	if e == nil {
+		e = h.readPayload(msg, h.payloads[0])
+	}
+	if e != nil {
+		return
+	}
+
+	// <- e, ee, s, es
+	msg, e = h.writeE(nil)
+	if e == nil {
+		e = h.mixDH(h.e, h.re)
+	}
+	if e == nil {
+		msg, e = h.ss.encryptAndHash(msg, h.s.PublicKey().Bytes())
+	}
+	if e == nil {
+		e = h.mixDH(h.s, h.re)
+	}
+	if e == nil {
+		msg, e = h.ss.encryptAndHash(msg, h.payloads[1])
+	}
+	if e == nil {
+		e = h.writeMessage(msg)
+	}
+	if e != nil {
+		return
+	}
+
+	// -> s, se
+	msg, e = h.readMessage()
+	if e != nil {
+		return
+	}
+	msg, e = h.readS(msg)
+	if e == nil {
+		e = h.mixDH(h.e, h.rs)
+	}
+	if e == nil {
+		e = h.readPayload(msg, h.payloads[2])
+	}
+	if e != nil {
+		return
+	}
+	recv, send = h.ss.split()
+	return
+}
+func (h *handshakeState) writeE(msg []byte) ([]byte, error) {
+	if h.e == nil {
+		key, e := GenerateKey()
+		if e != nil {
+			return msg, e
+		}
+		h.e = key
+	}
+	pub := h.e.PublicKey().Bytes()
+	h.ss.mixHash(pub)
+	return append(msg, pub...), nil
+}
+func (h *handshakeState) readE(msg []byte) (tail []byte, e error) {
+	if len(msg) < KeyLen {
+		e = fmt.Errorf(`%w: message too short`, ErrHandshake)
+		return
+	}
+	h.re, e = ecdh.X25519().NewPublicKey(msg[:KeyLen])
+	if e != nil {
+		e = fmt.Errorf(`%w: %v`, ErrHandshake, e)
+		return
+	}
+	h.ss.mixHash(msg[:KeyLen])
+	tail = msg[KeyLen:]
+	return
+}
+
+// readS decrypts the static key of the peer and authorizes it.
+func (h *handshakeState) readS(msg []byte) (tail []byte, e error) {
+	n := KeyLen + tagLen
+	if len(msg) < n {
+		e = fmt.Errorf(`%w: message too short`, ErrHandshake)
+		return
+	}
+	s, e := h.ss.decryptAndHash(nil, msg[:n])
+	if e != nil {
+		e = fmt.Errorf(`%w: %v`, ErrHandshake, e)
+		return
+	}
+	h.rs, e = ecdh.X25519().NewPublicKey(s)
+	if e != nil {
+		e = fmt.Errorf(`%w: %v`, ErrHandshake, e)
+		return
+	}
+	if h.ops.authorize != nil {
+		e = h.ops.authorize(s)
+		if e != nil {
+			return
+		}
+	}
+	tail = msg[n:]
+	return
+}
+
+// readPayload checks that the payload is the expected one, empty outside the test vectors.
+func (h *handshakeState) readPayload(msg, expected []byte) (e error) {
+	payload, e := h.ss.decryptAndHash(nil, msg)
+	if e != nil {
+		e = fmt.Errorf(`%w: %v`, ErrHandshake, e)
+	} else if !bytes.Equal(payload, expected) {
+		e = fmt.Errorf(`%w: unexpected payload`, ErrHandshake)
+	}
+	return
+}
+func (h *handshakeState) mixDH(key *ecdh.PrivateKey, pub *ecdh.PublicKey) error {
+	secret, e := key.ECDH(pub)
+	if e != nil {
+		return fmt.Errorf(`%w: %v`, ErrHandshake, e)
+	}
+	h.ss.mixKey(secret)
+	return nil
+}
+func (h *handshakeState) writeMessage(msg []byte) (e error) {
+	b := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(b, uint16(len(msg)))
+	copy(b[2:], msg)
+	_, e = h.c.Write(b)
+	return
+}
+func (h *handshakeState) readMessage() (msg []byte, e error) {
+	var b [2]byte
+	_, e = io.ReadFull(h.c, b[:])
+	if e != nil {
+		return
+	}
+	n := int(binary.BigEndian.Uint16(b[:]))
+	if cap(h.buf) < n {
+		h.buf = make([]byte, n)
+	}
+	msg = h.buf[:n]
+	_, e = io.ReadFull(h.c, msg)
+	if e == io.EOF {
+		e = io.ErrUnexpectedEOF
+	}
+	return
+}
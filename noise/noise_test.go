@@ -0,0 +1,162 @@
+package noise_test
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/powerpuffpenguin/vnet/noise"
+)
+
+func mustKey(t *testing.T) *ecdh.PrivateKey {
+	key, e := noise.GenerateKey()
+	if e != nil {
+		t.Fatal(e)
+	}
+	return key
+}
+
+// pair runs the handshake over a pipe and returns both ends and their handshake errors.
+func pair(t *testing.T, client, server *noise.Conn) (ce, se error) {
+	ch := make(chan error, 1)
+	go func() {
+		ch <- server.Handshake()
+	}()
+	ce = client.Handshake()
+	if ce != nil {
+		client.Close()
+	}
+	se = <-ch
+	if se != nil {
+		server.Close()
+	}
+	return
+}
+func TestConn(t *testing.T) {
+	ck, sk := mustKey(t), mustKey(t)
+	c0, c1 := net.Pipe()
+	client := noise.Client(c0, ck, noise.WithPeerKeys(sk.PublicKey().Bytes()))
+	server := noise.Server(c1, sk, noise.WithPeerKeys(ck.PublicKey().Bytes()))
+	if ce, se := pair(t, client, server); ce != nil || se != nil {
+		t.Fatal(ce, se)
+	}
+	defer client.Close()
+	defer server.Close()
+	if !bytes.Equal(client.PeerKey(), sk.PublicKey().Bytes()) || !bytes.Equal(server.PeerKey(), ck.PublicKey().Bytes()) {
+		t.Fatal("unexpected peer keys")
+	}
+
+	// larger than a record, both ways
+	data := make([]byte, 200000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	for _, c := range [][2]*noise.Conn{{client, server}, {server, client}} {
+		w, r := c[0], c[1]
+		go w.Write(data)
+		b := make([]byte, len(data))
+		_, e := io.ReadFull(r, b)
+		if e != nil {
+			t.Fatal(e)
+		} else if !bytes.Equal(b, data) {
+			t.Fatal("data mismatch")
+		}
+	}
+}
+func TestUnauthorized(t *testing.T) {
+	ck, sk, other := mustKey(t), mustKey(t), mustKey(t)
+	c0, c1 := net.Pipe()
+	client := noise.Client(c0, ck)
+	server := noise.Server(c1, sk, noise.WithPeerKeys(other.PublicKey().Bytes()))
+	ce, se := pair(t, client, server)
+	if !errors.Is(se, noise.ErrUnauthorized) {
+		t.Fatalf("expect ErrUnauthorized, got %v", se)
+	} else if ce == nil {
+		// the client finished its part, the conn is closed by the server
+		_, e := client.Read(make([]byte, 1))
+		if e == nil {
+			t.Fatal("expect client error")
+		}
+	}
+}
+func TestPrologue(t *testing.T) {
+	c0, c1 := net.Pipe()
+	client := noise.Client(c0, mustKey(t), noise.WithPrologue([]byte(`a`)))
+	server := noise.Server(c1, mustKey(t), noise.WithPrologue([]byte(`b`)))
+	ce, se := pair(t, client, server)
+	if !errors.Is(ce, noise.ErrHandshake) || se == nil {
+		t.Fatalf("expect handshake failure, got %v %v", ce, se)
+	}
+}
+
+// relay runs the handshake between client on c0 and server on c3, forwarding its messages between c1 and c2,
+// so that the test can play with the records afterwards.
+func relay(t *testing.T) (client *noise.Conn, c1, c2 net.Conn, server *noise.Conn) {
+	c0, c1 := net.Pipe()
+	c2, c3 := net.Pipe()
+	client = noise.Client(c0, mustKey(t))
+	server = noise.Server(c3, mustKey(t))
+	go func() {
+		// -> e, <- e ee s es, -> s se
+		io.CopyN(c2, c1, 2+32)
+		io.CopyN(c1, c2, 2+32+48+16)
+		io.CopyN(c2, c1, 2+48+16)
+	}()
+	if ce, se := pair(t, client, server); ce != nil || se != nil {
+		t.Fatal(ce, se)
+	}
+	return
+}
+func readRecord(t *testing.T, c net.Conn, n int) []byte {
+	b := make([]byte, 2+n+16)
+	_, e := io.ReadFull(c, b)
+	if e != nil {
+		t.Fatal(e)
+	}
+	return b
+}
+func TestResumeRecord(t *testing.T) {
+	client, c1, c2, server := relay(t)
+	defer client.Close()
+	defer server.Close()
+	go client.Write([]byte(`hello`))
+	record := readRecord(t, c1, 5)
+
+	// a record interrupted by a read deadline is resumed by the next read
+	go c2.Write(record[:3])
+	server.SetReadDeadline(time.Now().Add(time.Millisecond * 50))
+	b := make([]byte, 5)
+	_, e := server.Read(b)
+	var ne net.Error
+	if !errors.As(e, &ne) || !ne.Timeout() {
+		t.Fatalf("expect timeout, got %v", e)
+	}
+	go c2.Write(record[3:])
+	server.SetReadDeadline(time.Time{})
+	n, e := server.Read(b)
+	if e != nil || string(b[:n]) != `hello` {
+		t.Fatal(e, string(b[:n]))
+	}
+}
+func TestTamperedRecord(t *testing.T) {
+	client, c1, c2, server := relay(t)
+	defer client.Close()
+	defer server.Close()
+	go client.Write([]byte(`hello`))
+	record := readRecord(t, c1, 5)
+	record[5] ^= 1
+	go c2.Write(record)
+	_, e := server.Read(make([]byte, 5))
+	if !errors.Is(e, noise.ErrRecord) {
+		t.Fatalf("expect ErrRecord, got %v", e)
+	}
+	// the error is sticky
+	_, e = server.Read(make([]byte, 5))
+	if !errors.Is(e, noise.ErrRecord) {
+		t.Fatalf("expect ErrRecord, got %v", e)
+	}
+}
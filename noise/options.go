@@ -0,0 +1,54 @@
+package noise
+
+import "bytes"
+
+var defaultOptions = options{}
+
+type options struct {
+	prologue  []byte
+	authorize func(peerKey []byte) error
+}
+type Option interface {
+	apply(*options)
+}
+type funcOption struct {
+	f func(*options)
+}
+
+func (fo *funcOption) apply(o *options) {
+	fo.f(o)
+}
+func newOption(f func(*options)) *funcOption {
+	return &funcOption{
+		f: f,
+	}
+}
+
+// WithPrologue sets data both sides must agree on, such as an application name and version.
+// The handshake fails if the prologues differ.
+func WithPrologue(prologue []byte) Option {
+	return newOption(func(o *options) {
+		o.prologue = prologue
+	})
+}
+
+// WithAuthorize sets a function called with the static public key of the peer during the handshake,
+// the handshake fails with the error it returns.
+// Without it any peer key is accepted, the connection is encrypted but the peer is not authenticated.
+func WithAuthorize(f func(peerKey []byte) error) Option {
+	return newOption(func(o *options) {
+		o.authorize = f
+	})
+}
+
+// WithPeerKeys only accepts peers whose static public key is one of keys.
+func WithPeerKeys(keys ...[]byte) Option {
+	return WithAuthorize(func(peerKey []byte) error {
+		for _, key := range keys {
+			if bytes.Equal(key, peerKey) {
+				return nil
+			}
+		}
+		return ErrUnauthorized
+	})
+}
@@ -0,0 +1,144 @@
+package noise
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+// protocolName selects the handshake pattern and the primitives.
+const protocolName = `Noise_XX_25519_AESGCM_SHA256`
+
+const (
+	hashLen = sha256.Size
+	keyLen  = 32
+	tagLen  = 16
+)
+
+var errNonce = errors.New(`noise: nonce exhausted`)
+
+// cipherState is CipherState of the Noise specification.
+type cipherState struct {
+	aead cipher.AEAD
+	n    uint64
+	// nonce is the buffer of the AESGCM nonce: 4 zero bytes then n big endian
+	nonce [12]byte
+}
+
+func (cs *cipherState) init(k []byte) {
+	block, e := aes.NewCipher(k[:keyLen])
+	if e != nil {
+		panic(e)
+	}
+	aead, e := cipher.NewGCM(block)
+	if e != nil {
+		panic(e)
+	}
+	cs.aead = aead
+	cs.n = 0
+}
+func (cs *cipherState) hasKey() bool {
+	return cs.aead != nil
+}
+func (cs *cipherState) nextNonce() ([]byte, error) {
+	if cs.n == ^uint64(0) {
+		return nil, errNonce
+	}
+	binary.BigEndian.PutUint64(cs.nonce[4:], cs.n)
+	cs.n++
+	return cs.nonce[:], nil
+}
+
+// encrypt appends the encryption of plaintext to dst.
+func (cs *cipherState) encrypt(dst, ad, plaintext []byte) ([]byte, error) {
+	if !cs.hasKey() {
+		return append(dst, plaintext...), nil
+	}
+	nonce, e := cs.nextNonce()
+	if e != nil {
+		return dst, e
+	}
+	return cs.aead.Seal(dst, nonce, plaintext, ad), nil
+}
+
+// decrypt appends the decryption of ciphertext to dst.
+func (cs *cipherState) decrypt(dst, ad, ciphertext []byte) ([]byte, error) {
+	if !cs.hasKey() {
+		return append(dst, ciphertext...), nil
+	}
+	nonce, e := cs.nextNonce()
+	if e != nil {
+		return dst, e
+	}
+	return cs.aead.Open(dst, nonce, ciphertext, ad)
+}
+
+// symmetricState is SymmetricState of the Noise specification.
+type symmetricState struct {
+	cs cipherState
+	ck [hashLen]byte
+	h  [hashLen]byte
+}
+
+func (ss *symmetricState) init(prologue []byte) {
+	// the protocol name fits in a hash, it is padded with zeros
+	copy(ss.h[:], protocolName)
+	ss.ck = ss.h
+	ss.mixHash(prologue)
+}
+func (ss *symmetricState) mixHash(data []byte) {
+	h := sha256.New()
+	h.Write(ss.h[:])
+	h.Write(data)
+	h.Sum(ss.h[:0])
+}
+func (ss *symmetricState) mixKey(ikm []byte) {
+	ck, k := hkdf(ss.ck[:], ikm)
+	ss.ck = ck
+	ss.cs.init(k[:])
+}
+func (ss *symmetricState) encryptAndHash(dst, plaintext []byte) ([]byte, error) {
+	n := len(dst)
+	dst, e := ss.cs.encrypt(dst, ss.h[:], plaintext)
+	if e != nil {
+		return dst, e
+	}
+	ss.mixHash(dst[n:])
+	return dst, nil
+}
+func (ss *symmetricState) decryptAndHash(dst, ciphertext []byte) ([]byte, error) {
+	dst, e := ss.cs.decrypt(dst, ss.h[:], ciphertext)
+	if e != nil {
+		return dst, e
+	}
+	ss.mixHash(ciphertext)
+	return dst, nil
+}
+
+// split returns the cipher states of the initiator and the responder.
+func (ss *symmetricState) split() (c1, c2 cipherState) {
+	k1, k2 := hkdf(ss.ck[:], nil)
+	c1.init(k1[:])
+	c2.init(k2[:])
+	return
+}
+
+// hkdf is HKDF of the Noise specification returning two outputs.
+func hkdf(ck, ikm []byte) (out1, out2 [hashLen]byte) {
+	mac := hmac.New(sha256.New, ck)
+	mac.Write(ikm)
+	temp := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, temp)
+	mac.Write([]byte{1})
+	mac.Sum(out1[:0])
+
+	mac = hmac.New(sha256.New, temp)
+	mac.Write(out1[:])
+	mac.Write([]byte{2})
+	mac.Sum(out2[:0])
+	return
+}
@@ -0,0 +1,166 @@
+package noise
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"encoding/hex"
+	"net"
+	"sync"
+	"testing"
+)
+
+// vector is a Noise_XX_25519_AESGCM_SHA256 test vector.
+// The messages alternate between the initiator and the responder, the first three are the handshake.
+type vector struct {
+	name          string
+	prologue      string
+	initStatic    string
+	initEphemeral string
+	respStatic    string
+	respEphemeral string
+	// handshakeHash is empty when the vector does not give it
+	handshakeHash string
+	// messages are the payloads and their ciphertexts
+	messages [][2]string
+}
+
+// vectors are the ones of cacophony and snow, as published at
+// https://github.com/haskell-cryptography/cacophony and https://github.com/mcginty/snow.
+var vectors = []vector{
+	{
+		name:          `cacophony`,
+		prologue:      `4a6f686e2047616c74`,
+		initStatic:    `e61ef9919cde45dd5f82166404bd08e38bceb5dfdfded0a34c8df7ed542214d1`,
+		initEphemeral: `893e28b9dc6ca8d611ab664754b8ceb7bac5117349a4439a6b0569da977c464a`,
+		respStatic:    `4a3acbfdb163dec651dfa3194dece676d437029c62a408b4c5ea9114246e4893`,
+		respEphemeral: `bbdb4cdbd309f1a1f2e1456967fe288cadd6f712d65dc7b7793d5e63da6b375b`,
+		handshakeHash: `1b7aefb1125762aa21a252890d00af54519638b76437444538f9a52f21e2e0dc`,
+		messages: [][2]string{
+			{`4c756477696720766f6e204d69736573`, `ca35def5ae56cec33dc2036731ab14896bc4c75dbb07a61f879f8e3afa4c79444c756477696720766f6e204d69736573`},
+			{`4d757272617920526f746862617264`, `95ebc60d2b1fa672c1f46a8aa265ef51bfe38e7ccb39ec5be34069f144808843757117acceb05bd7a45733bc22015c97a9d0cbaf41b80446d5988ff5127235d76b79eade70f473d6a4ef521fdcbeda5340d01e028ba793fc059f2724a83af05f12dda0448a7621a926b379a92477fd`},
+			{`462e20412e20486179656b`, `c90f1cf77eba4e50edb038991565e36c9758943a989229b6051244dc4fbecb6946744b401af2ee1a5881b65fbb87fd07cb6a328ececc9ce6ce84c399dc332d4fd521fa4bb7f467ce909395`},
+			{`4361726c204d656e676572`, `bc3fa77f6aca3e8466d7dc6bea10013e88a6a29add5132b461806c`},
+			{`4a65616e2d426170746973746520536179`, `250b01074cdfe0df2ecf8ccbf1737b15a2ddb5b52fd9a396604e9c793cee3b3bb9`},
+			{`457567656e2042f6686d20766f6e2042617765726b`, `449d4d433b3cdc3d02bf6fc881774b9df54366ebcffb9689bb13f14709822cd7ef42bcdb4d`},
+		},
+	},
+	{
+		name:          `snow`,
+		prologue:      `5468657265206973206e6f20726967687420616e642077726f6e672e2054686572652773206f6e6c792066756e20616e6420626f72696e672e`,
+		initStatic:    `8332736541eede0aad3480ee75d9563769ba41bbcfb5a233a2df5211e1b28688`,
+		initEphemeral: `10541ced038edae4ecc5f3d9f8500405b48b21df8dee29128dbb432da8d102d6`,
+		respStatic:    `9d137b2cf1464e267de417bf5f5a3048d78e752c5b1dc98aab3679ecb16767d1`,
+		respEphemeral: `836a9fe7191c37411e5e261a20dd86b53b07b71cfa5944219c30c461d70f2c35`,
+		messages: [][2]string{
+			{`8727ca13a5735c9402b4a7eddbcf2b0685d41f21b49f432c15ebdea194bd8a48`, `a12bb1540bbce2a2de27d1c4a0312b1320e1031200c976466d5eff9f231d545d8727ca13a5735c9402b4a7eddbcf2b0685d41f21b49f432c15ebdea194bd8a48`},
+			{`2be85c58cf525a53ef168262f17a27b2a8aa88ea89d3f2a9d7b30e526e4d4148`, `ddf95a8783487e135ef1da9ce2d86c97a82ce3ee039b82fe3b65ae4f0ae8c657821abc223509f536362c00d650acd2da5c8beb6449c972dfb5353086ff10981a385ac097611210da4a0db4c373e46a0f290ca9a17d2240ef1c128aa878c9542b6b5210a49206c2cfb3d0c6fe97f29477dcbf9e7cde23dc166cb6894568cf13bd`},
+			{`b63277d8ac69e09ad11b0c1333a9859024a013306f36a93162ec6acde64a47ea`, `38dd6d54b33cc023cd01d3cbb5a042f64d93a2efc3c210ca7ebbf15e7c11dbd03c1360363d39898d8f9912f8f69dc2647d55b3ced726fd225522d3725855a7c29836dcb6d86fd783aba0ef974f82a1632378d43cf5a3edd19e002e19cdd32e7b`},
+		},
+	},
+}
+
+// recorder keeps what is written to the conn.
+type recorder struct {
+	net.Conn
+	m       *sync.Mutex
+	written *[][]byte
+}
+
+func (r recorder) Write(b []byte) (int, error) {
+	r.m.Lock()
+	*r.written = append(*r.written, append([]byte(nil), b...))
+	r.m.Unlock()
+	return r.Conn.Write(b)
+}
+func mustHex(t *testing.T, s string) []byte {
+	b, e := hex.DecodeString(s)
+	if e != nil {
+		t.Fatal(e)
+	}
+	return b
+}
+func mustPrivateKey(t *testing.T, s string) *ecdh.PrivateKey {
+	key, e := ecdh.X25519().NewPrivateKey(mustHex(t, s))
+	if e != nil {
+		t.Fatal(e)
+	}
+	return key
+}
+func TestVectors(t *testing.T) {
+	for _, v := range vectors {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			var payloads [3][]byte
+			for i := range payloads {
+				payloads[i] = mustHex(t, v.messages[i][0])
+			}
+			c0, c1 := net.Pipe()
+			defer c0.Close()
+			defer c1.Close()
+			var m sync.Mutex
+			var written [][]byte
+			initiator := &handshakeState{
+				c:        recorder{c0, &m, &written},
+				s:        mustPrivateKey(t, v.initStatic),
+				e:        mustPrivateKey(t, v.initEphemeral),
+				payloads: payloads,
+				ops:      &options{},
+			}
+			responder := &handshakeState{
+				c:        recorder{c1, &m, &written},
+				s:        mustPrivateKey(t, v.respStatic),
+				e:        mustPrivateKey(t, v.respEphemeral),
+				payloads: payloads,
+				ops:      &options{},
+			}
+			prologue := mustHex(t, v.prologue)
+			initiator.ss.init(prologue)
+			responder.ss.init(prologue)
+
+			var respSend, respRecv cipherState
+			ch := make(chan error, 1)
+			go func() {
+				var e error
+				respRecv, respSend, e = responder.respond()
+				ch <- e
+			}()
+			initSend, initRecv, e := initiator.initiate()
+			if e != nil {
+				t.Fatal(e)
+			}
+			if e = <-ch; e != nil {
+				t.Fatal(e)
+			}
+
+			if len(written) != 3 {
+				t.Fatalf("%d handshake messages", len(written))
+			}
+			for i, msg := range written {
+				if !bytes.Equal(msg[2:], mustHex(t, v.messages[i][1])) {
+					t.Fatalf("message %d: %x", i, msg[2:])
+				}
+			}
+			if v.handshakeHash != `` {
+				expected := mustHex(t, v.handshakeHash)
+				if !bytes.Equal(initiator.ss.h[:], expected) || !bytes.Equal(responder.ss.h[:], expected) {
+					t.Fatalf("handshake hash %x %x", initiator.ss.h, responder.ss.h)
+				}
+			}
+			for i := 3; i < len(v.messages); i++ {
+				send, recv := &initSend, &respRecv
+				if i%2 == 1 {
+					send, recv = &respSend, &initRecv
+				}
+				payload := mustHex(t, v.messages[i][0])
+				ciphertext, e := send.encrypt(nil, nil, payload)
+				if e != nil || !bytes.Equal(ciphertext, mustHex(t, v.messages[i][1])) {
+					t.Fatalf("message %d: %x %v", i, ciphertext, e)
+				}
+				plaintext, e := recv.decrypt(nil, nil, ciphertext)
+				if e != nil || !bytes.Equal(plaintext, payload) {
+					t.Fatalf("message %d: %x %v", i, plaintext, e)
+				}
+			}
+		})
+	}
+}
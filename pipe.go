@@ -5,6 +5,9 @@ import (
 	"net"
 	"sync"
 	"sync/atomic"
+
+	"github.com/powerpuffpenguin/vnet/logger"
+	"github.com/powerpuffpenguin/vnet/metrics"
 )
 
 type PipeListener struct {
@@ -12,21 +15,88 @@ type PipeListener struct {
 	close chan struct{}
 	done  uint32
 	m     sync.Mutex
+
+	dials   metrics.Counter
+	waiting metrics.Gauge
+	conns   *metrics.ConnMetrics
+	logger  logger.Logger
+}
+
+type pipeOptions struct {
+	registry metrics.Registry
+	logger   logger.Logger
+}
+type PipeOption interface {
+	apply(*pipeOptions)
+}
+type funcPipeOption struct {
+	f func(*pipeOptions)
+}
+
+func (fpo *funcPipeOption) apply(po *pipeOptions) {
+	fpo.f(po)
+}
+func newPipeOption(f func(*pipeOptions)) *funcPipeOption {
+	return &funcPipeOption{
+		f: f,
+	}
+}
+
+// WithPipeMetrics publishes the metrics of the listener in r:
+// vnet_pipe_dials_total, vnet_pipe_dials_waiting, vnet_pipe_active_conns,
+// vnet_pipe_bytes_read_total and vnet_pipe_bytes_written_total, the bytes being counted on the dialed side.
+// Dialed conns are then *metrics.Conn.
+func WithPipeMetrics(r metrics.Registry) PipeOption {
+	return newPipeOption(func(o *pipeOptions) {
+		o.registry = r
+	})
 }
 
-func ListenPipe() *PipeListener {
-	return &PipeListener{
-		ch:    make(chan net.Conn),
-		close: make(chan struct{}),
+// WithPipeLogger logs the dials that fail, at debug level as they are only canceled or made after Close.
+func WithPipeLogger(l logger.Logger) PipeOption {
+	return newPipeOption(func(o *pipeOptions) {
+		o.logger = l
+	})
+}
+
+func ListenPipe(opt ...PipeOption) *PipeListener {
+	var opts pipeOptions
+	for _, o := range opt {
+		o.apply(&opts)
+	}
+	if opts.logger == nil {
+		opts.logger = logger.Discard
 	}
+	l := &PipeListener{
+		ch:     make(chan net.Conn),
+		close:  make(chan struct{}),
+		logger: opts.logger,
+	}
+	r := opts.registry
+	if r == nil {
+		r = metrics.Discard
+	} else {
+		l.conns = metrics.NewConnMetrics(r, `vnet_pipe_`)
+	}
+	l.dials = r.Counter(`vnet_pipe_dials_total`, `Dials of the pipe listener.`)
+	l.waiting = r.Gauge(`vnet_pipe_dials_waiting`, `Dials waiting to be accepted.`)
+	return l
 }
 
 // Accept waits for and returns the next connection to the listener.
-func (l *PipeListener) Accept() (c net.Conn, e error) {
+func (l *PipeListener) Accept() (net.Conn, error) {
+	return l.AcceptContext(context.Background())
+}
+
+// AcceptContext waits for and returns the next connection to the listener,
+// or returns ctx.Err() if ctx is done first.
+func (l *PipeListener) AcceptContext(ctx context.Context) (c net.Conn, e error) {
 	select {
 	case c = <-l.ch:
 	case <-l.close:
 		e = ErrListenerClosed
+	case <-ctx.Done():
+		e = ctx.Err()
 	}
 	return
 }
@@ -58,9 +128,14 @@ func (l *PipeListener) DialContext(ctx context.Context, network, addr string) (c
 	// check closed
 	if atomic.LoadUint32(&l.done) != 0 {
 		e = ErrDialerClosed
+		l.logger.Log(logger.LevelDebug, `pipe dial failed`, `err`, e)
 		return
 	}
 
+	l.dials.Add(1)
+	l.waiting.Add(1)
+	defer l.waiting.Add(-1)
+
 	// pipe
 	c0, c1 := net.Pipe()
 	// waiting accepted or closed or done
@@ -68,12 +143,19 @@ func (l *PipeListener) DialContext(ctx context.Context, network, addr string) (c
 	case <-ctx.Done():
 		e = ctx.Err()
 	case l.ch <- c0:
-		conn = c1
+		if l.conns == nil {
+			conn = c1
+		} else {
+			conn = l.conns.Wrap(c1)
+		}
 	case <-l.close:
 		c0.Close()
 		c1.Close()
 		e = ErrDialerClosed
 	}
+	if e != nil {
+		l.logger.Log(logger.LevelDebug, `pipe dial failed`, `err`, e)
+	}
 	return
 }
 
@@ -4,13 +4,18 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"runtime"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/powerpuffpenguin/vnet"
+	"github.com/powerpuffpenguin/vnet/metrics"
 )
 
 func TestPipe(t *testing.T) {
@@ -94,3 +99,94 @@ func runServer(l net.Listener, ch chan<- error) {
 		ch <- nil
 	}
 }
+
+func TestAcceptContext(t *testing.T) {
+	tcp, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	for _, l := range []vnet.Listener{
+		vnet.ListenPipe(),
+		vnet.WrapListener(tcp),
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+		_, e := l.AcceptContext(ctx)
+		cancel()
+		if !errors.Is(e, context.DeadlineExceeded) {
+			t.Fatalf("expect context.DeadlineExceeded, got %v", e)
+		}
+		// the listener is still open
+		ch := make(chan error, 1)
+		go func() {
+			c, e := l.Accept()
+			if e == nil {
+				c.Close()
+			}
+			ch <- e
+		}()
+		var c net.Conn
+		if d, ok := l.(vnet.Dialer); ok {
+			c, e = d.Dial(`pipe`, ``)
+		} else {
+			c, e = net.Dial(`tcp`, tcp.Addr().String())
+		}
+		if e != nil {
+			t.Fatal(e)
+		}
+		c.Close()
+		if e := <-ch; e != nil {
+			t.Fatal(e)
+		}
+		l.Close()
+		_, e = l.AcceptContext(context.Background())
+		if !errors.Is(e, vnet.ErrListenerClosed) && !errors.Is(e, net.ErrClosed) {
+			t.Fatalf("expect closed, got %v", e)
+		}
+	}
+}
+
+func TestPipeMetrics(t *testing.T) {
+	r := metrics.NewPrometheus()
+	p := vnet.ListenPipe(vnet.WithPipeMetrics(r))
+	defer p.Close()
+	go func() {
+		c, e := p.Accept()
+		if e != nil {
+			return
+		}
+		io.Copy(c, c)
+		c.Close()
+	}()
+	c, e := p.Dial(`pipe`, ``)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if _, ok := c.(*metrics.Conn); !ok {
+		t.Fatalf("expect *metrics.Conn, got %T", c)
+	}
+	c.Write([]byte(`hello`))
+	b := make([]byte, 5)
+	_, e = io.ReadFull(c, b)
+	if e != nil {
+		t.Fatal(e)
+	}
+	expectMetrics(t, r,
+		"vnet_pipe_dials_total 1\n",
+		"vnet_pipe_dials_waiting 0\n",
+		"vnet_pipe_active_conns 1\n",
+		"vnet_pipe_bytes_read_total 5\n",
+		"vnet_pipe_bytes_written_total 5\n",
+	)
+	c.Close()
+	expectMetrics(t, r, "vnet_pipe_active_conns 0\n")
+}
+func expectMetrics(t *testing.T, r http.Handler, lines ...string) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(`GET`, `/metrics`, nil))
+	for _, line := range lines {
+		if !strings.Contains(w.Body.String(), line) {
+			t.Fatalf("expect %q in\n%s", line, w.Body.String())
+		}
+	}
+}
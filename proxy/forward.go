@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/powerpuffpenguin/vnet"
+	"github.com/powerpuffpenguin/vnet/logger"
+)
+
+// Forward accepts conns from l and joins each with a conn dialed through d, until Accept fails for good.
+// The dial context carries the addresses of the accepted conn as set by vnet.NewProxyContext,
+// so a reverse.Dialer with WithDialerProxyProtocol passes the client address on.
+// Conns already joined are not closed when Forward returns.
+func Forward(l net.Listener, d vnet.Dialer, opt ...Option) error {
+	opts := options{
+		network: `tcp`,
+		addr:    l.Addr().String(),
+		logger:  logger.Discard,
+	}
+	for _, o := range opt {
+		o.apply(&opts)
+	}
+	var tempDelay time.Duration // how long to sleep on accept failure
+	for {
+		c, e := l.Accept()
+		if e != nil {
+			if ne, ok := e.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				if opts.logger.Enabled(logger.LevelWarn) {
+					opts.logger.Log(logger.LevelWarn, `accept failed, retrying`, `err`, e, `addr`, l.Addr(), `delay`, tempDelay)
+				}
+				time.Sleep(tempDelay)
+				continue
+			}
+			return e
+		}
+		tempDelay = 0
+		go forward(c, d, &opts)
+	}
+}
+func forward(c net.Conn, d vnet.Dialer, opts *options) {
+	ctx := vnet.NewProxyContext(context.Background(), c.RemoteAddr(), c.LocalAddr())
+	if opts.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.dialTimeout)
+		defer cancel()
+	}
+	dc, e := d.DialContext(ctx, opts.network, opts.addr)
+	if e != nil {
+		if opts.logger.Enabled(logger.LevelWarn) {
+			opts.logger.Log(logger.LevelWarn, `dial failed`, `local`, c.LocalAddr(), `remote`, c.RemoteAddr(), `err`, e)
+		}
+		c.Close()
+		if opts.stats != nil {
+			opts.stats(Stats{
+				Err: e,
+			})
+		}
+		return
+	}
+	stats := join(c, dc, opts)
+	if opts.stats != nil {
+		opts.stats(stats)
+	}
+}
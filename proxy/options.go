@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/powerpuffpenguin/vnet/logger"
+)
+
+type options struct {
+	idleTimeout time.Duration
+	dialTimeout time.Duration
+	network     string
+	addr        string
+	stats       func(Stats)
+	logger      logger.Logger
+}
+type Option interface {
+	apply(*options)
+}
+type funcOption struct {
+	f func(*options)
+}
+
+func (fo *funcOption) apply(o *options) {
+	fo.f(o)
+}
+func newOption(f func(*options)) *funcOption {
+	return &funcOption{
+		f: f,
+	}
+}
+
+// WithIdleTimeout closes both conns once no byte has moved in either direction for timeout,
+// timeout < 1 never times out.
+func WithIdleTimeout(timeout time.Duration) Option {
+	return newOption(func(o *options) {
+		o.idleTimeout = timeout
+	})
+}
+
+// WithDialTimeout bounds the dials of Forward, timeout < 1 waits as long as the dialer does.
+func WithDialTimeout(timeout time.Duration) Option {
+	return newOption(func(o *options) {
+		o.dialTimeout = timeout
+	})
+}
+
+// WithAddr sets what Forward passes to the dialer, by default tcp and the address of the listener.
+func WithAddr(network, addr string) Option {
+	return newOption(func(o *options) {
+		o.network = network
+		o.addr = addr
+	})
+}
+
+// WithStats calls f with the stats of each pair of conns Forward joined, once both are closed.
+func WithStats(f func(Stats)) Option {
+	return newOption(func(o *options) {
+		o.stats = f
+	})
+}
+
+// WithLogger logs the dials of Forward that fail and its accept errors.
+func WithLogger(l logger.Logger) Option {
+	return newOption(func(o *options) {
+		o.logger = l
+	})
+}
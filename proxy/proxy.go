@@ -0,0 +1,203 @@
+// Package proxy joins conns, copying bytes in both directions with half-close,
+// idle timeouts and pooled buffers, and splice(2) on Linux.
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// bufferSize is the size of the pooled buffers used when the conns can't be spliced.
+const bufferSize = 32 * 1024
+
+var buffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, bufferSize)
+		return &b
+	},
+}
+
+// Splicer is implemented by the conns that wrap another without transforming its bytes,
+// such as *metrics.Conn, *audit.Conn and *reverse.Conn.
+// Join unwraps them to splice the underlying sockets, and reports the bytes moved around them.
+type Splicer interface {
+	net.Conn
+	// SpliceConn returns the wrapped conn, nil if the bytes must go through the wrapper.
+	SpliceConn() net.Conn
+	// Spliced counts bytes read from or written to the wrapped conn without the wrapper.
+	Spliced(read, written int64)
+}
+
+// Stats describe a Join.
+type Stats struct {
+	// Sent is the bytes copied from a to b, Received from b to a.
+	Sent     int64
+	Received int64
+	// Spliced reports whether a direction was copied by splice(2).
+	Spliced  bool
+	Duration time.Duration
+	// Err is the first error that ended a direction, nil if both reached EOF.
+	Err error
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// Join copies bytes in both directions between a and b until both directions are finished, then closes both conns.
+// When one direction reaches EOF the write side of its destination is closed, so the peer sees EOF too;
+// if the destination can't close its write side the other direction keeps running until it finishes on its own,
+// which without WithIdleTimeout waits for the peers to close. If a direction fails both conns are closed.
+func Join(a, b net.Conn, opt ...Option) Stats {
+	var opts options
+	for _, o := range opt {
+		o.apply(&opts)
+	}
+	return join(a, b, &opts)
+}
+func join(a, b net.Conn, opts *options) (stats Stats) {
+	j := &joiner{
+		idle: opts.idleTimeout,
+	}
+	start := time.Now()
+	j.touch()
+
+	var wait sync.WaitGroup
+	wait.Add(1)
+	var received int64
+	var receivedSpliced bool
+	go func() {
+		received, receivedSpliced = j.copyHalf(a, b)
+		wait.Done()
+	}()
+	stats.Sent, stats.Spliced = j.copyHalf(b, a)
+	wait.Wait()
+	a.Close()
+	b.Close()
+
+	stats.Received = received
+	stats.Spliced = stats.Spliced || receivedSpliced
+	stats.Duration = time.Since(start)
+	stats.Err = j.err
+	return
+}
+
+type joiner struct {
+	idle time.Duration
+	// last is when a byte last moved, in unix nanoseconds
+	last atomic.Int64
+
+	m   sync.Mutex
+	err error
+}
+
+// copyHalf copies src to dst then closes the write side of dst if it can, or both conns if it fails.
+func (j *joiner) copyHalf(dst, src net.Conn) (n int64, spliced bool) {
+	n, spliced, e := j.copy(dst, src)
+	if e == nil {
+		if cw, ok := dst.(closeWriter); ok {
+			cw.CloseWrite()
+		}
+		return
+	}
+	j.fail(e)
+	dst.Close()
+	src.Close()
+	return
+}
+
+// copy splices src to dst if both unwrap to sockets that can be spliced, otherwise copies through a pooled buffer.
+func (j *joiner) copy(dst, src net.Conn) (n int64, spliced bool, e error) {
+	rawDst, dstWrappers := unwrap(dst)
+	rawSrc, srcWrappers := unwrap(src)
+	n, spliced, e = j.splice(rawDst, rawSrc, func(moved int64) {
+		for _, w := range srcWrappers {
+			w.Spliced(moved, 0)
+		}
+		for _, w := range dstWrappers {
+			w.Spliced(0, moved)
+		}
+	})
+	if spliced {
+		return
+	}
+
+	bp := buffers.Get().(*[]byte)
+	defer buffers.Put(bp)
+	b := *bp
+	for {
+		j.deadline(src.SetReadDeadline)
+		nr, er := src.Read(b)
+		if nr > 0 {
+			j.touch()
+			j.deadline(dst.SetWriteDeadline)
+			nw, ew := dst.Write(b[:nr])
+			n += int64(nw)
+			if ew != nil {
+				e = ew
+				return
+			} else if nw != nr {
+				e = io.ErrShortWrite
+				return
+			}
+		}
+		if er == io.EOF {
+			return
+		} else if er != nil && !j.retry(er) {
+			e = er
+			return
+		}
+	}
+}
+
+// unwrap returns the innermost conn the Splicers around c let through, and those Splicers.
+func unwrap(c net.Conn) (raw net.Conn, wrappers []Splicer) {
+	for {
+		s, ok := c.(Splicer)
+		if !ok {
+			return c, wrappers
+		}
+		inner := s.SpliceConn()
+		if inner == nil {
+			return c, wrappers
+		}
+		wrappers = append(wrappers, s)
+		c = inner
+	}
+}
+
+// touch records that bytes moved.
+func (j *joiner) touch() {
+	if j.idle > 0 {
+		j.last.Store(time.Now().UnixNano())
+	}
+}
+
+// deadline sets the idle deadline of the next read or write.
+func (j *joiner) deadline(set func(time.Time) error) {
+	if j.idle > 0 {
+		set(time.Now().Add(j.idle))
+	}
+}
+
+// retry reports whether e is an idle timeout while the other direction was still moving bytes.
+func (j *joiner) retry(e error) bool {
+	if j.idle <= 0 || !errors.Is(e, os.ErrDeadlineExceeded) {
+		return false
+	}
+	return time.Since(time.Unix(0, j.last.Load())) < j.idle
+}
+
+// fail keeps the first error of the join.
+func (j *joiner) fail(e error) {
+	j.m.Lock()
+	if j.err == nil {
+		j.err = e
+	}
+	j.m.Unlock()
+}
@@ -0,0 +1,279 @@
+package proxy_test
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/powerpuffpenguin/vnet"
+	"github.com/powerpuffpenguin/vnet/noise"
+	"github.com/powerpuffpenguin/vnet/proxy"
+)
+
+// tcpPair returns the two ends of a tcp conn.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	l, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer l.Close()
+	ch := make(chan net.Conn, 1)
+	go func() {
+		c, _ := l.Accept()
+		ch <- c
+	}()
+	c0, e := net.Dial(`tcp`, l.Addr().String())
+	if e != nil {
+		t.Fatal(e)
+	}
+	c1 := <-ch
+	if c1 == nil {
+		t.Fatal(`accept failed`)
+	}
+	return c0, c1
+}
+
+// joined returns a client and a server whose conns are joined, and the stats of the join once it ends.
+func joined(t *testing.T, wrap func(net.Conn) net.Conn, opt ...proxy.Option) (client, server net.Conn, stats <-chan proxy.Stats) {
+	client, a := tcpPair(t)
+	b, server := tcpPair(t)
+	ch := make(chan proxy.Stats, 1)
+	go func() {
+		ch <- proxy.Join(wrap(a), wrap(b), opt...)
+	}()
+	return client, server, ch
+}
+func noWrap(c net.Conn) net.Conn {
+	return c
+}
+
+// opaque hides the type of the conn so it can't be spliced.
+type opaque struct {
+	net.Conn
+}
+
+func (o opaque) CloseWrite() error {
+	return o.Conn.(*net.TCPConn).CloseWrite()
+}
+
+func TestJoin(t *testing.T) {
+	for name, wrap := range map[string]func(net.Conn) net.Conn{
+		`socket`: noWrap,
+		`buffer`: func(c net.Conn) net.Conn {
+			return opaque{c}
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			client, server, stats := joined(t, wrap)
+			defer client.Close()
+			defer server.Close()
+			request := bytes.Repeat([]byte(`request`), 100000)
+			go func() {
+				client.Write(request)
+				// half-close reaches the server
+				client.(*net.TCPConn).CloseWrite()
+			}()
+			b, e := io.ReadAll(server)
+			if e != nil || !bytes.Equal(b, request) {
+				t.Fatal(len(b), e)
+			}
+			// the other direction still works
+			server.Write([]byte(`response`))
+			server.Close()
+			b, e = io.ReadAll(client)
+			if e != nil || string(b) != `response` {
+				t.Fatal(string(b), e)
+			}
+			s := <-stats
+			if s.Sent != int64(len(request)) || s.Received != 8 || s.Err != nil {
+				t.Fatalf("unexpected stats %+v", s)
+			}
+		})
+	}
+}
+
+// closeWriteConn is implemented by the conns of TestJoinHalfClose.
+type closeWriteConn interface {
+	net.Conn
+	CloseWrite() error
+}
+
+// noCloseWrite hides the CloseWrite of the conn.
+type noCloseWrite struct {
+	net.Conn
+}
+
+func TestJoinHalfClose(t *testing.T) {
+	compressed := func(t *testing.T) (peer, end closeWriteConn) {
+		c0, c1 := tcpPair(t)
+		peer, e := vnet.Compress(c0, flate.DefaultCompression, 0)
+		if e != nil {
+			t.Fatal(e)
+		}
+		end, e = vnet.Compress(c1, flate.DefaultCompression, 0)
+		if e != nil {
+			t.Fatal(e)
+		}
+		return
+	}
+	encrypted := func(t *testing.T) (peer, end closeWriteConn) {
+		ck, e := noise.GenerateKey()
+		if e != nil {
+			t.Fatal(e)
+		}
+		sk, e := noise.GenerateKey()
+		if e != nil {
+			t.Fatal(e)
+		}
+		c0, c1 := tcpPair(t)
+		return noise.Client(c0, ck), noise.Server(c1, sk)
+	}
+	for name, test := range map[string]struct {
+		pair func(t *testing.T) (peer, end closeWriteConn)
+		// hide hides the CloseWrite of the conn joined to the server
+		hide bool
+	}{
+		`compress`:            {pair: compressed},
+		`noise`:               {pair: encrypted},
+		`without close write`: {pair: compressed, hide: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			client, a := test.pair(t)
+			b, server := test.pair(t)
+			defer client.Close()
+			defer server.Close()
+			var dst net.Conn = b
+			if test.hide {
+				dst = noCloseWrite{b}
+			}
+			stats := make(chan proxy.Stats, 1)
+			go func() {
+				stats <- proxy.Join(a, dst)
+			}()
+
+			request := bytes.Repeat([]byte(`request`), 10000)
+			// random bytes don't compress, so the response is still moving when the request ends
+			response := make([]byte, 4*1024*1024)
+			rand.Read(response)
+			go func() {
+				client.Write(request)
+				client.CloseWrite()
+			}()
+			// the server is still writing when the client half-closes
+			written := make(chan error, 1)
+			go func() {
+				_, e := server.Write(response)
+				if e == nil {
+					e = server.CloseWrite()
+				}
+				written <- e
+			}()
+			b0 := make([]byte, len(request))
+			if _, e := io.ReadFull(server, b0); e != nil || !bytes.Equal(b0, request) {
+				t.Fatal(e)
+			}
+			if !test.hide {
+				if n, e := server.Read(b0); n != 0 || e != io.EOF {
+					t.Fatal(n, e)
+				}
+			}
+			b1, e := io.ReadAll(client)
+			if e != nil || !bytes.Equal(b1, response) {
+				t.Fatal(len(b1), e)
+			}
+			if e = <-written; e != nil {
+				t.Fatal(e)
+			}
+			if test.hide {
+				// the server never sees the half-close, the join ends when it closes
+				server.Close()
+			}
+			s := <-stats
+			if s.Sent != int64(len(request)) || s.Received != int64(len(response)) || s.Err != nil {
+				t.Fatalf("unexpected stats %+v", s)
+			}
+		})
+	}
+}
+func TestJoinIdleTimeout(t *testing.T) {
+	client, server, stats := joined(t, noWrap, proxy.WithIdleTimeout(time.Millisecond*200))
+	defer client.Close()
+	defer server.Close()
+	// traffic in one direction keeps the other one alive
+	for i := 0; i < 4; i++ {
+		time.Sleep(time.Millisecond * 100)
+		client.Write([]byte(`x`))
+		if _, e := io.ReadFull(server, make([]byte, 1)); e != nil {
+			t.Fatal(e)
+		}
+	}
+	select {
+	case s := <-stats:
+		if !errors.Is(s.Err, os.ErrDeadlineExceeded) || s.Sent != 4 {
+			t.Fatalf("unexpected stats %+v", s)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal(`idle join not closed`)
+	}
+	if _, e := io.ReadAll(server); e != nil {
+		t.Fatal(e)
+	}
+}
+func TestForward(t *testing.T) {
+	pipe := vnet.ListenPipe()
+	defer pipe.Close()
+	go func() {
+		for {
+			c, e := pipe.Accept()
+			if e != nil {
+				return
+			}
+			go func() {
+				// pipe conns can't half-close, so the server closes once it has answered
+				b := make([]byte, 4)
+				if _, e := io.ReadFull(c, b); e == nil {
+					c.Write(b)
+				}
+				c.Close()
+			}()
+		}
+	}()
+	l, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	stats := make(chan proxy.Stats, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- proxy.Forward(l, pipe, proxy.WithStats(func(s proxy.Stats) {
+			stats <- s
+		}))
+	}()
+
+	c, e := net.Dial(`tcp`, l.Addr().String())
+	if e != nil {
+		t.Fatal(e)
+	}
+	c.Write([]byte(`echo`))
+	b := make([]byte, 4)
+	_, e = io.ReadFull(c, b)
+	c.Close()
+	if e != nil || string(b) != `echo` {
+		t.Fatal(string(b), e)
+	}
+	if s := <-stats; s.Sent != 4 || s.Received != 4 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+
+	l.Close()
+	if e := <-done; e == nil {
+		t.Fatal(`Forward should return the accept error`)
+	}
+}
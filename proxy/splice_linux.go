@@ -0,0 +1,109 @@
+//go:build linux
+// +build linux
+
+package proxy
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+const (
+	spliceMove     = 0x1
+	spliceNonblock = 0x2
+	// maxSpliceSize is the most bytes moved by one splice, the default capacity of a pipe
+	maxSpliceSize = 64 * 1024
+)
+
+// spliceable reports whether c is a stream socket splice(2) can read or write.
+func spliceable(c net.Conn) (rc syscall.RawConn, ok bool) {
+	switch c := c.(type) {
+	case *net.TCPConn:
+		rc, e := c.SyscallConn()
+		return rc, e == nil
+	case *net.UnixConn:
+		if c.LocalAddr().Network() != `unix` {
+			return
+		}
+		rc, e := c.SyscallConn()
+		return rc, e == nil
+	}
+	return
+}
+
+// splice moves the bytes of src to dst through a pipe, without copying them to user space.
+// report is called with the bytes moved by each splice. spliced is false if the conns can't be spliced.
+func (j *joiner) splice(dst, src net.Conn, report func(int64)) (n int64, spliced bool, e error) {
+	wrc, ok := spliceable(dst)
+	if !ok {
+		return
+	}
+	rrc, ok := spliceable(src)
+	if !ok {
+		return
+	}
+	var p [2]int
+	if syscall.Pipe2(p[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK) != nil {
+		return
+	}
+	defer syscall.Close(p[0])
+	defer syscall.Close(p[1])
+	spliced = true
+
+	for {
+		j.deadline(src.SetReadDeadline)
+		var moved int64
+		var se error
+		e = rrc.Read(func(fd uintptr) bool {
+			for {
+				moved, se = syscall.Splice(int(fd), nil, p[1], nil, maxSpliceSize, spliceMove|spliceNonblock)
+				if se != syscall.EINTR {
+					break
+				}
+			}
+			// the pipe is empty, EAGAIN means the socket has nothing to read
+			return se != syscall.EAGAIN
+		})
+		if e == nil && se != nil {
+			e = os.NewSyscallError(`splice`, se)
+		}
+		if e != nil {
+			if j.retry(e) {
+				e = nil
+				continue
+			}
+			return
+		} else if moved == 0 {
+			// EOF
+			return
+		}
+		j.touch()
+
+		for moved > 0 {
+			j.deadline(dst.SetWriteDeadline)
+			var written int64
+			e = wrc.Write(func(fd uintptr) bool {
+				for {
+					written, se = syscall.Splice(p[0], nil, int(fd), nil, int(moved), spliceMove|spliceNonblock)
+					if se != syscall.EINTR {
+						break
+					}
+				}
+				// the pipe is not empty, EAGAIN means the socket is full
+				return se != syscall.EAGAIN
+			})
+			if e == nil && se != nil {
+				e = os.NewSyscallError(`splice`, se)
+			}
+			if written > 0 {
+				moved -= written
+				n += written
+				report(written)
+			}
+			if e != nil {
+				return
+			}
+		}
+	}
+}
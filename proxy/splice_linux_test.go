@@ -0,0 +1,52 @@
+//go:build linux
+// +build linux
+
+package proxy_test
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/powerpuffpenguin/vnet/metrics"
+)
+
+type counter struct {
+	n atomic.Int64
+}
+
+func (c *counter) Add(delta float64) {
+	c.n.Add(int64(delta))
+}
+
+func TestSplice(t *testing.T) {
+	read, written, active := &counter{}, &counter{}, &counter{}
+	m := &metrics.ConnMetrics{
+		Read:    read,
+		Written: written,
+		Active:  active,
+	}
+	client, server, stats := joined(t, func(c net.Conn) net.Conn {
+		return m.Wrap(c)
+	})
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		client.Write(make([]byte, 100000))
+		client.Close()
+	}()
+	n, e := io.Copy(io.Discard, server)
+	if e != nil || n != 100000 {
+		t.Fatal(n, e)
+	}
+	server.Close()
+	s := <-stats
+	if !s.Spliced || s.Sent != 100000 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+	// the bytes moved around the wrappers are still counted
+	if read.n.Load() != 100000 || written.n.Load() != 100000 || active.n.Load() != 0 {
+		t.Fatal(read.n.Load(), written.n.Load(), active.n.Load())
+	}
+}
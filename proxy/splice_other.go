@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package proxy
+
+import "net"
+
+// splice is only implemented on Linux, elsewhere the bytes are copied through a buffer.
+func (j *joiner) splice(dst, src net.Conn, report func(int64)) (n int64, spliced bool, e error) {
+	return
+}
@@ -0,0 +1,402 @@
+package vnet
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrProxyHeader = errors.New(`invalid proxy protocol header`)
+
+var (
+	proxyV1Prefix  = []byte(`PROXY `)
+	proxyV2Sig     = []byte("\r\n\r\n\x00\r\nQUIT\n")
+	proxyV1Unknown = []byte("PROXY UNKNOWN\r\n")
+)
+
+// proxyV1MaxLen is the longest version 1 header, CRLF included.
+const proxyV1MaxLen = 107
+
+// ProxyHeader is a HAProxy PROXY protocol header.
+type ProxyHeader struct {
+	// Version is 1 for the text format or 2 for the binary format.
+	Version uint8
+	// Source and Destination are the addresses of the proxied conn,
+	// they are nil if the conn is not proxied, a version 1 UNKNOWN or a version 2 LOCAL header.
+	// Version 1 only carries TCP addresses, version 2 carries TCP, UDP and unix addresses.
+	Source      net.Addr
+	Destination net.Addr
+}
+
+// Append appends the encoded header to b.
+// A Source of a type the version can't carry is encoded as a header of an unknown conn.
+func (h *ProxyHeader) Append(b []byte) ([]byte, error) {
+	switch h.Version {
+	case 1:
+		return h.appendV1(b), nil
+	case 2:
+		return h.appendV2(b)
+	}
+	return b, fmt.Errorf(`%w: unknown version=%v`, ErrProxyHeader, h.Version)
+}
+func (h *ProxyHeader) appendV1(b []byte) []byte {
+	src, ok0 := h.Source.(*net.TCPAddr)
+	dst, ok1 := h.Destination.(*net.TCPAddr)
+	if !ok0 || !ok1 {
+		return append(b, proxyV1Unknown...)
+	}
+	srcIP, dstIP, v4 := proxyIPs(src.IP, dst.IP)
+	if v4 {
+		b = append(b, `PROXY TCP4 `...)
+	} else {
+		b = append(b, `PROXY TCP6 `...)
+	}
+	b = append(b, srcIP.String()...)
+	b = append(b, ' ')
+	b = append(b, dstIP.String()...)
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, int64(src.Port), 10)
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, int64(dst.Port), 10)
+	return append(b, '\r', '\n')
+}
+func (h *ProxyHeader) appendV2(b []byte) ([]byte, error) {
+	b = append(b, proxyV2Sig...)
+	var (
+		fam  byte
+		addr []byte
+	)
+	switch src := h.Source.(type) {
+	case *net.TCPAddr:
+		if dst, ok := h.Destination.(*net.TCPAddr); ok {
+			fam, addr = proxyV2IPs(0x1, src.IP, dst.IP, src.Port, dst.Port)
+		}
+	case *net.UDPAddr:
+		if dst, ok := h.Destination.(*net.UDPAddr); ok {
+			fam, addr = proxyV2IPs(0x2, src.IP, dst.IP, src.Port, dst.Port)
+		}
+	case *net.UnixAddr:
+		if dst, ok := h.Destination.(*net.UnixAddr); ok {
+			if len(src.Name) > 108 || len(dst.Name) > 108 {
+				return b, fmt.Errorf(`%w: unix address too long`, ErrProxyHeader)
+			}
+			fam = 0x31
+			if src.Net == `unixgram` {
+				fam = 0x32
+			}
+			addr = make([]byte, 216)
+			copy(addr, src.Name)
+			copy(addr[108:], dst.Name)
+		}
+	}
+	if fam == 0 {
+		// LOCAL, the conn is not proxied
+		b = append(b, 0x20, 0, 0, 0)
+		return b, nil
+	}
+	b = append(b, 0x21, fam, 0, 0)
+	binary.BigEndian.PutUint16(b[len(b)-2:], uint16(len(addr)))
+	return append(b, addr...), nil
+}
+
+// proxyIPs returns both ips in the same family, mapping IPv4 to IPv6 if the families differ.
+func proxyIPs(src, dst net.IP) (srcIP, dstIP net.IP, v4 bool) {
+	src4, dst4 := src.To4(), dst.To4()
+	if src4 != nil && dst4 != nil {
+		return src4, dst4, true
+	}
+	srcIP, dstIP = src.To16(), dst.To16()
+	if srcIP == nil {
+		srcIP = net.IPv6unspecified
+	}
+	if dstIP == nil {
+		dstIP = net.IPv6unspecified
+	}
+	return
+}
+func proxyV2IPs(proto byte, src, dst net.IP, srcPort, dstPort int) (fam byte, addr []byte) {
+	srcIP, dstIP, v4 := proxyIPs(src, dst)
+	if v4 {
+		fam = 0x10 | proto
+	} else {
+		fam = 0x20 | proto
+	}
+	addr = make([]byte, 0, 2*len(srcIP)+4)
+	addr = append(addr, srcIP...)
+	addr = append(addr, dstIP...)
+	addr = binary.BigEndian.AppendUint16(addr, uint16(srcPort))
+	addr = binary.BigEndian.AppendUint16(addr, uint16(dstPort))
+	return
+}
+
+// ReadProxyHeader reads a PROXY protocol header of either version from r.
+// It never reads past the header, so r can be a net.Conn.
+func ReadProxyHeader(r io.Reader) (h *ProxyHeader, e error) {
+	// the shortest header, PROXY UNKNOWN\r\n, is longer than the version 2 signature
+	b := make([]byte, len(proxyV2Sig), proxyV1MaxLen)
+	_, e = io.ReadFull(r, b)
+	if e != nil {
+		return
+	}
+	if bytes.Equal(b, proxyV2Sig) {
+		h, e = readProxyV2(r)
+	} else if bytes.HasPrefix(b, proxyV1Prefix) {
+		h, e = readProxyV1(r, b)
+	} else {
+		e = fmt.Errorf(`%w: no signature`, ErrProxyHeader)
+	}
+	return
+}
+func readProxyV1(r io.Reader, b []byte) (h *ProxyHeader, e error) {
+	for !bytes.HasSuffix(b, []byte("\r\n")) {
+		if len(b) == proxyV1MaxLen {
+			e = fmt.Errorf(`%w: version 1 header too long`, ErrProxyHeader)
+			return
+		}
+		b = b[:len(b)+1]
+		_, e = io.ReadFull(r, b[len(b)-1:])
+		if e != nil {
+			if e == io.EOF {
+				e = io.ErrUnexpectedEOF
+			}
+			return
+		}
+	}
+	fields := strings.Split(string(b[len(proxyV1Prefix):len(b)-2]), ` `)
+	h = &ProxyHeader{
+		Version: 1,
+	}
+	if fields[0] == `UNKNOWN` {
+		return
+	} else if len(fields) != 5 || (fields[0] != `TCP4` && fields[0] != `TCP6`) {
+		h = nil
+		e = fmt.Errorf(`%w: invalid version 1 header`, ErrProxyHeader)
+		return
+	}
+	src, e0 := parseProxyV1Addr(fields[0], fields[1], fields[3])
+	dst, e1 := parseProxyV1Addr(fields[0], fields[2], fields[4])
+	if e0 != nil || e1 != nil {
+		h = nil
+		e = fmt.Errorf(`%w: invalid version 1 address`, ErrProxyHeader)
+		return
+	}
+	h.Source = src
+	h.Destination = dst
+	return
+}
+func parseProxyV1Addr(proto, ip, port string) (addr *net.TCPAddr, e error) {
+	a, e := netip.ParseAddr(ip)
+	if e != nil {
+		return
+	} else if a.Is4() != (proto == `TCP4`) {
+		e = errors.New(`family mismatch`)
+		return
+	}
+	p, e := strconv.ParseUint(port, 10, 16)
+	if e != nil {
+		return
+	} else if len(port) > 1 && port[0] == '0' {
+		e = errors.New(`leading zero`)
+		return
+	}
+	addr = net.TCPAddrFromAddrPort(netip.AddrPortFrom(a, uint16(p)))
+	return
+}
+func readProxyV2(r io.Reader) (h *ProxyHeader, e error) {
+	var head [4]byte
+	_, e = io.ReadFull(r, head[:])
+	if e != nil {
+		if e == io.EOF {
+			e = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	if head[0]>>4 != 2 {
+		e = fmt.Errorf(`%w: unknown version=%v`, ErrProxyHeader, head[0]>>4)
+		return
+	}
+	b := make([]byte, binary.BigEndian.Uint16(head[2:]))
+	_, e = io.ReadFull(r, b)
+	if e != nil {
+		if e == io.EOF {
+			e = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	h = &ProxyHeader{
+		Version: 2,
+	}
+	switch head[0] & 0xf {
+	case 0:
+		// LOCAL, the addresses are ignored
+		return
+	case 1:
+	default:
+		h = nil
+		e = fmt.Errorf(`%w: unknown command=%v`, ErrProxyHeader, head[0]&0xf)
+		return
+	}
+	// the addresses may be followed by TLVs, which are ignored
+	var size int
+	switch head[1] >> 4 {
+	case 0:
+		// UNSPEC, the addresses are ignored
+		return
+	case 1:
+		size = 12
+	case 2:
+		size = 36
+	case 3:
+		size = 216
+	}
+	proto := head[1] & 0xf
+	if size == 0 || proto == 0 || proto > 2 || len(b) < size {
+		h = nil
+		e = fmt.Errorf(`%w: invalid version 2 address family=%#x`, ErrProxyHeader, head[1])
+		return
+	}
+	if size == 216 {
+		network := `unix`
+		if proto == 2 {
+			network = `unixgram`
+		}
+		h.Source = &net.UnixAddr{Net: network, Name: string(bytes.TrimRight(b[:108], "\x00"))}
+		h.Destination = &net.UnixAddr{Net: network, Name: string(bytes.TrimRight(b[108:216], "\x00"))}
+		return
+	}
+	n := (size - 4) / 2
+	srcIP, _ := netip.AddrFromSlice(b[:n])
+	dstIP, _ := netip.AddrFromSlice(b[n : 2*n])
+	src := netip.AddrPortFrom(srcIP, binary.BigEndian.Uint16(b[2*n:]))
+	dst := netip.AddrPortFrom(dstIP, binary.BigEndian.Uint16(b[2*n+2:]))
+	if proto == 1 {
+		h.Source = net.TCPAddrFromAddrPort(src)
+		h.Destination = net.TCPAddrFromAddrPort(dst)
+	} else {
+		h.Source = net.UDPAddrFromAddrPort(src)
+		h.Destination = net.UDPAddrFromAddrPort(dst)
+	}
+	return
+}
+
+type proxyContextKey struct{}
+
+// NewProxyContext returns a copy of ctx carrying the addresses of the conn being proxied,
+// dialers that emit PROXY protocol headers read them with ProxyFromContext.
+func NewProxyContext(ctx context.Context, src, dst net.Addr) context.Context {
+	return context.WithValue(ctx, proxyContextKey{}, [2]net.Addr{src, dst})
+}
+
+// ProxyFromContext returns the addresses carried by a context returned by NewProxyContext.
+func ProxyFromContext(ctx context.Context) (src, dst net.Addr, ok bool) {
+	addrs, ok := ctx.Value(proxyContextKey{}).([2]net.Addr)
+	if ok {
+		src, dst = addrs[0], addrs[1]
+	}
+	return
+}
+
+// ProxyConn is a conn that started with a PROXY protocol header.
+// Its RemoteAddr and LocalAddr are the addresses carried by the header, if any.
+type ProxyConn struct {
+	net.Conn
+	header *ProxyHeader
+}
+
+// Header returns the PROXY protocol header read from the conn.
+func (c *ProxyConn) Header() *ProxyHeader {
+	return c.header
+}
+
+// NetConn returns the underlying conn.
+func (c *ProxyConn) NetConn() net.Conn {
+	return c.Conn
+}
+func (c *ProxyConn) RemoteAddr() net.Addr {
+	if c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+func (c *ProxyConn) LocalAddr() net.Addr {
+	if c.header.Destination != nil {
+		return c.header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+// TrustPrefixes returns a trust rule for ProxyListener that trusts the IP sources in one of prefixes.
+func TrustPrefixes(prefixes ...netip.Prefix) func(addr net.Addr) bool {
+	return func(addr net.Addr) bool {
+		var ip netip.Addr
+		switch a := addr.(type) {
+		case *net.TCPAddr:
+			ip = a.AddrPort().Addr()
+		case *net.UDPAddr:
+			ip = a.AddrPort().Addr()
+		default:
+			ap, e := netip.ParseAddrPort(addr.String())
+			if e != nil {
+				return false
+			}
+			ip = ap.Addr()
+		}
+		ip = ip.Unmap()
+		for _, prefix := range prefixes {
+			if prefix.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// ProxyListener returns a Listener whose conns accepted from a source that trusted reports are *ProxyConn.
+// Such conns must start with a PROXY protocol header read within timeout, otherwise they are closed and never returned.
+// Conns from other sources are returned as is. Headers are only trusted from sources allowed by a rule such as TrustPrefixes,
+// a nil trusted trusts no source.
+//
+// Headers are read by a goroutine per conn, so a slow source never holds back Accept.
+// At most 256 conns are read or wait for an Accept at once, further conns wait in the backlog of l.
+func ProxyListener(l net.Listener, trusted func(addr net.Addr) bool, timeout time.Duration) Listener {
+	r := &proxyHeaderReader{
+		trusted: trusted,
+		timeout: timeout,
+	}
+	return newWrapListener(l, r.read)
+}
+
+type proxyHeaderReader struct {
+	trusted func(addr net.Addr) bool
+	timeout time.Duration
+}
+
+// read returns c as a *ProxyConn if its source is trusted, nil if the header could not be read.
+func (r *proxyHeaderReader) read(c net.Conn) net.Conn {
+	if r.trusted == nil || !r.trusted(c.RemoteAddr()) {
+		return c
+	}
+	if r.timeout > 0 {
+		c.SetReadDeadline(time.Now().Add(r.timeout))
+	}
+	h, e := ReadProxyHeader(c)
+	if e != nil {
+		c.Close()
+		return nil
+	}
+	if r.timeout > 0 {
+		c.SetReadDeadline(time.Time{})
+	}
+	return &ProxyConn{
+		Conn:   c,
+		header: h,
+	}
+}
@@ -0,0 +1,220 @@
+package vnet_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/powerpuffpenguin/vnet"
+)
+
+func TestProxyHeader(t *testing.T) {
+	tcp4 := [2]net.Addr{
+		&net.TCPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 56324},
+		&net.TCPAddr{IP: net.IPv4(192, 168, 0, 11), Port: 443},
+	}
+	tcp6 := [2]net.Addr{
+		&net.TCPAddr{IP: net.ParseIP(`2001:db8::1`), Port: 56324},
+		&net.TCPAddr{IP: net.ParseIP(`2001:db8::2`), Port: 443},
+	}
+	for _, test := range []struct {
+		h      vnet.ProxyHeader
+		wire   string
+		expect [2]net.Addr
+	}{
+		{vnet.ProxyHeader{Version: 1, Source: tcp4[0], Destination: tcp4[1]}, "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n", tcp4},
+		{vnet.ProxyHeader{Version: 1, Source: tcp6[0], Destination: tcp6[1]}, "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", tcp6},
+		{vnet.ProxyHeader{Version: 1}, "PROXY UNKNOWN\r\n", [2]net.Addr{}},
+		{vnet.ProxyHeader{Version: 2, Source: tcp4[0], Destination: tcp4[1]}, "\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c\xc0\xa8\x00\x01\xc0\xa8\x00\x0b\xdc\x04\x01\xbb", tcp4},
+		{vnet.ProxyHeader{Version: 2, Source: tcp6[0], Destination: tcp6[1]}, "", tcp6},
+		{vnet.ProxyHeader{Version: 2}, "\r\n\r\n\x00\r\nQUIT\n\x20\x00\x00\x00", [2]net.Addr{}},
+		{vnet.ProxyHeader{
+			Version:     2,
+			Source:      &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 53},
+			Destination: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 53},
+		}, "", [2]net.Addr{
+			&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 53},
+			&net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 53},
+		}},
+		{vnet.ProxyHeader{
+			Version:     2,
+			Source:      &net.UnixAddr{Net: `unix`, Name: `/run/client.sock`},
+			Destination: &net.UnixAddr{Net: `unix`, Name: `/run/server.sock`},
+		}, "", [2]net.Addr{
+			&net.UnixAddr{Net: `unix`, Name: `/run/client.sock`},
+			&net.UnixAddr{Net: `unix`, Name: `/run/server.sock`},
+		}},
+	} {
+		b, e := test.h.Append(nil)
+		if e != nil {
+			t.Fatal(e)
+		} else if test.wire != `` && string(b) != test.wire {
+			t.Fatalf("expect %q, got %q", test.wire, b)
+		}
+		// the header is read without reading past it
+		r := bytes.NewReader(append(b, `data`...))
+		h, e := vnet.ReadProxyHeader(r)
+		if e != nil {
+			t.Fatal(e)
+		} else if h.Version != test.h.Version {
+			t.Fatalf("expect version %v, got %v", test.h.Version, h.Version)
+		}
+		for i, addr := range []net.Addr{h.Source, h.Destination} {
+			if test.expect[i] == nil {
+				if addr != nil {
+					t.Fatalf("expect no address, got %v", addr)
+				}
+			} else if addr == nil || addr.Network() != test.expect[i].Network() || addr.String() != test.expect[i].String() {
+				t.Fatalf("expect %v, got %v", test.expect[i], addr)
+			}
+		}
+		rest, _ := io.ReadAll(r)
+		if string(rest) != `data` {
+			t.Fatalf("expect data left, got %q", rest)
+		}
+	}
+}
+func TestProxyHeaderInvalid(t *testing.T) {
+	for _, wire := range []string{
+		"GET / HTTP/1.1\r\n\r\n",
+		"PROXY TCP4 192.168.0.1 192.168.0.11 56324\r\n",
+		"PROXY TCP4 2001:db8::1 192.168.0.11 56324 443\r\n",
+		"PROXY TCP4 192.168.0.1 192.168.0.11 056324 443\r\n",
+		"PROXY TCP4 192.168.0.1 192.168.0.11 65536 443\r\n",
+		"PROXY TCP4 192.168.0.1 192.168.0.11 56324 443 and then a line far too long to be a version 1 header ......\r\n",
+		"\r\n\r\n\x00\r\nQUIT\n\x11\x11\x00\x00",
+		"\r\n\r\n\x00\r\nQUIT\n\x22\x11\x00\x00",
+		"\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x04\x00\x00\x00\x00",
+	} {
+		_, e := vnet.ReadProxyHeader(bytes.NewReader([]byte(wire)))
+		if !errors.Is(e, vnet.ErrProxyHeader) {
+			t.Fatalf("%q: expect ErrProxyHeader, got %v", wire, e)
+		}
+	}
+	_, e := vnet.ReadProxyHeader(bytes.NewReader([]byte("PROXY TCP4 192.168")))
+	if e != io.ErrUnexpectedEOF {
+		t.Fatalf("expect io.ErrUnexpectedEOF, got %v", e)
+	}
+}
+func TestProxyListener(t *testing.T) {
+	source := &net.TCPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 40000}
+	// a nil rule trusts no source
+	rules := []func(addr net.Addr) bool{
+		vnet.TrustPrefixes(netip.MustParsePrefix(`127.0.0.0/8`)),
+		vnet.TrustPrefixes(netip.MustParsePrefix(`10.0.0.0/8`)),
+		nil,
+	}
+	for i, rule := range rules {
+		trusted := i == 0
+		tl, e := net.Listen(`tcp`, `127.0.0.1:0`)
+		if e != nil {
+			t.Fatal(e)
+		}
+		l := vnet.ProxyListener(tl, rule, time.Second)
+
+		// a trusted source that never sends a header is dropped, it doesn't hold back the next conn
+		if trusted {
+			silent, e := net.Dial(`tcp`, tl.Addr().String())
+			if e != nil {
+				t.Fatal(e)
+			}
+			defer silent.Close()
+		}
+		c, e := net.Dial(`tcp`, tl.Addr().String())
+		if e != nil {
+			t.Fatal(e)
+		}
+		h := vnet.ProxyHeader{
+			Version:     2,
+			Source:      source,
+			Destination: tl.Addr(),
+		}
+		b, _ := h.Append(nil)
+		c.Write(append(b, `ping`...))
+
+		accepted, e := l.Accept()
+		if e != nil {
+			t.Fatal(e)
+		}
+		pc, ok := accepted.(*vnet.ProxyConn)
+		if ok != trusted {
+			t.Fatalf("trusted %v: got %T", trusted, accepted)
+		}
+		b = make([]byte, 4)
+		if trusted {
+			if h := pc.Header(); h.Version != 2 || h.Destination.String() != tl.Addr().String() {
+				t.Fatalf("unexpected header %+v", h)
+			} else if accepted.RemoteAddr().String() != source.String() {
+				t.Fatalf("expect %v, got %v", source, accepted.RemoteAddr())
+			}
+		} else {
+			// an untrusted header is left to the application
+			_, e = io.ReadFull(accepted, make([]byte, 28))
+			if e != nil {
+				t.Fatal(e)
+			}
+		}
+		_, e = io.ReadFull(accepted, b)
+		if e != nil || string(b) != `ping` {
+			t.Fatal(e, string(b))
+		}
+		c.Close()
+		accepted.Close()
+		l.Close()
+	}
+}
+
+// countingListener counts the conns accepted from the backlog.
+type countingListener struct {
+	net.Listener
+	accepted int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	c, e := l.Listener.Accept()
+	if e == nil {
+		atomic.AddInt32(&l.accepted, 1)
+	}
+	return c, e
+}
+func TestProxyListenerPreparing(t *testing.T) {
+	const n = 300
+	tl, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	cl := &countingListener{Listener: tl}
+	l := vnet.ProxyListener(cl, vnet.TrustPrefixes(netip.MustParsePrefix(`127.0.0.0/8`)), time.Millisecond*500)
+	defer l.Close()
+	// starts the accepting goroutine
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	l.AcceptContext(ctx)
+
+	// sources that never send a header
+	for i := 0; i < n; i++ {
+		c, e := net.Dial(`tcp`, tl.Addr().String())
+		if e != nil {
+			t.Fatal(e)
+		}
+		defer c.Close()
+	}
+	time.Sleep(time.Millisecond * 200)
+	if accepted := atomic.LoadInt32(&cl.accepted); accepted != 256 {
+		t.Fatalf("expect 256 conns read at once, got %v", accepted)
+	}
+	// the silent conns are dropped, which lets the others in
+	deadline := time.Now().Add(time.Second * 5)
+	for atomic.LoadInt32(&cl.accepted) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expect %v conns accepted, got %v", n, atomic.LoadInt32(&cl.accepted))
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
@@ -0,0 +1,141 @@
+// Package ratelimit shapes byte streams with token buckets.
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// Limit is a rate in bytes per second and the burst of bytes allowed at once.
+// The zero Limit, or any Limit whose Rate is not positive, is unlimited.
+// A Burst below 1 allows one second of Rate.
+type Limit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// Unlimited reports whether l does not limit anything.
+func (l Limit) Unlimited() bool {
+	return l.Rate <= 0 || math.IsInf(l.Rate, 1)
+}
+func (l Limit) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	} else if l.Rate < 1 {
+		return 1
+	}
+	return math.Floor(l.Rate)
+}
+
+// Bucket is a token bucket of bytes, its limit can be changed at any time.
+type Bucket struct {
+	m      sync.Mutex
+	limit  Limit
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket returns a full bucket.
+func NewBucket(l Limit) *Bucket {
+	return &Bucket{
+		limit:  l,
+		tokens: l.burst(),
+		last:   time.Now(),
+	}
+}
+
+// Limit returns the limit of the bucket.
+func (b *Bucket) Limit() Limit {
+	b.m.Lock()
+	l := b.limit
+	b.m.Unlock()
+	return l
+}
+
+// SetLimit changes the limit, the tokens already available are kept up to the new burst.
+func (b *Bucket) SetLimit(l Limit) {
+	b.m.Lock()
+	b.refill(time.Now())
+	b.limit = l
+	if burst := l.burst(); b.tokens > burst {
+		b.tokens = burst
+	}
+	b.m.Unlock()
+}
+
+// Chunk returns the most bytes that should be moved at once, at most n.
+func (b *Bucket) Chunk(n int) int {
+	b.m.Lock()
+	l := b.limit
+	b.m.Unlock()
+	if l.Unlimited() {
+		return n
+	} else if burst := int(l.burst()); burst < n {
+		return burst
+	}
+	return n
+}
+
+// Reserve takes n tokens, it returns how long to wait before the bytes they stand for may be moved.
+func (b *Bucket) Reserve(n int) time.Duration {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if b.limit.Unlimited() {
+		return 0
+	}
+	now := time.Now()
+	b.refill(now)
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.limit.Rate * float64(time.Second))
+}
+
+// refill adds the tokens earned since the last refill, b.m must be held.
+func (b *Bucket) refill(now time.Time) {
+	if !b.limit.Unlimited() {
+		b.tokens += now.Sub(b.last).Seconds() * b.limit.Rate
+		if burst := b.limit.burst(); b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+	b.last = now
+}
+
+// Chunk returns the most bytes that should be moved at once through all the buckets, at most n.
+// Nil buckets are ignored.
+func Chunk(n int, buckets ...*Bucket) int {
+	for _, b := range buckets {
+		if b != nil {
+			n = b.Chunk(n)
+		}
+	}
+	return n
+}
+
+// Wait takes n tokens from every bucket and waits until the bytes may be moved through all of them,
+// or returns ctx.Err() if ctx is done first. Nil buckets are ignored.
+func Wait(ctx context.Context, n int, buckets ...*Bucket) error {
+	var delay time.Duration
+	for _, b := range buckets {
+		if b != nil {
+			if d := b.Reserve(n); d > delay {
+				delay = d
+			}
+		}
+	}
+	if delay <= 0 {
+		return nil
+	}
+	t := time.NewTimer(delay)
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		t.Stop()
+		return ctx.Err()
+	}
+}
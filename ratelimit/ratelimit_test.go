@@ -0,0 +1,50 @@
+package ratelimit_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/powerpuffpenguin/vnet/ratelimit"
+)
+
+func TestBucket(t *testing.T) {
+	b := ratelimit.NewBucket(ratelimit.Limit{Rate: 1000, Burst: 100})
+	if n := b.Chunk(500); n != 100 {
+		t.Fatalf("expect a chunk of 100, got %d", n)
+	}
+	if d := b.Reserve(100); d != 0 {
+		t.Fatalf("expect the burst at once, got %v", d)
+	}
+	if d := b.Reserve(100); d < time.Millisecond*90 || d > time.Millisecond*100 {
+		t.Fatalf("expect about 100ms, got %v", d)
+	}
+
+	b.SetLimit(ratelimit.Limit{})
+	if d := b.Reserve(1 << 20); d != 0 {
+		t.Fatalf("expect unlimited, got %v", d)
+	} else if n := b.Chunk(1 << 20); n != 1<<20 {
+		t.Fatalf("expect unlimited chunk, got %d", n)
+	}
+
+	b.SetLimit(ratelimit.Limit{Rate: 10})
+	if n := b.Chunk(100); n != 10 {
+		t.Fatalf("expect a burst of one second, got %d", n)
+	}
+}
+func TestWait(t *testing.T) {
+	fast := ratelimit.NewBucket(ratelimit.Limit{Rate: 1 << 20})
+	slow := ratelimit.NewBucket(ratelimit.Limit{Rate: 100, Burst: 10})
+	start := time.Now()
+	if e := ratelimit.Wait(context.Background(), 15, fast, nil, slow); e != nil {
+		t.Fatal(e)
+	} else if elapsed := time.Since(start); elapsed < time.Millisecond*40 {
+		t.Fatalf("expect the slowest bucket to be waited, took %v", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if e := ratelimit.Wait(ctx, 1000, slow); e != context.Canceled {
+		t.Fatalf("expect canceled, got %v", e)
+	}
+}
@@ -0,0 +1,168 @@
+package relay
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/powerpuffpenguin/vnet"
+	"github.com/powerpuffpenguin/vnet/reverse"
+)
+
+// Handshake registers c on the relay under token as role and waits until a peer of the other role is paired.
+// If ctx is done before that, c is closed and ctx.Err() is returned.
+func Handshake(ctx context.Context, c net.Conn, role uint8, token string) (e error) {
+	e = checkToken(token)
+	if e != nil {
+		return
+	}
+	done := make(chan struct{})
+	ch := make(chan error, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+			ch <- ctx.Err()
+		case <-done:
+			ch <- nil
+		}
+	}()
+	e = writeRegister(c, role, token)
+	if e == nil {
+		e = readPaired(c)
+	}
+	close(done)
+	if err := <-ch; err != nil {
+		e = err
+	}
+	return
+}
+
+// Dial dials the relay at addr and registers under token as role.
+// It returns once a peer has been paired.
+func Dial(ctx context.Context, network, addr string, role uint8, token string) (c net.Conn, e error) {
+	e = checkToken(token)
+	if e != nil {
+		return
+	}
+	var d net.Dialer
+	c, e = d.DialContext(ctx, network, addr)
+	if e != nil {
+		return
+	}
+	e = Handshake(ctx, c, role, token)
+	if e != nil {
+		c.Close()
+		c = nil
+	}
+	return
+}
+
+// Listen returns a reverse.Listener whose conns are dialed out to the relay at addr and registered under token.
+// It is used by the peer that provides the service.
+func Listen(addr net.Addr, token string, opt ...reverse.ListenerOption) *reverse.Listener {
+	return reverse.Listen(addr, append(opt,
+		reverse.WithListenerDialContext(func(ctx context.Context, network, address string) (net.Conn, error) {
+			return Dial(ctx, network, address, RoleListener, token)
+		}),
+	)...)
+}
+
+// NewDialer returns a reverse.Dialer whose agent conns are dialed out to the relay at addr and registered under token.
+// It is used by the peer that consumes the service, Serve must be called as for any reverse.Dialer.
+func NewDialer(addr net.Addr, token string, opt ...reverse.DialerOption) *reverse.Dialer {
+	return reverse.NewDialer(newListener(addr, token), opt...)
+}
+
+// listener accepts conns by registering RoleDialer on the relay.
+type listener struct {
+	addr  net.Addr
+	token string
+
+	close <-chan struct{}
+	done  uint32
+	m     sync.Mutex
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newListener(addr net.Addr, token string) *listener {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &listener{
+		addr:   addr,
+		token:  token,
+		close:  ctx.Done(),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+func (l *listener) Accept() (c net.Conn, e error) {
+	return l.AcceptContext(context.Background())
+}
+func (l *listener) AcceptContext(ctx context.Context) (c net.Conn, e error) {
+	if atomic.LoadUint32(&l.done) != 0 {
+		e = vnet.ErrListenerClosed
+		return
+	}
+	e = checkToken(l.token)
+	if e != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-l.close:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	c, e = Dial(ctx, l.addr.Network(), l.addr.String(), RoleDialer, l.token)
+	if e != nil {
+		select {
+		case <-l.close:
+			e = vnet.ErrListenerClosed
+			return
+		default:
+		}
+		if ctx.Err() != nil {
+			e = ctx.Err()
+		} else {
+			// the relay may come back, let reverse.Dialer.Serve retry
+			e = temporaryError{e}
+		}
+	}
+	return
+}
+func (l *listener) Close() (e error) {
+	if atomic.LoadUint32(&l.done) == 0 {
+		l.m.Lock()
+		defer l.m.Unlock()
+		if l.done == 0 {
+			defer atomic.StoreUint32(&l.done, 1)
+			l.cancel()
+			return
+		}
+	}
+	e = vnet.ErrListenerClosed
+	return
+}
+func (l *listener) Addr() net.Addr {
+	return l.addr
+}
+
+type temporaryError struct {
+	error
+}
+
+func (e temporaryError) Unwrap() error {
+	return e.error
+}
+func (temporaryError) Timeout() bool {
+	return false
+}
+func (temporaryError) Temporary() bool {
+	return true
+}
@@ -0,0 +1,21 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/powerpuffpenguin/vnet/errs"
+)
+
+var ErrProtocol = errors.New(`relay protocol error`)
+var ErrToken = errors.New(`invalid relay token`)
+
+// protocolError returns an *errs.ProtocolError that matches ErrProtocol.
+func protocolError(version, event uint8, format string, a ...interface{}) error {
+	return &errs.ProtocolError{
+		Err:     ErrProtocol,
+		Version: version,
+		Event:   event,
+		Msg:     fmt.Sprintf(format, a...),
+	}
+}
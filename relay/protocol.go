@@ -0,0 +1,111 @@
+package relay
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/powerpuffpenguin/vnet/errs"
+)
+
+// register frame: flag(2) version(1) role(1) token length(1) token
+// paired frame: flag(2) version(1) event(1)
+const DatagramLen = 2 + 1 + 1
+const DatagramFlag = uint16(3554)
+const DatagramVersion = uint8(1)
+const (
+	// RoleListener is registered by the peer that yields a reverse.Listener
+	RoleListener = uint8(1) + iota
+	// RoleDialer is registered by the peer that yields a reverse.Dialer
+	RoleDialer
+)
+const (
+	// EventPaired is sent by the relay when a peer has been paired
+	EventPaired = uint8(1) + iota
+)
+
+// MaxTokenLen is the maximum length of a rendezvous token.
+const MaxTokenLen = 255
+
+func checkToken(token string) error {
+	if len(token) == 0 || len(token) > MaxTokenLen {
+		return fmt.Errorf(`%w: token length must be in [1,%v]`, ErrToken, MaxTokenLen)
+	}
+	return nil
+}
+func writeRegister(w io.Writer, role uint8, token string) (e error) {
+	b := make([]byte, DatagramLen+1+len(token))
+	binary.BigEndian.PutUint16(b, DatagramFlag)
+	b[2] = DatagramVersion
+	b[3] = role
+	b[4] = uint8(len(token))
+	copy(b[5:], token)
+	_, e = w.Write(b)
+	return
+}
+func readRegister(r io.Reader) (role uint8, token string, e error) {
+	var b [DatagramLen + 1 + MaxTokenLen]byte
+	_, e = io.ReadFull(r, b[:DatagramLen+1])
+	if e != nil {
+		return
+	}
+	e = checkHeader(b[:])
+	if e != nil {
+		return
+	}
+	role = b[3]
+	if role != RoleListener && role != RoleDialer {
+		e = protocolError(b[2], role, `not supported role=%v`, role)
+		return
+	}
+	n := int(b[4])
+	if n == 0 {
+		e = protocolError(b[2], role, `empty token`)
+		return
+	}
+	_, e = io.ReadFull(r, b[DatagramLen+1:DatagramLen+1+n])
+	if e != nil {
+		return
+	}
+	token = string(b[DatagramLen+1 : DatagramLen+1+n])
+	return
+}
+func writePaired(c net.Conn) (e error) {
+	var b [DatagramLen]byte
+	binary.BigEndian.PutUint16(b[:], DatagramFlag)
+	b[2] = DatagramVersion
+	b[3] = EventPaired
+	_, e = c.Write(b[:])
+	return
+}
+func readPaired(r io.Reader) (e error) {
+	var b [DatagramLen]byte
+	_, e = io.ReadFull(r, b[:])
+	if e != nil {
+		return
+	}
+	e = checkHeader(b[:])
+	if e != nil {
+		return
+	}
+	if b[3] != EventPaired {
+		e = protocolError(b[2], b[3], `unexpected event=%v`, b[3])
+	}
+	return
+}
+func checkHeader(b []byte) error {
+	flag := binary.BigEndian.Uint16(b)
+	if flag != DatagramFlag {
+		return &errs.ProtocolError{
+			Err:  ErrProtocol,
+			Flag: flag,
+			Msg:  fmt.Sprintf(`not supported flag=%v`, flag),
+		}
+	}
+	version := b[2]
+	if version > DatagramVersion {
+		return protocolError(version, b[3], `not supported version=%v`, version)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package relay_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/powerpuffpenguin/vnet"
+	"github.com/powerpuffpenguin/vnet/relay"
+)
+
+func TestRelay(t *testing.T) {
+	l, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	srv := relay.NewServer()
+	defer srv.Close()
+	go srv.Serve(l)
+
+	// both peers dial out to the relay
+	dialer := relay.NewDialer(l.Addr(), `rendezvous`)
+	defer dialer.Close()
+	go dialer.Serve()
+	listener := relay.Listen(l.Addr(), `rendezvous`)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(`/info`, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte(`relay listener`))
+	})
+	ch := make(chan error, 1)
+	go func() {
+		e := http.Serve(listener, mux)
+		if e != nil && !errors.Is(e, vnet.ErrListenerClosed) {
+			ch <- e
+		} else {
+			ch <- nil
+		}
+	}()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: dialer.DialContext,
+		},
+	}
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, `http://relay/info`, nil)
+		resp, e := client.Do(req)
+		if e != nil {
+			cancel()
+			t.Fatal(e)
+		}
+		b, e := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		cancel()
+		if e != nil {
+			t.Fatal(e)
+		} else if string(b) != `relay listener` {
+			t.Fatalf("unexpected body: %s", b)
+		}
+		client.CloseIdleConnections()
+	}
+	listener.Close()
+	if e := <-ch; e != nil {
+		t.Fatal(e)
+	}
+}
+
+func TestRelayToken(t *testing.T) {
+	_, e := relay.Dial(context.Background(), `tcp`, `127.0.0.1:0`, relay.RoleDialer, ``)
+	if !errors.Is(e, relay.ErrToken) {
+		t.Fatalf("expect ErrToken, got %v", e)
+	}
+}
+func TestRelayEvict(t *testing.T) {
+	l, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	srv := relay.NewServer(relay.WithServerBacklog(1))
+	defer srv.Close()
+	go srv.Serve(l)
+
+	// a peer going away while waiting frees its place at once
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	_, e = relay.Dial(ctx, `tcp`, l.Addr().String(), relay.RoleListener, `evict`)
+	cancel()
+	if !errors.Is(e, context.DeadlineExceeded) {
+		t.Fatalf("expect deadline exceeded, got %v", e)
+	}
+	time.Sleep(time.Millisecond * 50)
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	ch := make(chan net.Conn, 1)
+	go func() {
+		c, e := relay.Dial(ctx, `tcp`, l.Addr().String(), relay.RoleListener, `evict`)
+		if e != nil {
+			t.Error(e)
+		}
+		ch <- c
+	}()
+	time.Sleep(time.Millisecond * 50)
+	d, e := relay.Dial(ctx, `tcp`, l.Addr().String(), relay.RoleDialer, `evict`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer d.Close()
+	c := <-ch
+	if c == nil {
+		t.FailNow()
+	}
+	defer c.Close()
+	d.Write([]byte(`ok`))
+	b := make([]byte, 2)
+	_, e = io.ReadFull(c, b)
+	if e != nil || string(b) != `ok` {
+		t.Fatal(e, string(b))
+	}
+}
@@ -0,0 +1,281 @@
+package relay
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/powerpuffpenguin/vnet"
+	"github.com/powerpuffpenguin/vnet/proxy"
+)
+
+// aLongTimeAgo is a non-zero time, far in the past, used to interrupt blocked reads.
+var aLongTimeAgo = time.Unix(1, 0)
+
+type rendezvous struct {
+	listeners []*waiter
+	dialers   []*waiter
+}
+
+// waiter is a registered conn waiting for its peer.
+type waiter struct {
+	c net.Conn
+	// done is closed once watch has returned
+	done chan struct{}
+}
+
+// stop ends the watch of a waiter taken from its rendezvous.
+func (w *waiter) stop() {
+	w.c.SetReadDeadline(aLongTimeAgo)
+	<-w.done
+	w.c.SetReadDeadline(time.Time{})
+}
+
+// Server pairs conns registered under the same token by a RoleListener peer and a RoleDialer peer,
+// then splices them together so the reverse handshake runs end to end.
+// Waiting peers are read, so a peer that goes away or sends anything before it is paired is dropped at once.
+type Server struct {
+	opts serverOptions
+
+	tokens    map[string]*rendezvous
+	conns     map[net.Conn]struct{}
+	listeners map[net.Listener]struct{}
+
+	close <-chan struct{}
+	done  uint32
+	m     sync.Mutex
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewServer(opt ...ServerOption) *Server {
+	opts := defaultServerOptions
+	for _, o := range opt {
+		o.apply(&opts)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Server{
+		opts:      opts,
+		tokens:    make(map[string]*rendezvous),
+		conns:     make(map[net.Conn]struct{}),
+		listeners: make(map[net.Listener]struct{}),
+		close:     ctx.Done(),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+}
+
+// Close closes the relay, all listeners passed to Serve and all conns waiting or spliced.
+func (s *Server) Close() (e error) {
+	if atomic.LoadUint32(&s.done) == 0 {
+		s.m.Lock()
+		defer s.m.Unlock()
+		if s.done == 0 {
+			defer atomic.StoreUint32(&s.done, 1)
+			s.cancel()
+			for l := range s.listeners {
+				l.Close()
+			}
+			for c := range s.conns {
+				c.Close()
+			}
+			s.tokens = nil
+			s.conns = nil
+			s.listeners = nil
+			return
+		}
+	}
+	e = vnet.ErrClosed
+	return
+}
+
+// Serve accepts peers on l until the relay or l is closed.
+func (s *Server) Serve(l net.Listener) error {
+	s.m.Lock()
+	if s.done != 0 {
+		s.m.Unlock()
+		return vnet.ErrClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.m.Unlock()
+
+	var tempDelay time.Duration // how long to sleep on accept failure
+	for {
+		c, e := l.Accept()
+		if e != nil {
+			select {
+			case <-s.close:
+				return vnet.ErrClosed
+			default:
+			}
+			if ne, ok := e.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				time.Sleep(tempDelay)
+				continue
+			}
+			s.m.Lock()
+			if s.done == 0 {
+				delete(s.listeners, l)
+			}
+			s.m.Unlock()
+			return e
+		}
+		tempDelay = 0
+		go s.onAccept(c)
+	}
+}
+func (s *Server) onAccept(c net.Conn) {
+	if !s.track(c) {
+		return
+	}
+	if s.opts.timeout > 0 {
+		c.SetReadDeadline(time.Now().Add(s.opts.timeout))
+	}
+	role, token, e := readRegister(c)
+	if e != nil {
+		s.untrack(c)
+		return
+	}
+	if s.opts.timeout > 0 {
+		c.SetReadDeadline(time.Time{})
+	}
+	s.register(role, token, c)
+}
+func (s *Server) track(c net.Conn) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.done != 0 {
+		c.Close()
+		return false
+	}
+	s.conns[c] = struct{}{}
+	return true
+}
+func (s *Server) untrack(c net.Conn) {
+	c.Close()
+	s.m.Lock()
+	if s.done == 0 {
+		delete(s.conns, c)
+	}
+	s.m.Unlock()
+}
+func (s *Server) register(role uint8, token string, c net.Conn) {
+	var peer, w *waiter
+	s.m.Lock()
+	if s.done != 0 {
+		s.m.Unlock()
+		c.Close()
+		return
+	}
+	r := s.tokens[token]
+	if r == nil {
+		r = &rendezvous{}
+		s.tokens[token] = r
+	}
+	var waiting, other *[]*waiter
+	if role == RoleListener {
+		waiting, other = &r.listeners, &r.dialers
+	} else {
+		waiting, other = &r.dialers, &r.listeners
+	}
+	if len(*other) != 0 {
+		peer = (*other)[0]
+		(*other)[0] = nil
+		*other = (*other)[1:]
+		if len(r.listeners) == 0 && len(r.dialers) == 0 {
+			delete(s.tokens, token)
+		}
+	} else if s.opts.backlog > 0 && len(*waiting) >= s.opts.backlog {
+		delete(s.conns, c)
+		s.m.Unlock()
+		c.Close()
+		return
+	} else {
+		w = &waiter{
+			c:    c,
+			done: make(chan struct{}),
+		}
+		*waiting = append(*waiting, w)
+	}
+	s.m.Unlock()
+
+	if w != nil {
+		go s.watch(role, token, w)
+	} else {
+		// the peer sends nothing until it is told it is paired, so the watch can't have read its bytes
+		peer.stop()
+		if role == RoleListener {
+			s.pair(token, c, peer.c)
+		} else {
+			s.pair(token, peer.c, c)
+		}
+	}
+}
+
+// watch reads the waiting conn so that it is evicted as soon as its peer goes away.
+// Peers send nothing while they wait, a byte read is evicted too.
+func (s *Server) watch(role uint8, token string, w *waiter) {
+	var b [1]byte
+	w.c.Read(b[:])
+	s.m.Lock()
+	evicted := s.done == 0 && s.unwait(role, token, w)
+	s.m.Unlock()
+	close(w.done)
+	if evicted {
+		s.untrack(w.c)
+	}
+}
+
+// unwait removes w from the conns waiting under token, s.m must be held.
+// It returns false if w is not waiting anymore.
+func (s *Server) unwait(role uint8, token string, w *waiter) bool {
+	r := s.tokens[token]
+	if r == nil {
+		return false
+	}
+	waiting := &r.dialers
+	if role == RoleListener {
+		waiting = &r.listeners
+	}
+	for i, found := range *waiting {
+		if found == w {
+			copy((*waiting)[i:], (*waiting)[i+1:])
+			(*waiting)[len(*waiting)-1] = nil
+			*waiting = (*waiting)[:len(*waiting)-1]
+			if len(r.listeners) == 0 && len(r.dialers) == 0 {
+				delete(s.tokens, token)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// pair notifies both peers and splices them.
+// If one of them has gone away the other one is registered again.
+func (s *Server) pair(token string, l, d net.Conn) {
+	if writePaired(l) != nil {
+		s.untrack(l)
+		s.register(RoleDialer, token, d)
+		return
+	}
+	if writePaired(d) != nil {
+		s.untrack(d)
+		// the listener peer has already been told it is paired, it can't wait again
+		s.untrack(l)
+		return
+	}
+	proxy.Join(l, d)
+	s.untrack(l)
+	s.untrack(d)
+}
@@ -0,0 +1,42 @@
+package relay
+
+import "time"
+
+var defaultServerOptions = serverOptions{
+	timeout: time.Second * 75,
+	backlog: 1024,
+}
+
+type serverOptions struct {
+	timeout time.Duration
+	backlog int
+}
+type ServerOption interface {
+	apply(*serverOptions)
+}
+type funcServerOption struct {
+	f func(*serverOptions)
+}
+
+func (fdo *funcServerOption) apply(do *serverOptions) {
+	fdo.f(do)
+}
+func newServerOption(f func(*serverOptions)) *funcServerOption {
+	return &funcServerOption{
+		f: f,
+	}
+}
+
+// WithServerTimeout sets how long the relay waits for a peer to send its register frame.
+func WithServerTimeout(timeout time.Duration) ServerOption {
+	return newServerOption(func(o *serverOptions) {
+		o.timeout = timeout
+	})
+}
+
+// WithServerBacklog sets the maximum number of peers waiting on one token for each role.
+func WithServerBacklog(backlog int) ServerOption {
+	return newServerOption(func(o *serverOptions) {
+		o.backlog = backlog
+	})
+}
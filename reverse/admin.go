@@ -0,0 +1,447 @@
+package reverse
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"mime"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// NewDialerAdmin returns a handler to inspect d while debugging stuck tunnels.
+//
+// GET returns a JSON snapshot of the agents, the idle conns with their age and last heart,
+// the dials waiting for an agent, the conns returned by dials with their byte counts, and the options.
+// POST with {"action":"close","id":<id>} closes the idle or dialed conn id,
+// POST with {"action":"evict","agent":"<agent>"} closes every conn of the agent, identified by its public key in hex or its IP.
+// Actions must be sent as JSON with Content-Type application/json, so a browser can't be tricked into posting one cross-site.
+// An evicted agent usually reconnects at once, WithDialerAcceptFilter keeps it out.
+//
+// The handler has no access control, serve it on a private address only.
+func NewDialerAdmin(d *Dialer) http.Handler {
+	return &admin{
+		snapshot: func() interface{} {
+			return d.snapshot()
+		},
+		closeConn:  d.closeConn,
+		evictAgent: d.evictAgent,
+	}
+}
+
+// NewListenerAdmin returns a handler to inspect l while debugging stuck tunnels.
+//
+// GET returns a JSON snapshot of the idle conns waiting for syn with their age and last heart,
+// the number of Accept calls in progress, and the options.
+// POST with {"action":"close","id":<id>} as JSON closes the idle conn id, the listener reconnects in its place.
+// Conns returned by Accept belong to the caller and are not listed.
+//
+// The handler has no access control, serve it on a private address only.
+func NewListenerAdmin(l *Listener) http.Handler {
+	return &admin{
+		snapshot: func() interface{} {
+			return l.snapshot()
+		},
+		closeConn: l.closeConn,
+	}
+}
+
+// maxAdminAction is the largest action body accepted.
+const maxAdminAction = 4096
+
+// adminAction is the JSON body of a POST.
+type adminAction struct {
+	Action string  `json:"action"`
+	ID     *uint64 `json:"id"`
+	Agent  string  `json:"agent"`
+}
+
+type admin struct {
+	snapshot func() interface{}
+	// closeConn and evictAgent return the number of conns closed
+	closeConn  func(id uint64) int
+	evictAgent func(agent string) int
+}
+
+func (a *admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		writeJSON(w, http.StatusOK, a.snapshot())
+	case http.MethodPost:
+		// forms can be posted cross-site without a preflight, JSON can't
+		if mt, _, e := mime.ParseMediaType(r.Header.Get(`Content-Type`)); e != nil || mt != `application/json` {
+			writeError(w, http.StatusUnsupportedMediaType, `content type must be application/json`)
+			return
+		}
+		var action adminAction
+		e := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAdminAction)).Decode(&action)
+		if e != nil {
+			writeError(w, http.StatusBadRequest, `invalid action`)
+			return
+		}
+		var closed int
+		switch action.Action {
+		case `close`:
+			if action.ID == nil {
+				writeError(w, http.StatusBadRequest, `invalid id`)
+				return
+			}
+			closed = a.closeConn(*action.ID)
+		case `evict`:
+			agent := action.Agent
+			if a.evictAgent == nil {
+				writeError(w, http.StatusBadRequest, `evict not supported`)
+				return
+			} else if agent == `` {
+				writeError(w, http.StatusBadRequest, `invalid agent`)
+				return
+			}
+			closed = a.evictAgent(agent)
+		default:
+			writeError(w, http.StatusBadRequest, `unknown action`)
+			return
+		}
+		if closed == 0 {
+			writeError(w, http.StatusNotFound, `not found`)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{
+			`closed`: closed,
+		})
+	default:
+		w.Header().Set(`Allow`, `GET, HEAD, POST`)
+		writeError(w, http.StatusMethodNotAllowed, `method not allowed`)
+	}
+}
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set(`Content-Type`, `application/json`)
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent(``, `  `)
+	enc.Encode(v)
+}
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{
+		`error`: msg,
+	})
+}
+
+// agentID identifies an agent by its public key, or by its IP if the conn is not secured.
+// It is empty for conns forwarded to another node of the cluster.
+func agentID(agent *Agent) string {
+	if len(agent.PublicKey) != 0 {
+		return hex.EncodeToString(agent.PublicKey)
+	} else if agent.RemoteAddr == nil {
+		return ``
+	}
+	return addrIP(agent.RemoteAddr)
+}
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ``
+	}
+	return addr.String()
+}
+func durationString(d time.Duration) string {
+	if d == 0 {
+		return ``
+	}
+	return d.String()
+}
+
+type dialerSnapshot struct {
+	Addr     string                `json:"addr"`
+	Closed   bool                  `json:"closed"`
+	Draining bool                  `json:"draining"`
+	Options  dialerOptionsSnapshot `json:"options"`
+	Agents   []*agentSnapshot      `json:"agents"`
+	Idle     []idleSnapshot        `json:"idle"`
+	Waiting  []waiterSnapshot      `json:"waiting"`
+	Active   []connSnapshot        `json:"active"`
+}
+type dialerOptionsSnapshot struct {
+	SynAck        bool   `json:"syn_ack"`
+	Timeout       string `json:"timeout,omitempty"`
+	Heart         string `json:"heart,omitempty"`
+	HeartTimeout  string `json:"heart_timeout,omitempty"`
+	MaxIdle       int    `json:"max_idle,omitempty"`
+	MaxIdlePerIP  int    `json:"max_idle_per_ip,omitempty"`
+	MaxIdleAge    string `json:"max_idle_age,omitempty"`
+	AcceptFilter  bool   `json:"accept_filter"`
+	Noise         bool   `json:"noise"`
+	Compress      bool   `json:"compress"`
+	CompressLevel int    `json:"compress_level,omitempty"`
+	ProxyVersion  uint8  `json:"proxy_version,omitempty"`
+	Observers     int    `json:"observers"`
+	ClusterID     string `json:"cluster_id,omitempty"`
+	ClusterAddr   string `json:"cluster_addr,omitempty"`
+}
+type agentSnapshot struct {
+	ID        string            `json:"id"`
+	PublicKey string            `json:"public_key,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Load      uint32            `json:"load"`
+	Capacity  uint32            `json:"capacity"`
+	Idle      int               `json:"idle"`
+	Active    int               `json:"active"`
+}
+type idleSnapshot struct {
+	ID         uint64     `json:"id"`
+	Agent      string     `json:"agent"`
+	RemoteAddr string     `json:"remote_addr"`
+	Age        string     `json:"age"`
+	LastHeart  *time.Time `json:"last_heart,omitempty"`
+	HeartRTT   string     `json:"heart_rtt,omitempty"`
+}
+type waiterSnapshot struct {
+	Selector Selector `json:"selector,omitempty"`
+	Waiting  string   `json:"waiting"`
+}
+type connSnapshot struct {
+	ID           uint64 `json:"id"`
+	Agent        string `json:"agent,omitempty"`
+	LocalAddr    string `json:"local_addr"`
+	RemoteAddr   string `json:"remote_addr"`
+	Age          string `json:"age"`
+	BytesRead    uint64 `json:"bytes_read"`
+	BytesWritten uint64 `json:"bytes_written"`
+}
+
+func (o *dialerOptions) snapshot() dialerOptionsSnapshot {
+	return dialerOptionsSnapshot{
+		SynAck:        o.synAck,
+		Timeout:       durationString(o.timeout),
+		Heart:         durationString(o.heart),
+		HeartTimeout:  durationString(o.heartTimeout),
+		MaxIdle:       o.maxIdle,
+		MaxIdlePerIP:  o.maxIdlePerIP,
+		MaxIdleAge:    durationString(o.maxIdleAge),
+		AcceptFilter:  o.acceptFilter != nil,
+		Noise:         o.noiseKey != nil,
+		Compress:      o.compress,
+		CompressLevel: o.compressLevel,
+		ProxyVersion:  o.proxyVersion,
+		Observers:     len(o.observers),
+		ClusterID:     o.clusterID,
+		ClusterAddr:   addrString(o.clusterAddr),
+	}
+}
+func (d *Dialer) snapshot() *dialerSnapshot {
+	s := &dialerSnapshot{
+		Addr:    addrString(d.l.Addr()),
+		Options: d.opts.snapshot(),
+		Agents:  []*agentSnapshot{},
+		Idle:    []idleSnapshot{},
+		Waiting: []waiterSnapshot{},
+		Active:  []connSnapshot{},
+	}
+	select {
+	case <-d.drain:
+		s.Draining = true
+	default:
+	}
+	agents := make(map[string]*agentSnapshot)
+	addAgent := func(agent *Agent) *agentSnapshot {
+		id := agentID(agent)
+		found := agents[id]
+		if found == nil {
+			found = &agentSnapshot{
+				ID:       id,
+				Labels:   agent.Labels,
+				Load:     agent.Load,
+				Capacity: agent.Capacity,
+			}
+			if len(agent.PublicKey) != 0 {
+				found.PublicKey = id
+			}
+			agents[id] = found
+			s.Agents = append(s.Agents, found)
+		}
+		return found
+	}
+
+	now := time.Now()
+	d.m.Lock()
+	s.Closed = d.done != 0
+	idle := make([]*idleConn, 0, len(d.idle))
+	for _, ic := range d.idle {
+		idle = append(idle, ic)
+	}
+	sort.Slice(idle, func(i, j int) bool {
+		return idle[i].id < idle[j].id
+	})
+	for _, ic := range idle {
+		addAgent(&ic.agent).Idle++
+		snapshot := idleSnapshot{
+			ID:         ic.id,
+			Agent:      agentID(&ic.agent),
+			RemoteAddr: addrString(ic.agent.RemoteAddr),
+			Age:        now.Sub(ic.accepted).String(),
+			HeartRTT:   durationString(ic.rtt),
+		}
+		if !ic.lastHeart.IsZero() {
+			lastHeart := ic.lastHeart
+			snapshot.LastHeart = &lastHeart
+		}
+		s.Idle = append(s.Idle, snapshot)
+	}
+	for _, w := range d.waiters {
+		s.Waiting = append(s.Waiting, waiterSnapshot{
+			Selector: w.selector,
+			Waiting:  now.Sub(w.since).String(),
+		})
+	}
+	active := make([]*Conn, 0, len(d.active))
+	for c := range d.active {
+		active = append(active, c)
+	}
+	d.m.Unlock()
+
+	sort.Slice(active, func(i, j int) bool {
+		return active[i].id < active[j].id
+	})
+	for _, c := range active {
+		id := agentID(&c.agent)
+		if id != `` {
+			addAgent(&c.agent).Active++
+		}
+		s.Active = append(s.Active, connSnapshot{
+			ID:           c.id,
+			Agent:        id,
+			LocalAddr:    addrString(c.LocalAddr()),
+			RemoteAddr:   addrString(c.RemoteAddr()),
+			Age:          now.Sub(c.handedOff).String(),
+			BytesRead:    c.BytesRead(),
+			BytesWritten: c.BytesWritten(),
+		})
+	}
+	return s
+}
+
+// closeConn closes the idle or dialed conn id.
+func (d *Dialer) closeConn(id uint64) int {
+	return d.evict(func(conn uint64, agent *Agent) bool {
+		return conn == id
+	})
+}
+
+// evictAgent closes the idle and dialed conns of agent.
+func (d *Dialer) evictAgent(agent string) int {
+	return d.evict(func(conn uint64, a *Agent) bool {
+		return agentID(a) == agent
+	})
+}
+
+// evict closes the idle and dialed conns matched by match.
+func (d *Dialer) evict(match func(id uint64, agent *Agent) bool) int {
+	var idle []*idleConn
+	var active []*Conn
+	d.m.Lock()
+	for _, ic := range d.idle {
+		if match(ic.id, &ic.agent) {
+			idle = append(idle, ic)
+		}
+	}
+	for _, ic := range idle {
+		d.removeIdle(ic)
+	}
+	for c := range d.active {
+		if c.agent.RemoteAddr != nil && match(c.id, &c.agent) {
+			active = append(active, c)
+		}
+	}
+	d.m.Unlock()
+	for _, ic := range idle {
+		d.closed(ic, ErrEvicted)
+		ic.stream.rw.Close()
+	}
+	for _, c := range active {
+		c.Close()
+	}
+	return len(idle) + len(active)
+}
+
+type listenerSnapshot struct {
+	Addr      string                  `json:"addr"`
+	Closed    bool                    `json:"closed"`
+	Accepting int32                   `json:"accepting"`
+	Options   listenerOptionsSnapshot `json:"options"`
+	Idle      []listenerIdleSnapshot  `json:"idle"`
+}
+type listenerOptionsSnapshot struct {
+	SynAck        bool              `json:"syn_ack"`
+	SynAckTimeout string            `json:"syn_ack_timeout,omitempty"`
+	HeartTimeout  string            `json:"heart_timeout,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	Load          bool              `json:"load"`
+	Noise         bool              `json:"noise"`
+	Compress      bool              `json:"compress"`
+	CompressLevel int               `json:"compress_level,omitempty"`
+	Observers     int               `json:"observers"`
+}
+type listenerIdleSnapshot struct {
+	ID         uint64     `json:"id"`
+	LocalAddr  string     `json:"local_addr"`
+	RemoteAddr string     `json:"remote_addr"`
+	Age        string     `json:"age"`
+	LastHeart  *time.Time `json:"last_heart,omitempty"`
+}
+
+func (o *listenerOptions) snapshot() listenerOptionsSnapshot {
+	return listenerOptionsSnapshot{
+		SynAck:        o.synAck,
+		SynAckTimeout: durationString(o.synAckTimeout),
+		HeartTimeout:  durationString(o.heartTimeout),
+		Labels:        o.labels,
+		Load:          o.load != nil,
+		Noise:         o.noiseKey != nil,
+		Compress:      o.compress,
+		CompressLevel: o.compressLevel,
+		Observers:     len(o.observers),
+	}
+}
+func (l *Listener) snapshot() *listenerSnapshot {
+	s := &listenerSnapshot{
+		Addr:      addrString(l.Addr()),
+		Accepting: l.accepting.Load(),
+		Options:   l.opts.snapshot(),
+		Idle:      []listenerIdleSnapshot{},
+	}
+	now := time.Now()
+	l.m.Lock()
+	s.Closed = l.done != 0
+	for _, idle := range l.idle {
+		c := idle.stream.rw
+		snapshot := listenerIdleSnapshot{
+			ID:         idle.id,
+			LocalAddr:  addrString(c.LocalAddr()),
+			RemoteAddr: addrString(c.RemoteAddr()),
+			Age:        now.Sub(idle.since).String(),
+		}
+		if !idle.lastHeart.IsZero() {
+			lastHeart := idle.lastHeart
+			snapshot.LastHeart = &lastHeart
+		}
+		s.Idle = append(s.Idle, snapshot)
+	}
+	l.m.Unlock()
+	sort.Slice(s.Idle, func(i, j int) bool {
+		return s.Idle[i].ID < s.Idle[j].ID
+	})
+	return s
+}
+
+// closeConn interrupts the idle conn id, the listener closes it and reconnects.
+func (l *Listener) closeConn(id uint64) int {
+	l.m.Lock()
+	defer l.m.Unlock()
+	for _, idle := range l.idle {
+		if idle.id == id && !idle.evicted {
+			idle.evicted = true
+			idle.stream.rw.SetReadDeadline(aLongTimeAgo)
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,186 @@
+package reverse_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/powerpuffpenguin/vnet"
+	"github.com/powerpuffpenguin/vnet/reverse"
+)
+
+type adminSnapshot struct {
+	Agents []struct {
+		ID     string
+		Idle   int
+		Active int
+	}
+	Idle []struct {
+		ID        uint64
+		Agent     string
+		LastHeart *time.Time `json:"last_heart"`
+	}
+	Waiting []struct {
+		Selector map[string]string
+	}
+	Active []struct {
+		ID           uint64
+		BytesRead    uint64 `json:"bytes_read"`
+		BytesWritten uint64 `json:"bytes_written"`
+	}
+	Options struct {
+		Heart string
+	}
+}
+
+// getSnapshot waits until the snapshot served by h satisfies ok.
+func getSnapshot(t *testing.T, h http.Handler, ok func(s *adminSnapshot) bool) *adminSnapshot {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(`GET`, `/`, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected status %v", w.Code)
+		}
+		var s adminSnapshot
+		e := json.Unmarshal(w.Body.Bytes(), &s)
+		if e != nil {
+			t.Fatal(e)
+		} else if ok(&s) {
+			return &s
+		} else if time.Now().After(deadline) {
+			t.Fatalf("unexpected snapshot %s", w.Body.String())
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+func postAction(h http.Handler, action map[string]interface{}) int {
+	b, _ := json.Marshal(action)
+	r := httptest.NewRequest(`POST`, `/`, bytes.NewReader(b))
+	r.Header.Set(`Content-Type`, `application/json`)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w.Code
+}
+func TestAdmin(t *testing.T) {
+	l, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	dialer := reverse.NewDialer(l, reverse.WithDialerHeart(time.Millisecond*20))
+	defer dialer.Close()
+	go dialer.Serve()
+	dialerAdmin := reverse.NewDialerAdmin(dialer)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	ch := make(chan net.Conn, 1)
+	go func() {
+		c, e := dialer.DialAgent(ctx, reverse.Selector{`app`: `web`}, nil)
+		if e == nil {
+			ch <- c
+		}
+	}()
+	s := getSnapshot(t, dialerAdmin, func(s *adminSnapshot) bool {
+		return len(s.Waiting) == 1
+	})
+	if s.Waiting[0].Selector[`app`] != `web` || s.Options.Heart != `20ms` {
+		t.Fatalf("unexpected snapshot %+v", s)
+	}
+
+	listener := reverse.Listen(l.Addr(), reverse.WithListenerLabels(map[string]string{`app`: `web`}))
+	defer listener.Close()
+	listenerAdmin := reverse.NewListenerAdmin(listener)
+	go func() {
+		for {
+			c, e := listener.Accept()
+			if errors.Is(e, vnet.ErrListenerClosed) {
+				return
+			} else if e != nil {
+				// the evicted conn ends Accept, reconnect as agents do
+				continue
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	var c net.Conn
+	select {
+	case c = <-ch:
+	case <-ctx.Done():
+		t.Fatal(ctx.Err())
+	}
+	c.Write([]byte(`hello`))
+	io.ReadFull(c, make([]byte, 5))
+	s = getSnapshot(t, dialerAdmin, func(s *adminSnapshot) bool {
+		return len(s.Active) == 1 && s.Active[0].BytesRead == 5 &&
+			len(s.Idle) == 1 && s.Idle[0].LastHeart != nil &&
+			len(s.Agents) == 1 && s.Agents[0].Idle == 1 && s.Agents[0].Active == 1
+	})
+	if s.Agents[0].ID != `127.0.0.1` {
+		t.Fatalf("unexpected agent %v", s.Agents[0].ID)
+	}
+
+	// close the dialed conn
+	if code := postAction(dialerAdmin, map[string]interface{}{`action`: `close`, `id`: s.Active[0].ID}); code != http.StatusOK {
+		t.Fatalf("unexpected status %v", code)
+	}
+	if _, e := c.Read(make([]byte, 1)); e == nil {
+		t.Fatal("expect the conn closed")
+	}
+	getSnapshot(t, dialerAdmin, func(s *adminSnapshot) bool {
+		return len(s.Active) == 0
+	})
+
+	// the listener replaces an idle conn it is told to close
+	ls := getSnapshot(t, listenerAdmin, func(s *adminSnapshot) bool {
+		return len(s.Idle) == 1
+	})
+	if code := postAction(listenerAdmin, map[string]interface{}{`action`: `close`, `id`: ls.Idle[0].ID}); code != http.StatusOK {
+		t.Fatalf("unexpected status %v", code)
+	}
+	getSnapshot(t, listenerAdmin, func(s *adminSnapshot) bool {
+		return len(s.Idle) == 1 && s.Idle[0].ID != ls.Idle[0].ID
+	})
+	if code := postAction(listenerAdmin, map[string]interface{}{`action`: `evict`, `agent`: `127.0.0.1`}); code != http.StatusBadRequest {
+		t.Fatalf("unexpected status %v", code)
+	}
+
+	// evict the agent, it reconnects with a new idle conn
+	s = getSnapshot(t, dialerAdmin, func(s *adminSnapshot) bool {
+		return len(s.Idle) == 1
+	})
+	if code := postAction(dialerAdmin, map[string]interface{}{`action`: `evict`, `agent`: `127.0.0.1`}); code != http.StatusOK {
+		t.Fatalf("unexpected status %v", code)
+	}
+	evicted := s.Idle[0].ID
+	getSnapshot(t, dialerAdmin, func(s *adminSnapshot) bool {
+		return len(s.Idle) == 1 && s.Idle[0].ID != evicted
+	})
+	if code := postAction(dialerAdmin, map[string]interface{}{`action`: `close`, `id`: 999}); code != http.StatusNotFound {
+		t.Fatalf("unexpected status %v", code)
+	}
+	if code := postAction(dialerAdmin, map[string]interface{}{`action`: `reboot`}); code != http.StatusBadRequest {
+		t.Fatalf("unexpected status %v", code)
+	}
+	// a form, which any site can make a browser post, is refused
+	r := httptest.NewRequest(`POST`, `/`, strings.NewReader(url.Values{`action`: {`close`}, `id`: {`999`}}.Encode()))
+	r.Header.Set(`Content-Type`, `application/x-www-form-urlencoded`)
+	w := httptest.NewRecorder()
+	dialerAdmin.ServeHTTP(w, r)
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("unexpected status %v", w.Code)
+	}
+}
@@ -0,0 +1,129 @@
+package reverse
+
+import (
+	"bytes"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Agent describes an idle agent attached to a Dialer.
+type Agent struct {
+	// Labels advertised by the agent when it connected.
+	Labels map[string]string
+	// Load and Capacity reported by the agent in its last heartbeat.
+	// Capacity is 0 if the agent did not report it.
+	Load     uint32
+	Capacity uint32
+	// RemoteAddr is the address of the agent conn.
+	RemoteAddr net.Addr
+	// PublicKey is the agent's static key if the conn is secured by WithDialerNoise.
+	PublicKey []byte
+}
+
+// Selector selects agents whose labels contain all of its key/value pairs.
+type Selector map[string]string
+
+// String returns the pairs of the selector sorted by key, as k1=v1,k2=v2.
+func (s Selector) String() string {
+	keys := make([]string, 0, len(s))
+	for k := range s {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var sb strings.Builder
+	for i, k := range keys {
+		if i != 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(k)
+		sb.WriteByte('=')
+		sb.WriteString(s[k])
+	}
+	return sb.String()
+}
+
+// Match reports whether labels contain all of the selector's key/value pairs.
+func (s Selector) Match(labels map[string]string) bool {
+	for k, v := range s {
+		if val, ok := labels[k]; !ok || val != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Picker picks one of the idle agents, which all match the selector of the dial.
+// It returns the index of the picked agent, or -1 to wait for another agent.
+// The agents are copies the picker may keep. It runs without the dialer lock held,
+// so the picked agent may be taken meanwhile and the picker called again, but it must not block:
+// a waiting dial runs it each time a matching agent becomes idle.
+type Picker func(agents []*Agent) int
+
+// FirstIdle picks the agent that has been idle for the longest time.
+func FirstIdle(agents []*Agent) int {
+	if len(agents) == 0 {
+		return -1
+	}
+	return 0
+}
+
+// LeastLoaded picks the agent with the lowest load,
+// relative to its capacity if the agents report one.
+func LeastLoaded(agents []*Agent) int {
+	found := -1
+	var min float64
+	for i, agent := range agents {
+		load := float64(agent.Load)
+		if agent.Capacity != 0 {
+			load /= float64(agent.Capacity)
+		}
+		if found == -1 || load < min {
+			found = i
+			min = load
+		}
+	}
+	return found
+}
+
+// PublicKeyPicker returns a Picker that picks the agent longest idle among the agents whose PublicKey is key.
+func PublicKeyPicker(key []byte) Picker {
+	return func(agents []*Agent) int {
+		for i, agent := range agents {
+			if bytes.Equal(agent.PublicKey, key) {
+				return i
+			}
+		}
+		return -1
+	}
+}
+
+// WeightedRandom picks an agent at random, weighted by its free capacity.
+// Agents that do not report a capacity have a weight of 1, agents at full capacity are only picked if every agent is full.
+func WeightedRandom(agents []*Agent) int {
+	if len(agents) == 0 {
+		return -1
+	}
+	weights := make([]uint64, len(agents))
+	var sum uint64
+	for i, agent := range agents {
+		weight := uint64(1)
+		if agent.Capacity != 0 {
+			if agent.Load < agent.Capacity {
+				weight = uint64(agent.Capacity - agent.Load)
+			} else {
+				weight = 0
+			}
+		}
+		sum += weight
+		weights[i] = sum
+	}
+	if sum == 0 {
+		return rand.Intn(len(agents))
+	}
+	n := uint64(rand.Int63n(int64(sum)))
+	return sort.Search(len(weights), func(i int) bool {
+		return weights[i] > n
+	})
+}
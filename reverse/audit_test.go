@@ -0,0 +1,60 @@
+package reverse_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/powerpuffpenguin/vnet"
+	"github.com/powerpuffpenguin/vnet/audit"
+	"github.com/powerpuffpenguin/vnet/reverse"
+)
+
+func TestAudit(t *testing.T) {
+	l, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	records := make(chan audit.Record, 1)
+	dialer := reverse.NewDialer(l, reverse.WithDialerAudit(audit.SinkFunc(func(r audit.Record) {
+		records <- r
+	})))
+	defer dialer.Close()
+	go dialer.Serve()
+	listener := reverse.Listen(l.Addr(), reverse.WithListenerLabels(map[string]string{`app`: `web`}))
+	defer listener.Close()
+	go func() {
+		c, e := listener.Accept()
+		if e != nil {
+			return
+		}
+		c.Write([]byte(`hello`))
+		io.Copy(io.Discard, c)
+		c.Close()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	src := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+	dst := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 443}
+	c, e := dialer.DialAgent(vnet.NewProxyContext(ctx, src, dst), reverse.Selector{`app`: `web`}, nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	io.ReadFull(c, make([]byte, 5))
+	c.Write([]byte(`abc`))
+	c.Close()
+	var r audit.Record
+	select {
+	case r = <-records:
+	case <-ctx.Done():
+		t.Fatal(ctx.Err())
+	}
+	if r.Side != `dialer` || r.Agent != `127.0.0.1` || r.AgentLabels[`app`] != `web` ||
+		r.Source != src.String() || r.Destination != dst.String() ||
+		r.BytesIn != 5 || r.BytesOut != 3 || r.Reason != `closed` || r.RemoteAddr != c.RemoteAddr().String() {
+		t.Fatalf("unexpected record %+v", r)
+	}
+}
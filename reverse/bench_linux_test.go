@@ -0,0 +1,78 @@
+//go:build linux
+// +build linux
+
+package reverse_test
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/powerpuffpenguin/vnet/reverse"
+)
+
+// BenchmarkIdleAgents measures what idle agents cost the Dialer.
+// Every iteration is one heart interval, agents are raw tcp conns that never answer.
+// Hearts are scheduled centrally and idle tcp conns are watched by the epoll poller,
+// so goroutines/agent stays near 0 where it was 1 with a reader per conn.
+func BenchmarkIdleAgents(b *testing.B) {
+	for _, n := range []int{1000, 5000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			benchmarkIdleAgents(b, n)
+		})
+	}
+}
+func benchmarkIdleAgents(b *testing.B, n int) {
+	const heart = time.Millisecond * 100
+	l, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		b.Fatal(e)
+	}
+	runtime.GC()
+	goroutines := runtime.NumGoroutine()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	dialer := reverse.NewDialer(l,
+		reverse.WithDialerHeart(heart),
+		reverse.WithDialerHeartTimeout(time.Second),
+	)
+	go dialer.Serve()
+	agents := make([]net.Conn, 0, n)
+	for i := 0; i < n; i++ {
+		c, e := net.Dial(`tcp`, l.Addr().String())
+		if e != nil {
+			b.Fatal(e)
+		}
+		agents = append(agents, c)
+	}
+	defer func() {
+		dialer.Close()
+		for _, c := range agents {
+			c.Close()
+		}
+	}()
+	// let the dialer accept every agent and settle
+	time.Sleep(heart * 4)
+	runtime.GC()
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+	goroutines = runtime.NumGoroutine() - goroutines
+
+	var start syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &start)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		time.Sleep(heart)
+	}
+	b.StopTimer()
+	var end syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &end)
+	cpu := time.Duration(end.Utime.Nano()+end.Stime.Nano()) - time.Duration(start.Utime.Nano()+start.Stime.Nano())
+	b.ReportMetric(float64(cpu.Nanoseconds())/float64(n)/float64(b.N), `cpu-ns/agent/heart`)
+	b.ReportMetric(float64(goroutines)/float64(n), `goroutines/agent`)
+	b.ReportMetric(float64((after.HeapInuse+after.StackInuse)-(before.HeapInuse+before.StackInuse))/float64(n), `bytes/agent`)
+}
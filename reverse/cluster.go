@@ -0,0 +1,289 @@
+package reverse
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/powerpuffpenguin/vnet"
+	"github.com/powerpuffpenguin/vnet/logger"
+	"github.com/powerpuffpenguin/vnet/noise"
+	"github.com/powerpuffpenguin/vnet/proxy"
+	"github.com/powerpuffpenguin/vnet/reverse/codec"
+)
+
+var (
+	errNoNode  = errors.New(`no cluster node has idle agents`)
+	errNoAgent = errors.New(`no idle agent matches`)
+)
+
+// Node is the presence of a Dialer node in a cluster.
+type Node struct {
+	// ID identifies the node in the cluster.
+	ID string
+	// Network and Addr are where the node's ServeCluster listens, other nodes forward dials to it.
+	Network string
+	Addr    string
+	// Idle is the number of idle agents attached to the node, whatever their labels.
+	// A node without an idle agent matching a forwarded dial refuses it at once, and the next node is tried.
+	Idle int
+}
+
+// Registry shares agent presence between the Dialer nodes of a cluster.
+// It can be backed by gossip or by a shared store, MemoryRegistry is provided for tests and single process clusters.
+type Registry interface {
+	// Update publishes the presence of a node.
+	Update(ctx context.Context, node Node) error
+	// Remove withdraws the presence of a node.
+	Remove(ctx context.Context, id string) error
+	// Nodes returns the presence of all known nodes.
+	Nodes(ctx context.Context) ([]Node, error)
+}
+
+type memoryNode struct {
+	node    Node
+	updated time.Time
+}
+
+// MemoryRegistry is a Registry kept in memory.
+type MemoryRegistry struct {
+	ttl   time.Duration
+	nodes map[string]memoryNode
+	m     sync.Mutex
+}
+
+// NewMemoryRegistry returns a MemoryRegistry that forgets nodes not updated within ttl, ttl < 1 never forgets.
+func NewMemoryRegistry(ttl time.Duration) *MemoryRegistry {
+	return &MemoryRegistry{
+		ttl:   ttl,
+		nodes: make(map[string]memoryNode),
+	}
+}
+func (r *MemoryRegistry) Update(ctx context.Context, node Node) error {
+	r.m.Lock()
+	r.nodes[node.ID] = memoryNode{
+		node:    node,
+		updated: time.Now(),
+	}
+	r.m.Unlock()
+	return nil
+}
+func (r *MemoryRegistry) Remove(ctx context.Context, id string) error {
+	r.m.Lock()
+	delete(r.nodes, id)
+	r.m.Unlock()
+	return nil
+}
+func (r *MemoryRegistry) Nodes(ctx context.Context) (nodes []Node, e error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	nodes = make([]Node, 0, len(r.nodes))
+	now := time.Now()
+	for id, n := range r.nodes {
+		if r.ttl > 0 && now.Sub(n.updated) > r.ttl {
+			delete(r.nodes, id)
+			continue
+		}
+		nodes = append(nodes, n.node)
+	}
+	return
+}
+
+// ServeCluster accepts dials forwarded by other nodes of the cluster on l, and publishes the presence of this node.
+// The Dialer must be created with WithDialerCluster.
+//
+// Without WithDialerClusterNoise forwarded dials are not authenticated,
+// anyone reaching l can dial the agents of the node, serve it on a private address only.
+func (d *Dialer) ServeCluster(l net.Listener) error {
+	if d.opts.registry == nil {
+		return errors.New(`reverse: ServeCluster requires WithDialerCluster`)
+	}
+	d.m.Lock()
+	if d.done != 0 {
+		d.m.Unlock()
+		return vnet.ErrDialerClosed
+	}
+	d.listeners[l] = struct{}{}
+	d.m.Unlock()
+
+	// one presence for the node however many cluster listeners it serves
+	d.publishOnce.Do(func() {
+		go d.publish()
+	})
+	return d.serve(l, d.onForward)
+}
+func (d *Dialer) notifyPresence() {
+	if d.presence != nil {
+		select {
+		case d.presence <- struct{}{}:
+		default:
+		}
+	}
+}
+func (d *Dialer) publish() {
+	opts := &d.opts
+	var refresh <-chan time.Time
+	if opts.clusterRefresh > 0 {
+		t := time.NewTicker(opts.clusterRefresh)
+		defer t.Stop()
+		refresh = t.C
+	}
+	for {
+		d.m.Lock()
+		idle := len(d.idle)
+		select {
+		case <-d.drain:
+			// draining nodes must not attract forwarded dials
+			idle = 0
+		default:
+		}
+		d.m.Unlock()
+		e := opts.registry.Update(d.ctx, Node{
+			ID:      opts.clusterID,
+			Network: opts.clusterAddr.Network(),
+			Addr:    opts.clusterAddr.String(),
+			Idle:    idle,
+		})
+		if e != nil && d.ctx.Err() == nil {
+			d.log(logger.LevelWarn, `cluster presence update failed`, nil, e, `node`, opts.clusterID)
+		}
+
+		select {
+		case <-d.close:
+			e = opts.registry.Remove(context.Background(), opts.clusterID)
+			if e != nil {
+				d.log(logger.LevelWarn, `cluster presence remove failed`, nil, e, `node`, opts.clusterID)
+			}
+			return
+		case <-d.presence:
+		case <-refresh:
+		}
+	}
+}
+
+// forward dials an agent matching selector attached to another node of the cluster.
+func (d *Dialer) forward(ctx context.Context, selector Selector) (c net.Conn, e error) {
+	opts := &d.opts
+	nodes, e := opts.registry.Nodes(ctx)
+	if e != nil {
+		return
+	}
+	candidates := make([]Node, 0, len(nodes))
+	for _, node := range nodes {
+		if node.ID != opts.clusterID && node.Idle > 0 {
+			candidates = append(candidates, node)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Idle > candidates[j].Idle
+	})
+	e = errNoNode
+	for _, node := range candidates {
+		c, e = d.forwardTo(ctx, node, selector)
+		if e == nil {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			e = ctx.Err()
+			return
+		default:
+		}
+	}
+	return
+}
+func (d *Dialer) forwardTo(ctx context.Context, node Node, selector Selector) (c net.Conn, e error) {
+	opts := &d.opts
+	if opts.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.timeout)
+		defer cancel()
+	}
+	if opts.clusterDial != nil {
+		c, e = opts.clusterDial(ctx, node.Network, node.Addr)
+	} else {
+		var dialer net.Dialer
+		c, e = dialer.DialContext(ctx, node.Network, node.Addr)
+	}
+	if e != nil {
+		return
+	}
+	if opts.clusterNoiseKey != nil {
+		// the handshake runs on the first write, within the deadline below
+		c = noise.Client(c, opts.clusterNoiseKey, opts.clusterNoiseOpts...)
+	}
+	payload, e := codec.EncodeLabels(selector)
+	if e != nil {
+		c.Close()
+		c = nil
+		return
+	}
+	stream := &datagramStream{
+		rw: c,
+	}
+	c.SetDeadline(handshakeDeadline(ctx, opts.timeout))
+	stop := watch(ctx, d.close, vnet.ErrDialerClosed, c)
+	e = stream.SendPayload(DatagramForward, payload)
+	if e == nil {
+		e = stream.Recv(DatagramAck)
+	}
+	if err := stop(); err != nil {
+		e = err
+	} else if e != nil {
+		e = timeoutError(e)
+	}
+	if e != nil {
+		c.Close()
+		c = nil
+		return
+	}
+	c.SetDeadline(time.Time{})
+	return
+}
+
+// onForward serves a dial forwarded by another node with a local agent.
+func (d *Dialer) onForward(c net.Conn) {
+	opts := &d.opts
+	if opts.clusterNoiseKey != nil {
+		c = noise.Server(c, opts.clusterNoiseKey, opts.clusterNoiseOpts...)
+	}
+	stream := &datagramStream{
+		rw: c,
+	}
+	if opts.timeout > 0 {
+		c.SetDeadline(time.Now().Add(opts.timeout))
+	}
+	e := stream.Recv(DatagramForward)
+	if e != nil {
+		c.Close()
+		return
+	}
+	selector, e := codec.DecodeLabels(stream.Payload())
+	if e != nil {
+		c.Close()
+		return
+	}
+	ctx := d.ctx
+	if opts.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.timeout)
+		defer cancel()
+	}
+	// Idle ignores labels, refuse at once rather than wait so the forwarding node tries another node
+	agent, e := d.dialLocal(ctx, selector, opts.picker, false)
+	if e != nil {
+		c.Close()
+		return
+	}
+	e = stream.Send(DatagramAck)
+	if e != nil {
+		c.Close()
+		agent.Close()
+		return
+	}
+	c.SetDeadline(time.Time{})
+	proxy.Join(c, agent)
+}
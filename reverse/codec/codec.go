@@ -0,0 +1,222 @@
+// Package codec encodes and decodes the frames exchanged by reverse.Dialer and reverse.Listener.
+//
+// The wire protocol is specified in SPEC.md next to this file,
+// testdata/vectors.json holds golden frames that other implementations can check against.
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/powerpuffpenguin/vnet/errs"
+)
+
+// HeaderLen is the length of a frame header: flag(2) version(1) event(1).
+//
+// Version 1 frames are made of the header only.
+// Version 2 frames follow the header with a payload length(2) and the payload.
+const HeaderLen = 2 + 1 + 1
+
+// PayloadLenLen is the length of the payload length of version 2 frames.
+const PayloadLenLen = 2
+
+// MaxPayloadLen is the largest payload a frame can carry.
+const MaxPayloadLen = 0xffff
+
+// Flag starts every frame.
+const Flag = uint16(3553)
+
+// Version is the highest protocol version supported.
+const Version = uint8(2)
+
+const (
+	EventHeart = uint8(1) + iota
+	EventSyn
+	EventSynAck
+	EventAck
+	// EventRedirect asks an idle agent to reconnect to the address carried in the payload. (version 2)
+	EventRedirect
+	// EventForward asks a node of a cluster to dial one of its agents on behalf of another node. (version 2)
+	EventForward
+	// EventFin says goodbye, the receiver drops the idle conn at once. (version 2)
+	EventFin
+	// EventHello is sent by an agent right after connecting, the payload carries its labels. (version 2)
+	EventHello
+	// EventLoad answers a heart, the payload carries the agent's load and capacity. (version 2)
+	EventLoad
+)
+
+// CompressFlate is the flate compression method.
+//
+// An agent offers its compression methods in the SynAck payload, one byte each,
+// the dialer answers with the chosen method in the Ack payload or with an Ack without payload.
+const CompressFlate = uint8(1)
+
+var ErrProtocol = errors.New(`protocol error`)
+
+// EventVersion returns the protocol version that introduced evt, 0 if evt is unknown.
+func EventVersion(evt uint8) uint8 {
+	switch evt {
+	case EventHeart, EventSyn, EventSynAck, EventAck:
+		return 1
+	case EventRedirect, EventForward, EventFin, EventHello, EventLoad:
+		return 2
+	}
+	return 0
+}
+
+// Header is the fixed part of a frame.
+type Header struct {
+	Flag    uint16
+	Version uint8
+	Event   uint8
+}
+
+// DecodeHeader decodes and checks the header at the start of b.
+// It returns io.ErrUnexpectedEOF if b is shorter than HeaderLen.
+func DecodeHeader(b []byte) (h Header, e error) {
+	if len(b) < HeaderLen {
+		e = io.ErrUnexpectedEOF
+		return
+	}
+	h = Header{
+		Flag:    binary.BigEndian.Uint16(b),
+		Version: b[2],
+		Event:   b[3],
+	}
+	if h.Flag != Flag {
+		e = &errs.ProtocolError{
+			Err:  ErrProtocol,
+			Flag: h.Flag,
+			Msg:  fmt.Sprintf(`not supported flag=%v`, h.Flag),
+		}
+	} else if h.Version > Version || h.Version == 0 {
+		e = protocolError(h.Version, h.Event, `not supported version=%v`, h.Version)
+	} else if v := EventVersion(h.Event); v == 0 || v > h.Version {
+		e = protocolError(h.Version, h.Event, `not supported event=%v`, h.Event)
+	}
+	return
+}
+
+// Frame is a decoded frame.
+type Frame struct {
+	// Version of the frame, 0 when encoding picks the version by the rules of Append.
+	Version uint8
+	Event   uint8
+	// Payload is only carried by version 2 frames.
+	Payload []byte
+}
+
+// Append appends the encoding of f to b.
+//
+// If f.Version is 0, a frame without payload is encoded in the version that introduced f.Event,
+// so that version 1 peers keep working, and a frame with payload is encoded as version 2.
+func Append(b []byte, f Frame) ([]byte, error) {
+	v := EventVersion(f.Event)
+	if v == 0 {
+		return b, protocolError(f.Version, f.Event, `not supported event=%v`, f.Event)
+	}
+	version := f.Version
+	if version == 0 {
+		if len(f.Payload) == 0 {
+			version = v
+		} else {
+			version = 2
+		}
+	}
+	if version > Version || version < v {
+		return b, protocolError(version, f.Event, `not supported version=%v`, version)
+	} else if version == 1 && len(f.Payload) != 0 {
+		return b, protocolError(version, f.Event, `version 1 frame can't carry payload`)
+	} else if len(f.Payload) > MaxPayloadLen {
+		return b, protocolError(version, f.Event, `payload too large len=%v`, len(f.Payload))
+	}
+	b = append(b, uint8(Flag>>8), uint8(Flag&0xff), version, f.Event)
+	if version > 1 {
+		b = append(b, uint8(len(f.Payload)>>8), uint8(len(f.Payload)))
+		b = append(b, f.Payload...)
+	}
+	return b, nil
+}
+
+// Encode returns the encoding of f, see Append.
+func Encode(f Frame) ([]byte, error) {
+	return Append(nil, f)
+}
+
+// Decode decodes the frame at the start of b and returns the number of bytes it takes.
+// The payload aliases b.
+// It returns io.ErrUnexpectedEOF if b holds only part of a frame.
+func Decode(b []byte) (f Frame, n int, e error) {
+	h, e := DecodeHeader(b)
+	if e != nil {
+		return
+	}
+	f.Version = h.Version
+	f.Event = h.Event
+	n = HeaderLen
+	if h.Version == 1 {
+		return
+	}
+	if len(b) < HeaderLen+PayloadLenLen {
+		e = io.ErrUnexpectedEOF
+		return
+	}
+	size := int(binary.BigEndian.Uint16(b[HeaderLen:]))
+	n += PayloadLenLen
+	if len(b) < n+size {
+		e = io.ErrUnexpectedEOF
+		return
+	}
+	if size != 0 {
+		f.Payload = b[n : n+size]
+	}
+	n += size
+	return
+}
+
+// Read reads a frame from r.
+// It returns io.EOF only if no byte was read, and io.ErrUnexpectedEOF if r ends inside a frame.
+func Read(r io.Reader) (f Frame, e error) {
+	var b [HeaderLen + PayloadLenLen]byte
+	_, e = io.ReadFull(r, b[:HeaderLen])
+	if e != nil {
+		return
+	}
+	h, e := DecodeHeader(b[:])
+	if e != nil {
+		return
+	}
+	f.Version = h.Version
+	f.Event = h.Event
+	if h.Version == 1 {
+		return
+	}
+	_, e = io.ReadFull(r, b[HeaderLen:])
+	if e != nil {
+		if e == io.EOF {
+			e = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	size := int(binary.BigEndian.Uint16(b[HeaderLen:]))
+	if size != 0 {
+		f.Payload = make([]byte, size)
+		_, e = io.ReadFull(r, f.Payload)
+		if e == io.EOF {
+			e = io.ErrUnexpectedEOF
+		}
+	}
+	return
+}
+
+func protocolError(version, event uint8, format string, a ...interface{}) error {
+	return &errs.ProtocolError{
+		Err:     ErrProtocol,
+		Version: version,
+		Event:   event,
+		Msg:     fmt.Sprintf(format, a...),
+	}
+}
@@ -0,0 +1,178 @@
+package codec_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/powerpuffpenguin/vnet/reverse/codec"
+)
+
+type vectors struct {
+	Frames []struct {
+		Name    string `json:"name"`
+		Version uint8  `json:"version"`
+		Event   uint8  `json:"event"`
+		Payload string `json:"payload"`
+		Hex     string `json:"hex"`
+	} `json:"frames"`
+	Invalid []struct {
+		Name  string `json:"name"`
+		Hex   string `json:"hex"`
+		Error string `json:"error"`
+	} `json:"invalid"`
+	Payloads struct {
+		Address []struct {
+			Network string `json:"network"`
+			Address string `json:"address"`
+			Hex     string `json:"hex"`
+		} `json:"address"`
+		Labels []struct {
+			Labels map[string]string `json:"labels"`
+			Hex    string            `json:"hex"`
+		} `json:"labels"`
+		Load []struct {
+			Load     uint32 `json:"load"`
+			Capacity uint32 `json:"capacity"`
+			Hex      string `json:"hex"`
+		} `json:"load"`
+	} `json:"payloads"`
+}
+
+func loadVectors(t testing.TB) *vectors {
+	b, e := ioutil.ReadFile(`testdata/vectors.json`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	var v vectors
+	e = json.Unmarshal(b, &v)
+	if e != nil {
+		t.Fatal(e)
+	}
+	return &v
+}
+func mustHex(t testing.TB, s string) []byte {
+	b, e := hex.DecodeString(s)
+	if e != nil {
+		t.Fatal(e)
+	}
+	return b
+}
+func TestFrames(t *testing.T) {
+	v := loadVectors(t)
+	for _, vector := range v.Frames {
+		payload := mustHex(t, vector.Payload)
+		b := mustHex(t, vector.Hex)
+
+		encoded, e := codec.Encode(codec.Frame{
+			Version: vector.Version,
+			Event:   vector.Event,
+			Payload: payload,
+		})
+		if e != nil {
+			t.Fatalf("%s: %v", vector.Name, e)
+		} else if !bytes.Equal(encoded, b) {
+			t.Fatalf("%s: encoded %x, expect %s", vector.Name, encoded, vector.Hex)
+		}
+
+		f, n, e := codec.Decode(append(b, 0xff))
+		if e != nil {
+			t.Fatalf("%s: %v", vector.Name, e)
+		} else if n != len(b) || f.Version != vector.Version || f.Event != vector.Event || !bytes.Equal(f.Payload, payload) {
+			t.Fatalf("%s: decoded %+v n=%v", vector.Name, f, n)
+		}
+
+		f, e = codec.Read(bytes.NewReader(b))
+		if e != nil {
+			t.Fatalf("%s: %v", vector.Name, e)
+		} else if f.Version != vector.Version || f.Event != vector.Event || !bytes.Equal(f.Payload, payload) {
+			t.Fatalf("%s: read %+v", vector.Name, f)
+		}
+	}
+}
+func TestInvalidFrames(t *testing.T) {
+	v := loadVectors(t)
+	for _, vector := range v.Invalid {
+		b := mustHex(t, vector.Hex)
+		_, _, e := codec.Decode(b)
+		if e == nil || !strings.Contains(e.Error(), vector.Error) {
+			t.Fatalf("%s: decode expect %q, got %v", vector.Name, vector.Error, e)
+		}
+		_, e = codec.Read(bytes.NewReader(b))
+		if e == nil || !strings.Contains(e.Error(), vector.Error) {
+			t.Fatalf("%s: read expect %q, got %v", vector.Name, vector.Error, e)
+		}
+	}
+}
+func TestPayloads(t *testing.T) {
+	v := loadVectors(t)
+	for _, vector := range v.Payloads.Address {
+		b := mustHex(t, vector.Hex)
+		encoded, e := codec.EncodeAddr(vector.Network, vector.Address)
+		if e != nil {
+			t.Fatal(e)
+		} else if !bytes.Equal(encoded, b) {
+			t.Fatalf("address encoded %x, expect %s", encoded, vector.Hex)
+		}
+		network, address, e := codec.DecodeAddr(b)
+		if e != nil {
+			t.Fatal(e)
+		} else if network != vector.Network || address != vector.Address {
+			t.Fatalf("address decoded %s %s", network, address)
+		}
+	}
+	for _, vector := range v.Payloads.Labels {
+		b := mustHex(t, vector.Hex)
+		encoded, e := codec.EncodeLabels(vector.Labels)
+		if e != nil {
+			t.Fatal(e)
+		} else if !bytes.Equal(encoded, b) {
+			t.Fatalf("labels encoded %x, expect %s", encoded, vector.Hex)
+		}
+		labels, e := codec.DecodeLabels(b)
+		if e != nil {
+			t.Fatal(e)
+		} else if !reflect.DeepEqual(labels, vector.Labels) {
+			t.Fatalf("labels decoded %v", labels)
+		}
+	}
+	for _, vector := range v.Payloads.Load {
+		b := mustHex(t, vector.Hex)
+		if encoded := codec.EncodeLoad(vector.Load, vector.Capacity); !bytes.Equal(encoded, b) {
+			t.Fatalf("load encoded %x, expect %s", encoded, vector.Hex)
+		}
+		load, capacity, e := codec.DecodeLoad(b)
+		if e != nil {
+			t.Fatal(e)
+		} else if load != vector.Load || capacity != vector.Capacity {
+			t.Fatalf("load decoded %v %v", load, capacity)
+		}
+	}
+}
+func TestEncodeVersion(t *testing.T) {
+	// events without payload are encoded in the version that introduced them
+	b, e := codec.Encode(codec.Frame{Event: codec.EventHeart})
+	if e != nil || !bytes.Equal(b, []byte{0x0d, 0xe1, 1, codec.EventHeart}) {
+		t.Fatalf("heart %x %v", b, e)
+	}
+	b, e = codec.Encode(codec.Frame{Event: codec.EventFin})
+	if e != nil || !bytes.Equal(b, []byte{0x0d, 0xe1, 2, codec.EventFin, 0, 0}) {
+		t.Fatalf("fin %x %v", b, e)
+	}
+	for _, f := range []codec.Frame{
+		{Event: 0},
+		{Version: 1, Event: codec.EventFin},
+		{Version: 1, Event: codec.EventHeart, Payload: []byte{1}},
+		{Version: 3, Event: codec.EventHeart},
+		{Event: codec.EventHello, Payload: make([]byte, codec.MaxPayloadLen+1)},
+	} {
+		_, e = codec.Encode(f)
+		if e == nil {
+			t.Fatalf("expect error for %v %v", f.Version, f.Event)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+// Command conformance checks a peer of the reverse protocol written in any language.
+//
+//	conformance -agent 127.0.0.1:9000    listen and run the agent cases against the agent that connects
+//	conformance -dialer 127.0.0.1:9000   connect to a dialer and run the dialer cases,
+//	                                     dial through the dialer whenever a case waits for syn
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/powerpuffpenguin/vnet/reverse/codec/conformance"
+)
+
+func main() {
+	var (
+		agent, dialer, labels string
+		timeout               time.Duration
+	)
+	flag.StringVar(&agent, `agent`, ``, `listen address for the agent under test`)
+	flag.StringVar(&dialer, `dialer`, ``, `address of the dialer under test`)
+	flag.StringVar(&labels, `labels`, ``, `labels sent in hello to the dialer, such as zone=eu,gpu=1`)
+	flag.DurationVar(&timeout, `timeout`, time.Second*30, `timeout of each case`)
+	flag.Parse()
+
+	opts := []conformance.Option{
+		conformance.WithTimeout(timeout),
+		conformance.WithLabels(parseLabels(labels)),
+	}
+	var results []conformance.Result
+	if agent != `` {
+		l, e := net.Listen(`tcp`, agent)
+		if e != nil {
+			log.Fatalln(e)
+		}
+		log.Println(`waiting for the agent on`, l.Addr())
+		results = append(results, conformance.RunAgent(context.Background(), l, opts...)...)
+	}
+	if dialer != `` {
+		addr, e := net.ResolveTCPAddr(`tcp`, dialer)
+		if e != nil {
+			log.Fatalln(e)
+		}
+		log.Println(`dial through the dialer whenever a case waits for syn`)
+		results = append(results, conformance.RunDialer(context.Background(), addr, nil, opts...)...)
+	}
+	if agent == `` && dialer == `` {
+		flag.Usage()
+		os.Exit(2)
+	}
+	for _, r := range results {
+		fmt.Println(r)
+	}
+	if conformance.Failed(results) {
+		os.Exit(1)
+	}
+}
+func parseLabels(s string) map[string]string {
+	labels := make(map[string]string)
+	for _, kv := range strings.Split(s, `,`) {
+		if kv == `` {
+			continue
+		}
+		i := strings.IndexByte(kv, '=')
+		if i < 0 {
+			labels[kv] = ``
+		} else {
+			labels[kv[:i]] = kv[i+1:]
+		}
+	}
+	return labels
+}
@@ -0,0 +1,375 @@
+// Package conformance drives a peer of the reverse protocol over a socket and checks it follows codec/SPEC.md.
+//
+// RunAgent plays the dialer against an agent, RunDialer plays an agent against a dialer.
+// The peer may be written in any language, cmd/conformance runs the cases from the command line.
+package conformance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/powerpuffpenguin/vnet"
+	"github.com/powerpuffpenguin/vnet/reverse/codec"
+)
+
+// Result is the outcome of a case.
+type Result struct {
+	Name string
+	// Err is nil if the peer passed the case.
+	Err error
+}
+
+func (r Result) String() string {
+	if r.Err == nil {
+		return `PASS ` + r.Name
+	}
+	return `FAIL ` + r.Name + `: ` + r.Err.Error()
+}
+
+// Failed reports whether any result is a failure.
+func Failed(results []Result) bool {
+	for _, r := range results {
+		if r.Err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+var errNotClosed = errors.New(`peer did not close the conn`)
+
+// peer reads and writes frames, every operation is bounded by the deadline of the case.
+type peer struct {
+	c net.Conn
+}
+
+func newPeer(ctx context.Context, c net.Conn) *peer {
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+	return &peer{c: c}
+}
+func (p *peer) send(version, event uint8, payload []byte) error {
+	b, e := codec.Encode(codec.Frame{
+		Version: version,
+		Event:   event,
+		Payload: payload,
+	})
+	if e != nil {
+		return e
+	}
+	_, e = p.c.Write(b)
+	return e
+}
+
+// recv reads the next frame, it checks the payloads of hello and load on the way.
+func (p *peer) recv() (f codec.Frame, e error) {
+	f, e = codec.Read(p.c)
+	if e != nil {
+		return
+	}
+	switch f.Event {
+	case codec.EventHello:
+		_, e = codec.DecodeLabels(f.Payload)
+	case codec.EventLoad:
+		_, _, e = codec.DecodeLoad(f.Payload)
+	}
+	return
+}
+
+// expect reads frames until one of events, frames of skip events are read over.
+func (p *peer) expect(skip []uint8, events ...uint8) (f codec.Frame, e error) {
+	for {
+		f, e = p.recv()
+		if e != nil {
+			return
+		}
+		for _, evt := range events {
+			if f.Event == evt {
+				return
+			}
+		}
+		if !contains(skip, f.Event) {
+			e = fmt.Errorf(`unexpected event=%v`, f.Event)
+			return
+		}
+	}
+}
+
+// expectClosed reads frames of skip events until the peer closes the conn.
+func (p *peer) expectClosed(skip ...uint8) error {
+	for {
+		f, e := p.recv()
+		if e != nil {
+			if errors.Is(e, codec.ErrProtocol) {
+				return e
+			} else if isTimeout(e) {
+				return errNotClosed
+			}
+			// EOF or reset
+			return nil
+		} else if !contains(skip, f.Event) {
+			return fmt.Errorf(`unexpected event=%v`, f.Event)
+		}
+	}
+}
+func contains(events []uint8, evt uint8) bool {
+	for _, v := range events {
+		if v == evt {
+			return true
+		}
+	}
+	return false
+}
+func isTimeout(e error) bool {
+	var ne net.Error
+	return errors.As(e, &ne) && ne.Timeout()
+}
+func caseContext(ctx context.Context, opts *options) (context.Context, context.CancelFunc) {
+	if opts.timeout > 0 {
+		return context.WithTimeout(ctx, opts.timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// agentRun accepts the conns of an agent, a conn accepted by a case that checks reconnection is handed to the next case.
+type agentRun struct {
+	l    vnet.Listener
+	next net.Conn
+}
+
+func (r *agentRun) accept(ctx context.Context) (p *peer, e error) {
+	c := r.next
+	r.next = nil
+	if c == nil {
+		c, e = r.l.AcceptContext(ctx)
+		if e != nil {
+			return
+		}
+	}
+	p = newPeer(ctx, c)
+	return
+}
+
+type agentCase struct {
+	name string
+	run  func(ctx context.Context, r *agentRun) error
+}
+
+var agentCases = []agentCase{
+	{`handshake`, agentHandshake},
+	{`version 1 events in version 2 frames`, agentVersion2Frames},
+	{`fin`, agentFin},
+	{`redirect`, agentRedirect},
+	{`unknown event`, agentUnknownEvent},
+}
+
+// RunAgent runs the agent cases against the agent that connects to l.
+// The agent must keep accepting, some cases end with its accept failing.
+// l is closed when RunAgent returns.
+func RunAgent(ctx context.Context, l net.Listener, opt ...Option) (results []Result) {
+	opts := defaultOptions
+	for _, o := range opt {
+		o.apply(&opts)
+	}
+	r := &agentRun{
+		l: vnet.WrapListener(l),
+	}
+	defer r.l.Close()
+	for _, c := range agentCases {
+		caseCtx, cancel := caseContext(ctx, &opts)
+		e := c.run(caseCtx, r)
+		cancel()
+		results = append(results, Result{
+			Name: c.name,
+			Err:  e,
+		})
+	}
+	if r.next != nil {
+		r.next.Close()
+	}
+	return
+}
+func agentHandshake(ctx context.Context, r *agentRun) error {
+	return agentSynAck(ctx, r, 0)
+}
+func agentVersion2Frames(ctx context.Context, r *agentRun) error {
+	return agentSynAck(ctx, r, 2)
+}
+func agentSynAck(ctx context.Context, r *agentRun, version uint8) (e error) {
+	p, e := r.accept(ctx)
+	if e != nil {
+		return
+	}
+	defer p.c.Close()
+	e = p.send(version, codec.EventHeart, nil)
+	if e != nil {
+		return
+	}
+	e = p.send(version, codec.EventSyn, nil)
+	if e != nil {
+		return
+	}
+	_, e = p.expect([]uint8{codec.EventHello, codec.EventLoad}, codec.EventSynAck)
+	if e != nil {
+		return
+	}
+	e = p.send(version, codec.EventAck, nil)
+	return
+}
+func agentFin(ctx context.Context, r *agentRun) (e error) {
+	p, e := r.accept(ctx)
+	if e != nil {
+		return
+	}
+	defer p.c.Close()
+	e = p.send(0, codec.EventFin, nil)
+	if e != nil {
+		return
+	}
+	e = p.expectClosed(codec.EventHello)
+	if e != nil {
+		return
+	}
+	// the agent reconnects at once
+	r.next, e = r.l.AcceptContext(ctx)
+	if e != nil {
+		e = fmt.Errorf(`agent did not reconnect: %w`, e)
+	}
+	return
+}
+func agentRedirect(ctx context.Context, r *agentRun) (e error) {
+	p, e := r.accept(ctx)
+	if e != nil {
+		return
+	}
+	defer p.c.Close()
+	addr := r.l.Addr()
+	payload, e := codec.EncodeAddr(addr.Network(), addr.String())
+	if e != nil {
+		return
+	}
+	e = p.send(0, codec.EventRedirect, payload)
+	if e != nil {
+		return
+	}
+	// the agent connects to the new address before closing the old conn
+	r.next, e = r.l.AcceptContext(ctx)
+	if e != nil {
+		e = fmt.Errorf(`agent did not follow redirect: %w`, e)
+		return
+	}
+	e = p.expectClosed(codec.EventHello, codec.EventLoad)
+	return
+}
+func agentUnknownEvent(ctx context.Context, r *agentRun) (e error) {
+	p, e := r.accept(ctx)
+	if e != nil {
+		return
+	}
+	defer p.c.Close()
+	_, e = p.c.Write([]byte{uint8(codec.Flag >> 8), uint8(codec.Flag & 0xff), codec.Version, 0xff, 0, 0})
+	if e != nil {
+		return
+	}
+	e = p.expectClosed(codec.EventHello, codec.EventLoad)
+	return
+}
+
+type dialerCase struct {
+	name string
+	run  func(ctx context.Context, p *peer, opts *options) error
+}
+
+var dialerCases = []dialerCase{
+	{`handshake`, dialerHandshake},
+	{`version 1 agent`, dialerVersion1},
+	{`load before synack`, dialerLoad},
+	{`fin`, dialerFin},
+}
+
+// RunDialer runs the dialer cases against the dialer listening at addr, dial connects to it.
+// If dial is nil a tcp conn is dialed.
+func RunDialer(ctx context.Context, addr net.Addr, dial func(ctx context.Context, network, addr string) (net.Conn, error), opt ...Option) (results []Result) {
+	opts := defaultOptions
+	for _, o := range opt {
+		o.apply(&opts)
+	}
+	if dial == nil {
+		var dialer net.Dialer
+		dial = dialer.DialContext
+	}
+	for _, c := range dialerCases {
+		caseCtx, cancel := caseContext(ctx, &opts)
+		conn, e := dial(caseCtx, addr.Network(), addr.String())
+		if e == nil {
+			e = c.run(caseCtx, newPeer(caseCtx, conn), &opts)
+			conn.Close()
+		}
+		cancel()
+		results = append(results, Result{
+			Name: c.name,
+			Err:  e,
+		})
+	}
+	return
+}
+func dialerHandshake(ctx context.Context, p *peer, opts *options) (e error) {
+	payload, e := codec.EncodeLabels(opts.labels)
+	if e != nil {
+		return
+	}
+	e = p.send(0, codec.EventHello, payload)
+	if e != nil {
+		return
+	}
+	return dialerSynAck(ctx, p, opts, false)
+}
+func dialerVersion1(ctx context.Context, p *peer, opts *options) error {
+	return dialerSynAck(ctx, p, opts, false)
+}
+func dialerLoad(ctx context.Context, p *peer, opts *options) error {
+	return dialerSynAck(ctx, p, opts, true)
+}
+
+// dialerSynAck waits for syn while idle, then finishes the handshake.
+func dialerSynAck(ctx context.Context, p *peer, opts *options, load bool) (e error) {
+	var triggered chan error
+	if opts.trigger != nil {
+		triggered = make(chan error, 1)
+		go func() {
+			triggered <- opts.trigger(ctx)
+		}()
+	}
+	_, e = p.expect([]uint8{codec.EventHeart}, codec.EventSyn)
+	if e == nil && load {
+		// an answer to a heart sent just before syn
+		e = p.send(0, codec.EventLoad, codec.EncodeLoad(1, 2))
+	}
+	if e == nil {
+		e = p.send(0, codec.EventSynAck, nil)
+	}
+	if e == nil {
+		_, e = p.expect(nil, codec.EventAck)
+	}
+	if triggered != nil {
+		if e != nil {
+			// unblock the trigger if the dialer handed it this conn
+			p.c.Close()
+		}
+		if err := <-triggered; e == nil && err != nil {
+			e = fmt.Errorf(`dial failed: %w`, err)
+		}
+	}
+	return
+}
+func dialerFin(ctx context.Context, p *peer, opts *options) (e error) {
+	e = p.send(0, codec.EventFin, nil)
+	if e != nil {
+		return
+	}
+	// the dialer drops the conn at once
+	return p.expectClosed(codec.EventHeart)
+}
@@ -0,0 +1,68 @@
+package conformance_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/powerpuffpenguin/vnet"
+	"github.com/powerpuffpenguin/vnet/reverse"
+	"github.com/powerpuffpenguin/vnet/reverse/codec/conformance"
+)
+
+func TestAgent(t *testing.T) {
+	l, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	listener := reverse.Listen(l.Addr(),
+		reverse.WithListenerLabels(map[string]string{`zone`: `eu`}),
+		reverse.WithListenerLoad(func() (uint32, uint32) { return 1, 8 }),
+	)
+	defer listener.Close()
+	go func() {
+		for {
+			c, e := listener.Accept()
+			if e == nil {
+				c.Close()
+			} else if errors.Is(e, vnet.ErrListenerClosed) {
+				return
+			}
+		}
+	}()
+	results := conformance.RunAgent(context.Background(), l, conformance.WithTimeout(time.Second*2))
+	for _, r := range results {
+		t.Log(r)
+	}
+	if conformance.Failed(results) {
+		t.Fatal("reverse.Listener failed conformance")
+	}
+}
+func TestDialer(t *testing.T) {
+	l, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	dialer := reverse.NewDialer(l)
+	defer dialer.Close()
+	go dialer.Serve()
+	results := conformance.RunDialer(context.Background(), l.Addr(), nil,
+		conformance.WithTimeout(time.Second*2),
+		conformance.WithLabels(map[string]string{`zone`: `eu`}),
+		conformance.WithTrigger(func(ctx context.Context) error {
+			c, e := dialer.DialContext(ctx, `tcp`, ``)
+			if e != nil {
+				return e
+			}
+			return c.Close()
+		}),
+	)
+	for _, r := range results {
+		t.Log(r)
+	}
+	if conformance.Failed(results) {
+		t.Fatal("reverse.Dialer failed conformance")
+	}
+}
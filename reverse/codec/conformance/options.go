@@ -0,0 +1,54 @@
+package conformance
+
+import (
+	"context"
+	"time"
+)
+
+var defaultOptions = options{
+	timeout: time.Second * 5,
+}
+
+type options struct {
+	timeout time.Duration
+	labels  map[string]string
+	trigger func(ctx context.Context) error
+}
+type Option interface {
+	apply(*options)
+}
+type funcOption struct {
+	f func(*options)
+}
+
+func (fo *funcOption) apply(o *options) {
+	fo.f(o)
+}
+func newOption(f func(*options)) *funcOption {
+	return &funcOption{
+		f: f,
+	}
+}
+
+// WithTimeout bounds each case, 5s by default.
+func WithTimeout(timeout time.Duration) Option {
+	return newOption(func(o *options) {
+		o.timeout = timeout
+	})
+}
+
+// WithLabels sets the labels sent in hello by RunDialer.
+func WithLabels(labels map[string]string) Option {
+	return newOption(func(o *options) {
+		o.labels = labels
+	})
+}
+
+// WithTrigger sets the function RunDialer calls to make the dialer dial one of its agents,
+// it should dial, close the conn and return the dial error.
+// Without a trigger someone else has to dial through the dialer while a case waits for syn.
+func WithTrigger(trigger func(ctx context.Context) error) Option {
+	return newOption(func(o *options) {
+		o.trigger = trigger
+	})
+}
@@ -0,0 +1,78 @@
+package codec_test
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/powerpuffpenguin/vnet/reverse/codec"
+)
+
+func FuzzDecode(f *testing.F) {
+	v := loadVectors(f)
+	for _, vector := range v.Frames {
+		b := mustHex(f, vector.Hex)
+		f.Add(b)
+		// garbage after a valid frame
+		f.Add(append(b, 0x0d, 0xe1, 0xff))
+	}
+	for _, vector := range v.Invalid {
+		f.Add(mustHex(f, vector.Hex))
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		frame, n, e := codec.Decode(b)
+		read, er := codec.Read(bytes.NewReader(b))
+		if (e == nil) != (er == nil) {
+			t.Fatalf("Decode %v, Read %v", e, er)
+		} else if e != nil {
+			return
+		}
+		if n > len(b) {
+			t.Fatalf("n=%v len=%v", n, len(b))
+		} else if read.Version != frame.Version || read.Event != frame.Event || !bytes.Equal(read.Payload, frame.Payload) {
+			t.Fatalf("Decode %+v, Read %+v", frame, read)
+		}
+		encoded, e := codec.Encode(frame)
+		if e != nil {
+			t.Fatalf("encode decoded frame %+v: %v", frame, e)
+		} else if !bytes.Equal(encoded, b[:n]) {
+			t.Fatalf("encoded %x, decoded from %x", encoded, b[:n])
+		}
+	})
+}
+func FuzzPayloads(f *testing.F) {
+	v := loadVectors(f)
+	for _, vector := range v.Payloads.Address {
+		f.Add(mustHex(f, vector.Hex))
+	}
+	for _, vector := range v.Payloads.Labels {
+		f.Add(mustHex(f, vector.Hex))
+	}
+	for _, vector := range v.Payloads.Load {
+		f.Add(mustHex(f, vector.Hex))
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		if network, address, e := codec.DecodeAddr(b); e == nil {
+			encoded, e := codec.EncodeAddr(network, address)
+			if e != nil || !bytes.Equal(encoded, b) {
+				t.Fatalf("address %x re-encoded %x %v", b, encoded, e)
+			}
+		}
+		if labels, e := codec.DecodeLabels(b); e == nil {
+			// keys may come in any order, they are encoded sorted
+			encoded, e := codec.EncodeLabels(labels)
+			if e != nil || len(encoded) != len(b) {
+				t.Fatalf("labels %x re-encoded %x %v", b, encoded, e)
+			}
+			decoded, e := codec.DecodeLabels(encoded)
+			if e != nil || !reflect.DeepEqual(decoded, labels) {
+				t.Fatalf("labels %v decoded %v %v", labels, decoded, e)
+			}
+		}
+		if load, capacity, e := codec.DecodeLoad(b); e == nil {
+			if encoded := codec.EncodeLoad(load, capacity); !bytes.Equal(encoded, b) {
+				t.Fatalf("load %x re-encoded %x", b, encoded)
+			}
+		}
+	})
+}
@@ -0,0 +1,134 @@
+package codec
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// address payload: network length(1) network address
+func EncodeAddr(network, address string) (b []byte, e error) {
+	if len(network) > 0xff {
+		e = protocolError(0, 0, `network too long len=%v`, len(network))
+		return
+	} else if 1+len(network)+len(address) > MaxPayloadLen {
+		e = protocolError(0, 0, `address too long len=%v`, len(address))
+		return
+	}
+	b = make([]byte, 1+len(network)+len(address))
+	b[0] = uint8(len(network))
+	copy(b[1:], network)
+	copy(b[1+len(network):], address)
+	return
+}
+func DecodeAddr(b []byte) (network, address string, e error) {
+	if len(b) == 0 || len(b) < 1+int(b[0]) {
+		e = protocolError(0, 0, `invalid address payload`)
+		return
+	}
+	n := 1 + int(b[0])
+	network = string(b[1:n])
+	address = string(b[n:])
+	if address == `` {
+		e = protocolError(0, 0, `empty address`)
+	}
+	return
+}
+
+// labels payload: count(2) then key length(2) key value length(2) value for each label
+func EncodeLabels(labels map[string]string) (b []byte, e error) {
+	if len(labels) > 0xffff {
+		e = protocolError(0, 0, `too many labels count=%v`, len(labels))
+		return
+	}
+	keys := make([]string, 0, len(labels))
+	size := 2
+	for k, v := range labels {
+		if len(k) > 0xffff || len(v) > 0xffff {
+			e = protocolError(0, 0, `label too long key=%s`, k)
+			return
+		}
+		keys = append(keys, k)
+		size += 4 + len(k) + len(v)
+	}
+	if size > 0xffff {
+		e = protocolError(0, 0, `labels too large len=%v`, size)
+		return
+	}
+	sort.Strings(keys)
+	b = make([]byte, 2, size)
+	binary.BigEndian.PutUint16(b, uint16(len(keys)))
+	for _, k := range keys {
+		b = appendString(b, k)
+		b = appendString(b, labels[k])
+	}
+	return
+}
+func DecodeLabels(b []byte) (labels map[string]string, e error) {
+	if len(b) < 2 {
+		e = protocolError(0, 0, `invalid labels payload`)
+		return
+	}
+	count := int(binary.BigEndian.Uint16(b))
+	b = b[2:]
+	if count > len(b)/4 {
+		// each label takes at least 4 bytes
+		e = protocolError(0, 0, `invalid labels count=%v`, count)
+		return
+	}
+	labels = make(map[string]string, count)
+	var k, v string
+	for i := 0; i < count; i++ {
+		k, b, e = readString(b)
+		if e != nil {
+			return
+		}
+		v, b, e = readString(b)
+		if e != nil {
+			return
+		}
+		if _, ok := labels[k]; ok {
+			e = protocolError(0, 0, `duplicate label key=%q`, k)
+			return
+		}
+		labels[k] = v
+	}
+	if len(b) != 0 {
+		e = protocolError(0, 0, `trailing bytes after labels len=%v`, len(b))
+	}
+	return
+}
+func appendString(b []byte, s string) []byte {
+	b = append(b, uint8(len(s)>>8), uint8(len(s)))
+	return append(b, s...)
+}
+func readString(b []byte) (s string, tail []byte, e error) {
+	if len(b) < 2 {
+		e = protocolError(0, 0, `invalid string payload`)
+		return
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		e = protocolError(0, 0, `invalid string payload`)
+		return
+	}
+	s = string(b[2 : 2+n])
+	tail = b[2+n:]
+	return
+}
+
+// load payload: load(4) capacity(4)
+func EncodeLoad(load, capacity uint32) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint32(b, load)
+	binary.BigEndian.PutUint32(b[4:], capacity)
+	return b
+}
+func DecodeLoad(b []byte) (load, capacity uint32, e error) {
+	if len(b) != 8 {
+		e = protocolError(0, 0, `invalid load payload`)
+		return
+	}
+	load = binary.BigEndian.Uint32(b)
+	capacity = binary.BigEndian.Uint32(b[4:])
+	return
+}
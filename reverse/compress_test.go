@@ -0,0 +1,79 @@
+package reverse_test
+
+import (
+	"compress/flate"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/powerpuffpenguin/vnet"
+	"github.com/powerpuffpenguin/vnet/reverse"
+)
+
+func TestCompress(t *testing.T) {
+	for _, test := range []struct {
+		dialer, listener bool
+	}{
+		{true, true},
+		{false, true},
+		{true, false},
+	} {
+		l, e := net.Listen(`tcp`, `127.0.0.1:0`)
+		if e != nil {
+			t.Fatal(e)
+		}
+		var dialerOpts []reverse.DialerOption
+		if test.dialer {
+			dialerOpts = append(dialerOpts, reverse.WithDialerCompress(flate.DefaultCompression, time.Millisecond))
+		}
+		dialer := reverse.NewDialer(l, dialerOpts...)
+		go dialer.Serve()
+		var listenerOpts []reverse.ListenerOption
+		if test.listener {
+			listenerOpts = append(listenerOpts, reverse.WithListenerCompress(flate.BestSpeed, 0))
+		}
+		listener := reverse.Listen(l.Addr(), listenerOpts...)
+		compressed := test.dialer && test.listener
+		go func() {
+			for {
+				c, e := listener.Accept()
+				if e != nil {
+					return
+				}
+				if _, ok := c.(*vnet.CompressConn); ok != compressed {
+					c.Close()
+					continue
+				}
+				go func() {
+					io.Copy(c, c)
+					c.Close()
+				}()
+			}
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		c, e := dialer.DialContext(ctx, `tcp`, ``)
+		cancel()
+		if e != nil {
+			t.Fatal(e)
+		}
+		if _, ok := c.(*reverse.Conn).Unwrap().(*vnet.CompressConn); ok != compressed {
+			t.Fatalf("dialer %v listener %v: expect compressed %v", test.dialer, test.listener, compressed)
+		}
+		data := strings.Repeat(`{"level":"info","msg":"compressible"}`, 1024)
+		go c.Write([]byte(data))
+		b := make([]byte, len(data))
+		_, e = io.ReadFull(c, b)
+		if e != nil {
+			t.Fatal(e)
+		} else if string(b) != data {
+			t.Fatal("data mismatch")
+		}
+		c.Close()
+		listener.Close()
+		dialer.Close()
+	}
+}
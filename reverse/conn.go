@@ -0,0 +1,297 @@
+package reverse
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/powerpuffpenguin/vnet/metrics"
+)
+
+var errCloseWrite = errors.New(`close write not supported`)
+
+// Conn is a conn returned by the dials of a Dialer, it describes the tunnel to the agent.
+//
+// Unwrap returns the conn it wraps, a *net.TCPConn unless the tunnel is secured, compressed
+// or the Dialer serves another listener.
+type Conn struct {
+	net.Conn
+
+	// id identifies the conn in the admin handler, it is the id of the idle conn it was
+	id        uint64
+	handedOff time.Time
+	agent     Agent
+	version   uint8
+	handshake time.Duration
+	idle      time.Duration
+	rtt       time.Duration
+
+	read    atomic.Uint64
+	written atomic.Uint64
+	// err is the first error returned by Read or Write
+	errm sync.Mutex
+	err  error
+	// metrics is set when the conn is handed off
+	metrics *metrics.ConnMetrics
+	// limiter is set when the conn is handed off
+	limiter *connLimiter
+	// deadlines bound the waits of the limiter
+	deadlines     sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	// onClose is called once when the conn is closed
+	onClose   func()
+	closeOnce sync.Once
+}
+
+// Close closes the conn.
+func (c *Conn) Close() (e error) {
+	e = c.Conn.Close()
+	if c.limiter != nil {
+		c.limiter.cancel()
+	}
+	if c.onClose != nil {
+		c.closeOnce.Do(c.onClose)
+	}
+	return
+}
+
+// observedAgent returns the agent reported to observers, nil if the dial was forwarded.
+func (c *Conn) observedAgent() *Agent {
+	if c.agent.RemoteAddr == nil {
+		return nil
+	}
+	agent := c.agent
+	return &agent
+}
+
+// Unwrap returns the underlying conn.
+func (c *Conn) Unwrap() net.Conn {
+	return c.Conn
+}
+
+// Agent returns the agent as it was when the conn was taken from the pool.
+// It is empty if the dial was forwarded to another node of the cluster.
+func (c *Conn) Agent() Agent {
+	return c.agent
+}
+
+// Version returns the highest protocol version of the frames received from the agent, 0 if none was received.
+func (c *Conn) Version() uint8 {
+	return c.version
+}
+
+// HandshakeDuration returns the time spent turning the idle conn into this conn,
+// or forwarding the dial to another node of the cluster.
+func (c *Conn) HandshakeDuration() time.Duration {
+	return c.handshake
+}
+
+// IdleDuration returns the time the conn spent idle in the pool before it was taken.
+func (c *Conn) IdleDuration() time.Duration {
+	return c.idle
+}
+
+// HeartRTT returns the round trip time of the last heart answered by the agent with its load,
+// 0 if the agent never answered one.
+func (c *Conn) HeartRTT() time.Duration {
+	return c.rtt
+}
+
+// BytesRead returns the number of bytes read through the conn, before decompression and decryption.
+func (c *Conn) BytesRead() uint64 {
+	return c.read.Load()
+}
+
+// BytesWritten returns the number of bytes written through the conn, before compression and encryption.
+func (c *Conn) BytesWritten() uint64 {
+	return c.written.Load()
+}
+
+// SpliceConn returns the underlying conn.
+// The bandwidth limits still apply to the bytes moved around the conn, Spliced waits for them as Read and Write do,
+// but a splice moves up to 64KiB at once whatever the bursts.
+func (c *Conn) SpliceConn() net.Conn {
+	return c.Conn
+}
+
+// Spliced counts bytes read from or written to the underlying conn without the conn,
+// and waits until the bandwidth limits allow them, which holds back the splice.
+func (c *Conn) Spliced(read, written int64) {
+	if read > 0 {
+		c.read.Add(uint64(read))
+		if c.metrics != nil {
+			c.metrics.Read.Add(float64(read))
+		}
+	}
+	if written > 0 {
+		c.written.Add(uint64(written))
+		if c.metrics != nil {
+			c.metrics.Written.Add(float64(written))
+		}
+	}
+	if c.limiter != nil {
+		// the bytes are already moved, a close while waiting only ends the wait
+		if read > 0 {
+			c.limiter.count(int(read))
+			c.limiter.wait(int(read), false, time.Time{})
+		}
+		if written > 0 {
+			c.limiter.count(int(written))
+			c.limiter.wait(int(written), true, time.Time{})
+		}
+		if remaining, ok := c.limiter.remaining(); ok && remaining == 0 {
+			// closing the underlying conn ends the splice
+			c.quotaExceeded()
+		}
+	}
+}
+func (c *Conn) Read(b []byte) (n int, e error) {
+	if c.limiter != nil && len(b) != 0 {
+		chunk := c.limiter.chunk(len(b), false)
+		if chunk == 0 {
+			e = c.quotaExceeded()
+			return
+		}
+		b = b[:chunk]
+	}
+	n, e = c.Conn.Read(b)
+	if n > 0 {
+		c.read.Add(uint64(n))
+		if c.metrics != nil {
+			c.metrics.Read.Add(float64(n))
+		}
+		if c.limiter != nil {
+			// the bytes are already read, a close or the read deadline only ends the wait
+			c.limiter.count(n)
+			c.limiter.wait(n, false, c.deadline(false))
+		}
+	}
+	if e != nil {
+		c.fail(e)
+	}
+	return
+}
+
+// Write writes b in chunks no larger than the bursts of the bandwidth limits, waiting for each to be allowed.
+// The wait is bound by the write deadline, os.ErrDeadlineExceeded is returned once it passes.
+// Once a transfer quota is used up Read and Write close the conn and return ErrQuotaExceeded.
+func (c *Conn) Write(b []byte) (n int, e error) {
+	if c.limiter == nil {
+		n, e = c.write(b)
+		return
+	}
+	for len(b) != 0 {
+		chunk := c.limiter.chunk(len(b), true)
+		if chunk == 0 {
+			e = c.quotaExceeded()
+			break
+		}
+		e = c.limiter.wait(chunk, true, c.deadline(true))
+		if e != nil {
+			c.fail(e)
+			break
+		}
+		var written int
+		written, e = c.write(b[:chunk])
+		// only the bytes written count against the quotas
+		c.limiter.count(written)
+		n += written
+		if e != nil {
+			break
+		}
+		b = b[chunk:]
+	}
+	return
+}
+func (c *Conn) write(b []byte) (n int, e error) {
+	n, e = c.Conn.Write(b)
+	if n > 0 {
+		c.written.Add(uint64(n))
+		if c.metrics != nil {
+			c.metrics.Written.Add(float64(n))
+		}
+	}
+	if e != nil {
+		c.fail(e)
+	}
+	return
+}
+
+// SetDeadline sets the read and write deadlines of the conn, they also bound the waits of the bandwidth limits.
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.deadlines.Lock()
+	c.readDeadline = t
+	c.writeDeadline = t
+	c.deadlines.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the conn, it also bounds the waits of the bandwidth limits.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.deadlines.Lock()
+	c.readDeadline = t
+	c.deadlines.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline of the conn, it also bounds the waits of the bandwidth limits.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.deadlines.Lock()
+	c.writeDeadline = t
+	c.deadlines.Unlock()
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// deadline returns the write or read deadline.
+func (c *Conn) deadline(write bool) (t time.Time) {
+	c.deadlines.Lock()
+	if write {
+		t = c.writeDeadline
+	} else {
+		t = c.readDeadline
+	}
+	c.deadlines.Unlock()
+	return
+}
+
+// quotaExceeded closes the conn whose quota is used up.
+func (c *Conn) quotaExceeded() error {
+	c.fail(ErrQuotaExceeded)
+	c.Close()
+	return ErrQuotaExceeded
+}
+
+// fail keeps the first error met by the conn.
+func (c *Conn) fail(e error) {
+	c.errm.Lock()
+	if c.err == nil {
+		c.err = e
+	}
+	c.errm.Unlock()
+}
+
+// firstError returns the first error returned by Read or Write.
+func (c *Conn) firstError() error {
+	c.errm.Lock()
+	e := c.err
+	c.errm.Unlock()
+	return e
+}
+
+// CloseWrite shuts down the writing side of the underlying conn if it supports it, as *net.TCPConn does.
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return &net.OpError{
+		Op:     `close`,
+		Net:    c.Conn.LocalAddr().Network(),
+		Source: c.Conn.LocalAddr(),
+		Addr:   c.Conn.RemoteAddr(),
+		Err:    errCloseWrite,
+	}
+}
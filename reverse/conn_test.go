@@ -0,0 +1,76 @@
+package reverse_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/powerpuffpenguin/vnet/reverse"
+)
+
+func TestConn(t *testing.T) {
+	l, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	dialer := reverse.NewDialer(l, reverse.WithDialerHeart(time.Millisecond*20))
+	defer dialer.Close()
+	go dialer.Serve()
+	listener := reverse.Listen(l.Addr(),
+		reverse.WithListenerLabels(map[string]string{`region`: `eu`}),
+		reverse.WithListenerLoad(func() (uint32, uint32) {
+			return 1, 10
+		}),
+	)
+	defer listener.Close()
+	go func() {
+		c, e := listener.Accept()
+		if e != nil {
+			return
+		}
+		// echo until the dialer closes its writing side
+		io.Copy(c, c)
+		c.Close()
+	}()
+
+	// let the agent answer a few hearts
+	time.Sleep(time.Millisecond * 100)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	c, e := dialer.DialContext(ctx, `tcp`, ``)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer c.Close()
+	conn := c.(*reverse.Conn)
+	if conn.Agent().Labels[`region`] != `eu` || conn.Agent().Capacity != 10 {
+		t.Fatalf("unexpected agent %+v", conn.Agent())
+	} else if conn.Version() != 2 {
+		t.Fatalf("expect version 2, got %v", conn.Version())
+	} else if conn.IdleDuration() < time.Millisecond*50 {
+		t.Fatalf("unexpected idle duration %v", conn.IdleDuration())
+	} else if conn.HeartRTT() <= 0 {
+		t.Fatalf("unexpected heart rtt %v", conn.HeartRTT())
+	} else if conn.HandshakeDuration() <= 0 {
+		t.Fatalf("unexpected handshake duration %v", conn.HandshakeDuration())
+	} else if _, ok := conn.Unwrap().(*net.TCPConn); !ok {
+		t.Fatalf("expect *net.TCPConn, got %T", conn.Unwrap())
+	}
+
+	_, e = c.Write([]byte(`ping`))
+	if e != nil {
+		t.Fatal(e)
+	}
+	e = conn.CloseWrite()
+	if e != nil {
+		t.Fatal(e)
+	}
+	b, e := io.ReadAll(c)
+	if e != nil || string(b) != `ping` {
+		t.Fatal(e, string(b))
+	} else if conn.BytesRead() != 4 || conn.BytesWritten() != 4 {
+		t.Fatalf("expect 4 bytes each way, got %v %v", conn.BytesRead(), conn.BytesWritten())
+	}
+}
@@ -0,0 +1,58 @@
+package reverse
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// aLongTimeAgo is a non-zero time, far in the past, used to interrupt blocked I/O.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// watch interrupts the I/O blocked on c when ctx is done or closed is closed, by moving its deadline to the past.
+// The returned stop must be called once the I/O is finished, it returns the cause of the interruption if any.
+// The watching goroutine always exits when stop is called.
+func watch(ctx context.Context, closed <-chan struct{}, closedErr error, c net.Conn) (stop func() error) {
+	if ctx.Done() == nil && closed == nil {
+		return func() error {
+			return nil
+		}
+	}
+	done := make(chan struct{})
+	result := make(chan error, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.SetDeadline(aLongTimeAgo)
+			result <- ctx.Err()
+		case <-closed:
+			c.SetDeadline(aLongTimeAgo)
+			result <- closedErr
+		case <-done:
+			result <- nil
+		}
+	}()
+	return func() error {
+		close(done)
+		return <-result
+	}
+}
+
+// handshakeDeadline returns the earlier of now+timeout and the deadline of ctx, zero if there is none.
+func handshakeDeadline(ctx context.Context, timeout time.Duration) (deadline time.Time) {
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	if t, ok := ctx.Deadline(); ok && (deadline.IsZero() || t.Before(deadline)) {
+		deadline = t
+	}
+	return
+}
+
+// timeoutError converts a deadline expired on the conn to context.DeadlineExceeded.
+func timeoutError(e error) error {
+	if ne, ok := e.(net.Error); ok && ne.Timeout() {
+		return context.DeadlineExceeded
+	}
+	return e
+}
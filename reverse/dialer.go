@@ -1,6 +1,8 @@
 package reverse
 
 import (
+	"bytes"
+	"container/list"
 	"context"
 	"net"
 	"sync"
@@ -8,17 +10,59 @@ import (
 	"time"
 
 	"github.com/powerpuffpenguin/vnet"
+	"github.com/powerpuffpenguin/vnet/audit"
+	"github.com/powerpuffpenguin/vnet/errs"
+	"github.com/powerpuffpenguin/vnet/logger"
+	"github.com/powerpuffpenguin/vnet/noise"
+	"github.com/powerpuffpenguin/vnet/reverse/codec"
+	"github.com/powerpuffpenguin/vnet/trace"
 )
 
 type Dialer struct {
 	opts dialerOptions
 	l    net.Listener
 
-	ch    chan *datagramStream
 	close <-chan struct{}
 	done  uint32
 	m     sync.Mutex
 
+	// idle conns accepted and not taken yet
+	idle map[net.Conn]*idleConn
+	// number of idle conns by source IP, only counted if WithDialerMaxIdlePerIP is set
+	idlePerIP map[string]int
+	// idle conns that can be handed out, oldest first
+	pool *list.List
+	// dials waiting for an idle conn, oldest first
+	waiters []*waiter
+	// conns returned by dials and not closed yet
+	active map[*Conn]struct{}
+	// seq numbers the conns for the admin handler
+	seq uint64
+	// handshaking counts the accepted conns running the noise handshake, they hold an idle slot
+	handshaking int
+
+	// heart scheduler
+	hearts    heartQueue
+	hm        sync.Mutex
+	heartWake chan struct{}
+	heartOnce sync.Once
+
+	// poller watches the idle conns, it is started by the first accept
+	poller     *poller
+	pollerOnce sync.Once
+
+	drain    chan struct{}
+	drained  chan struct{}
+	redirect []byte
+
+	// cluster listeners and presence notification
+	listeners   map[net.Listener]struct{}
+	presence    chan struct{}
+	publishOnce sync.Once
+
+	metrics *dialerMetrics
+	limits  *Limits
+
 	ctx    context.Context
 	cancel context.CancelFunc
 }
@@ -29,15 +73,44 @@ func NewDialer(l net.Listener, opt ...DialerOption) *Dialer {
 		o.apply(&opts)
 	}
 	ctx, cancel := context.WithCancel(context.Background())
-	return &Dialer{
+	var presence chan struct{}
+	if opts.registry != nil {
+		presence = make(chan struct{}, 1)
+	}
+	limits := opts.limits
+	if limits == nil {
+		limits = NewLimits()
+	}
+	d := &Dialer{
 		opts: opts,
 		l:    l,
 
-		ch:     make(chan *datagramStream),
 		close:  ctx.Done(),
+		idle:   make(map[net.Conn]*idleConn),
+		pool:   list.New(),
+		active: make(map[*Conn]struct{}),
+
+		heartWake: make(chan struct{}, 1),
+
+		drain:   make(chan struct{}),
+		drained: make(chan struct{}, 1),
+
+		listeners: make(map[net.Listener]struct{}),
+		presence:  presence,
+
+		metrics: newDialerMetrics(opts.metrics),
+		limits:  limits,
+
 		ctx:    ctx,
 		cancel: cancel,
 	}
+	limits.watch(d)
+	return d
+}
+
+// Limits returns the bandwidth limits and transfer quotas of the conns returned by dials.
+func (d *Dialer) Limits() *Limits {
+	return d.limits
 }
 func (d *Dialer) Close() (e error) {
 	if atomic.LoadUint32(&d.done) == 0 {
@@ -45,8 +118,19 @@ func (d *Dialer) Close() (e error) {
 		defer d.m.Unlock()
 		if d.done == 0 {
 			defer atomic.StoreUint32(&d.done, 1)
+			// say goodbye so agents stop using idle conns at once
+			streams := make([]*datagramStream, 0, len(d.idle))
+			for _, ic := range d.idle {
+				streams = append(streams, ic.stream)
+			}
+			sendFin(streams)
+			d.metrics.idle.Add(-float64(len(d.idle)))
+			d.limits.unwatch(d)
 			d.cancel()
 			d.l.Close()
+			for l := range d.listeners {
+				l.Close()
+			}
 			return
 		}
 	}
@@ -54,15 +138,24 @@ func (d *Dialer) Close() (e error) {
 	return
 }
 func (d *Dialer) Serve() error {
+	if d.opts.heart > 0 || d.opts.maxIdleAge > 0 {
+		d.heartOnce.Do(func() {
+			go d.runHeart()
+		})
+	}
+	return d.serve(d.l, d.onAccept)
+}
+func (d *Dialer) serve(l net.Listener, onAccept func(net.Conn)) error {
 	var tempDelay time.Duration // how long to sleep on accept failure
 	for {
-		c, e := d.l.Accept()
+		c, e := l.Accept()
 		if e != nil {
 			select {
 			case <-d.close:
 				return vnet.ErrDialerClosed
 			default:
 			}
+			d.metrics.acceptErrors.Add(1)
 			if ne, ok := e.(net.Error); ok && ne.Temporary() {
 				if tempDelay == 0 {
 					tempDelay = 5 * time.Millisecond
@@ -72,136 +165,511 @@ func (d *Dialer) Serve() error {
 				if max := 1 * time.Second; tempDelay > max {
 					tempDelay = max
 				}
+				d.log(logger.LevelWarn, `accept failed, retrying`, nil, e, `addr`, l.Addr(), `delay`, tempDelay)
 				time.Sleep(tempDelay)
 				continue
 			}
+			d.log(logger.LevelError, `accept failed`, nil, e, `addr`, l.Addr())
 			return e
 		}
 		tempDelay = 0
-		go d.onAccept(c)
+		go onAccept(c)
 	}
 }
 func (d *Dialer) onAccept(c net.Conn) {
-	stream := &datagramStream{
-		rw: c,
+	observers := d.opts.observers
+	observers.observeConn(EventAccept, errs.SideDialer, c, nil, 0, nil)
+	// the filter and the idle limits apply before the noise handshake,
+	// so peers that never finish it are screened and counted like idle conns
+	if d.opts.acceptFilter != nil && !d.opts.acceptFilter(c) {
+		d.log(logger.LevelInfo, `conn rejected`, c, ErrAcceptFilter)
+		observers.observeConn(EventClose, errs.SideDialer, c, nil, 0, ErrAcceptFilter)
+		c.Close()
+		return
 	}
-	var deadline <-chan time.Time
-	var t *time.Timer
-	if d.opts.heart > 0 {
-		t = time.NewTimer(d.opts.heart)
-		deadline = t.C
+	ic := &idleConn{
+		stream: &datagramStream{
+			rw: c,
+		},
+		agent: Agent{
+			RemoteAddr: c.RemoteAddr(),
+		},
+		accepted: time.Now(),
 	}
-	work := true
-	for work {
-		select {
-		case <-d.close:
-			work = false
+	if d.opts.maxIdlePerIP > 0 {
+		ic.ip = addrIP(ic.agent.RemoteAddr)
+	}
+
+	d.m.Lock()
+	if d.done != 0 {
+		d.m.Unlock()
+		d.closed(ic, vnet.ErrDialerClosed)
+		c.Close()
+		return
+	} else if !d.admit(ic) {
+		d.m.Unlock()
+		d.log(logger.LevelWarn, `conn rejected`, c, ErrIdleLimit)
+		d.closed(ic, ErrIdleLimit)
+		c.Close()
+		return
+	}
+	if d.opts.noiseKey != nil {
+		// the slot is reserved while the handshake runs
+		d.handshaking++
+		d.m.Unlock()
+		sc, e := d.secure(c)
+		d.m.Lock()
+		d.handshaking--
+		if e != nil {
+			d.release(ic)
+			d.m.Unlock()
+			d.metrics.acceptErrors.Add(1)
+			d.log(logLevel(e, logger.LevelWarn), `noise handshake failed`, c, e)
+			observers.observeConn(EventClose, errs.SideDialer, c, nil, 0, e)
 			c.Close()
-		case <-deadline:
-			e := d.sendHeart(stream)
-			if e != nil {
-				c.Close()
-				return
-			} else if t != nil {
-				t.Reset(d.opts.heart)
-			}
-		case d.ch <- stream:
-			work = false
+			return
+		}
+		c = sc
+		ic.stream.rw = sc
+		ic.agent.PublicKey = sc.PeerKey()
+		if d.done != 0 {
+			d.m.Unlock()
+			d.closed(ic, vnet.ErrDialerClosed)
+			c.Close()
+			return
 		}
 	}
-	if t != nil && !t.Stop() {
-		<-t.C
+	// conns that can't be interrupted by a deadline are not read while idle
+	var polled bool
+	if c.SetReadDeadline(time.Time{}) == nil {
+		ic.done = make(chan error, 1)
+		// a watched conn costs no goroutine until its agent sends a frame
+		polled = d.idlePoller().watch(ic)
 	}
-}
-func (d *Dialer) sendHeart(stream *datagramStream) (e error) {
-	if d.opts.heartTimeout < 1 {
-		e = stream.Send(DatagramHeart)
+	d.seq++
+	ic.id = d.seq
+	d.idle[c] = ic
+	d.metrics.idle.Add(1)
+	d.notifyPresence()
+	var redirect bool
+	select {
+	case <-d.drain:
+		redirect = true
+	default:
+		d.offer(ic)
+	}
+	d.m.Unlock()
+
+	d.observe(EventIdle, ic, 0, nil)
+	if redirect {
+		d.sendRedirect(ic)
 	} else {
-		t := time.NewTimer(d.opts.heartTimeout)
-		ch := make(chan error, 1)
-		go func() {
-			ch <- stream.Send(DatagramHeart)
-		}()
+		d.schedule(ic)
+	}
+	if ic.done != nil && !polled {
+		// the accepting goroutine becomes the reader of the idle conn
+		d.read(ic)
+	}
+}
+
+// idlePoller returns the poller of the idle conns, nil if they can't be polled.
+func (d *Dialer) idlePoller() *poller {
+	d.pollerOnce.Do(func() {
+		d.poller = newPoller(d)
+	})
+	return d.poller
+}
+
+// secure runs the Noise handshake on an accepted conn,
+// bounded by the heart timeout as agents handshake as soon as they connect.
+func (d *Dialer) secure(c net.Conn) (sc *noise.Conn, e error) {
+	timeout := d.opts.heartTimeout
+	if timeout <= 0 {
+		timeout = d.opts.timeout
+	}
+	c.SetDeadline(handshakeDeadline(d.ctx, timeout))
+	stop := watch(d.ctx, d.close, vnet.ErrDialerClosed, c)
+	sc = noise.Server(c, d.opts.noiseKey, d.opts.noiseOpts...)
+	e = sc.Handshake()
+	if err := stop(); err != nil {
+		e = err
+	} else if e == nil {
+		c.SetDeadline(time.Time{})
+	}
+	return
+}
+
+// sendRedirect tells the agent to reconnect to the drain address.
+// The reader closes the conn once the agent has re-established elsewhere and closed its end.
+func (d *Dialer) sendRedirect(ic *idleConn) {
+	ic.hm.Lock()
+	defer ic.hm.Unlock()
+	c := ic.stream.rw
+	if d.opts.heartTimeout > 0 {
+		c.SetWriteDeadline(time.Now().Add(d.opts.heartTimeout))
+	}
+	e := ic.stream.SendPayload(DatagramRedirect, d.redirect)
+	if e != nil {
+		d.closeIdle(ic, e)
+		return
+	} else if ic.done == nil {
+		d.closeIdle(ic, ErrDraining)
+		return
+	}
+	c.SetWriteDeadline(time.Time{})
+}
+
+// Drain stops handing out conns and asks every idle agent, including agents that connect later, to reconnect to addr.
+// Idle conns are closed once their agents have re-established elsewhere.
+// Agents only follow if they authenticate the dialer key with WithListenerNoise or allow addr with WithListenerRedirect,
+// the others close their idle conns and their Accept returns ErrRedirectRefused.
+// Drain returns when no idle conn is left, or closes the remaining idle conns and returns ctx.Err() when ctx is done.
+//
+// Conns already returned by DialContext are not affected, the Dialer should be closed once they are finished.
+func (d *Dialer) Drain(ctx context.Context, addr net.Addr) (e error) {
+	redirect, e := encodeAddr(addr)
+	if e != nil {
+		return
+	}
+	d.m.Lock()
+	if d.done != 0 {
+		d.m.Unlock()
+		e = vnet.ErrDialerClosed
+		return
+	}
+	select {
+	case <-d.drain:
+		d.m.Unlock()
+		e = ErrDraining
+		return
+	default:
+	}
+	d.redirect = redirect
+	close(d.drain)
+	d.notifyPresence()
+	idle := make([]*idleConn, 0, d.pool.Len())
+	for elem := d.pool.Front(); elem != nil; elem = elem.Next() {
+		idle = append(idle, elem.Value.(*idleConn))
+	}
+	for _, ic := range idle {
+		d.unpool(ic)
+	}
+	d.m.Unlock()
+	for _, ic := range idle {
+		d.sendRedirect(ic)
+	}
+
+	for {
+		d.m.Lock()
+		if d.done != 0 {
+			d.m.Unlock()
+			e = vnet.ErrDialerClosed
+			return
+		} else if len(d.idle) == 0 {
+			d.m.Unlock()
+			return
+		}
+		d.m.Unlock()
+
 		select {
+		case <-ctx.Done():
+			e = ctx.Err()
+			idle = idle[:0]
+			d.m.Lock()
+			for _, ic := range d.idle {
+				idle = append(idle, ic)
+			}
+			d.m.Unlock()
+			for _, ic := range idle {
+				d.closeIdle(ic, e)
+			}
+			return
 		case <-d.close:
 			e = vnet.ErrDialerClosed
-		case e = <-ch:
-		case <-t.C:
-			e = context.DeadlineExceeded
 			return
-		}
-		if !t.Stop() {
-			<-t.C
+		case <-d.drained:
 		}
 	}
-	return
 }
 func (d *Dialer) Dial(network, addr string) (c net.Conn, e error) {
 	return d.DialContext(context.Background(), network, addr)
 }
 func (d *Dialer) DialContext(ctx context.Context, network, addr string) (c net.Conn, e error) {
-	var stream *datagramStream
-	select {
-	case <-ctx.Done():
-		e = ctx.Err()
+	return d.DialAgent(ctx, nil, nil)
+}
+
+// DialAgent dials an idle agent whose labels match selector, picked by picker.
+// If picker is nil the picker set by WithDialerPicker is used.
+// When no idle agent is picked, DialAgent waits, running picker again on the idle agents matching selector each time one of them becomes idle.
+func (d *Dialer) DialAgent(ctx context.Context, selector Selector, picker Picker) (c net.Conn, e error) {
+	ctx, span := d.opts.tracer.Start(ctx, `vnet.reverse.dial`, trace.String(trace.Selector, selector.String()))
+	defer func() {
+		span.End(e)
+	}()
+	if d.limits.exhausted() {
+		e = errs.NewOpError(`dial`, errs.SideDialer, nil, ErrQuotaExceeded)
 		return
-	case stream = <-d.ch:
-	case <-d.close:
-		e = vnet.ErrDialerClosed
+	}
+	conn, e := d.dialAgent(ctx, selector, picker)
+	if e == nil && d.opts.proxyVersion != 0 {
+		e = d.sendProxyHeader(ctx, conn.Conn)
+		if e != nil {
+			d.log(logger.LevelWarn, `proxy header failed`, conn, e)
+			d.opts.observers.observeConn(EventClose, errs.SideDialer, conn, conn.observedAgent(), 0, e)
+			conn.Close()
+		}
+	}
+	if e != nil {
+		e = errs.NewOpError(`dial`, errs.SideDialer, nil, e)
 		return
 	}
-	if d.opts.synAck {
-		e = d.synAck(ctx, stream)
+	conns := d.metrics.conns
+	conns.Active.Add(1)
+	conn.metrics = conns
+	conn.limiter = d.limits.newConnLimiter(agentID(&conn.agent))
+	conn.handedOff = time.Now()
+	d.m.Lock()
+	if conn.id == 0 {
+		d.seq++
+		conn.id = d.seq
+	}
+	d.active[conn] = struct{}{}
+	d.m.Unlock()
+	observers := d.opts.observers
+	var agent *Agent
+	if len(observers) != 0 {
+		agent = conn.observedAgent()
+		observers.observeConn(EventHandoff, errs.SideDialer, conn, agent, 0, nil)
+	}
+	record := d.auditRecord(ctx, conn)
+	conn.onClose = func() {
+		d.m.Lock()
+		delete(d.active, conn)
+		d.m.Unlock()
+		conns.Active.Add(-1)
+		observers.observeConn(EventClose, errs.SideDialer, conn, agent, 0, nil)
+		if record != nil {
+			record.BytesIn = conn.BytesRead()
+			record.BytesOut = conn.BytesWritten()
+			record.Close(conn.firstError())
+			d.opts.audit.Write(*record)
+		}
+	}
+	c = conn
+	return
+}
+
+// auditRecord returns the record of the session of conn, nil if sessions are not audited.
+func (d *Dialer) auditRecord(ctx context.Context, conn *Conn) *audit.Record {
+	if d.opts.audit == nil {
+		return nil
+	}
+	record := &audit.Record{
+		Opened:      conn.handedOff,
+		Side:        errs.SideDialer,
+		LocalAddr:   conn.LocalAddr().String(),
+		RemoteAddr:  conn.RemoteAddr().String(),
+		Agent:       agentID(&conn.agent),
+		AgentLabels: conn.agent.Labels,
+	}
+	if src, dst, ok := vnet.ProxyFromContext(ctx); ok {
+		record.Source = addrString(src)
+		record.Destination = addrString(dst)
+	}
+	return record
+}
+
+// sendProxyHeader tells the service behind the agent where the proxied conn comes from.
+func (d *Dialer) sendProxyHeader(ctx context.Context, c net.Conn) (e error) {
+	h := vnet.ProxyHeader{
+		Version: d.opts.proxyVersion,
+	}
+	h.Source, h.Destination, _ = vnet.ProxyFromContext(ctx)
+	b, e := h.Append(nil)
+	if e != nil {
+		return
+	}
+	c.SetWriteDeadline(handshakeDeadline(ctx, d.opts.timeout))
+	_, e = c.Write(b)
+	if e != nil {
+		e = timeoutError(e)
+		return
+	}
+	c.SetWriteDeadline(time.Time{})
+	return
+}
+func (d *Dialer) dialAgent(ctx context.Context, selector Selector, picker Picker) (c *Conn, e error) {
+	if picker == nil {
+		picker = d.opts.picker
+	}
+	if d.opts.registry != nil {
+		// prefer a local agent, then an agent attached to another node
+		for {
+			var ic *idleConn
+			ic, e = d.tracedWait(ctx, selector, picker, false)
+			if e != nil {
+				return
+			} else if ic == nil {
+				break
+			}
+			c, e = d.handshake(ctx, ic)
+			if e != errFin {
+				return
+			}
+		}
+		start := time.Now()
+		var fc net.Conn
+		forwardCtx, span := d.opts.tracer.Start(ctx, `vnet.reverse.forward`)
+		fc, e = d.forward(forwardCtx, selector)
+		if e == nil {
+			span.SetAttributes(trace.String(trace.PeerAddr, fc.RemoteAddr().String()))
+		}
+		span.End(e)
+		if e == nil {
+			c = &Conn{
+				Conn:      fc,
+				handshake: time.Since(start),
+			}
+			return
+		}
+	}
+	c, e = d.dialLocal(ctx, selector, picker, true)
+	return
+}
+
+// dialLocal waits for an agent attached to this node,
+// if block is false it fails at once with errNoAgent when no idle agent matches.
+func (d *Dialer) dialLocal(ctx context.Context, selector Selector, picker Picker, block bool) (c *Conn, e error) {
+	for {
+		var ic *idleConn
+		ic, e = d.tracedWait(ctx, selector, picker, block)
 		if e != nil {
-			stream.rw.Close()
+			return
+		} else if ic == nil {
+			e = errNoAgent
+			return
+		}
+		c, e = d.handshake(ctx, ic)
+		if e != errFin {
 			return
 		}
+		// the agent said goodbye, try another one
+	}
+}
+
+// tracedWait is wait traced as a vnet.reverse.pool_wait span.
+func (d *Dialer) tracedWait(ctx context.Context, selector Selector, picker Picker, block bool) (ic *idleConn, e error) {
+	_, span := d.opts.tracer.Start(ctx, `vnet.reverse.pool_wait`)
+	ic, e = d.wait(ctx, selector, picker, block)
+	if ic != nil {
+		d.m.Lock()
+		agent := ic.agent
+		d.m.Unlock()
+		span.SetAttributes(
+			trace.String(trace.AgentID, agentID(&agent)),
+			trace.String(trace.PeerAddr, agent.RemoteAddr.String()),
+		)
 	}
-	c = stream.rw
+	span.End(e)
 	return
 }
-func (d *Dialer) synAck(ctx context.Context, stream *datagramStream) (e error) {
-	var t *time.Timer
-	var deadline <-chan time.Time
-	if d.opts.timeout > 0 {
-		t = time.NewTimer(d.opts.timeout)
-		deadline = t.C
+func (d *Dialer) handshake(ctx context.Context, ic *idleConn) (c *Conn, e error) {
+	d.m.Lock()
+	agent := ic.agent
+	d.m.Unlock()
+	ctx, span := d.opts.tracer.Start(ctx, `vnet.reverse.handshake`,
+		trace.String(trace.AgentID, agentID(&agent)),
+		trace.String(trace.PeerAddr, agent.RemoteAddr.String()),
+	)
+	defer func() {
+		span.End(e)
+	}()
+	start := time.Now()
+	d.observe(EventHandshakeStart, ic, 0, nil)
+	stream := ic.stream
+	if !ic.detach() {
+		e = errFin
+		d.log(logger.LevelDebug, `handshake failed`, stream.rw, e)
+		observeHandshake(d.metrics.handshake, d.metrics.handshakeFailures, start, e)
+		d.observe(EventHandshakeEnd, ic, time.Since(start), e)
+		d.closed(ic, e)
+		stream.rw.Close()
+		return
 	}
-	ch := make(chan error, 1)
-	go d.asyncSynAck(ch, stream)
-	select {
-	case <-ctx.Done():
-		e = ctx.Err()
-	case <-deadline:
-		e = context.DeadlineExceeded
+	var compress bool
+	if d.opts.synAck {
+		compress, e = d.synAck(ctx, stream)
+	}
+	var rw net.Conn = stream.rw
+	if e == nil && compress {
+		rw, e = vnet.Compress(stream.rw, d.opts.compressLevel, d.opts.compressDelay)
+	}
+	observeHandshake(d.metrics.handshake, d.metrics.handshakeFailures, start, e)
+	d.observe(EventHandshakeEnd, ic, time.Since(start), e)
+	if e != nil {
+		level := logger.LevelWarn
+		if e == errFin {
+			// the agent said goodbye as it was taken, another one is tried
+			level = logger.LevelDebug
+		}
+		d.log(logLevel(e, level), `handshake failed`, stream.rw, e)
+		d.closed(ic, e)
+		stream.rw.Close()
 		return
-	case e = <-ch:
-	case <-d.close:
-		e = vnet.ErrDialerClosed
 	}
-	if t != nil && !t.Stop() {
-		<-t.C
+	// the reader has ended, the agent can't change any more
+	d.m.Lock()
+	c = &Conn{
+		Conn:    rw,
+		id:      ic.id,
+		agent:   ic.agent,
+		version: stream.version,
+		idle:    start.Sub(ic.accepted),
+		rtt:     ic.rtt,
 	}
+	d.m.Unlock()
+	c.handshake = time.Since(start)
 	return
 }
-func (d *Dialer) asyncSynAck(ch chan<- error, stream *datagramStream) {
+func (d *Dialer) synAck(ctx context.Context, stream *datagramStream) (compress bool, e error) {
+	c := stream.rw
+	c.SetDeadline(handshakeDeadline(ctx, d.opts.timeout))
+	stop := watch(ctx, d.close, vnet.ErrDialerClosed, c)
+	compress, e = d.exchangeSynAck(stream)
+	if err := stop(); err != nil {
+		e = err
+	} else if e != nil {
+		e = timeoutError(e)
+	} else {
+		c.SetDeadline(time.Time{})
+	}
+	return
+}
+func (d *Dialer) exchangeSynAck(stream *datagramStream) (compress bool, e error) {
 	// dial send syn
-	e := stream.Send(DatagramSyn)
+	e = stream.Send(DatagramSyn)
 	if e != nil {
-		ch <- e
 		return
 	}
-	// recv syn+ack
-	e = stream.Recv(DatagramSynAck)
-	if e != nil {
-		ch <- e
-		return
+	// recv syn+ack, the agent may still answer a heart sent just before,
+	// or say hello if the conn was taken as soon as it was accepted
+	for {
+		e = stream.Recv(DatagramSynAck, DatagramFin, DatagramLoad, DatagramHello)
+		if e != nil {
+			return
+		} else if stream.Event() == DatagramFin {
+			e = errFin
+			return
+		} else if stream.Event() == DatagramSynAck {
+			break
+		}
 	}
-	// send ack
-	e = stream.Send(DatagramAck)
-	if e != nil {
-		ch <- e
+	// send ack, choosing flate if the agent offers it
+	if d.opts.compress && bytes.IndexByte(stream.Payload(), codec.CompressFlate) != -1 {
+		e = stream.SendPayload(DatagramAck, []byte{codec.CompressFlate})
+		compress = e == nil
 		return
 	}
-	ch <- nil
+	e = stream.Send(DatagramAck)
+	return
 }
@@ -1,12 +1,29 @@
 package reverse
 
-import "time"
+import (
+	"context"
+	"crypto/ecdh"
+	"net"
+	"time"
+
+	"github.com/powerpuffpenguin/vnet/audit"
+	"github.com/powerpuffpenguin/vnet/logger"
+	"github.com/powerpuffpenguin/vnet/metrics"
+	"github.com/powerpuffpenguin/vnet/noise"
+	"github.com/powerpuffpenguin/vnet/trace"
+)
 
 var defaultDialerOptions = dialerOptions{
 	synAck:       true,
 	timeout:      time.Second * 75,
 	heart:        time.Second * 50,
 	heartTimeout: time.Second * 25,
+
+	clusterRefresh: time.Second * 10,
+
+	metrics: metrics.Discard,
+	logger:  logger.Discard,
+	tracer:  trace.Discard,
 }
 
 type dialerOptions struct {
@@ -14,6 +31,37 @@ type dialerOptions struct {
 	timeout      time.Duration
 	heart        time.Duration
 	heartTimeout time.Duration
+	picker       Picker
+
+	maxIdle      int
+	maxIdlePerIP int
+	maxIdleAge   time.Duration
+	acceptFilter func(c net.Conn) bool
+
+	noiseKey  *ecdh.PrivateKey
+	noiseOpts []noise.Option
+
+	compress      bool
+	compressLevel int
+	compressDelay time.Duration
+
+	proxyVersion uint8
+
+	observers observers
+	metrics   metrics.Registry
+	logger    logger.Logger
+	tracer    trace.Tracer
+	audit     audit.Sink
+	limits    *Limits
+
+	registry       Registry
+	clusterID      string
+	clusterAddr    net.Addr
+	clusterRefresh time.Duration
+	clusterDial    func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	clusterNoiseKey  *ecdh.PrivateKey
+	clusterNoiseOpts []noise.Option
 }
 type DialerOption interface {
 	apply(*dialerOptions)
@@ -50,3 +98,173 @@ func WithDialerHeartTimeout(timeout time.Duration) DialerOption {
 		o.heartTimeout = timeout
 	})
 }
+
+// WithDialerPicker sets the picker used by DialContext, and by DialAgent when no picker is passed.
+// A nil picker takes the agent that has been idle for the longest time.
+func WithDialerPicker(picker Picker) DialerOption {
+	return newDialerOption(func(o *dialerOptions) {
+		o.picker = picker
+	})
+}
+
+// WithDialerMaxIdle limits the number of idle conns, conns accepted beyond the limit are closed at once.
+// 0 means no limit.
+func WithDialerMaxIdle(n int) DialerOption {
+	return newDialerOption(func(o *dialerOptions) {
+		o.maxIdle = n
+	})
+}
+
+// WithDialerMaxIdlePerIP limits the number of idle conns from a single source IP,
+// conns accepted beyond the limit are closed at once.
+// 0 means no limit.
+func WithDialerMaxIdlePerIP(n int) DialerOption {
+	return newDialerOption(func(o *dialerOptions) {
+		o.maxIdlePerIP = n
+	})
+}
+
+// WithDialerMaxIdleAge limits the time a conn stays idle without being handshaken.
+// An older idle conn is told goodbye and closed, a well behaved agent reconnects at once.
+// 0 means no limit.
+func WithDialerMaxIdleAge(d time.Duration) DialerOption {
+	return newDialerOption(func(o *dialerOptions) {
+		o.maxIdleAge = d
+	})
+}
+
+// WithDialerAcceptFilter sets a function called with every accepted conn before it enters the pool,
+// the conn is closed if it returns false. With WithDialerNoise it is called before the handshake, with the raw conn.
+// It runs on the goroutine serving the conn, so it may block without delaying other accepts.
+func WithDialerAcceptFilter(f func(c net.Conn) bool) DialerOption {
+	return newDialerOption(func(o *dialerOptions) {
+		o.acceptFilter = f
+	})
+}
+
+// WithDialerNoise secures every agent conn with the Noise protocol keyed by the dialer's static key.
+// The agents must be configured with WithListenerNoise, opt restricts the accepted agent keys;
+// without noise.WithPeerKeys or noise.WithAuthorize the conns are encrypted but the agents are not authenticated.
+// The handshake runs after the accept filter, holds an idle slot counted by the idle limits
+// and is bounded by the heart timeout, or the dialer timeout if there is no heart timeout.
+// The agent key is then reported in Agent.PublicKey and the conns returned by dials unwrap to *noise.Conn.
+func WithDialerNoise(key *ecdh.PrivateKey, opt ...noise.Option) DialerOption {
+	return newDialerOption(func(o *dialerOptions) {
+		o.noiseKey = key
+		o.noiseOpts = opt
+	})
+}
+
+// WithDialerCompress compresses the conns of agents that offer compression with flate at level, see vnet.Compress.
+// The method is negotiated by the handshake, agents configured with WithListenerCompress offer it.
+// The conns returned by dials then unwrap to *vnet.CompressConn.
+func WithDialerCompress(level int, delay time.Duration) DialerOption {
+	return newDialerOption(func(o *dialerOptions) {
+		o.compress = true
+		o.compressLevel = level
+		o.compressDelay = delay
+	})
+}
+
+// WithDialerProxyProtocol makes every dial send a PROXY protocol header of version 1 or 2 before the conn is returned.
+// The header carries the addresses set on the dial context by vnet.NewProxyContext, or says the conn is not proxied.
+// The service behind the agent reads it by wrapping the reverse.Listener with vnet.ProxyListener.
+func WithDialerProxyProtocol(version uint8) DialerOption {
+	return newDialerOption(func(o *dialerOptions) {
+		o.proxyVersion = version
+	})
+}
+
+// WithDialerObserver adds an observer of the life of agent conns, it can be set several times.
+func WithDialerObserver(observer Observer) DialerOption {
+	return newDialerOption(func(o *dialerOptions) {
+		o.observers = append(o.observers, observer)
+	})
+}
+
+// WithDialerMetrics publishes the metrics of the Dialer in r, with names starting with vnet_reverse_dialer_:
+// idle_conns, dials_waiting, handshake_seconds, handshake_failures_total, heart_failures_total,
+// accept_errors_total, active_conns, bytes_read_total and bytes_written_total.
+func WithDialerMetrics(r metrics.Registry) DialerOption {
+	return newDialerOption(func(o *dialerOptions) {
+		o.metrics = r
+	})
+}
+
+// WithDialerLogger logs handshake failures, heart failures, accept errors with their backoff and protocol violations,
+// with the addresses of the conns. A nil logger logs nothing.
+func WithDialerLogger(l logger.Logger) DialerOption {
+	return newDialerOption(func(o *dialerOptions) {
+		if l == nil {
+			o.logger = logger.Discard
+		} else {
+			o.logger = l
+		}
+	})
+}
+
+// WithDialerTracer traces the dials as a vnet.reverse.dial span, child of the span in the dial context,
+// with children for the phases: vnet.reverse.pool_wait waiting for an idle conn, vnet.reverse.handshake
+// and vnet.reverse.forward dialing another node of the cluster. A nil tracer traces nothing.
+func WithDialerTracer(t trace.Tracer) DialerOption {
+	return newDialerOption(func(o *dialerOptions) {
+		if t == nil {
+			o.tracer = trace.Discard
+		} else {
+			o.tracer = t
+		}
+	})
+}
+
+// WithDialerAudit writes a record to sink when a conn returned by a dial is closed,
+// with the addresses set by vnet.NewProxyContext on the dial context as the source and destination.
+func WithDialerAudit(sink audit.Sink) DialerOption {
+	return newDialerOption(func(o *dialerOptions) {
+		o.audit = sink
+	})
+}
+
+// WithDialerLimits sets the bandwidth limits and transfer quotas of the conns returned by dials,
+// limits may be shared by several dialers. By default each Dialer has its own, see Dialer.Limits.
+func WithDialerLimits(limits *Limits) DialerOption {
+	return newDialerOption(func(o *dialerOptions) {
+		o.limits = limits
+	})
+}
+
+// WithDialerCluster makes the Dialer a node of a cluster sharing agent presence through registry.
+// addr is where ServeCluster listens, other nodes forward dials to it.
+// Whoever reaches addr can dial the agents of the node, secure the link with WithDialerClusterNoise
+// or keep addr on a private network.
+func WithDialerCluster(id string, addr net.Addr, registry Registry) DialerOption {
+	return newDialerOption(func(o *dialerOptions) {
+		o.clusterID = id
+		o.clusterAddr = addr
+		o.registry = registry
+	})
+}
+
+// WithDialerClusterRefresh sets how often the node republishes its presence, refresh < 1 only publishes on change.
+func WithDialerClusterRefresh(refresh time.Duration) DialerOption {
+	return newDialerOption(func(o *dialerOptions) {
+		o.clusterRefresh = refresh
+	})
+}
+
+// WithDialerClusterDial sets the function used to connect to other nodes of the cluster.
+// The forwarded dials are only authenticated by the conns f returns, or by WithDialerClusterNoise.
+func WithDialerClusterDial(f func(ctx context.Context, network, addr string) (net.Conn, error)) DialerOption {
+	return newDialerOption(func(o *dialerOptions) {
+		o.clusterDial = f
+	})
+}
+
+// WithDialerClusterNoise secures the links between the nodes of the cluster with the Noise protocol keyed by the node's static key.
+// Every node must be configured with it, opt such as noise.WithPeerKeys should only accept the keys of the other nodes,
+// forwarded dials from nodes not accepted are closed before they are read.
+func WithDialerClusterNoise(key *ecdh.PrivateKey, opt ...noise.Option) DialerOption {
+	return newDialerOption(func(o *dialerOptions) {
+		o.clusterNoiseKey = key
+		o.clusterNoiseOpts = opt
+	})
+}
@@ -1,5 +1,35 @@
 package reverse
 
-import "errors"
+import (
+	"errors"
+	"fmt"
 
-var ErrProtocol = errors.New(`protocol error`)
+	"github.com/powerpuffpenguin/vnet/errs"
+	"github.com/powerpuffpenguin/vnet/reverse/codec"
+)
+
+var ErrProtocol = codec.ErrProtocol
+var ErrDraining = errors.New(`dialer is draining`)
+
+// ErrRedirectRefused is returned by Accept when a dialer asks the listener to reconnect elsewhere
+// and WithListenerRedirect does not allow it, or without it the dialer is not authenticated by WithListenerNoise.
+var ErrRedirectRefused = errors.New(`redirect refused`)
+
+// ErrEvicted is the error of the conns closed by an admin handler.
+var ErrEvicted = errors.New(`evicted by the admin handler`)
+
+// errFin is returned by the handshake when the peer said goodbye.
+var errFin = errors.New(`peer said goodbye`)
+
+// errDetached ends the reader of an idle conn that finished a frame while being taken.
+var errDetached = errors.New(`idle conn detached`)
+
+// protocolError returns an *errs.ProtocolError that matches ErrProtocol.
+func protocolError(version, event uint8, format string, a ...interface{}) error {
+	return &errs.ProtocolError{
+		Err:     ErrProtocol,
+		Version: version,
+		Event:   event,
+		Msg:     fmt.Sprintf(format, a...),
+	}
+}
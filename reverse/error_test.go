@@ -0,0 +1,62 @@
+package reverse_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/powerpuffpenguin/vnet/errs"
+	"github.com/powerpuffpenguin/vnet/reverse"
+)
+
+func TestProtocolError(t *testing.T) {
+	// flag 3553, version 9, event SynAck
+	addr, _ := rawPeer(t, []byte{0x0d, 0xe1, 9, reverse.DatagramSynAck})
+	listener := reverse.Listen(addr, reverse.WithListenerSynAck(true))
+	defer listener.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+	_, e := listener.AcceptContext(ctx)
+	if !errors.Is(e, reverse.ErrProtocol) {
+		t.Fatalf("expect ErrProtocol, got %v", e)
+	}
+	var oe *errs.OpError
+	if !errors.As(e, &oe) {
+		t.Fatalf("expect *errs.OpError, got %T", e)
+	} else if oe.Op != `accept` || oe.Side != errs.SideListener || oe.Version != 9 {
+		t.Fatalf("unexpected op error %+v", oe)
+	}
+	var pe *errs.ProtocolError
+	if !errors.As(e, &pe) {
+		t.Fatalf("expect *errs.ProtocolError, got %T", e)
+	} else if pe.Version != 9 || pe.Event != reverse.DatagramSynAck {
+		t.Fatalf("unexpected protocol error %+v", pe)
+	}
+}
+func TestNetError(t *testing.T) {
+	l, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	dialer := reverse.NewDialer(l)
+	go dialer.Serve()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	_, e = dialer.DialContext(ctx, `tcp`, ``)
+	cancel()
+	if ne, ok := e.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("expect timeout net.Error, got %v", e)
+	} else if !errors.Is(e, context.DeadlineExceeded) {
+		t.Fatalf("expect context.DeadlineExceeded, got %v", e)
+	}
+
+	dialer.Close()
+	_, e = dialer.Dial(`tcp`, ``)
+	if !errors.Is(e, net.ErrClosed) {
+		t.Fatalf("expect net.ErrClosed, got %v", e)
+	} else if ne, ok := e.(net.Error); !ok || ne.Temporary() || ne.Timeout() {
+		t.Fatalf("expect permanent net.Error, got %v", e)
+	}
+}
@@ -0,0 +1,143 @@
+package reverse_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/powerpuffpenguin/vnet"
+	"github.com/powerpuffpenguin/vnet/reverse"
+	"github.com/powerpuffpenguin/vnet/reverse/codec"
+)
+
+func frame(version, event uint8, payload []byte) []byte {
+	b, e := codec.Encode(codec.Frame{
+		Version: version,
+		Event:   event,
+		Payload: payload,
+	})
+	if e != nil {
+		panic(e)
+	}
+	return b
+}
+func frames(b ...[]byte) (s []byte) {
+	for _, v := range b {
+		s = append(s, v...)
+	}
+	return
+}
+
+// drip writes b to c in chunks of n bytes, then reads c until it is closed.
+func drip(c net.Conn, b []byte, n uint8) {
+	size := int(n)
+	if size == 0 {
+		size = len(b)
+	}
+	for len(b) != 0 {
+		if size > len(b) {
+			size = len(b)
+		}
+		_, e := c.Write(b[:size])
+		if e != nil {
+			return
+		}
+		b = b[size:]
+		if n != 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	io.Copy(io.Discard, c)
+}
+
+// bounded fails the test if f does not return within the handshake timeouts used by the fuzz targets.
+func bounded(t *testing.T, f func()) {
+	ch := make(chan struct{})
+	go func() {
+		f()
+		close(ch)
+	}()
+	select {
+	case <-ch:
+	case <-time.After(time.Second * 5):
+		t.Fatal("handshake hung")
+	}
+}
+
+// FuzzDialerHandshake runs a Dialer against an agent that sends arbitrary bytes.
+func FuzzDialerHandshake(f *testing.F) {
+	hello, _ := codec.EncodeLabels(map[string]string{`zone`: `eu`})
+	f.Add(frame(0, codec.EventSynAck, nil), uint8(0))
+	f.Add(frames(frame(0, codec.EventHello, hello), frame(0, codec.EventSynAck, nil)), uint8(1))
+	f.Add(frames(frame(0, codec.EventLoad, codec.EncodeLoad(1, 2)), frame(0, codec.EventSynAck, nil)), uint8(3))
+	f.Add(frame(0, codec.EventFin, nil), uint8(0))
+	// garbage after a valid synack
+	f.Add(frames(frame(0, codec.EventSynAck, nil), []byte{0x0d, 0xe1, 0xff, 0xff}), uint8(0))
+	f.Add([]byte{0x0d}, uint8(0))
+	f.Fuzz(func(t *testing.T, data []byte, chunk uint8) {
+		pipe := vnet.ListenPipe()
+		dialer := reverse.NewDialer(pipe,
+			reverse.WithDialerTimeout(time.Millisecond*100),
+			reverse.WithDialerHeart(time.Millisecond*20),
+			reverse.WithDialerHeartTimeout(time.Millisecond*50),
+		)
+		served := make(chan struct{})
+		go func() {
+			dialer.Serve()
+			close(served)
+		}()
+		c, e := pipe.Dial(`pipe`, ``)
+		if e != nil {
+			t.Fatal(e)
+		}
+		go drip(c, data, chunk)
+		bounded(t, func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+			conn, e := dialer.DialContext(ctx, `tcp`, ``)
+			cancel()
+			if e == nil {
+				conn.Close()
+			}
+			dialer.Close()
+			c.Close()
+			<-served
+		})
+	})
+}
+
+// FuzzListenerHandshake runs a Listener against a dialer that sends arbitrary bytes.
+func FuzzListenerHandshake(f *testing.F) {
+	redirect, _ := codec.EncodeAddr(`pipe`, `pipe`)
+	f.Add(frames(frame(0, codec.EventSyn, nil), frame(0, codec.EventAck, nil)), uint8(0))
+	f.Add(frames(frame(0, codec.EventHeart, nil), frame(0, codec.EventSyn, nil), frame(0, codec.EventAck, nil)), uint8(1))
+	f.Add(frames(frame(2, codec.EventHeart, nil), frame(2, codec.EventSyn, nil), frame(2, codec.EventAck, nil)), uint8(2))
+	f.Add(frame(0, codec.EventRedirect, redirect), uint8(0))
+	f.Add(frame(0, codec.EventFin, nil), uint8(0))
+	// garbage after a valid syn
+	f.Add(frames(frame(0, codec.EventSyn, nil), []byte{0xff, 0xff, 0xff}), uint8(0))
+	f.Add([]byte{0x0d, 0xe1, 0x02}, uint8(0))
+	f.Fuzz(func(t *testing.T, data []byte, chunk uint8) {
+		listener := reverse.Listen(vnet.ListenPipe().Addr(),
+			reverse.WithListenerDialContext(func(ctx context.Context, network, address string) (net.Conn, error) {
+				c0, c1 := net.Pipe()
+				go drip(c1, data, chunk)
+				return c0, nil
+			}),
+			reverse.WithListenerHeartTimeout(time.Millisecond*50),
+			reverse.WithListenerSynAckTimeout(time.Millisecond*50),
+			reverse.WithListenerLabels(map[string]string{`zone`: `eu`}),
+			reverse.WithListenerLoad(func() (uint32, uint32) { return 1, 2 }),
+		)
+		bounded(t, func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+			c, e := listener.AcceptContext(ctx)
+			cancel()
+			if e == nil {
+				c.Close()
+			}
+			listener.Close()
+		})
+	})
+}
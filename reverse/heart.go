@@ -0,0 +1,186 @@
+package reverse
+
+import (
+	"container/heap"
+	"time"
+
+	"github.com/powerpuffpenguin/vnet/logger"
+)
+
+// heartWorkers is the number of goroutines sending hearts,
+// so that one agent slow to read its socket does not delay the hearts of the others.
+const heartWorkers = 8
+
+type heartItem struct {
+	at time.Time
+	ic *idleConn
+}
+type heartQueue []heartItem
+
+func (q heartQueue) Len() int {
+	return len(q)
+}
+func (q heartQueue) Less(i, j int) bool {
+	return q[i].at.Before(q[j].at)
+}
+func (q heartQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+}
+func (q *heartQueue) Push(x interface{}) {
+	*q = append(*q, x.(heartItem))
+}
+func (q *heartQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = heartItem{}
+	*q = old[:n-1]
+	return item
+}
+
+// schedule sends the next heart to ic after the heart interval,
+// or expires ic earlier if it reaches the max idle age first.
+func (d *Dialer) schedule(ic *idleConn) {
+	var at time.Time
+	if d.opts.heart > 0 {
+		at = time.Now().Add(d.opts.heart)
+	}
+	if d.opts.maxIdleAge > 0 {
+		expire := ic.accepted.Add(d.opts.maxIdleAge)
+		if at.IsZero() || expire.Before(at) {
+			at = expire
+		}
+	}
+	if at.IsZero() {
+		return
+	}
+	d.hm.Lock()
+	heap.Push(&d.hearts, heartItem{
+		at: at,
+		ic: ic,
+	})
+	first := d.hearts[0].ic == ic
+	d.hm.Unlock()
+	if first {
+		select {
+		case d.heartWake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// runHeart is the only timer of the Dialer, it hands the due hearts to the heart workers.
+func (d *Dialer) runHeart() {
+	ch := make(chan *idleConn)
+	for i := 0; i < heartWorkers; i++ {
+		go func() {
+			for {
+				select {
+				case <-d.close:
+					return
+				case ic := <-ch:
+					d.sendHeart(ic)
+				}
+			}
+		}()
+	}
+
+	t := time.NewTimer(time.Hour)
+	for {
+		var wait time.Duration = -1
+		var due *idleConn
+		d.hm.Lock()
+		if len(d.hearts) != 0 {
+			wait = time.Until(d.hearts[0].at)
+			if wait <= 0 {
+				due = heap.Pop(&d.hearts).(heartItem).ic
+			}
+		}
+		d.hm.Unlock()
+
+		if due != nil {
+			select {
+			case <-d.close:
+				return
+			case ch <- due:
+			}
+			continue
+		}
+
+		var deadline <-chan time.Time
+		if wait > 0 {
+			if !t.Stop() {
+				select {
+				case <-t.C:
+				default:
+				}
+			}
+			t.Reset(wait)
+			deadline = t.C
+		}
+		select {
+		case <-d.close:
+			t.Stop()
+			return
+		case <-d.heartWake:
+		case <-deadline:
+		}
+	}
+}
+func (d *Dialer) sendHeart(ic *idleConn) {
+	ic.hm.Lock()
+	defer ic.hm.Unlock()
+	d.m.Lock()
+	pooled := ic.pooled()
+	d.m.Unlock()
+	if !pooled {
+		// taken, draining or gone
+		return
+	}
+
+	c := ic.stream.rw
+	if d.opts.heartTimeout > 0 {
+		c.SetWriteDeadline(time.Now().Add(d.opts.heartTimeout))
+	}
+	if d.opts.maxIdleAge > 0 && time.Since(ic.accepted) >= d.opts.maxIdleAge {
+		// too old, say goodbye so the agent reconnects
+		d.m.Lock()
+		taken := ic.taken
+		if !taken {
+			d.removeIdle(ic)
+		}
+		d.m.Unlock()
+		if !taken {
+			ic.stream.Send(DatagramFin)
+			d.log(logger.LevelDebug, `idle conn expired`, c, ErrMaxIdleAge)
+			d.closed(ic, ErrMaxIdleAge)
+			c.Close()
+		}
+		return
+	}
+	d.m.Lock()
+	ic.heartSent = time.Now()
+	ic.lastHeart = ic.heartSent
+	d.m.Unlock()
+	e := ic.stream.Send(DatagramHeart)
+	d.observe(EventHeart, ic, 0, e)
+	if e == nil {
+		if d.opts.heartTimeout > 0 {
+			c.SetWriteDeadline(time.Time{})
+		}
+		d.schedule(ic)
+		return
+	}
+	d.metrics.heartFailures.Add(1)
+	d.log(logger.LevelWarn, `heart failed`, c, e)
+	d.m.Lock()
+	taken := ic.taken
+	if !taken {
+		d.removeIdle(ic)
+	}
+	d.m.Unlock()
+	if !taken {
+		d.closed(ic, e)
+		c.Close()
+	}
+}
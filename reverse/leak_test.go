@@ -0,0 +1,177 @@
+package reverse_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/powerpuffpenguin/vnet"
+	"github.com/powerpuffpenguin/vnet/reverse"
+)
+
+// checkGoroutines fails if the number of goroutines does not fall back to base.
+func checkGoroutines(t *testing.T, base int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 2)
+	for {
+		n := runtime.NumGoroutine()
+		if n <= base {
+			return
+		} else if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			buf = buf[:runtime.Stack(buf, true)]
+			t.Fatalf("%v goroutines leaked\n%s", n-base, buf)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+// rawPeer accepts one conn, optionally writes b, then keeps it open until the peer closes it.
+func rawPeer(t *testing.T, b []byte) (addr net.Addr, closed <-chan struct{}) {
+	l, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	ch := make(chan struct{})
+	go func() {
+		defer close(ch)
+		c, e := l.Accept()
+		l.Close()
+		if e != nil {
+			return
+		}
+		if len(b) != 0 {
+			c.Write(b)
+		}
+		io.Copy(io.Discard, c)
+		c.Close()
+	}()
+	return l.Addr(), ch
+}
+func waitClosed(t *testing.T, closed <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-closed:
+	case <-time.After(time.Second * 2):
+		t.Fatal("conn not closed")
+	}
+}
+
+func TestDialerHandshakeTimeout(t *testing.T) {
+	base := runtime.NumGoroutine()
+	for _, cancel := range []bool{false, true} {
+		l, e := net.Listen(`tcp`, `127.0.0.1:0`)
+		if e != nil {
+			t.Fatal(e)
+		}
+		dialer := reverse.NewDialer(l, reverse.WithDialerTimeout(time.Millisecond*100))
+		go dialer.Serve()
+		// an agent that never answers syn
+		agent, e := net.Dial(`tcp`, l.Addr().String())
+		if e != nil {
+			t.Fatal(e)
+		}
+
+		ctx, cancelFunc := context.WithCancel(context.Background())
+		if cancel {
+			time.AfterFunc(time.Millisecond*50, cancelFunc)
+		}
+		_, e = dialer.DialContext(ctx, `tcp`, ``)
+		cancelFunc()
+		if cancel && !errors.Is(e, context.Canceled) {
+			t.Fatalf("expect context.Canceled, got %v", e)
+		} else if !cancel && !errors.Is(e, context.DeadlineExceeded) {
+			t.Fatalf("expect context.DeadlineExceeded, got %v", e)
+		}
+		// the dialer closed its end
+		agent.SetReadDeadline(time.Now().Add(time.Second))
+		b, e := io.ReadAll(agent)
+		if e != nil {
+			t.Fatal(e)
+		} else if bytes.Count(b, []byte{0x0d, 0xe1, 1, reverse.DatagramSyn}) != 1 {
+			t.Fatalf("expect one syn, got %v", b)
+		}
+		agent.Close()
+		dialer.Close()
+	}
+	checkGoroutines(t, base)
+}
+
+func TestDialerSlowDrip(t *testing.T) {
+	base := runtime.NumGoroutine()
+	l, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	dialer := reverse.NewDialer(l, reverse.WithDialerHeartTimeout(time.Millisecond*100))
+	go dialer.Serve()
+	// an agent that starts a frame and never finishes it
+	agent, e := net.Dial(`tcp`, l.Addr().String())
+	if e != nil {
+		t.Fatal(e)
+	}
+	_, e = agent.Write([]byte{0x0d})
+	if e != nil {
+		t.Fatal(e)
+	}
+	// the dialer drops the idle conn
+	agent.SetReadDeadline(time.Now().Add(time.Second * 2))
+	_, e = io.ReadAll(agent)
+	if e != nil {
+		t.Fatal(e)
+	}
+	agent.Close()
+	dialer.Close()
+	checkGoroutines(t, base)
+}
+
+func TestListenerHeartTimeout(t *testing.T) {
+	base := runtime.NumGoroutine()
+	// a dialer that never sends heart or syn
+	addr, closed := rawPeer(t, nil)
+	l := reverse.Listen(addr, reverse.WithListenerHeartTimeout(time.Millisecond*100))
+	_, e := l.Accept()
+	if !errors.Is(e, context.DeadlineExceeded) {
+		t.Fatalf("expect context.DeadlineExceeded, got %v", e)
+	}
+	waitClosed(t, closed)
+	l.Close()
+	checkGoroutines(t, base)
+}
+
+func TestListenerSynAckTimeout(t *testing.T) {
+	base := runtime.NumGoroutine()
+	// a dialer that sends syn and never acks
+	addr, closed := rawPeer(t, []byte{0x0d, 0xe1, 1, reverse.DatagramSyn})
+	l := reverse.Listen(addr, reverse.WithListenerSynAckTimeout(time.Millisecond*100))
+	_, e := l.Accept()
+	if !errors.Is(e, context.DeadlineExceeded) {
+		t.Fatalf("expect context.DeadlineExceeded, got %v", e)
+	}
+	waitClosed(t, closed)
+	l.Close()
+	checkGoroutines(t, base)
+}
+
+func TestListenerCloseDuringHandshake(t *testing.T) {
+	base := runtime.NumGoroutine()
+	addr, closed := rawPeer(t, nil)
+	l := reverse.Listen(addr)
+	ch := make(chan error, 1)
+	go func() {
+		_, e := l.Accept()
+		ch <- e
+	}()
+	time.Sleep(time.Millisecond * 50)
+	l.Close()
+	if e := <-ch; !errors.Is(e, vnet.ErrListenerClosed) {
+		t.Fatalf("expect ErrListenerClosed, got %v", e)
+	}
+	waitClosed(t, closed)
+	checkGoroutines(t, base)
+}
@@ -0,0 +1,179 @@
+package reverse_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/powerpuffpenguin/vnet/reverse"
+)
+
+// expectOpen fails if c is closed by the dialer within d.
+func expectOpen(t *testing.T, c net.Conn, d time.Duration) {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(d))
+	var b [64]byte
+	_, e := c.Read(b[:])
+	var ne net.Error
+	if !errors.As(e, &ne) || !ne.Timeout() {
+		t.Fatalf("expect conn open, got %v", e)
+	}
+	c.SetReadDeadline(time.Time{})
+}
+
+// expectClosed fails if c is not closed by the dialer within d, it returns what was read.
+func expectClosed(t *testing.T, c net.Conn, d time.Duration) []byte {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(d))
+	b, e := io.ReadAll(c)
+	if e != nil {
+		t.Fatalf("expect conn closed, got %v", e)
+	}
+	return b
+}
+func dialAll(t *testing.T, addr net.Addr, n int) []net.Conn {
+	conns := make([]net.Conn, n)
+	for i := range conns {
+		c, e := net.Dial(addr.Network(), addr.String())
+		if e != nil {
+			t.Fatal(e)
+		}
+		conns[i] = c
+		// let the dialer count the conns in order
+		time.Sleep(time.Millisecond * 20)
+	}
+	return conns
+}
+func TestMaxIdle(t *testing.T) {
+	l, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	dialer := reverse.NewDialer(l, reverse.WithDialerMaxIdle(2))
+	defer dialer.Close()
+	go dialer.Serve()
+
+	conns := dialAll(t, l.Addr(), 3)
+	expectClosed(t, conns[2], time.Second)
+	expectOpen(t, conns[0], time.Millisecond*50)
+	expectOpen(t, conns[1], time.Millisecond*50)
+
+	// a slot is freed when an idle conn goes away
+	conns[0].Close()
+	time.Sleep(time.Millisecond * 50)
+	c := dialAll(t, l.Addr(), 1)[0]
+	expectOpen(t, c, time.Millisecond*50)
+	c.Close()
+	conns[1].Close()
+}
+func TestMaxIdlePerIP(t *testing.T) {
+	l, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	dialer := reverse.NewDialer(l, reverse.WithDialerMaxIdlePerIP(1))
+	defer dialer.Close()
+	go dialer.Serve()
+
+	conns := dialAll(t, l.Addr(), 2)
+	expectClosed(t, conns[1], time.Second)
+	expectOpen(t, conns[0], time.Millisecond*50)
+
+	// another source IP has its own limit
+	d := net.Dialer{
+		LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2)},
+	}
+	other, e := d.Dial(`tcp`, l.Addr().String())
+	if e != nil {
+		t.Log("skip other source IP:", e)
+	} else {
+		expectOpen(t, other, time.Millisecond*50)
+		other.Close()
+	}
+	conns[0].Close()
+}
+func TestNoiseMaxIdlePerIP(t *testing.T) {
+	l, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	dialer := reverse.NewDialer(l,
+		reverse.WithDialerNoise(noiseKey(t)),
+		reverse.WithDialerMaxIdlePerIP(2),
+	)
+	defer dialer.Close()
+	go dialer.Serve()
+
+	// raw conns never finish the handshake, they hold their slot meanwhile
+	conns := dialAll(t, l.Addr(), 4)
+	expectClosed(t, conns[2], time.Millisecond*200)
+	expectClosed(t, conns[3], time.Millisecond*200)
+	expectOpen(t, conns[0], time.Millisecond*50)
+	expectOpen(t, conns[1], time.Millisecond*50)
+
+	// a failed handshake gives its slot back
+	conns[0].Close()
+	time.Sleep(time.Millisecond * 50)
+	c := dialAll(t, l.Addr(), 1)[0]
+	expectOpen(t, c, time.Millisecond*50)
+	c.Close()
+	conns[1].Close()
+}
+func TestMaxIdleAge(t *testing.T) {
+	l, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	dialer := reverse.NewDialer(l,
+		reverse.WithDialerHeart(0),
+		reverse.WithDialerMaxIdleAge(time.Millisecond*100),
+	)
+	defer dialer.Close()
+	go dialer.Serve()
+
+	// a raw conn is told goodbye and closed
+	c := dialAll(t, l.Addr(), 1)[0]
+	b := expectClosed(t, c, time.Second)
+	if !bytes.Equal(b, []byte{0x0d, 0xe1, 2, reverse.DatagramFin, 0, 0}) {
+		t.Fatalf("expect fin, got %v", b)
+	}
+	c.Close()
+
+	// an agent reconnects and can still be dialed
+	listener := reverse.Listen(l.Addr())
+	defer listener.Close()
+	go func() {
+		for {
+			c, e := listener.Accept()
+			if e != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	time.Sleep(time.Millisecond * 300)
+	c, e = dialer.Dial(`tcp`, ``)
+	if e != nil {
+		t.Fatal(e)
+	}
+	c.Close()
+}
+func TestAcceptFilter(t *testing.T) {
+	l, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	dialer := reverse.NewDialer(l, reverse.WithDialerAcceptFilter(func(c net.Conn) bool {
+		// reject every conn
+		return false
+	}))
+	defer dialer.Close()
+	go dialer.Serve()
+
+	c := dialAll(t, l.Addr(), 1)[0]
+	expectClosed(t, c, time.Second)
+	c.Close()
+}
@@ -0,0 +1,328 @@
+package reverse
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/powerpuffpenguin/vnet/ratelimit"
+)
+
+// ErrQuotaExceeded is returned by dials once the transfer quota of the Dialer,
+// or of every agent they could pick, is used up, and by the Read and Write of conns that used up their quota.
+var ErrQuotaExceeded = errors.New(`transfer quota exceeded`)
+
+// Limits are the bandwidth limits and transfer quotas of the conns returned by the dials of a Dialer.
+// They may be changed at any time, conns already dialed follow the new limits.
+//
+// Ingress is the traffic read from agents, egress the traffic written to them,
+// both counted before compression and encryption.
+// Agents are identified as in the admin handler, by their hex public key when tunnels are secured, by IP otherwise.
+// Dials forwarded to another node of the cluster are only limited per conn and globally.
+type Limits struct {
+	m sync.Mutex
+
+	ingress, egress         *ratelimit.Bucket
+	connIngress, connEgress ratelimit.Limit
+	quota, used             uint64
+
+	agents  map[string]*agentLimits
+	dialers map[*Dialer]struct{}
+}
+type agentLimits struct {
+	ingress, egress *ratelimit.Bucket
+	quota, used     uint64
+}
+
+// NewLimits returns limits that limit nothing.
+func NewLimits() *Limits {
+	return &Limits{
+		ingress: ratelimit.NewBucket(ratelimit.Limit{}),
+		egress:  ratelimit.NewBucket(ratelimit.Limit{}),
+		agents:  make(map[string]*agentLimits),
+		dialers: make(map[*Dialer]struct{}),
+	}
+}
+
+// SetGlobal limits the traffic of all the conns together.
+func (l *Limits) SetGlobal(ingress, egress ratelimit.Limit) {
+	l.ingress.SetLimit(ingress)
+	l.egress.SetLimit(egress)
+}
+
+// SetConn limits the traffic of each conn dialed from now on, Conn.SetRateLimit changes the limits of one conn.
+func (l *Limits) SetConn(ingress, egress ratelimit.Limit) {
+	l.m.Lock()
+	l.connIngress = ingress
+	l.connEgress = egress
+	l.m.Unlock()
+}
+
+// SetAgent limits the traffic of all the conns of agent together.
+func (l *Limits) SetAgent(agent string, ingress, egress ratelimit.Limit) {
+	l.m.Lock()
+	a := l.agent(agent)
+	a.ingress.SetLimit(ingress)
+	a.egress.SetLimit(egress)
+	l.m.Unlock()
+}
+
+// SetQuota sets how many bytes all the conns may transfer in total before dials fail with ErrQuotaExceeded,
+// 0 removes the quota. Conns already dialed are closed once the quota is used up, their Read and Write return ErrQuotaExceeded.
+func (l *Limits) SetQuota(bytes uint64) {
+	l.m.Lock()
+	l.quota = bytes
+	l.m.Unlock()
+	l.changed()
+}
+
+// SetAgentQuota sets how many bytes the conns of agent may transfer in total before it is no longer picked by dials,
+// 0 removes the quota. Conns of agent already dialed are closed once the quota is used up, as with SetQuota.
+func (l *Limits) SetAgentQuota(agent string, bytes uint64) {
+	l.m.Lock()
+	l.agent(agent).quota = bytes
+	l.m.Unlock()
+	l.changed()
+}
+
+// Used returns the bytes transferred by all the conns since the limits were created or last reset.
+func (l *Limits) Used() uint64 {
+	l.m.Lock()
+	used := l.used
+	l.m.Unlock()
+	return used
+}
+
+// AgentUsed returns the bytes transferred by the conns of agent since its limits or quota were set or its usage reset.
+// The traffic of agents without limits nor quota is not counted.
+func (l *Limits) AgentUsed(agent string) (used uint64) {
+	l.m.Lock()
+	if a, ok := l.agents[agent]; ok {
+		used = a.used
+	}
+	l.m.Unlock()
+	return
+}
+
+// ResetUsed restarts counting the bytes transferred by all the conns from 0.
+func (l *Limits) ResetUsed() {
+	l.m.Lock()
+	l.used = 0
+	l.m.Unlock()
+	l.changed()
+}
+
+// ResetAgentUsed restarts counting the bytes transferred by the conns of agent from 0.
+func (l *Limits) ResetAgentUsed(agent string) {
+	l.m.Lock()
+	if a, ok := l.agents[agent]; ok {
+		a.used = 0
+	}
+	l.m.Unlock()
+	l.changed()
+}
+
+// RemoveAgent removes the limits and the quota of agent.
+func (l *Limits) RemoveAgent(agent string) {
+	l.m.Lock()
+	a, ok := l.agents[agent]
+	if ok {
+		delete(l.agents, agent)
+	}
+	l.m.Unlock()
+	if ok {
+		// conns still holding the buckets must not be limited anymore
+		a.ingress.SetLimit(ratelimit.Limit{})
+		a.egress.SetLimit(ratelimit.Limit{})
+		l.changed()
+	}
+}
+
+// agent returns the limits of agent, creating unlimited ones if needed, l.m must be held.
+func (l *Limits) agent(agent string) *agentLimits {
+	a, ok := l.agents[agent]
+	if !ok {
+		a = &agentLimits{
+			ingress: ratelimit.NewBucket(ratelimit.Limit{}),
+			egress:  ratelimit.NewBucket(ratelimit.Limit{}),
+		}
+		l.agents[agent] = a
+	}
+	return a
+}
+
+// exhausted reports whether the global quota is used up.
+func (l *Limits) exhausted() bool {
+	l.m.Lock()
+	exhausted := l.quota != 0 && l.used >= l.quota
+	l.m.Unlock()
+	return exhausted
+}
+
+// agentExhausted reports whether the quota of agent is used up.
+func (l *Limits) agentExhausted(agent string) (exhausted bool) {
+	l.m.Lock()
+	if a, ok := l.agents[agent]; ok {
+		exhausted = a.quota != 0 && a.used >= a.quota
+	}
+	l.m.Unlock()
+	return
+}
+
+// watch lets the idle conns of d be picked again when a quota is raised or reset.
+func (l *Limits) watch(d *Dialer) {
+	l.m.Lock()
+	l.dialers[d] = struct{}{}
+	l.m.Unlock()
+}
+func (l *Limits) unwatch(d *Dialer) {
+	l.m.Lock()
+	delete(l.dialers, d)
+	l.m.Unlock()
+}
+
+// changed offers the idle conns of the watching dialers to their waiting dials again.
+func (l *Limits) changed() {
+	l.m.Lock()
+	dialers := make([]*Dialer, 0, len(l.dialers))
+	for d := range l.dialers {
+		dialers = append(dialers, d)
+	}
+	l.m.Unlock()
+	for _, d := range dialers {
+		d.rematch()
+	}
+}
+
+// connLimiter shapes the traffic of one conn.
+type connLimiter struct {
+	limits          *Limits
+	agent           string
+	ingress, egress *ratelimit.Bucket
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (l *Limits) newConnLimiter(agent string) *connLimiter {
+	l.m.Lock()
+	ingress, egress := l.connIngress, l.connEgress
+	l.m.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	return &connLimiter{
+		limits:  l,
+		agent:   agent,
+		ingress: ratelimit.NewBucket(ingress),
+		egress:  ratelimit.NewBucket(egress),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+// buckets returns the buckets the traffic goes through, nil for the agent if it has no limits.
+func (cl *connLimiter) buckets(egress bool) (conn, agent, global *ratelimit.Bucket) {
+	l := cl.limits
+	var a *agentLimits
+	if cl.agent != `` {
+		l.m.Lock()
+		a = l.agents[cl.agent]
+		l.m.Unlock()
+	}
+	if egress {
+		conn, global = cl.egress, l.egress
+		if a != nil {
+			agent = a.egress
+		}
+	} else {
+		conn, global = cl.ingress, l.ingress
+		if a != nil {
+			agent = a.ingress
+		}
+	}
+	return
+}
+
+// chunk returns the most bytes to move at once, at most n, 0 once a quota is used up.
+func (cl *connLimiter) chunk(n int, egress bool) int {
+	conn, agent, global := cl.buckets(egress)
+	n = ratelimit.Chunk(n, conn, agent, global)
+	if remaining, ok := cl.remaining(); ok && uint64(n) > remaining {
+		n = int(remaining)
+	}
+	return n
+}
+
+// remaining returns the bytes the quotas still allow, ok is false if no quota applies.
+// Conns moving bytes at the same time may go past the quotas by the bytes in flight.
+func (cl *connLimiter) remaining() (remaining uint64, ok bool) {
+	l := cl.limits
+	l.m.Lock()
+	defer l.m.Unlock()
+	left := func(quota, used uint64) {
+		var r uint64
+		if used < quota {
+			r = quota - used
+		}
+		if !ok || r < remaining {
+			remaining = r
+			ok = true
+		}
+	}
+	if l.quota != 0 {
+		left(l.quota, l.used)
+	}
+	if a, found := l.agents[cl.agent]; found && cl.agent != `` && a.quota != 0 {
+		left(a.quota, a.used)
+	}
+	return
+}
+
+// count adds n bytes to the usage of the quotas.
+func (cl *connLimiter) count(n int) {
+	l := cl.limits
+	l.m.Lock()
+	l.used += uint64(n)
+	if a, ok := l.agents[cl.agent]; ok && cl.agent != `` {
+		a.used += uint64(n)
+	}
+	l.m.Unlock()
+}
+
+// wait waits until n bytes may be moved, it returns net.ErrClosed if the conn is closed meanwhile
+// and os.ErrDeadlineExceeded if deadline, unless zero, passes first.
+func (cl *connLimiter) wait(n int, egress bool, deadline time.Time) (e error) {
+	ctx := cl.ctx
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	conn, agent, global := cl.buckets(egress)
+	e = ratelimit.Wait(ctx, n, conn, agent, global)
+	if e == context.DeadlineExceeded {
+		e = os.ErrDeadlineExceeded
+	} else if e != nil {
+		e = net.ErrClosed
+	}
+	return
+}
+
+// SetRateLimit changes the bandwidth limits of the conn alone, Limits.SetConn sets those of the conns dialed later.
+func (c *Conn) SetRateLimit(ingress, egress ratelimit.Limit) {
+	if c.limiter != nil {
+		c.limiter.ingress.SetLimit(ingress)
+		c.limiter.egress.SetLimit(egress)
+	}
+}
+
+// RateLimit returns the bandwidth limits of the conn alone.
+func (c *Conn) RateLimit() (ingress, egress ratelimit.Limit) {
+	if c.limiter != nil {
+		ingress = c.limiter.ingress.Limit()
+		egress = c.limiter.egress.Limit()
+	}
+	return
+}
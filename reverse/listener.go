@@ -8,21 +8,56 @@ import (
 	"time"
 
 	"github.com/powerpuffpenguin/vnet"
+	"github.com/powerpuffpenguin/vnet/errs"
+	"github.com/powerpuffpenguin/vnet/logger"
+	"github.com/powerpuffpenguin/vnet/noise"
+	"github.com/powerpuffpenguin/vnet/reverse/codec"
 )
 
-type dialResult struct {
-	c net.Conn
-	e error
+// maxRedirectFailures is how many failures in a row at a redirected address send the listener back to its own address.
+const maxRedirectFailures = 3
+
+// redirectError is returned by the handshake when the dialer asks the agent to reconnect to addr.
+type redirectError struct {
+	addr net.Addr
+}
+
+func (e *redirectError) Error() string {
+	return `redirect to ` + e.addr.Network() + `://` + e.addr.String()
+}
+
+// listenerIdle is a conn waiting for syn, its fields are guarded by Listener.m.
+type listenerIdle struct {
+	stream *datagramStream
+	// id identifies the conn in the admin handler
+	id        uint64
+	since     time.Time
+	lastHeart time.Time
+	// evicted is set when the admin handler closes the conn, the listener then reconnects
+	evicted bool
 }
+
 type Listener struct {
 	opts listenerOptions
 	addr net.Addr
+	// origin is the address the listener was created with,
+	// redirectFailures counts the failures in a row since the listener was redirected away from it
+	origin           net.Addr
+	redirectFailures int
 
-	ch    chan dialResult
 	close <-chan struct{}
 	done  uint32
 	m     sync.Mutex
 
+	// idle conns waiting for syn
+	idle map[net.Conn]*listenerIdle
+	// seq numbers the idle conns for the admin handler
+	seq uint64
+	// accepting is the number of Accept calls in progress
+	accepting atomic.Int32
+
+	metrics *listenerMetrics
+
 	ctx    context.Context
 	cancel context.CancelFunc
 }
@@ -34,11 +69,15 @@ func Listen(addr net.Addr, opt ...ListenerOption) *Listener {
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 	return &Listener{
-		opts: opts,
-		addr: addr,
+		opts:   opts,
+		addr:   addr,
+		origin: addr,
+
+		close: ctx.Done(),
+		idle:  make(map[net.Conn]*listenerIdle),
+
+		metrics: newListenerMetrics(opts.metrics),
 
-		ch:     make(chan dialResult),
-		close:  ctx.Done(),
 		ctx:    ctx,
 		cancel: cancel,
 	}
@@ -46,22 +85,38 @@ func Listen(addr net.Addr, opt ...ListenerOption) *Listener {
 
 // Accept waits for and returns the next connection to the listener.
 func (l *Listener) Accept() (c net.Conn, e error) {
+	return l.AcceptContext(context.Background())
+}
+
+// AcceptContext waits for and returns the next connection to the listener,
+// or returns an error matching ctx.Err() if ctx is done first.
+// An idle conn given up this way says goodbye, so the dialer picks another agent.
+func (l *Listener) AcceptContext(ctx context.Context) (c net.Conn, e error) {
 	// check closed
 	if atomic.LoadUint32(&l.done) != 0 {
-		e = vnet.ErrListenerClosed
+		e = errs.NewOpError(`accept`, errs.SideListener, l.Addr(), vnet.ErrListenerClosed)
 		return
 	}
+	l.accepting.Add(1)
+	defer l.accepting.Add(-1)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-l.close:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
 
-	// dial
-	go l.asyncDial()
-
-	// wait result
-	select {
-	case result := <-l.ch:
-		c = result.c
-		e = result.e
-	case <-l.close:
-		e = vnet.ErrListenerClosed
+	c, e = l.dial(ctx)
+	if e != nil {
+		select {
+		case <-l.close:
+			e = vnet.ErrListenerClosed
+		default:
+		}
+		e = errs.NewOpError(`accept`, errs.SideListener, l.Addr(), e)
 	}
 	return
 }
@@ -73,7 +128,9 @@ func (l *Listener) Close() (e error) {
 		l.m.Lock()
 		defer l.m.Unlock()
 		if l.done == 0 {
-			defer atomic.StoreUint32(&l.done, 1)
+			atomic.StoreUint32(&l.done, 1)
+			// interrupt the accepts first so no idle conn is handed off after goodbye,
+			// each of them then says goodbye so the dialer stops using its idle conn at once
 			l.cancel()
 			return
 		}
@@ -83,156 +140,396 @@ func (l *Listener) Close() (e error) {
 }
 
 // Addr returns the listener's network address.
+// It changes when the dialer redirects the listener to another address.
 func (l *Listener) Addr() net.Addr {
-	return l.addr
+	l.m.Lock()
+	addr := l.addr
+	l.m.Unlock()
+	return addr
 }
-func (l *Listener) asyncDial() {
-	c, e := l.dial()
-	select {
-	case <-l.close:
-		if e == nil {
+func (l *Listener) dial(ctx context.Context) (c net.Conn, e error) {
+	var old net.Conn
+	for {
+		addr := l.Addr()
+		c, e = l.connect(ctx, addr)
+		if old != nil {
+			// the agent has re-established elsewhere, let the old dialer close its idle conn
+			old.Close()
+			old = nil
+		}
+		if e != nil {
+			if ctx.Err() == nil {
+				l.reached(addr, false)
+			}
+			return
+		} else if !l.opts.synAck {
+			l.reached(addr, true)
+			l.observe(EventHandoff, c, 0, nil)
+			c = l.handoff(c)
+			return
+		}
+
+		var compress bool
+		compress, e = l.synAck(ctx, c)
+		if e == nil && compress {
+			var cc *vnet.CompressConn
+			cc, e = vnet.Compress(c, l.opts.compressLevel, l.opts.compressDelay)
+			if e == nil {
+				c = cc
+			}
+		}
+		if e != nil {
+			l.observe(EventClose, c, 0, e)
+			if redirect, ok := e.(*redirectError); ok {
+				l.reached(addr, true)
+				if !l.followRedirect(c, redirect.addr) {
+					l.log(logger.LevelWarn, `redirect refused`, c, e)
+					c.Close()
+					c = nil
+					e = ErrRedirectRefused
+					return
+				}
+				l.log(logger.LevelInfo, `redirected`, c, e)
+				l.m.Lock()
+				l.addr = redirect.addr
+				l.redirectFailures = 0
+				l.m.Unlock()
+				old = c
+				c = nil
+				continue
+			} else if e == errFin || e == ErrEvicted {
+				l.reached(addr, true)
+				// the dialer said goodbye or the conn was evicted, reconnect at once if still running
+				l.log(logger.LevelInfo, `idle conn closed`, c, e)
+				c.Close()
+				c = nil
+				select {
+				case <-ctx.Done():
+					e = ctx.Err()
+					return
+				default:
+				}
+				continue
+			}
+			if ctx.Err() == nil {
+				l.reached(addr, false)
+			}
 			c.Close()
+			c = nil
+		} else {
+			l.reached(addr, true)
+			l.observe(EventHandoff, c, 0, nil)
+			c = l.handoff(c)
 		}
-	case l.ch <- dialResult{
-		c: c,
-		e: e,
-	}:
+		return
+	}
+}
+
+// followRedirect reports whether the listener may be redirected to addr by the dialer at the other end of c.
+// Without WithListenerRedirect only dialers whose key was authorized, by the noise.WithPeerKeys or noise.WithAuthorize
+// options of WithListenerNoise, may redirect it.
+func (l *Listener) followRedirect(c net.Conn, addr net.Addr) bool {
+	if l.opts.redirect != nil {
+		return l.opts.redirect(addr)
+	}
+	nc, ok := c.(*noise.Conn)
+	return ok && nc.Authenticated()
+}
+
+// reached records whether a dialer was reached at addr. After maxRedirectFailures failures in a row
+// at an address the listener was redirected to, it goes back to the address it was created with.
+func (l *Listener) reached(addr net.Addr, ok bool) {
+	l.m.Lock()
+	if l.addr != addr || addr == l.origin {
+		// redirected meanwhile, or not redirected
+		l.m.Unlock()
+		return
+	} else if ok {
+		l.redirectFailures = 0
+		l.m.Unlock()
+		return
+	}
+	l.redirectFailures++
+	fallback := l.redirectFailures >= maxRedirectFailures
+	if fallback {
+		l.redirectFailures = 0
+		l.addr = l.origin
+	}
+	l.m.Unlock()
+	if fallback {
+		l.log(logger.LevelWarn, `redirect target unreachable, back to origin`, nil, nil, `addr`, addr, `origin`, l.origin)
+	}
+}
+
+// handoff wraps c to count it if metrics are published.
+func (l *Listener) handoff(c net.Conn) net.Conn {
+	if l.metrics.conns == nil {
+		return c
 	}
+	return l.metrics.conns.Wrap(c)
 }
-func (l *Listener) dial() (c net.Conn, e error) {
+func (l *Listener) connect(ctx context.Context, addr net.Addr) (c net.Conn, e error) {
 	opts := &l.opts
 	if opts.dialContext != nil {
-		c, e = opts.dialContext(l.ctx, l.addr.Network(), l.Addr().String())
-		if e != nil {
-			return
-		}
+		c, e = opts.dialContext(ctx, addr.Network(), addr.String())
 	} else if opts.dial != nil {
-		c, e = opts.dial(l.addr.Network(), l.Addr().String())
+		c, e = opts.dial(addr.Network(), addr.String())
 		if e != nil {
 			return
 		}
 		select {
-		case <-l.close:
+		case <-ctx.Done():
 			c.Close()
-			e = vnet.ErrListenerClosed
+			e = ctx.Err()
 		default:
 		}
 	} else {
 		// default dial tcp
 		var d net.Dialer
-		c, e = d.DialContext(l.ctx, l.addr.Network(), l.Addr().String())
-		if e != nil {
-			return
+		c, e = d.DialContext(ctx, addr.Network(), addr.String())
+	}
+	if e != nil {
+		if ctx.Err() == nil {
+			l.metrics.acceptErrors.Add(1)
+			l.log(logger.LevelWarn, `connect failed`, nil, e, `addr`, addr)
 		}
+		return
 	}
-
-	if opts.synAck {
-		ch := make(chan error, 1)
-		go l.asyncSynAck(ch, c)
-		select {
-		case e = <-ch:
-			if e != nil {
-				c.Close()
-				c = nil
+	l.observe(EventAccept, c, 0, nil)
+	if opts.noiseKey != nil {
+		raw := c
+		c, e = l.secure(ctx, c)
+		if e != nil {
+			l.metrics.acceptErrors.Add(1)
+			if ctx.Err() == nil {
+				l.log(logLevel(e, logger.LevelWarn), `noise handshake failed`, raw, e)
 			}
-		case <-l.close:
-			e = vnet.ErrListenerClosed
-			c.Close()
-			c = nil
+			l.observe(EventClose, raw, 0, e)
 		}
 	}
 	return
 }
 
-func (l *Listener) asyncSynAck(ch chan<- error, c net.Conn) {
+// secure runs the Noise handshake on a new conn, bounded by the heart timeout.
+func (l *Listener) secure(ctx context.Context, c net.Conn) (sc net.Conn, e error) {
+	c.SetDeadline(handshakeDeadline(ctx, l.opts.heartTimeout))
+	stop := watch(ctx, nil, nil, c)
+	nc := noise.Client(c, l.opts.noiseKey, l.opts.noiseOpts...)
+	e = nc.Handshake()
+	if err := stop(); err != nil {
+		e = err
+	} else if e != nil {
+		e = timeoutError(e)
+	}
+	if e != nil {
+		c.Close()
+		return
+	}
+	c.SetDeadline(time.Time{})
+	sc = nc
+	return
+}
+
+// synAck runs the agent side of the handshake on c.
+// Every step is bounded by a deadline on c, and ctx interrupts it.
+func (l *Listener) synAck(ctx context.Context, c net.Conn) (compress bool, e error) {
+	stop := watch(ctx, nil, nil, c)
+	compress, e = l.exchangeSynAck(ctx, c)
+	if err := stop(); err != nil {
+		// interrupted by ctx or Close, the watch is over so the deadline can be moved again
+		e = err
+		c.SetWriteDeadline(time.Now().Add(finTimeout))
+		(&datagramStream{rw: c}).Send(DatagramFin)
+	} else if e != nil {
+		e = timeoutError(e)
+	} else {
+		c.SetDeadline(time.Time{})
+	}
+	return
+}
+func (l *Listener) exchangeSynAck(ctx context.Context, c net.Conn) (compress bool, e error) {
 	opts := &l.opts
 	stream := &datagramStream{
 		rw: c,
 	}
-	buffer := make(chan error, 1)
+	// send hello
+	if opts.hello {
+		var payload []byte
+		payload, e = codec.EncodeLabels(opts.labels)
+		if e != nil {
+			return
+		}
+		e = l.setDeadline(ctx, c, opts.heartTimeout)
+		if e != nil {
+			return
+		}
+		e = stream.SendPayload(DatagramHello, payload)
+		if e != nil {
+			return
+		}
+	}
 	// recv syn
-	e := l.recvSyn(buffer, stream, opts.heartTimeout)
+	idle := l.addIdle(stream)
+	if idle == nil {
+		e = vnet.ErrListenerClosed
+		return
+	}
+	l.metrics.idle.Add(1)
+	l.observe(EventIdle, c, 0, nil)
+	e = l.recvSyn(ctx, idle, opts.heartTimeout)
+	if l.removeIdle(idle) {
+		e = ErrEvicted
+	}
+	l.metrics.idle.Add(-1)
 	if e != nil {
-		ch <- e
 		return
 	}
 	// send syn+ack
 	// recv ack
-	ch <- l.sendSynAck(buffer, stream, opts.synAckTimeout)
+	start := time.Now()
+	l.observe(EventHandshakeStart, c, 0, nil)
+	compress, e = l.sendSynAck(ctx, stream, opts.synAckTimeout)
+	if e != nil && ctx.Err() == nil {
+		l.log(logLevel(e, logger.LevelWarn), `handshake failed`, c, e)
+	}
+	observeHandshake(l.metrics.handshake, l.metrics.handshakeFailures, start, e)
+	l.observe(EventHandshakeEnd, c, time.Since(start), e)
+	return
 }
-func (l *Listener) sendSynAck(ch chan error, stream *datagramStream, timeout time.Duration) (e error) {
-	var t *time.Timer
-	var deadline <-chan time.Time
+
+// setDeadline moves the deadline of c timeout from now, or clears it if timeout < 1.
+// It reports if the accept was canceled meanwhile, so a deadline set by watch is never overridden unnoticed.
+func (l *Listener) setDeadline(ctx context.Context, c net.Conn, timeout time.Duration) error {
 	if timeout > 0 {
-		t = time.NewTimer(timeout)
-		deadline = t.C
+		c.SetDeadline(time.Now().Add(timeout))
+	} else {
+		c.SetDeadline(time.Time{})
 	}
-	go func() {
-		var err error
-		err = stream.Send(DatagramSynAck)
-		if err == nil {
-			err = stream.Recv(DatagramAck)
-			if err == nil {
-				close(ch)
-				return
-			}
-		}
-		ch <- err
-	}()
 	select {
-	case <-deadline:
-		e = context.DeadlineExceeded
-		return
-	case e = <-ch:
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+		return nil
+	}
+}
+
+// addIdle registers stream as waiting for syn, it returns nil if the listener is closed.
+func (l *Listener) addIdle(stream *datagramStream) *listenerIdle {
+	l.m.Lock()
+	defer l.m.Unlock()
+	if l.done != 0 {
+		return nil
+	}
+	l.seq++
+	idle := &listenerIdle{
+		stream: stream,
+		id:     l.seq,
+		since:  time.Now(),
 	}
-	if t != nil && !t.Stop() {
-		<-t.C
+	l.idle[stream.rw] = idle
+	return idle
+}
+
+func (l *Listener) evicted(idle *listenerIdle) bool {
+	l.m.Lock()
+	evicted := idle.evicted
+	l.m.Unlock()
+	return evicted
+}
+
+// removeIdle forgets idle, it reports whether the conn was evicted.
+func (l *Listener) removeIdle(idle *listenerIdle) (evicted bool) {
+	l.m.Lock()
+	if l.done == 0 {
+		delete(l.idle, idle.stream.rw)
 	}
+	evicted = idle.evicted
+	l.m.Unlock()
 	return
 }
-func (l *Listener) recvSyn(ch chan error, stream *datagramStream, timeout time.Duration) (e error) {
-	var t *time.Timer
-	var deadline <-chan time.Time
-	var heart chan bool
-	if timeout > 0 {
-		t = time.NewTimer(timeout)
-		deadline = t.C
-		heart = make(chan bool, 1)
+func (l *Listener) sendSynAck(ctx context.Context, stream *datagramStream, timeout time.Duration) (compress bool, e error) {
+	e = l.setDeadline(ctx, stream.rw, timeout)
+	if e != nil {
+		return
 	}
-	go func() {
-		var err error
-		for {
-			err = stream.Recv(DatagramHeart, DatagramSyn)
-			if err != nil {
-				break
-			} else if stream.Event() == DatagramSyn {
-				break
-			} else if heart != nil {
-				select {
-				case heart <- true:
-				default:
-				}
+	if l.opts.compress {
+		// offer compression, the dialer picks it in ack
+		e = stream.SendPayload(DatagramSynAck, []byte{codec.CompressFlate})
+	} else {
+		e = stream.Send(DatagramSynAck)
+	}
+	if e != nil {
+		return
+	}
+	e = stream.Recv(DatagramAck)
+	if e != nil {
+		return
+	}
+	switch payload := stream.Payload(); len(payload) {
+	case 0:
+	case 1:
+		if !l.opts.compress || payload[0] != codec.CompressFlate {
+			e = protocolError(2, DatagramAck, `unexpected compression method=%v`, payload[0])
+		}
+		compress = e == nil
+	default:
+		e = protocolError(2, DatagramAck, `invalid ack payload len=%v`, len(payload))
+	}
+	return
+}
+
+// recvSyn waits for syn, each heart moves the deadline timeout from now.
+func (l *Listener) recvSyn(ctx context.Context, idle *listenerIdle, timeout time.Duration) (e error) {
+	stream := idle.stream
+	for {
+		e = l.setDeadline(ctx, stream.rw, timeout)
+		if e != nil {
+			return
+		}
+		// evict interrupts reads once the flag is set, check it after the deadline has moved
+		if l.evicted(idle) {
+			e = ErrEvicted
+			return
+		}
+		e = stream.Recv(DatagramHeart, DatagramSyn, DatagramRedirect, DatagramFin)
+		if e != nil {
+			if ctx.Err() != nil || l.evicted(idle) {
+				return
+			} else if ne, ok := e.(net.Error); ok && ne.Timeout() {
+				// no heart within the heart timeout
+				l.metrics.heartFailures.Add(1)
+				l.log(logger.LevelWarn, `heart timeout`, stream.rw, e, `timeout`, timeout)
+			} else {
+				l.log(logLevel(e, logger.LevelInfo), `idle conn closed`, stream.rw, e)
 			}
+			return
 		}
-		ch <- err
-	}()
-	work := true
-	for work {
-		select {
-		case <-deadline:
-			e = context.DeadlineExceeded
+		switch stream.Event() {
+		case DatagramSyn:
+			return
+		case DatagramFin:
+			e = errFin
 			return
-		case e = <-ch:
-			work = false
-		case <-heart:
-			if !t.Stop() {
-				<-t.C
+		case DatagramRedirect:
+			var addr *Addr
+			addr, e = decodeAddr(stream.Payload())
+			if e == nil {
+				e = &redirectError{addr: addr}
+			}
+			return
+		}
+		l.m.Lock()
+		idle.lastHeart = time.Now()
+		l.m.Unlock()
+		l.observe(EventHeart, stream.rw, 0, nil)
+		if l.opts.load != nil {
+			// answer the heart with the current load
+			e = stream.SendPayload(DatagramLoad, codec.EncodeLoad(l.opts.load()))
+			if e != nil {
+				l.metrics.heartFailures.Add(1)
+				l.log(logger.LevelWarn, `heart failed`, stream.rw, e)
+				return
 			}
-			t.Reset(timeout)
 		}
 	}
-	if t != nil && !t.Stop() {
-		<-t.C
-	}
-	return
 }
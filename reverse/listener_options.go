@@ -2,8 +2,13 @@ package reverse
 
 import (
 	"context"
+	"crypto/ecdh"
 	"net"
 	"time"
+
+	"github.com/powerpuffpenguin/vnet/logger"
+	"github.com/powerpuffpenguin/vnet/metrics"
+	"github.com/powerpuffpenguin/vnet/noise"
 )
 
 var defaultListenerOptions = listenerOptions{
@@ -12,6 +17,9 @@ var defaultListenerOptions = listenerOptions{
 	synAck:        true,
 	synAckTimeout: time.Second * 75,
 	heartTimeout:  time.Second * 75,
+
+	metrics: metrics.Discard,
+	logger:  logger.Discard,
 }
 
 type listenerOptions struct {
@@ -20,6 +28,23 @@ type listenerOptions struct {
 	synAck        bool
 	synAckTimeout time.Duration
 	heartTimeout  time.Duration
+
+	// hello is set when labels or load are configured, the agent then speaks version 2
+	hello  bool
+	labels map[string]string
+	load   func() (load, capacity uint32)
+
+	noiseKey  *ecdh.PrivateKey
+	noiseOpts []noise.Option
+	redirect  func(addr net.Addr) bool
+
+	compress      bool
+	compressLevel int
+	compressDelay time.Duration
+
+	observers observers
+	metrics   metrics.Registry
+	logger    logger.Logger
 }
 
 type ListenerOption interface {
@@ -62,3 +87,83 @@ func WithListenerHeartTimeout(d time.Duration) ListenerOption {
 		o.heartTimeout = d
 	})
 }
+
+// WithListenerLabels sets the labels the agent advertises when it connects, so the dialer can select it.
+// It requires a dialer that speaks version 2 of the protocol.
+func WithListenerLabels(labels map[string]string) ListenerOption {
+	return newListenerOption(func(o *listenerOptions) {
+		o.labels = labels
+		o.hello = len(labels) != 0 || o.load != nil
+	})
+}
+
+// WithListenerLoad sets the function reporting the agent's current load and capacity in each heartbeat.
+// It requires a dialer that speaks version 2 of the protocol.
+func WithListenerLoad(f func() (load, capacity uint32)) ListenerOption {
+	return newListenerOption(func(o *listenerOptions) {
+		o.load = f
+		o.hello = len(o.labels) != 0 || f != nil
+	})
+}
+
+// WithListenerNoise secures every conn with the Noise protocol keyed by the agent's static key.
+// The dialer must be configured with WithDialerNoise, opt restricts the accepted dialer keys;
+// without noise.WithPeerKeys or noise.WithAuthorize the conns are encrypted but the dialer is not authenticated.
+// The conns returned by Accept are *noise.Conn, their PeerKey is the dialer's static key.
+func WithListenerNoise(key *ecdh.PrivateKey, opt ...noise.Option) ListenerOption {
+	return newListenerOption(func(o *listenerOptions) {
+		o.noiseKey = key
+		o.noiseOpts = opt
+	})
+}
+
+// WithListenerRedirect sets the function deciding whether to follow a dialer that asks to reconnect to addr,
+// as Dialer.Drain does. Without it redirects are only followed from dialers authenticated by WithListenerNoise
+// with noise.WithPeerKeys or noise.WithAuthorize, Noise without them only encrypts and any dialer key is accepted.
+// Refused redirects make Accept return ErrRedirectRefused.
+// A listener failing to reach a dialer 3 times in a row at a redirected address goes back to the address it was created with.
+func WithListenerRedirect(f func(addr net.Addr) bool) ListenerOption {
+	return newListenerOption(func(o *listenerOptions) {
+		o.redirect = f
+	})
+}
+
+// WithListenerCompress offers flate compression at level in the handshake, see vnet.Compress.
+// Conns are compressed if the dialer is configured with WithDialerCompress, Accept then returns *vnet.CompressConn.
+// A version 1 dialer can't read the offer, don't enable it with such dialers.
+func WithListenerCompress(level int, delay time.Duration) ListenerOption {
+	return newListenerOption(func(o *listenerOptions) {
+		o.compress = true
+		o.compressLevel = level
+		o.compressDelay = delay
+	})
+}
+
+// WithListenerObserver adds an observer of the life of the conns to the dialer, it can be set several times.
+func WithListenerObserver(observer Observer) ListenerOption {
+	return newListenerOption(func(o *listenerOptions) {
+		o.observers = append(o.observers, observer)
+	})
+}
+
+// WithListenerMetrics publishes the metrics of the Listener in r, with names starting with vnet_reverse_listener_:
+// idle_conns, handshake_seconds, handshake_failures_total, heart_failures_total,
+// accept_errors_total, active_conns, bytes_read_total and bytes_written_total.
+// Accepted conns are then *metrics.Conn, Unwrap returns the conn they would have been.
+func WithListenerMetrics(r metrics.Registry) ListenerOption {
+	return newListenerOption(func(o *listenerOptions) {
+		o.metrics = r
+	})
+}
+
+// WithListenerLogger logs failures to connect to the dialer, handshake failures, heart timeouts and protocol violations,
+// with the addresses of the conns. A nil logger logs nothing.
+func WithListenerLogger(l logger.Logger) ListenerOption {
+	return newListenerOption(func(o *listenerOptions) {
+		if l == nil {
+			o.logger = logger.Discard
+		} else {
+			o.logger = l
+		}
+	})
+}
@@ -0,0 +1,39 @@
+package reverse
+
+import (
+	"errors"
+	"net"
+
+	"github.com/powerpuffpenguin/vnet/errs"
+	"github.com/powerpuffpenguin/vnet/logger"
+)
+
+// logConn logs msg with side, the addresses of c and err if not nil, followed by keyvals.
+func logConn(l logger.Logger, level logger.Level, side, msg string, c net.Conn, err error, keyvals ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	kv := make([]interface{}, 0, 8+len(keyvals))
+	kv = append(kv, `side`, side)
+	if c != nil {
+		kv = append(kv, `local`, c.LocalAddr(), `remote`, c.RemoteAddr())
+	}
+	if err != nil {
+		kv = append(kv, `err`, err)
+	}
+	l.Log(level, msg, append(kv, keyvals...)...)
+}
+
+// logLevel is the level of a conn failure, protocol violations are errors.
+func logLevel(e error, level logger.Level) logger.Level {
+	if errors.Is(e, ErrProtocol) {
+		return logger.LevelError
+	}
+	return level
+}
+func (d *Dialer) log(level logger.Level, msg string, c net.Conn, err error, keyvals ...interface{}) {
+	logConn(d.opts.logger, level, errs.SideDialer, msg, c, err, keyvals...)
+}
+func (l *Listener) log(level logger.Level, msg string, c net.Conn, err error, keyvals ...interface{}) {
+	logConn(l.opts.logger, level, errs.SideListener, msg, c, err, keyvals...)
+}
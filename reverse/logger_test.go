@@ -0,0 +1,165 @@
+package reverse_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/powerpuffpenguin/vnet/logger"
+	"github.com/powerpuffpenguin/vnet/reverse"
+)
+
+type logRecord struct {
+	level   logger.Level
+	msg     string
+	keyvals map[string]string
+}
+type logRecorder struct {
+	m       sync.Mutex
+	records []logRecord
+}
+
+func (r *logRecorder) Enabled(level logger.Level) bool {
+	return true
+}
+func (r *logRecorder) Log(level logger.Level, msg string, keyvals ...interface{}) {
+	record := logRecord{
+		level:   level,
+		msg:     msg,
+		keyvals: make(map[string]string),
+	}
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		record.keyvals[fmt.Sprint(keyvals[i])] = fmt.Sprint(keyvals[i+1])
+	}
+	r.m.Lock()
+	r.records = append(r.records, record)
+	r.m.Unlock()
+}
+
+// wait waits for a record of level with msg.
+func (r *logRecorder) wait(t *testing.T, level logger.Level, msg string) logRecord {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		r.m.Lock()
+		records := append([]logRecord(nil), r.records...)
+		r.m.Unlock()
+		for _, record := range records {
+			if record.level == level && record.msg == msg {
+				return record
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expect %v %v, got %+v", level, msg, records)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestLoggerDialer(t *testing.T) {
+	l, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	var log logRecorder
+	dialer := reverse.NewDialer(l, reverse.WithDialerLogger(&log))
+	defer dialer.Close()
+	go dialer.Serve()
+
+	c, e := net.Dial(`tcp`, l.Addr().String())
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer c.Close()
+	// flag 3553, version 9, event Hello
+	c.Write([]byte{0x0d, 0xe1, 9, reverse.DatagramHello})
+	record := log.wait(t, logger.LevelError, `idle conn closed`)
+	if record.keyvals[`side`] != `dialer` || record.keyvals[`remote`] != c.LocalAddr().String() || record.keyvals[`err`] == `` {
+		t.Fatalf("unexpected record %+v", record)
+	}
+}
+func TestLoggerListener(t *testing.T) {
+	// flag 3553, version 9, event SynAck
+	addr, _ := rawPeer(t, []byte{0x0d, 0xe1, 9, reverse.DatagramSynAck})
+	var log logRecorder
+	listener := reverse.Listen(addr, reverse.WithListenerLogger(&log))
+	defer listener.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+	listener.AcceptContext(ctx)
+	record := log.wait(t, logger.LevelError, `idle conn closed`)
+	if record.keyvals[`side`] != `listener` || record.keyvals[`remote`] != addr.String() {
+		t.Fatalf("unexpected record %+v", record)
+	}
+
+	addr, _ = rawPeer(t, nil)
+	var timeoutLog logRecorder
+	listener = reverse.Listen(addr,
+		reverse.WithListenerHeartTimeout(time.Millisecond*50),
+		reverse.WithListenerLogger(&timeoutLog),
+	)
+	defer listener.Close()
+	listener.AcceptContext(ctx)
+	record = timeoutLog.wait(t, logger.LevelWarn, `heart timeout`)
+	if record.keyvals[`timeout`] != `50ms` {
+		t.Fatalf("unexpected record %+v", record)
+	}
+}
+
+// failingRegistry counts the updates and fails every call.
+type failingRegistry struct {
+	m       sync.Mutex
+	updates int
+}
+
+func (r *failingRegistry) Update(ctx context.Context, node reverse.Node) error {
+	r.m.Lock()
+	r.updates++
+	r.m.Unlock()
+	return errors.New(`registry down`)
+}
+func (r *failingRegistry) Remove(ctx context.Context, id string) error {
+	return errors.New(`registry down`)
+}
+func (r *failingRegistry) Nodes(ctx context.Context) ([]reverse.Node, error) {
+	return nil, errors.New(`registry down`)
+}
+func TestLoggerCluster(t *testing.T) {
+	l, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	var registry failingRegistry
+	var log logRecorder
+	dialer := reverse.NewDialer(l,
+		reverse.WithDialerCluster(`a`, l.Addr(), &registry),
+		reverse.WithDialerClusterRefresh(0),
+		reverse.WithDialerLogger(&log),
+	)
+	// the presence is published once however many cluster listeners are served
+	for i := 0; i < 2; i++ {
+		cl, e := net.Listen(`tcp`, `127.0.0.1:0`)
+		if e != nil {
+			t.Fatal(e)
+		}
+		go dialer.ServeCluster(cl)
+	}
+	record := log.wait(t, logger.LevelWarn, `cluster presence update failed`)
+	if record.keyvals[`node`] != `a` || record.keyvals[`err`] != `registry down` {
+		t.Fatalf("unexpected record %+v", record)
+	}
+	time.Sleep(time.Millisecond * 100)
+	registry.m.Lock()
+	updates := registry.updates
+	registry.m.Unlock()
+	if updates != 1 {
+		t.Fatalf("expect 1 update, got %v", updates)
+	}
+
+	dialer.Close()
+	log.wait(t, logger.LevelWarn, `cluster presence remove failed`)
+}
@@ -0,0 +1,70 @@
+package reverse
+
+import (
+	"time"
+
+	"github.com/powerpuffpenguin/vnet/metrics"
+)
+
+type dialerMetrics struct {
+	idle              metrics.Gauge
+	waiting           metrics.Gauge
+	handshake         metrics.Histogram
+	handshakeFailures metrics.Counter
+	heartFailures     metrics.Counter
+	acceptErrors      metrics.Counter
+	conns             *metrics.ConnMetrics
+}
+
+func newDialerMetrics(r metrics.Registry) *dialerMetrics {
+	if r == nil {
+		r = metrics.Discard
+	}
+	const prefix = `vnet_reverse_dialer_`
+	return &dialerMetrics{
+		idle:              r.Gauge(prefix+`idle_conns`, `Agent conns idle in the pool.`),
+		waiting:           r.Gauge(prefix+`dials_waiting`, `Dials waiting for an idle agent.`),
+		handshake:         r.Histogram(prefix+`handshake_seconds`, `Duration of the handshakes turning idle conns into dialed conns.`, metrics.DefaultBuckets),
+		handshakeFailures: r.Counter(prefix+`handshake_failures_total`, `Handshakes that failed.`),
+		heartFailures:     r.Counter(prefix+`heart_failures_total`, `Hearts that could not be sent to idle agents.`),
+		acceptErrors:      r.Counter(prefix+`accept_errors_total`, `Errors accepting agent conns.`),
+		conns:             metrics.NewConnMetrics(r, prefix),
+	}
+}
+
+type listenerMetrics struct {
+	idle              metrics.Gauge
+	handshake         metrics.Histogram
+	handshakeFailures metrics.Counter
+	heartFailures     metrics.Counter
+	acceptErrors      metrics.Counter
+	// conns is nil unless WithListenerMetrics is set, accepted conns are then wrapped
+	conns *metrics.ConnMetrics
+}
+
+func newListenerMetrics(r metrics.Registry) *listenerMetrics {
+	if r == nil {
+		r = metrics.Discard
+	}
+	const prefix = `vnet_reverse_listener_`
+	m := &listenerMetrics{
+		idle:              r.Gauge(prefix+`idle_conns`, `Conns idle waiting for syn.`),
+		handshake:         r.Histogram(prefix+`handshake_seconds`, `Duration of the handshakes answering syn.`, metrics.DefaultBuckets),
+		handshakeFailures: r.Counter(prefix+`handshake_failures_total`, `Handshakes that failed.`),
+		heartFailures:     r.Counter(prefix+`heart_failures_total`, `Hearts the dialer failed to send in time, or that could not be answered.`),
+		acceptErrors:      r.Counter(prefix+`accept_errors_total`, `Errors connecting to the dialer.`),
+	}
+	if r != metrics.Discard {
+		m.conns = metrics.NewConnMetrics(r, prefix)
+	}
+	return m
+}
+
+// observeHandshake records the end of a handshake started at start.
+func observeHandshake(h metrics.Histogram, failures metrics.Counter, start time.Time, e error) {
+	if e == nil {
+		h.Observe(time.Since(start).Seconds())
+	} else {
+		failures.Add(1)
+	}
+}
@@ -0,0 +1,97 @@
+package reverse_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/powerpuffpenguin/vnet/metrics"
+	"github.com/powerpuffpenguin/vnet/reverse"
+)
+
+// waitMetrics waits until the metrics served by r contain lines.
+func waitMetrics(t *testing.T, r *metrics.Prometheus, lines ...string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(`GET`, `/metrics`, nil))
+		body := w.Body.String()
+		missing := ``
+		for _, line := range lines {
+			if !strings.Contains(body, line+"\n") {
+				missing = line
+				break
+			}
+		}
+		if missing == `` {
+			return
+		} else if time.Now().After(deadline) {
+			t.Fatalf("expect %q in\n%s", missing, body)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+func TestMetrics(t *testing.T) {
+	l, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	r := metrics.NewPrometheus()
+	dialer := reverse.NewDialer(l, reverse.WithDialerMetrics(r))
+	defer dialer.Close()
+	go dialer.Serve()
+	listener := reverse.Listen(l.Addr(), reverse.WithListenerMetrics(r))
+	defer listener.Close()
+	go func() {
+		c, e := listener.Accept()
+		if e != nil {
+			return
+		}
+		if _, ok := c.(*metrics.Conn); !ok {
+			c.Close()
+			return
+		}
+		io.Copy(c, c)
+		c.Close()
+	}()
+	waitMetrics(t, r,
+		`vnet_reverse_dialer_idle_conns 1`,
+		`vnet_reverse_listener_idle_conns 1`,
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	c, e := dialer.DialContext(ctx, `tcp`, ``)
+	if e != nil {
+		t.Fatal(e)
+	}
+	c.Write([]byte(`hello`))
+	b := make([]byte, 5)
+	_, e = io.ReadFull(c, b)
+	if e != nil {
+		t.Fatal(e)
+	}
+	waitMetrics(t, r,
+		`vnet_reverse_dialer_idle_conns 0`,
+		`vnet_reverse_dialer_dials_waiting 0`,
+		`vnet_reverse_dialer_handshake_seconds_count 1`,
+		`vnet_reverse_dialer_handshake_failures_total 0`,
+		`vnet_reverse_dialer_active_conns 1`,
+		`vnet_reverse_dialer_bytes_read_total 5`,
+		`vnet_reverse_dialer_bytes_written_total 5`,
+		`vnet_reverse_listener_handshake_seconds_count 1`,
+		`vnet_reverse_listener_active_conns 1`,
+		`vnet_reverse_listener_bytes_read_total 5`,
+		`vnet_reverse_listener_bytes_written_total 5`,
+	)
+	c.Close()
+	waitMetrics(t, r,
+		`vnet_reverse_dialer_active_conns 0`,
+		`vnet_reverse_listener_active_conns 0`,
+	)
+}
@@ -0,0 +1,150 @@
+package reverse_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/powerpuffpenguin/vnet/noise"
+	"github.com/powerpuffpenguin/vnet/reverse"
+)
+
+func noiseKey(t *testing.T) *ecdh.PrivateKey {
+	key, e := noise.GenerateKey()
+	if e != nil {
+		t.Fatal(e)
+	}
+	return key
+}
+func TestNoise(t *testing.T) {
+	dialerKey, agentKey, otherKey := noiseKey(t), noiseKey(t), noiseKey(t)
+	l, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	dialer := reverse.NewDialer(l, reverse.WithDialerNoise(dialerKey,
+		noise.WithPeerKeys(agentKey.PublicKey().Bytes(), otherKey.PublicKey().Bytes()),
+	))
+	defer dialer.Close()
+	go dialer.Serve()
+
+	for _, key := range []*ecdh.PrivateKey{agentKey, otherKey} {
+		listener := reverse.Listen(l.Addr(), reverse.WithListenerNoise(key,
+			noise.WithPeerKeys(dialerKey.PublicKey().Bytes()),
+		))
+		defer listener.Close()
+		go func() {
+			for {
+				c, e := listener.Accept()
+				if e != nil {
+					return
+				}
+				if !bytes.Equal(c.(*noise.Conn).PeerKey(), dialerKey.PublicKey().Bytes()) {
+					c.Close()
+					continue
+				}
+				go func() {
+					io.Copy(c, c)
+					c.Close()
+				}()
+			}
+		}()
+	}
+
+	// dial the agent by its key
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	c, e := dialer.DialAgent(ctx, nil, reverse.PublicKeyPicker(agentKey.PublicKey().Bytes()))
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer c.Close()
+	if !bytes.Equal(c.(*reverse.Conn).Agent().PublicKey, agentKey.PublicKey().Bytes()) ||
+		!bytes.Equal(c.(*reverse.Conn).Unwrap().(*noise.Conn).PeerKey(), agentKey.PublicKey().Bytes()) {
+		t.Fatal("unexpected agent key")
+	}
+	_, e = c.Write([]byte(`ping`))
+	if e != nil {
+		t.Fatal(e)
+	}
+	b := make([]byte, 4)
+	_, e = io.ReadFull(c, b)
+	if e != nil || string(b) != `ping` {
+		t.Fatal(e, string(b))
+	}
+}
+func TestNoiseUnauthorized(t *testing.T) {
+	dialerKey, agentKey := noiseKey(t), noiseKey(t)
+	l, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	dialer := reverse.NewDialer(l, reverse.WithDialerNoise(dialerKey,
+		noise.WithPeerKeys(dialerKey.PublicKey().Bytes()),
+	))
+	defer dialer.Close()
+	go dialer.Serve()
+	listener := reverse.Listen(l.Addr(), reverse.WithListenerNoise(agentKey))
+	defer listener.Close()
+	_, e = listener.Accept()
+	if e == nil {
+		t.Fatal("expect unauthorized agent to fail")
+	}
+
+	// a plain agent can't get in either
+	plain := reverse.Listen(l.Addr(), reverse.WithListenerHeartTimeout(time.Millisecond*200))
+	defer plain.Close()
+	_, e = plain.Accept()
+	if e == nil {
+		t.Fatal("expect plain agent to fail")
+	}
+}
+func TestNoiseRedirect(t *testing.T) {
+	dialerKey, agentKey := noiseKey(t), noiseKey(t)
+	l, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	dialer := reverse.NewDialer(l, reverse.WithDialerNoise(dialerKey))
+	defer dialer.Close()
+	go dialer.Serve()
+	target, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer target.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	go dialer.Drain(ctx, target.Addr())
+	time.Sleep(time.Millisecond * 50)
+
+	// without a peer key the dialer is not authenticated, its redirect is refused
+	listener := reverse.Listen(l.Addr(), reverse.WithListenerNoise(agentKey))
+	defer listener.Close()
+	_, e = listener.AcceptContext(ctx)
+	if !errors.Is(e, reverse.ErrRedirectRefused) {
+		t.Fatalf("expect ErrRedirectRefused, got %v", e)
+	} else if listener.Addr() != l.Addr() {
+		t.Fatalf("expect %v, got %v", l.Addr(), listener.Addr())
+	}
+
+	// an authorized dialer redirects the agent
+	listener = reverse.Listen(l.Addr(), reverse.WithListenerNoise(agentKey,
+		noise.WithPeerKeys(dialerKey.PublicKey().Bytes()),
+	))
+	defer listener.Close()
+	go listener.AcceptContext(ctx)
+	c, e := target.Accept()
+	if e != nil {
+		t.Fatal(e)
+	}
+	c.Close()
+	if listener.Addr().String() != target.Addr().String() {
+		t.Fatalf("expect redirected to %v, got %v", target.Addr(), listener.Addr())
+	}
+}
@@ -0,0 +1,139 @@
+package reverse
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/powerpuffpenguin/vnet/errs"
+)
+
+var ErrAcceptFilter = errors.New(`rejected by the accept filter`)
+var ErrIdleLimit = errors.New(`idle conn limit reached`)
+var ErrMaxIdleAge = errors.New(`max idle age reached`)
+
+// EventKind is the kind of an Event.
+type EventKind uint8
+
+const (
+	// EventAccept is observed when the Dialer accepts an agent conn, or when the Listener connects to the dialer.
+	EventAccept EventKind = 1 + iota
+	// EventIdle is observed when a conn becomes idle, in the pool of the Dialer or waiting for syn in the Listener.
+	EventIdle
+	// EventHeart is observed when the Dialer sends a heart, or when the Listener receives one.
+	// Err is set if sending failed.
+	EventHeart
+	// EventHandshakeStart is observed when the Dialer takes an idle conn for a dial, or when the Listener receives syn.
+	EventHandshakeStart
+	// EventHandshakeEnd is observed when the handshake ends, Err is set if it failed and Duration is its duration.
+	EventHandshakeEnd
+	// EventHandoff is observed when a conn is returned by a dial of the Dialer or by Accept of the Listener.
+	EventHandoff
+	// EventClose is observed when the Dialer or the Listener closes a conn it has not handed off, Err is the reason.
+	// The Dialer also observes it, with a nil Err, when a conn returned by a dial is closed.
+	EventClose
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case EventAccept:
+		return `accept`
+	case EventIdle:
+		return `idle`
+	case EventHeart:
+		return `heart`
+	case EventHandshakeStart:
+		return `handshake start`
+	case EventHandshakeEnd:
+		return `handshake end`
+	case EventHandoff:
+		return `handoff`
+	case EventClose:
+		return `close`
+	}
+	return `unknown`
+}
+
+// Event describes a step of the life of a reverse conn.
+type Event struct {
+	Kind EventKind
+	// Side is errs.SideDialer or errs.SideListener.
+	Side string
+	// LocalAddr and RemoteAddr are the addresses of the conn, nil before it is established.
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+	// Agent is a copy of the agent as the Dialer knows it, nil on the Listener side and for dials forwarded to another node.
+	Agent *Agent
+	// Duration is the duration of the handshake for EventHandshakeEnd.
+	Duration time.Duration
+	Err      error
+}
+
+// Observer observes the life of reverse conns, for monitoring, auditing or alerting.
+// Observe is called synchronously by the goroutine driving the conn, it must not block,
+// and the Event must not be retained after it returns.
+type Observer interface {
+	Observe(e *Event)
+}
+
+// ObserverFunc is an Observer calling itself.
+type ObserverFunc func(e *Event)
+
+func (f ObserverFunc) Observe(e *Event) {
+	f(e)
+}
+
+type observers []Observer
+
+func (o observers) observe(e *Event) {
+	for _, observer := range o {
+		observer.Observe(e)
+	}
+}
+
+// observeConn reports an event about c, agent may be nil.
+func (o observers) observeConn(kind EventKind, side string, c net.Conn, agent *Agent, duration time.Duration, err error) {
+	if len(o) == 0 {
+		return
+	}
+	o.observe(&Event{
+		Kind:       kind,
+		Side:       side,
+		LocalAddr:  c.LocalAddr(),
+		RemoteAddr: c.RemoteAddr(),
+		Agent:      agent,
+		Duration:   duration,
+		Err:        err,
+	})
+}
+
+// observe reports an event about ic, d.m must not be held.
+func (d *Dialer) observe(kind EventKind, ic *idleConn, duration time.Duration, err error) {
+	if len(d.opts.observers) == 0 {
+		return
+	}
+	d.m.Lock()
+	agent := ic.agent
+	d.m.Unlock()
+	d.opts.observers.observeConn(kind, errs.SideDialer, ic.stream.rw, &agent, duration, err)
+}
+
+// closed reports that ic is closed before it was handed off, only the first reason is reported.
+// It must be called before the conn is closed, d.m must not be held.
+func (d *Dialer) closed(ic *idleConn, err error) {
+	if len(d.opts.observers) == 0 {
+		return
+	}
+	d.m.Lock()
+	reported := ic.reported
+	ic.reported = true
+	d.m.Unlock()
+	if !reported {
+		d.observe(EventClose, ic, 0, err)
+	}
+}
+
+// observe reports an event about c.
+func (l *Listener) observe(kind EventKind, c net.Conn, duration time.Duration, err error) {
+	l.opts.observers.observeConn(kind, errs.SideListener, c, nil, duration, err)
+}
@@ -0,0 +1,124 @@
+package reverse_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/powerpuffpenguin/vnet/errs"
+	"github.com/powerpuffpenguin/vnet/reverse"
+)
+
+type recorder struct {
+	m      sync.Mutex
+	events []reverse.Event
+}
+
+func (r *recorder) Observe(e *reverse.Event) {
+	r.m.Lock()
+	r.events = append(r.events, *e)
+	r.m.Unlock()
+}
+
+// wait waits until the recorded events contain kinds in order.
+func (r *recorder) wait(t *testing.T, side string, kinds ...reverse.EventKind) []reverse.Event {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		r.m.Lock()
+		events := append([]reverse.Event(nil), r.events...)
+		r.m.Unlock()
+		found := make([]reverse.Event, 0, len(kinds))
+		for _, e := range events {
+			if len(found) < len(kinds) && e.Kind == kinds[len(found)] {
+				if e.Side != side {
+					t.Fatalf("expect side %v, got %+v", side, e)
+				}
+				found = append(found, e)
+			}
+		}
+		if len(found) == len(kinds) {
+			return found
+		} else if time.Now().After(deadline) {
+			t.Fatalf("expect %v, got %v", kinds, events)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestObserver(t *testing.T) {
+	l, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	var dialerEvents, listenerEvents recorder
+	dialer := reverse.NewDialer(l,
+		reverse.WithDialerHeart(time.Millisecond*20),
+		reverse.WithDialerObserver(&dialerEvents),
+	)
+	defer dialer.Close()
+	go dialer.Serve()
+	listener := reverse.Listen(l.Addr(), reverse.WithListenerObserver(&listenerEvents))
+	defer listener.Close()
+	go func() {
+		c, e := listener.Accept()
+		if e != nil {
+			return
+		}
+		io.Copy(io.Discard, c)
+		c.Close()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	dialerEvents.wait(t, errs.SideDialer, reverse.EventAccept, reverse.EventIdle, reverse.EventHeart)
+	c, e := dialer.DialContext(ctx, `tcp`, ``)
+	if e != nil {
+		t.Fatal(e)
+	}
+	c.Close()
+	events := dialerEvents.wait(t, errs.SideDialer,
+		reverse.EventAccept, reverse.EventIdle, reverse.EventHeart,
+		reverse.EventHandshakeStart, reverse.EventHandshakeEnd, reverse.EventHandoff, reverse.EventClose,
+	)
+	for _, e := range events[1:] {
+		if e.Agent == nil || e.Err != nil {
+			t.Fatalf("unexpected %+v", e)
+		}
+	}
+	if events[4].Duration <= 0 {
+		t.Fatalf("expect handshake duration, got %v", events[4].Duration)
+	}
+	listenerEvents.wait(t, errs.SideListener,
+		reverse.EventAccept, reverse.EventIdle, reverse.EventHeart,
+		reverse.EventHandshakeStart, reverse.EventHandshakeEnd, reverse.EventHandoff,
+	)
+}
+func TestObserverReject(t *testing.T) {
+	l, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	var events recorder
+	dialer := reverse.NewDialer(l,
+		reverse.WithDialerAcceptFilter(func(c net.Conn) bool {
+			return false
+		}),
+		reverse.WithDialerObserver(&events),
+	)
+	defer dialer.Close()
+	go dialer.Serve()
+	c, e := net.Dial(`tcp`, l.Addr().String())
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer c.Close()
+	found := events.wait(t, errs.SideDialer, reverse.EventAccept, reverse.EventClose)
+	if !errors.Is(found[1].Err, reverse.ErrAcceptFilter) {
+		t.Fatalf("expect ErrAcceptFilter, got %v", found[1].Err)
+	}
+}
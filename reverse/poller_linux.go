@@ -0,0 +1,267 @@
+//go:build linux
+// +build linux
+
+package reverse
+
+import (
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/powerpuffpenguin/vnet"
+	"github.com/powerpuffpenguin/vnet/logger"
+	"github.com/powerpuffpenguin/vnet/noise"
+)
+
+// pollEvents are the events an idle conn is watched for, it is disarmed once one is reported until it is armed again.
+const pollEvents = syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT
+
+// poller watches the idle conns with one epoll instance, so that an idle conn costs no goroutine while its agent is silent.
+// Once a conn is readable a goroutine reads its frames, then the conn is armed again.
+type poller struct {
+	d    *Dialer
+	epfd int
+	// wake interrupts the wait once the Dialer is closed, its read end is watched with id 0
+	wake [2]int
+
+	m      sync.Mutex
+	seq    uint32
+	conns  map[uint32]*idleConn
+	closed bool
+}
+
+// watched is what the poller knows of a conn.
+type watched struct {
+	id  uint32
+	raw syscall.RawConn
+	// buffered returns the bytes already read from raw and not from the conn, nil if the conn buffers nothing
+	buffered func() int
+}
+
+// newPoller returns nil if epoll can't be used, the idle conns are then read by a goroutine each.
+func newPoller(d *Dialer) *poller {
+	epfd, e := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if e != nil {
+		d.log(logger.LevelWarn, `idle poller unavailable`, nil, e)
+		return nil
+	}
+	p := &poller{
+		d:     d,
+		epfd:  epfd,
+		conns: make(map[uint32]*idleConn),
+	}
+	e = syscall.Pipe2(p.wake[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC)
+	if e == nil {
+		e = syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, p.wake[0], &syscall.EpollEvent{Events: syscall.EPOLLIN})
+		if e != nil {
+			syscall.Close(p.wake[0])
+			syscall.Close(p.wake[1])
+		}
+	}
+	if e != nil {
+		syscall.Close(epfd)
+		d.log(logger.LevelWarn, `idle poller unavailable`, nil, e)
+		return nil
+	}
+	go p.run()
+	go func() {
+		<-d.close
+		p.m.Lock()
+		if !p.closed {
+			syscall.Write(p.wake[1], []byte{0})
+		}
+		p.m.Unlock()
+	}()
+	return p
+}
+
+// pollable returns the raw conn under c if the poller can watch c.
+// Only the conns known not to buffer what they read, or to tell how much they buffered, are watched.
+func pollable(c net.Conn) (w *watched, ok bool) {
+	w = &watched{}
+	if nc, isNoise := c.(*noise.Conn); isNoise {
+		w.buffered = nc.Buffered
+		c = nc.NetConn()
+	}
+	var sc syscall.Conn
+	switch c := c.(type) {
+	case *net.TCPConn:
+		sc = c
+	case *net.UnixConn:
+		sc = c
+	default:
+		return
+	}
+	raw, e := sc.SyscallConn()
+	if e != nil {
+		return
+	}
+	w.raw = raw
+	ok = true
+	return
+}
+
+// watch starts watching ic before it is published, it returns false if ic needs a reader of its own.
+// d.m must be held.
+func (p *poller) watch(ic *idleConn) bool {
+	if p == nil {
+		return false
+	}
+	w, ok := pollable(ic.stream.rw)
+	if !ok {
+		return false
+	}
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.closed {
+		return false
+	}
+	p.seq++
+	if p.seq == 0 {
+		p.seq++
+	}
+	w.id = p.seq
+	ic.poller = p
+	ic.watched = w
+	ic.polled = true
+	p.conns[w.id] = ic
+	if p.ctl(syscall.EPOLL_CTL_ADD, w) != nil {
+		delete(p.conns, w.id)
+		ic.poller = nil
+		ic.watched = nil
+		ic.polled = false
+		return false
+	}
+	return true
+}
+
+// ctl adds, arms again or removes the conn of w, p.m must be held.
+// The conn can't be closed while its fd is used, so its fd number is never mistaken for another conn's.
+func (p *poller) ctl(op int, w *watched) (e error) {
+	if p.closed {
+		return vnet.ErrDialerClosed
+	}
+	event := syscall.EpollEvent{
+		Events: pollEvents,
+		Fd:     int32(w.id),
+	}
+	err := w.raw.Control(func(fd uintptr) {
+		e = syscall.EpollCtl(p.epfd, op, int(fd), &event)
+	})
+	if err != nil {
+		e = err
+	}
+	return
+}
+
+// remove forgets ic, the events still reported for it are ignored.
+func (p *poller) remove(ic *idleConn) {
+	p.m.Lock()
+	if p.conns[ic.watched.id] == ic {
+		delete(p.conns, ic.watched.id)
+	}
+	p.m.Unlock()
+}
+
+// unwatch stops watching ic as it is taken by a dial, ic.rm must be held.
+func (p *poller) unwatch(ic *idleConn) {
+	ic.polled = false
+	p.m.Lock()
+	p.ctl(syscall.EPOLL_CTL_DEL, ic.watched)
+	if p.conns[ic.watched.id] == ic {
+		delete(p.conns, ic.watched.id)
+	}
+	p.m.Unlock()
+}
+
+// run waits for the conns to become readable until the Dialer is closed.
+func (p *poller) run() {
+	events := make([]syscall.EpollEvent, 128)
+	for stop := false; !stop; {
+		n, e := syscall.EpollWait(p.epfd, events, -1)
+		if e == syscall.EINTR {
+			continue
+		} else if e != nil {
+			p.d.log(logger.LevelError, `idle poller failed`, nil, e)
+			break
+		}
+		for _, event := range events[:n] {
+			id := uint32(event.Fd)
+			if id == 0 {
+				stop = true
+				continue
+			}
+			p.m.Lock()
+			ic := p.conns[id]
+			p.m.Unlock()
+			if ic != nil {
+				go p.ready(ic)
+			}
+		}
+	}
+	p.shutdown()
+}
+
+// shutdown closes epoll and ends the conns still watched.
+func (p *poller) shutdown() {
+	p.m.Lock()
+	p.closed = true
+	conns := p.conns
+	p.conns = nil
+	syscall.Close(p.epfd)
+	syscall.Close(p.wake[0])
+	syscall.Close(p.wake[1])
+	p.m.Unlock()
+	for _, ic := range conns {
+		ic.rm.Lock()
+		polled := ic.polled
+		ic.polled = false
+		ic.rm.Unlock()
+		if polled {
+			p.d.endRead(ic, vnet.ErrDialerClosed)
+		}
+	}
+}
+
+// ready reads the frames of a readable idle conn, then arms it again.
+// The conn is not taken meanwhile, detach waits for ic.rm.
+func (p *poller) ready(ic *idleConn) {
+	d := p.d
+	ic.rm.Lock()
+	if !ic.polled {
+		// taken or ended since the event was reported
+		ic.rm.Unlock()
+		return
+	}
+	stream := ic.stream
+	var e error
+	for {
+		// the frame has begun, it must arrive within heartTimeout
+		stream.rw.SetReadDeadline(frameDeadline(d.opts.heartTimeout))
+		e = stream.Wait()
+		if e == nil {
+			e = stream.Recv(DatagramHello, DatagramLoad, DatagramFin)
+		}
+		if e == nil {
+			e = d.handleFrame(ic)
+		}
+		if e != nil || ic.watched.buffered == nil || ic.watched.buffered() == 0 {
+			break
+		}
+	}
+	if e == nil {
+		stream.rw.SetReadDeadline(time.Time{})
+		p.m.Lock()
+		e = p.ctl(syscall.EPOLL_CTL_MOD, ic.watched)
+		p.m.Unlock()
+	}
+	if e != nil {
+		ic.polled = false
+		p.remove(ic)
+	}
+	ic.rm.Unlock()
+	if e != nil {
+		d.endRead(ic, e)
+	}
+}
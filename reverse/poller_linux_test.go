@@ -0,0 +1,55 @@
+//go:build linux
+// +build linux
+
+package reverse_test
+
+import (
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/powerpuffpenguin/vnet/logger"
+	"github.com/powerpuffpenguin/vnet/reverse"
+)
+
+func TestIdlePoller(t *testing.T) {
+	const n = 100
+	l, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	var log logRecorder
+	dialer := reverse.NewDialer(l, reverse.WithDialerLogger(&log))
+	defer dialer.Close()
+	go dialer.Serve()
+	// the first agent starts the poller
+	agents := make([]net.Conn, 0, n)
+	c, e := net.Dial(`tcp`, l.Addr().String())
+	if e != nil {
+		t.Fatal(e)
+	}
+	agents = append(agents, c)
+	time.Sleep(time.Millisecond * 100)
+	base := runtime.NumGoroutine()
+
+	for i := 1; i < n; i++ {
+		c, e := net.Dial(`tcp`, l.Addr().String())
+		if e != nil {
+			t.Fatal(e)
+		}
+		agents = append(agents, c)
+	}
+	time.Sleep(time.Millisecond * 200)
+	// silent idle conns are watched without a goroutine each
+	if grown := runtime.NumGoroutine() - base; grown > n/10 {
+		t.Fatalf("%v goroutines for %v idle conns", grown, n-1)
+	}
+
+	// a closed agent is still noticed
+	agents[n-1].Close()
+	log.wait(t, logger.LevelDebug, `idle conn closed`)
+	for _, c := range agents[:n-1] {
+		c.Close()
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package reverse
+
+// poller is only implemented on Linux, elsewhere every idle conn is read by a goroutine of its own.
+type poller struct{}
+type watched struct{}
+
+func newPoller(d *Dialer) *poller {
+	return nil
+}
+func (p *poller) watch(ic *idleConn) bool {
+	return false
+}
+func (p *poller) remove(ic *idleConn)  {}
+func (p *poller) unwatch(ic *idleConn) {}
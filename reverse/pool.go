@@ -0,0 +1,472 @@
+package reverse
+
+import (
+	"container/list"
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/powerpuffpenguin/vnet"
+	"github.com/powerpuffpenguin/vnet/logger"
+	"github.com/powerpuffpenguin/vnet/reverse/codec"
+)
+
+// idleConn is an agent conn waiting in the pool.
+// Fields after hm are guarded by Dialer.m.
+type idleConn struct {
+	stream *datagramStream
+	// done receives the error that ended the reader once the conn has been taken, nil if the conn is not read
+	done chan error
+	// hm is held while a heart is sent
+	hm sync.Mutex
+	// rm is held while the reader reads a frame whose first byte has arrived
+	rm        sync.Mutex
+	detaching bool
+	// polled is set while the poller watches the conn instead of a reader, it is guarded by rm
+	polled  bool
+	poller  *poller
+	watched *watched
+
+	// id identifies the conn in the admin handler
+	id       uint64
+	agent    Agent
+	elem     *list.Element
+	taken    bool
+	accepted time.Time
+	// ip is only set if WithDialerMaxIdlePerIP is set
+	ip string
+	// heartSent is when the last heart not answered yet was sent, rtt the round trip of the last answered one
+	heartSent time.Time
+	rtt       time.Duration
+	// lastHeart is when the last heart was sent
+	lastHeart time.Time
+	// reported is set once the close of the conn has been observed
+	reported bool
+}
+
+func (ic *idleConn) pooled() bool {
+	return ic.elem != nil
+}
+
+type waiter struct {
+	selector Selector
+	picker   Picker
+	// ch receives the conn handed to a waiter without picker,
+	// wake tells a waiter with a picker to pick among the pool again
+	ch    chan *idleConn
+	wake  chan struct{}
+	since time.Time
+}
+
+// matches reports whether ic may be handed to the waiter, d.m must be held.
+func (w *waiter) matches(ic *idleConn, limits *Limits) bool {
+	return w.selector.Match(ic.agent.Labels) && !limits.agentExhausted(agentID(&ic.agent))
+}
+
+// read reads the idle conn until the agent says goodbye, the conn fails or it is taken by a dial.
+// It is the goroutine of the idle conns the poller can't watch.
+func (d *Dialer) read(ic *idleConn) {
+	stream := ic.stream
+	var e error
+	for e == nil {
+		e = stream.Wait()
+		if e != nil {
+			break
+		}
+		// a frame that has begun must arrive within heartTimeout,
+		// it is read to its end even if detach has begun meanwhile
+		ic.rm.Lock()
+		detaching := ic.detaching
+		stream.rw.SetReadDeadline(frameDeadline(d.opts.heartTimeout))
+		e = stream.Recv(DatagramHello, DatagramLoad, DatagramFin)
+		if e == nil && !detaching {
+			stream.rw.SetReadDeadline(time.Time{})
+		}
+		ic.rm.Unlock()
+		if e != nil {
+			break
+		} else if detaching && stream.Event() != DatagramFin {
+			e = errDetached
+			break
+		}
+		e = d.handleFrame(ic)
+	}
+	d.endRead(ic, e)
+}
+
+// handleFrame applies the frame just received over the idle conn. Idle agents only send hello, load and goodbye.
+func (d *Dialer) handleFrame(ic *idleConn) (e error) {
+	stream := ic.stream
+	switch stream.Event() {
+	case DatagramHello:
+		var labels map[string]string
+		labels, e = codec.DecodeLabels(stream.Payload())
+		if e != nil {
+			break
+		}
+		d.m.Lock()
+		ic.agent.Labels = labels
+		if ic.pooled() {
+			// labels changed, waiting dials may now match
+			d.unpool(ic)
+			d.offer(ic)
+		}
+		d.m.Unlock()
+	case DatagramLoad:
+		var load, capacity uint32
+		load, capacity, e = codec.DecodeLoad(stream.Payload())
+		if e != nil {
+			break
+		}
+		d.m.Lock()
+		ic.agent.Load = load
+		ic.agent.Capacity = capacity
+		if !ic.heartSent.IsZero() {
+			ic.rtt = time.Since(ic.heartSent)
+			ic.heartSent = time.Time{}
+		}
+		d.m.Unlock()
+	default:
+		e = errFin
+	}
+	return
+}
+
+// endRead hands e to the dial that took the conn, or forgets and closes the conn if it was not taken.
+func (d *Dialer) endRead(ic *idleConn, e error) {
+	d.m.Lock()
+	taken := ic.taken
+	if !taken {
+		d.removeIdle(ic)
+	}
+	d.m.Unlock()
+	if taken {
+		ic.done <- e
+	} else {
+		d.log(logLevel(e, logger.LevelDebug), `idle conn closed`, ic.stream.rw, e)
+		d.closed(ic, e)
+		ic.stream.rw.Close()
+	}
+}
+
+// closeIdle forgets and closes an idle conn that can't be taken any more, d.m must not be held.
+// A reader of the conn ends on its own, the poller has forgotten it.
+func (d *Dialer) closeIdle(ic *idleConn, e error) {
+	d.m.Lock()
+	d.removeIdle(ic)
+	d.m.Unlock()
+	d.closed(ic, e)
+	ic.stream.rw.Close()
+}
+
+// detach waits until the taken conn is neither read nor sent a heart.
+// It returns false if the reader has already ended, the conn must not be used any more.
+func (ic *idleConn) detach() bool {
+	ic.hm.Lock()
+	ic.hm.Unlock()
+	if ic.done == nil {
+		return true
+	}
+	c := ic.stream.rw
+	ic.rm.Lock()
+	if ic.polled {
+		// no frame is being read, the poller stops watching the conn
+		ic.poller.unwatch(ic)
+		ic.rm.Unlock()
+		return true
+	}
+	ic.detaching = true
+	c.SetReadDeadline(aLongTimeAgo)
+	ic.rm.Unlock()
+	e := <-ic.done
+	c.SetReadDeadline(time.Time{})
+	if e == errDetached {
+		return true
+	} else if ne, ok := e.(net.Error); ok && ne.Timeout() {
+		return true
+	}
+	return false
+}
+
+// frameDeadline bounds the time spent reading the rest of a frame, no bound if timeout < 1.
+func frameDeadline(timeout time.Duration) time.Time {
+	if timeout > 0 {
+		return time.Now().Add(timeout)
+	}
+	return time.Time{}
+}
+
+// admit reports whether ic is allowed to become idle by the idle limits and counts it, d.m must be held.
+func (d *Dialer) admit(ic *idleConn) bool {
+	opts := &d.opts
+	if opts.maxIdle > 0 && len(d.idle)+d.handshaking >= opts.maxIdle {
+		return false
+	}
+	if opts.maxIdlePerIP > 0 {
+		if d.idlePerIP == nil {
+			d.idlePerIP = make(map[string]int)
+		}
+		n := d.idlePerIP[ic.ip]
+		if n >= opts.maxIdlePerIP {
+			return false
+		}
+		d.idlePerIP[ic.ip] = n + 1
+	}
+	return true
+}
+
+// release gives back the per IP slot counted by admit, d.m must be held.
+func (d *Dialer) release(ic *idleConn) {
+	if d.idlePerIP != nil {
+		if n := d.idlePerIP[ic.ip] - 1; n > 0 {
+			d.idlePerIP[ic.ip] = n
+		} else {
+			delete(d.idlePerIP, ic.ip)
+		}
+	}
+}
+
+// addrIP returns the IP of addr, or addr itself if it has no IP.
+func addrIP(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.String()
+	case *net.UDPAddr:
+		return a.IP.String()
+	}
+	s := addr.String()
+	if host, _, e := net.SplitHostPort(s); e == nil {
+		return host
+	}
+	return s
+}
+
+// removeIdle forgets an idle conn that is not taken, d.m must be held.
+func (d *Dialer) removeIdle(ic *idleConn) {
+	if d.done != 0 {
+		return
+	}
+	if _, ok := d.idle[ic.stream.rw]; !ok {
+		return
+	}
+	d.unpool(ic)
+	delete(d.idle, ic.stream.rw)
+	if ic.poller != nil {
+		ic.poller.remove(ic)
+	}
+	d.metrics.idle.Add(-1)
+	d.release(ic)
+	d.notifyPresence()
+	if len(d.idle) == 0 {
+		select {
+		case d.drained <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// take hands ic to a dial, d.m must be held.
+func (d *Dialer) take(ic *idleConn) {
+	d.removeIdle(ic)
+	ic.taken = true
+}
+
+// offer hands ic to the oldest waiting dial it matches, or puts it in the pool, d.m must be held.
+func (d *Dialer) offer(ic *idleConn) {
+	if !d.handToWaiter(ic) {
+		ic.elem = d.pool.PushBack(ic)
+	}
+}
+
+// handToWaiter hands ic to the oldest waiting dial it matches if any, d.m must be held.
+func (d *Dialer) handToWaiter(ic *idleConn) bool {
+	for _, w := range d.waiters {
+		if !w.matches(ic, d.limits) {
+			continue
+		} else if w.picker != nil {
+			// pickers never run with d.m held, the dial picks by itself
+			select {
+			case w.wake <- struct{}{}:
+			default:
+			}
+			continue
+		}
+		d.removeWaiter(w)
+		d.take(ic)
+		w.ch <- ic
+		return true
+	}
+	return false
+}
+
+// removeWaiter forgets w, d.m must be held.
+func (d *Dialer) removeWaiter(w *waiter) {
+	for i, found := range d.waiters {
+		if found == w {
+			copy(d.waiters[i:], d.waiters[i+1:])
+			d.waiters[len(d.waiters)-1] = nil
+			d.waiters = d.waiters[:len(d.waiters)-1]
+			return
+		}
+	}
+}
+
+// rematch offers the pooled conns to the waiting dials again, after the quotas changed.
+func (d *Dialer) rematch() {
+	d.m.Lock()
+	for elem := d.pool.Front(); elem != nil && len(d.waiters) != 0; {
+		next := elem.Next()
+		d.handToWaiter(elem.Value.(*idleConn))
+		elem = next
+	}
+	d.m.Unlock()
+}
+
+// unpool removes ic from the pool, d.m must be held.
+func (d *Dialer) unpool(ic *idleConn) {
+	if ic.elem != nil {
+		d.pool.Remove(ic.elem)
+		ic.elem = nil
+	}
+}
+
+// pick takes an idle conn matching selector chosen by picker, d.m must be held.
+// A nil picker takes the conn that has been idle for the longest time.
+// d.m is released while picker runs on copies of the agents, the pick is taken if it is still idle by then.
+// Agents whose quota is used up are skipped, exhausted reports whether one matched.
+func (d *Dialer) pick(selector Selector, picker Picker) (ic *idleConn, exhausted bool) {
+	for d.done == 0 {
+		var candidates []*idleConn
+		var agents []*Agent
+		exhausted = false
+		for elem := d.pool.Front(); elem != nil; elem = elem.Next() {
+			ic := elem.Value.(*idleConn)
+			if !selector.Match(ic.agent.Labels) {
+				continue
+			} else if d.limits.agentExhausted(agentID(&ic.agent)) {
+				exhausted = true
+				continue
+			} else if picker == nil {
+				d.take(ic)
+				return ic, false
+			}
+			candidates = append(candidates, ic)
+			agents = append(agents, copyAgent(&ic.agent))
+		}
+		if len(candidates) == 0 {
+			return nil, exhausted
+		}
+		d.m.Unlock()
+		i := picker(agents)
+		d.m.Lock()
+		if i < 0 || i >= len(candidates) {
+			return nil, exhausted
+		}
+		ic = candidates[i]
+		if ic.pooled() && d.done == 0 {
+			d.take(ic)
+			return ic, false
+		}
+		// taken or closed while picking, pick among the conns left
+	}
+	return nil, false
+}
+
+// copyAgent returns a copy of agent a picker may keep or change.
+func copyAgent(agent *Agent) *Agent {
+	c := *agent
+	if agent.Labels != nil {
+		c.Labels = make(map[string]string, len(agent.Labels))
+		for k, v := range agent.Labels {
+			c.Labels[k] = v
+		}
+	}
+	c.PublicKey = append([]byte(nil), agent.PublicKey...)
+	return &c
+}
+
+// wait takes an idle conn, waiting for one if none matches and block is true.
+func (d *Dialer) wait(ctx context.Context, selector Selector, picker Picker, block bool) (ic *idleConn, e error) {
+	d.m.Lock()
+	if d.done != 0 {
+		d.m.Unlock()
+		e = vnet.ErrDialerClosed
+		return
+	}
+	select {
+	case <-d.drain:
+		d.m.Unlock()
+		e = ErrDraining
+		return
+	default:
+	}
+	ic, exhausted := d.pick(selector, picker)
+	if ic != nil || !block {
+		d.m.Unlock()
+		return
+	} else if d.done != 0 {
+		// closed while picking
+		d.m.Unlock()
+		e = vnet.ErrDialerClosed
+		return
+	} else if exhausted {
+		// the matching agents are out of quota, waiting would likely only find them again
+		d.m.Unlock()
+		e = ErrQuotaExceeded
+		return
+	}
+	w := &waiter{
+		selector: selector,
+		picker:   picker,
+		ch:       make(chan *idleConn, 1),
+		wake:     make(chan struct{}, 1),
+		since:    time.Now(),
+	}
+	d.waiters = append(d.waiters, w)
+	d.m.Unlock()
+	d.metrics.waiting.Add(1)
+	defer d.metrics.waiting.Add(-1)
+
+	for e == nil {
+		select {
+		case ic = <-w.ch:
+			return
+		case <-w.wake:
+			// a matching conn was offered, let the picker choose among the pool
+			d.m.Lock()
+			if d.done == 0 {
+				ic, _ = d.pick(selector, picker)
+			}
+			if ic != nil {
+				d.removeWaiter(w)
+				d.m.Unlock()
+				return
+			}
+			d.m.Unlock()
+		case <-ctx.Done():
+			e = ctx.Err()
+		case <-d.close:
+			e = vnet.ErrDialerClosed
+		case <-d.drain:
+			e = ErrDraining
+		}
+	}
+	d.m.Lock()
+	d.removeWaiter(w)
+	d.m.Unlock()
+	select {
+	case abandoned := <-w.ch:
+		// handed out while giving up, say goodbye so the agent reconnects at once
+		reason := e
+		go func() {
+			if abandoned.detach() {
+				abandoned.stream.Send(DatagramFin)
+			}
+			d.closed(abandoned, reason)
+			abandoned.stream.rw.Close()
+		}()
+	default:
+	}
+	return
+}
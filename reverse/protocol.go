@@ -2,25 +2,63 @@ package reverse
 
 import (
 	"encoding/binary"
-	"fmt"
 	"io"
 	"net"
+	"sync"
+	"time"
+
+	"github.com/powerpuffpenguin/vnet/reverse/codec"
 )
 
-const DatagramLen = 2 + 1 + 1
-const DatagramFlag = uint16(3553)
-const DatagramVersion = uint8(1)
+// DatagramLen is the length of a frame header.
+//
+// The wire format is implemented by package codec and specified in codec/SPEC.md.
+const DatagramLen = codec.HeaderLen
+const DatagramPayloadLen = codec.PayloadLenLen
+const DatagramFlag = codec.Flag
+const DatagramVersion = codec.Version
 const (
-	DatagramHeart = uint8(1) + iota
-	DatagramSyn
-	DatagramSynAck
-	DatagramAck
+	DatagramHeart  = codec.EventHeart
+	DatagramSyn    = codec.EventSyn
+	DatagramSynAck = codec.EventSynAck
+	DatagramAck    = codec.EventAck
+	// DatagramRedirect asks an idle agent to reconnect to the address carried in the payload. (version 2)
+	DatagramRedirect = codec.EventRedirect
+	// DatagramForward asks a node of a cluster to dial one of its agents on behalf of another node. (version 2)
+	DatagramForward = codec.EventForward
+	// DatagramFin says goodbye, the receiver drops the idle conn at once. (version 2)
+	DatagramFin = codec.EventFin
+	// DatagramHello is sent by an agent right after connecting, the payload carries its labels. (version 2)
+	DatagramHello = codec.EventHello
+	// DatagramLoad answers a heart, the payload carries the agent's load and capacity. (version 2)
+	DatagramLoad = codec.EventLoad
 )
 
+// finTimeout bounds the time spent sending goodbye over idle conns on close.
+const finTimeout = time.Second
+
 type datagramStream struct {
-	rw net.Conn
-	r  [DatagramLen]byte
-	w  [DatagramLen]byte
+	rw      net.Conn
+	r       [DatagramLen + DatagramPayloadLen]byte
+	w       []byte
+	payload []byte
+	wm      sync.Mutex
+	// waited is set when Wait has read the first byte of the next frame
+	waited bool
+	// version is the highest version of the frames received
+	version uint8
+}
+
+// sendFin says goodbye over idle conns and closes them.
+func sendFin(streams []*datagramStream) {
+	deadline := time.Now().Add(finTimeout)
+	for _, stream := range streams {
+		stream.rw.SetWriteDeadline(deadline)
+	}
+	for _, stream := range streams {
+		stream.Send(DatagramFin)
+		stream.rw.Close()
+	}
 }
 
 func (s *datagramStream) Flag() uint16 {
@@ -32,47 +70,138 @@ func (s *datagramStream) Version() uint8 {
 func (s *datagramStream) Event() uint8 {
 	return uint8(s.r[3])
 }
+
+// Payload returns the payload of the last received frame, it is only valid until the next Recv.
+func (s *datagramStream) Payload() []byte {
+	return s.payload
+}
+
+// Wait blocks until the first byte of the next frame arrives, Recv then reads the frame.
+// An error returned by Wait never interrupts a frame.
+func (s *datagramStream) Wait() (e error) {
+	_, e = io.ReadFull(s.rw, s.r[:1])
+	if e == nil {
+		s.waited = true
+	}
+	return
+}
 func (s *datagramStream) Recv(events ...uint8) (e error) {
-	_, e = io.ReadAtLeast(s.rw, s.r[:], DatagramLen)
+	s.payload = s.payload[:0]
+	offset := 0
+	if s.waited {
+		s.waited = false
+		offset = 1
+	}
+	n, e := io.ReadAtLeast(s.rw, s.r[offset:DatagramLen], DatagramLen-offset)
 	if e != nil {
+		if n != 0 || offset != 0 {
+			e = partialError(e)
+		}
 		return
 	}
-	flag := s.Flag()
-	if flag != DatagramFlag {
-		e = fmt.Errorf(`%w: not supported flag=%v`, ErrProtocol, flag)
+	h, e := codec.DecodeHeader(s.r[:])
+	if e != nil {
 		return
 	}
-	version := s.Version()
-	if version > DatagramVersion {
-		e = fmt.Errorf(`%w: not supported version=%v`, ErrProtocol, version)
-		return
+	if h.Version > s.version {
+		s.version = h.Version
 	}
-	event := s.Event()
-	if event > DatagramAck || event < DatagramHeart {
-		e = fmt.Errorf(`%w: not supported event=%v`, ErrProtocol, event)
-		return
+	if h.Version > 1 {
+		_, e = io.ReadAtLeast(s.rw, s.r[DatagramLen:], DatagramPayloadLen)
+		if e != nil {
+			e = partialError(e)
+			return
+		}
+		n := int(binary.BigEndian.Uint16(s.r[DatagramLen:]))
+		if n != 0 {
+			if cap(s.payload) < n {
+				s.payload = make([]byte, n)
+			} else {
+				s.payload = s.payload[:n]
+			}
+			_, e = io.ReadAtLeast(s.rw, s.payload, n)
+			if e != nil {
+				e = partialError(e)
+				return
+			}
+		}
 	}
 	if len(events) != 0 {
 		for _, evt := range events {
-			if evt == event {
+			if evt == h.Event {
 				return
 			}
 		}
-		e = fmt.Errorf(`%w: unexpected event=%v`, ErrProtocol, event)
+		e = protocolError(h.Version, h.Event, `unexpected event=%v`, h.Event)
 	}
 	return
 }
+
+// partialError makes sure an error that interrupted a frame is not taken for a clean timeout,
+// the stream can't be used any more.
+func partialError(e error) error {
+	if e == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	if ne, ok := e.(net.Error); ok && ne.Timeout() {
+		return protocolError(0, 0, `frame interrupted: %v`, e)
+	}
+	return e
+}
+
+// Send sends a frame without payload.
+// Events introduced by version 1 are sent as version 1 frames, so that version 1 peers keep working.
 func (s *datagramStream) Send(evt uint8) (e error) {
-	if evt > DatagramAck || evt < DatagramHeart {
-		e = fmt.Errorf(`%w: not supported event=%v`, ErrProtocol, evt)
+	e = s.write(codec.Frame{
+		Event: evt,
+	})
+	return
+}
+
+// SendPayload sends a version 2 frame carrying payload.
+func (s *datagramStream) SendPayload(evt uint8, payload []byte) (e error) {
+	e = s.write(codec.Frame{
+		Version: 2,
+		Event:   evt,
+		Payload: payload,
+	})
+	return
+}
+func (s *datagramStream) write(f codec.Frame) (e error) {
+	s.wm.Lock()
+	defer s.wm.Unlock()
+	s.w, e = codec.Append(s.w[:0], f)
+	if e != nil {
 		return
 	}
+	_, e = s.rw.Write(s.w)
+	return
+}
+
+// Addr is a net.Addr carried by the protocol.
+type Addr struct {
+	Net     string
+	Address string
+}
 
-	if s.w[2] == 0 {
-		binary.BigEndian.PutUint16(s.w[:], DatagramFlag)
-		s.w[2] = DatagramVersion
+func (a *Addr) Network() string {
+	return a.Net
+}
+func (a *Addr) String() string {
+	return a.Address
+}
+
+func encodeAddr(addr net.Addr) ([]byte, error) {
+	return codec.EncodeAddr(addr.Network(), addr.String())
+}
+func decodeAddr(b []byte) (addr *Addr, e error) {
+	network, address, e := codec.DecodeAddr(b)
+	if e != nil {
+		return
+	}
+	addr = &Addr{
+		Net:     network,
+		Address: address,
 	}
-	s.w[3] = evt
-	_, e = s.rw.Write(s.w[:])
 	return
 }
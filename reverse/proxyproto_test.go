@@ -0,0 +1,73 @@
+package reverse_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/powerpuffpenguin/vnet"
+	"github.com/powerpuffpenguin/vnet/reverse"
+)
+
+func TestProxyProtocol(t *testing.T) {
+	for _, version := range []uint8{1, 2} {
+		l, e := net.Listen(`tcp`, `127.0.0.1:0`)
+		if e != nil {
+			t.Fatal(e)
+		}
+		dialer := reverse.NewDialer(l, reverse.WithDialerProxyProtocol(version))
+		go dialer.Serve()
+		listener := vnet.ProxyListener(reverse.Listen(l.Addr()), vnet.TrustPrefixes(netip.MustParsePrefix(`127.0.0.0/8`)), time.Second)
+		ch := make(chan net.Addr, 2)
+		go func() {
+			for {
+				c, e := listener.Accept()
+				if e != nil {
+					return
+				}
+				ch <- c.RemoteAddr()
+				io.Copy(io.Discard, c)
+				c.Close()
+			}
+		}()
+
+		// the public client whose address the service should see
+		src := &net.TCPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 40000}
+		dst := &net.TCPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 443}
+		ctx, cancel := context.WithTimeout(vnet.NewProxyContext(context.Background(), src, dst), time.Second*5)
+		c, e := dialer.DialContext(ctx, `tcp`, ``)
+		cancel()
+		if e != nil {
+			t.Fatal(e)
+		}
+		select {
+		case addr := <-ch:
+			if addr.String() != src.String() {
+				t.Fatalf("version %v: expect %v, got %v", version, src, addr)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("not accepted")
+		}
+
+		// without addresses the conn is not proxied, the service sees the dialer
+		c.Close()
+		c, e = dialer.Dial(`tcp`, ``)
+		if e != nil {
+			t.Fatal(e)
+		}
+		select {
+		case addr := <-ch:
+			if addr.String() == src.String() {
+				t.Fatalf("version %v: unexpected %v", version, addr)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("not accepted")
+		}
+		c.Close()
+		listener.Close()
+		dialer.Close()
+	}
+}
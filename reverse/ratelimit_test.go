@@ -0,0 +1,220 @@
+package reverse_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/powerpuffpenguin/vnet/proxy"
+	"github.com/powerpuffpenguin/vnet/ratelimit"
+	"github.com/powerpuffpenguin/vnet/reverse"
+)
+
+func TestLimits(t *testing.T) {
+	l, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	dialer := reverse.NewDialer(l)
+	defer dialer.Close()
+	go dialer.Serve()
+	listener := reverse.Listen(l.Addr(), reverse.WithListenerLabels(map[string]string{`app`: `web`}))
+	defer listener.Close()
+	go func() {
+		for {
+			c, e := listener.Accept()
+			if e != nil {
+				return
+			}
+			go func() {
+				io.Copy(io.Discard, c)
+				c.Close()
+			}()
+		}
+	}()
+
+	limits := dialer.Limits()
+	limits.SetConn(ratelimit.Limit{}, ratelimit.Limit{Rate: 64 * 1024, Burst: 8 * 1024})
+	limits.SetAgentQuota(`127.0.0.1`, 32*1024)
+	selector := reverse.Selector{`app`: `web`}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	c, e := dialer.DialAgent(ctx, selector, nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	start := time.Now()
+	n, e := c.Write(make([]byte, 32*1024))
+	if e != nil || n != 32*1024 {
+		t.Fatal(n, e)
+	}
+	// 8k of burst then 24k at 64k/s
+	if elapsed := time.Since(start); elapsed < time.Millisecond*300 {
+		t.Fatalf("write not shaped, took %v", elapsed)
+	}
+	if ingress, egress := c.(*reverse.Conn).RateLimit(); !ingress.Unlimited() || egress.Rate != 64*1024 {
+		t.Fatalf("unexpected conn limits %v %v", ingress, egress)
+	}
+	c.Close()
+	if used := limits.AgentUsed(`127.0.0.1`); used != 32*1024 {
+		t.Fatalf("expect 32k used, got %d", used)
+	}
+
+	// the agent is out of quota once it has an idle conn again
+	for {
+		dialCtx, dialCancel := context.WithTimeout(ctx, time.Millisecond*100)
+		c, e = dialer.DialAgent(dialCtx, selector, nil)
+		dialCancel()
+		if errors.Is(e, reverse.ErrQuotaExceeded) {
+			break
+		} else if e == nil {
+			c.Close()
+			t.Fatal(`dial should fail once the quota is used up`)
+		} else if ctx.Err() != nil {
+			t.Fatal(e)
+		}
+	}
+
+	limits.ResetAgentUsed(`127.0.0.1`)
+	c, e = dialer.DialAgent(ctx, selector, nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	// a conn using up the quota is closed
+	n, e = c.Write(make([]byte, 40*1024))
+	if !errors.Is(e, reverse.ErrQuotaExceeded) || n != 32*1024 {
+		t.Fatalf("expect quota exceeded after 32k, got %v %v", n, e)
+	}
+	_, e = c.Read(make([]byte, 1))
+	if !errors.Is(e, reverse.ErrQuotaExceeded) {
+		t.Fatalf("expect quota exceeded, got %v", e)
+	}
+	c.Close()
+	limits.ResetAgentUsed(`127.0.0.1`)
+
+	limits.SetQuota(1)
+	_, e = dialer.DialAgent(ctx, selector, nil)
+	if !errors.Is(e, reverse.ErrQuotaExceeded) {
+		t.Fatalf("expect global quota exceeded, got %v", e)
+	}
+}
+func TestLimitsSplice(t *testing.T) {
+	l, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	dialer := reverse.NewDialer(l)
+	defer dialer.Close()
+	go dialer.Serve()
+	listener := reverse.Listen(l.Addr())
+	defer listener.Close()
+	received := make(chan int64, 1)
+	go func() {
+		c, e := listener.Accept()
+		if e != nil {
+			return
+		}
+		n, _ := io.Copy(io.Discard, c)
+		c.Close()
+		received <- n
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	c, e := dialer.DialContext(ctx, `tcp`, ``)
+	if e != nil {
+		t.Fatal(e)
+	}
+	public, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer public.Close()
+	client, e := net.Dial(`tcp`, public.Addr().String())
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer client.Close()
+	server, e := public.Accept()
+	if e != nil {
+		t.Fatal(e)
+	}
+	stats := make(chan proxy.Stats, 1)
+	go func() {
+		stats <- proxy.Join(server, c)
+	}()
+
+	// limits set once the conns are joined still shape the splice
+	dialer.Limits().SetGlobal(ratelimit.Limit{}, ratelimit.Limit{Rate: 256 * 1024, Burst: 32 * 1024})
+	start := time.Now()
+	_, e = client.Write(make([]byte, 512*1024))
+	if e != nil {
+		t.Fatal(e)
+	}
+	client.(*net.TCPConn).CloseWrite()
+	select {
+	case n := <-received:
+		if n != 512*1024 {
+			t.Fatalf("expect 512k, got %d", n)
+		}
+	case <-time.After(time.Second * 10):
+		t.Fatal("not received")
+	}
+	// 32k of burst then 480k at 256k/s
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Fatalf("splice not shaped, took %v", elapsed)
+	}
+	client.Close()
+	if s := <-stats; runtime.GOOS == `linux` && !s.Spliced {
+		t.Fatal("expect spliced")
+	}
+}
+func TestLimitsDeadline(t *testing.T) {
+	l, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	dialer := reverse.NewDialer(l)
+	defer dialer.Close()
+	go dialer.Serve()
+	listener := reverse.Listen(l.Addr())
+	defer listener.Close()
+	go func() {
+		c, e := listener.Accept()
+		if e != nil {
+			return
+		}
+		io.Copy(io.Discard, c)
+		c.Close()
+	}()
+
+	limits := dialer.Limits()
+	limits.SetConn(ratelimit.Limit{}, ratelimit.Limit{Rate: 1024, Burst: 1024})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	c, e := dialer.DialContext(ctx, `tcp`, ``)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer c.Close()
+
+	// the burst is written at once, the wait for the next chunk is cut short by the deadline
+	start := time.Now()
+	c.SetWriteDeadline(start.Add(time.Millisecond * 100))
+	n, e := c.Write(make([]byte, 16*1024))
+	if !errors.Is(e, os.ErrDeadlineExceeded) || n != 1024 {
+		t.Fatal(n, e)
+	} else if elapsed := time.Since(start); elapsed > time.Millisecond*500 {
+		t.Fatalf("write deadline ignored, took %v", elapsed)
+	}
+	// only the bytes written count
+	if used := limits.Used(); used != 1024 {
+		t.Fatalf("expect 1024 used, got %d", used)
+	}
+}
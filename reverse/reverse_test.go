@@ -7,10 +7,14 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"runtime"
 	"testing"
+	"time"
 
 	"github.com/powerpuffpenguin/vnet"
+	"github.com/powerpuffpenguin/vnet/logger"
+	"github.com/powerpuffpenguin/vnet/noise"
 	"github.com/powerpuffpenguin/vnet/reverse"
 )
 
@@ -100,3 +104,514 @@ func runServer(l net.Listener, ch chan<- error) {
 		ch <- nil
 	}
 }
+
+func TestDrain(t *testing.T) {
+	l0, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	l1, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	d0 := reverse.NewDialer(l0)
+	defer d0.Close()
+	go d0.Serve()
+	d1 := reverse.NewDialer(l1)
+	defer d1.Close()
+	go d1.Serve()
+
+	l := reverse.Listen(l0.Addr(), reverse.WithListenerRedirect(func(addr net.Addr) bool {
+		return addr.String() == l1.Addr().String()
+	}))
+	defer l.Close()
+	go func() {
+		for {
+			c, e := l.Accept()
+			if e != nil {
+				return
+			}
+			c.Write([]byte(`ok`))
+			c.Close()
+		}
+	}()
+
+	// wait for the agent to be idle on d0
+	c, e := d0.Dial(`tcp`, ``)
+	if e != nil {
+		t.Fatal(e)
+	}
+	c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	e = d0.Drain(ctx, l1.Addr())
+	if e != nil {
+		t.Fatal(e)
+	}
+	_, e = d0.Dial(`tcp`, ``)
+	if !errors.Is(e, reverse.ErrDraining) {
+		t.Fatalf("expect ErrDraining, got %v", e)
+	}
+
+	c, e = d1.DialContext(ctx, `tcp`, ``)
+	if e != nil {
+		t.Fatal(e)
+	}
+	b, e := ioutil.ReadAll(c)
+	c.Close()
+	if e != nil {
+		t.Fatal(e)
+	} else if string(b) != `ok` {
+		t.Fatalf("unexpected %s", b)
+	}
+	if l.Addr().String() != l1.Addr().String() {
+		t.Fatalf("expect listener redirected to %v, got %v", l1.Addr(), l.Addr())
+	}
+}
+
+func TestRedirect(t *testing.T) {
+	l0, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	d0 := reverse.NewDialer(l0)
+	defer d0.Close()
+	go d0.Serve()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	// nothing listens on the address the dialer redirects to
+	l1, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	l1.Close()
+	go d0.Drain(ctx, l1.Addr())
+	time.Sleep(time.Millisecond * 50)
+
+	// an unauthenticated dialer can't redirect the listener
+	l := reverse.Listen(l0.Addr())
+	defer l.Close()
+	_, e = l.AcceptContext(ctx)
+	if !errors.Is(e, reverse.ErrRedirectRefused) {
+		t.Fatalf("expect ErrRedirectRefused, got %v", e)
+	} else if l.Addr() != l0.Addr() {
+		t.Fatalf("expect %v, got %v", l0.Addr(), l.Addr())
+	}
+
+	// an allowed redirect is followed, and given up once its address keeps failing
+	l = reverse.Listen(l0.Addr(), reverse.WithListenerRedirect(func(addr net.Addr) bool {
+		return true
+	}))
+	defer l.Close()
+	for i := 0; i < 3; i++ {
+		_, e = l.AcceptContext(ctx)
+		if e == nil {
+			t.Fatal("expect error")
+		} else if i < 2 && l.Addr().String() != l1.Addr().String() {
+			t.Fatalf("expect redirected to %v, got %v", l1.Addr(), l.Addr())
+		}
+	}
+	if l.Addr() != l0.Addr() {
+		t.Fatalf("expect back to %v, got %v", l0.Addr(), l.Addr())
+	}
+}
+
+// clusterNode returns a node of the cluster of registry and the address its agents connect to.
+func clusterNode(t *testing.T, registry reverse.Registry, id string, opt ...reverse.DialerOption) (*reverse.Dialer, net.Addr) {
+	l, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	cl, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	d := reverse.NewDialer(l, append([]reverse.DialerOption{reverse.WithDialerCluster(id, cl.Addr(), registry)}, opt...)...)
+	go d.Serve()
+	go d.ServeCluster(cl)
+	return d, l.Addr()
+}
+
+// serveClusterAgent attaches an agent writing id to addr and waits until node id publishes it.
+func serveClusterAgent(ctx context.Context, t *testing.T, registry reverse.Registry, id string, addr net.Addr, opt ...reverse.ListenerOption) *reverse.Listener {
+	l := reverse.Listen(addr, opt...)
+	go func() {
+		for {
+			c, e := l.Accept()
+			if e != nil {
+				return
+			}
+			c.Write([]byte(id))
+			c.Close()
+		}
+	}()
+	for {
+		nodes, _ := registry.Nodes(ctx)
+		for _, node := range nodes {
+			if node.ID == id && node.Idle > 0 {
+				return l
+			}
+		}
+		select {
+		case <-ctx.Done():
+			l.Close()
+			t.Fatal(ctx.Err())
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+}
+
+func TestCluster(t *testing.T) {
+	registry := reverse.NewMemoryRegistry(0)
+	a, _ := clusterNode(t, registry, `a`)
+	defer a.Close()
+	b, addr := clusterNode(t, registry, `b`)
+	defer b.Close()
+
+	// the agent is only attached to b
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	l := serveClusterAgent(ctx, t, registry, `b`, addr)
+	defer l.Close()
+
+	c, e := a.DialContext(ctx, `tcp`, ``)
+	if e != nil {
+		t.Fatal(e)
+	}
+	b0, e := ioutil.ReadAll(c)
+	c.Close()
+	if e != nil {
+		t.Fatal(e)
+	} else if string(b0) != `b` {
+		t.Fatalf("unexpected %s", b0)
+	}
+}
+
+func TestClusterLabels(t *testing.T) {
+	registry := reverse.NewMemoryRegistry(0)
+	a, _ := clusterNode(t, registry, `a`)
+	defer a.Close()
+	b, bAddr := clusterNode(t, registry, `b`)
+	defer b.Close()
+	c, cAddr := clusterNode(t, registry, `c`)
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	// b has the most idle agents but none matches, it must refuse at once instead of waiting for one
+	for i := 0; i < 2; i++ {
+		l := serveClusterAgent(ctx, t, registry, `b`, bAddr, reverse.WithListenerLabels(map[string]string{`zone`: `x`}))
+		defer l.Close()
+	}
+	l := serveClusterAgent(ctx, t, registry, `c`, cAddr, reverse.WithListenerLabels(map[string]string{`zone`: `y`}))
+	defer l.Close()
+	for {
+		nodes, _ := registry.Nodes(ctx)
+		idle := make(map[string]int)
+		for _, node := range nodes {
+			idle[node.ID] = node.Idle
+		}
+		if idle[`b`] > idle[`c`] {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal(ctx.Err())
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+
+	dialCtx, dialCancel := context.WithTimeout(ctx, time.Second)
+	defer dialCancel()
+	conn, e := a.DialAgent(dialCtx, reverse.Selector{`zone`: `y`}, nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	b0, e := ioutil.ReadAll(conn)
+	conn.Close()
+	if e != nil {
+		t.Fatal(e)
+	} else if string(b0) != `c` {
+		t.Fatalf("unexpected %s", b0)
+	}
+}
+
+func TestClusterNoise(t *testing.T) {
+	aKey, bKey, otherKey := noiseKey(t), noiseKey(t), noiseKey(t)
+	registry := reverse.NewMemoryRegistry(0)
+	a, _ := clusterNode(t, registry, `a`, reverse.WithDialerClusterNoise(aKey,
+		noise.WithPeerKeys(bKey.PublicKey().Bytes()),
+	))
+	defer a.Close()
+	b, addr := clusterNode(t, registry, `b`, reverse.WithDialerClusterNoise(bKey,
+		noise.WithPeerKeys(aKey.PublicKey().Bytes()),
+	))
+	defer b.Close()
+	// other is not a node b accepts
+	other, _ := clusterNode(t, registry, `other`, reverse.WithDialerClusterNoise(otherKey))
+	defer other.Close()
+	// plain is not secured at all
+	plain, _ := clusterNode(t, registry, `plain`)
+	defer plain.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	l := serveClusterAgent(ctx, t, registry, `b`, addr)
+	defer l.Close()
+
+	c, e := a.DialContext(ctx, `tcp`, ``)
+	if e != nil {
+		t.Fatal(e)
+	}
+	b0, e := ioutil.ReadAll(c)
+	c.Close()
+	if e != nil {
+		t.Fatal(e)
+	} else if string(b0) != `b` {
+		t.Fatalf("unexpected %s", b0)
+	}
+
+	// refused forwards fall back to waiting for a local agent
+	for _, d := range []*reverse.Dialer{other, plain} {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+		c, e = d.DialContext(ctx, `tcp`, ``)
+		cancel()
+		if e == nil {
+			c.Close()
+			t.Fatal("expect forward refused")
+		}
+	}
+}
+
+func TestFin(t *testing.T) {
+	l, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	dialer := reverse.NewDialer(l)
+	go dialer.Serve()
+	listener := reverse.Listen(l.Addr())
+	defer listener.Close()
+
+	ch := make(chan error, 1)
+	go func() {
+		_, e := listener.Accept()
+		ch <- e
+	}()
+	// wait for the agent to be idle
+	time.Sleep(time.Millisecond * 100)
+	dialer.Close()
+
+	// the agent reconnects at once instead of waiting for the heart timeout, and finds the dialer gone
+	select {
+	case e = <-ch:
+		if e == nil {
+			t.Fatal("expect error")
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("agent did not notice goodbye")
+	}
+}
+
+func TestListenerFin(t *testing.T) {
+	l, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	var log logRecorder
+	dialer := reverse.NewDialer(l, reverse.WithDialerLogger(&log))
+	defer dialer.Close()
+	go dialer.Serve()
+	listener := reverse.Listen(l.Addr())
+
+	ch := make(chan error, 1)
+	go func() {
+		_, e := listener.Accept()
+		ch <- e
+	}()
+	// wait for the agent to be idle
+	time.Sleep(time.Millisecond * 100)
+	listener.Close()
+	if e = <-ch; !errors.Is(e, vnet.ErrListenerClosed) {
+		t.Fatal(e)
+	}
+	// the accept is interrupted first, then says goodbye
+	record := log.wait(t, logger.LevelDebug, `idle conn closed`)
+	if record.keyvals[`err`] != `peer said goodbye` {
+		t.Fatalf("unexpected record %+v", record)
+	}
+}
+
+func TestDialAgent(t *testing.T) {
+	l, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	dialer := reverse.NewDialer(l,
+		reverse.WithDialerHeart(time.Millisecond*20),
+		reverse.WithDialerPicker(reverse.LeastLoaded),
+	)
+	defer dialer.Close()
+	go dialer.Serve()
+
+	serve := func(region string, load uint32) *reverse.Listener {
+		l := reverse.Listen(l.Addr(),
+			reverse.WithListenerLabels(map[string]string{`region`: region}),
+			reverse.WithListenerLoad(func() (uint32, uint32) {
+				return load, 10
+			}),
+		)
+		go func() {
+			for {
+				c, e := l.Accept()
+				if e != nil {
+					return
+				}
+				c.Write([]byte(region))
+				c.Close()
+			}
+		}()
+		return l
+	}
+	for _, l := range []*reverse.Listener{
+		serve(`eu`, 1),
+		serve(`us`, 5),
+	} {
+		defer l.Close()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	for _, region := range []string{`us`, `eu`, `us`} {
+		c, e := dialer.DialAgent(ctx, reverse.Selector{`region`: region}, nil)
+		if e != nil {
+			t.Fatal(e)
+		}
+		b, e := ioutil.ReadAll(c)
+		c.Close()
+		if e != nil {
+			t.Fatal(e)
+		} else if string(b) != region {
+			t.Fatalf("expect %s, got %s", region, b)
+		}
+	}
+}
+
+func TestPicker(t *testing.T) {
+	agents := []*reverse.Agent{
+		{Load: 8, Capacity: 10},
+		{Load: 3, Capacity: 10},
+		{Load: 10, Capacity: 10},
+	}
+	if i := reverse.LeastLoaded(agents); i != 1 {
+		t.Fatalf("LeastLoaded expect 1, got %v", i)
+	}
+	for i := 0; i < 100; i++ {
+		if i := reverse.WeightedRandom(agents); i == 2 {
+			t.Fatal("WeightedRandom picked a full agent")
+		}
+	}
+	if i := reverse.WeightedRandom(nil); i != -1 {
+		t.Fatalf("WeightedRandom expect -1, got %v", i)
+	}
+}
+
+func TestPickerUnlocked(t *testing.T) {
+	l, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	dialer := reverse.NewDialer(l)
+	defer dialer.Close()
+	go dialer.Serve()
+	admin := reverse.NewDialerAdmin(dialer)
+
+	// the picker may use the dialer and change the agents it is given
+	picker := func(agents []*reverse.Agent) int {
+		admin.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(`GET`, `/`, nil))
+		for _, agent := range agents {
+			agent.Labels[`picked`] = `yes`
+		}
+		return 0
+	}
+	ch := make(chan net.Conn, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		c, e := dialer.DialAgent(ctx, reverse.Selector{`region`: `eu`}, picker)
+		if e != nil {
+			t.Error(e)
+		}
+		ch <- c
+	}()
+	// the dial is waiting when the agent arrives
+	time.Sleep(time.Millisecond * 50)
+	listener := reverse.Listen(l.Addr(), reverse.WithListenerLabels(map[string]string{`region`: `eu`}))
+	defer listener.Close()
+	go func() {
+		for {
+			c, e := listener.Accept()
+			if e != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	select {
+	case c := <-ch:
+		if c == nil {
+			t.FailNow()
+		}
+		defer c.Close()
+		if labels := c.(*reverse.Conn).Agent().Labels; labels[`picked`] != `` {
+			t.Fatalf("picker changed the labels of the pool %v", labels)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("dial not picked")
+	}
+}
+
+func TestAcceptContext(t *testing.T) {
+	l, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	dialer := reverse.NewDialer(l)
+	defer dialer.Close()
+	go dialer.Serve()
+	listener := reverse.Listen(l.Addr())
+	defer listener.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	_, e = listener.AcceptContext(ctx)
+	cancel()
+	if !errors.Is(e, context.DeadlineExceeded) {
+		t.Fatalf("expect context.DeadlineExceeded, got %v", e)
+	}
+
+	// the abandoned idle conn said goodbye, so the dialer is not handed a dead conn
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*200)
+	_, e = dialer.DialContext(ctx, `tcp`, ``)
+	cancel()
+	if e == nil {
+		t.Fatal("expect dial to wait for a new agent")
+	}
+
+	ch := make(chan error, 1)
+	go func() {
+		c, e := listener.Accept()
+		if e == nil {
+			c.Close()
+		}
+		ch <- e
+	}()
+	c, e := dialer.Dial(`tcp`, ``)
+	if e != nil {
+		t.Fatal(e)
+	}
+	c.Close()
+	if e = <-ch; e != nil {
+		t.Fatal(e)
+	}
+}
@@ -0,0 +1,113 @@
+package reverse_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/powerpuffpenguin/vnet/reverse"
+	"github.com/powerpuffpenguin/vnet/trace"
+)
+
+func TestTrace(t *testing.T) {
+	registry := reverse.NewMemoryRegistry(0)
+	newNode := func(id string, tracer trace.Tracer) (*reverse.Dialer, net.Addr) {
+		l, e := net.Listen(`tcp`, `127.0.0.1:0`)
+		if e != nil {
+			t.Fatal(e)
+		}
+		cl, e := net.Listen(`tcp`, `127.0.0.1:0`)
+		if e != nil {
+			t.Fatal(e)
+		}
+		d := reverse.NewDialer(l,
+			reverse.WithDialerCluster(id, cl.Addr(), registry),
+			reverse.WithDialerTracer(tracer),
+		)
+		go d.Serve()
+		go d.ServeCluster(cl)
+		return d, l.Addr()
+	}
+	ra, rb := trace.NewRecorder(), trace.NewRecorder()
+	a, _ := newNode(`a`, ra)
+	defer a.Close()
+	b, addr := newNode(`b`, rb)
+	defer b.Close()
+
+	// the agent is only attached to b
+	l := reverse.Listen(addr)
+	defer l.Close()
+	go func() {
+		for {
+			c, e := l.Accept()
+			if e != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	parent := trace.SpanContext{
+		TraceID: [16]byte{1},
+		SpanID:  [8]byte{2},
+	}
+	ctx = trace.ContextWithSpanContext(ctx, parent)
+	waitIdle := func() {
+		for {
+			nodes, _ := registry.Nodes(ctx)
+			found := false
+			for _, node := range nodes {
+				if node.ID == `b` && node.Idle > 0 {
+					found = true
+				}
+			}
+			if found {
+				break
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+
+	// local dial
+	waitIdle()
+	c, e := b.DialContext(ctx, `tcp`, ``)
+	if e != nil {
+		t.Fatal(e)
+	}
+	c.Close()
+	spans := rb.Spans()
+	if len(spans) != 3 {
+		t.Fatalf("expect 3 spans, got %v", spans)
+	}
+	wait, handshake, dial := spans[0], spans[1], spans[2]
+	if wait.Name != `vnet.reverse.pool_wait` || handshake.Name != `vnet.reverse.handshake` || dial.Name != `vnet.reverse.dial` {
+		t.Fatalf("unexpected spans %v", spans)
+	} else if dial.Parent != parent || wait.Parent != dial.SpanContext || handshake.Parent != dial.SpanContext {
+		t.Fatalf("unexpected parents %v", spans)
+	}
+	for _, span := range spans[:2] {
+		if span.Attribute(trace.AgentID) != `127.0.0.1` || span.Attribute(trace.PeerAddr) == nil || span.Err != nil {
+			t.Fatalf("unexpected span %+v", span)
+		}
+	}
+
+	// forwarded dial
+	waitIdle()
+	c, e = a.DialContext(ctx, `tcp`, ``)
+	if e != nil {
+		t.Fatal(e)
+	}
+	c.Close()
+	names := make(map[string]trace.SpanData)
+	for _, span := range ra.Spans() {
+		names[span.Name] = span
+	}
+	forward, ok := names[`vnet.reverse.forward`]
+	if !ok || forward.Err != nil || forward.Attribute(trace.PeerAddr) == nil {
+		t.Fatalf("unexpected spans %v", ra.Spans())
+	} else if forward.Parent != names[`vnet.reverse.dial`].SpanContext || forward.TraceID != parent.TraceID {
+		t.Fatalf("unexpected forward span %+v", forward)
+	}
+}
@@ -0,0 +1,155 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+
+	"github.com/powerpuffpenguin/vnet/errs"
+)
+
+var errNetwork = errors.New(`socks5 dialer only dials tcp`)
+
+// Dialer is a vnet.Dialer connecting to its targets through a SOCKS5 server with CONNECT.
+type Dialer struct {
+	opts    dialerOptions
+	network string
+	addr    string
+}
+
+// NewDialer returns a dialer using the server at addr.
+func NewDialer(network, addr string, opt ...DialerOption) *Dialer {
+	opts := defaultDialerOptions
+	for _, o := range opt {
+		o.apply(&opts)
+	}
+	return &Dialer{
+		opts:    opts,
+		network: network,
+		addr:    addr,
+	}
+}
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext asks the server to connect to addr, network must be tcp, tcp4 or tcp6.
+// Host names in addr are resolved by the server.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (c net.Conn, e error) {
+	switch network {
+	case `tcp`, `tcp4`, `tcp6`:
+	default:
+		e = errs.NewOpError(`dial`, errs.SideDialer, nil, errNetwork)
+		return
+	}
+	host, port, e := splitAddr(addr)
+	if e != nil {
+		e = errs.NewOpError(`dial`, errs.SideDialer, nil, e)
+		return
+	}
+	c, e = d.opts.forward.DialContext(ctx, d.network, d.addr)
+	if e != nil {
+		e = errs.NewOpError(`dial`, errs.SideDialer, nil, e)
+		return
+	}
+	e = d.handshake(ctx, c, host, port)
+	if e != nil {
+		e = errs.NewOpError(`dial`, errs.SideDialer, c.RemoteAddr(), e)
+		c.Close()
+		c = nil
+	}
+	return
+}
+
+// handshake authenticates and sends CONNECT, c is closed if ctx is done first.
+func (d *Dialer) handshake(ctx context.Context, c net.Conn, host string, port uint16) (e error) {
+	done := make(chan struct{})
+	ch := make(chan error, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+			ch <- ctx.Err()
+		case <-done:
+			ch <- nil
+		}
+	}()
+	e = d.exchange(c, host, port)
+	close(done)
+	if err := <-ch; err != nil {
+		e = err
+	}
+	return
+}
+func (d *Dialer) exchange(c net.Conn, host string, port uint16) (e error) {
+	method := MethodNoAuth
+	if d.opts.auth {
+		method = MethodUserPassword
+	}
+	_, e = c.Write([]byte{Version, 1, method})
+	if e != nil {
+		return
+	}
+	var b [2]byte
+	_, e = io.ReadFull(c, b[:])
+	if e != nil {
+		return
+	} else if b[0] != Version {
+		e = protocolError(0, `unknown version %v`, b[0])
+		return
+	} else if b[1] == MethodNoAcceptable {
+		e = ErrNoAcceptableMethods
+		return
+	} else if b[1] != method {
+		e = protocolError(b[1], `unexpected method %v`, b[1])
+		return
+	}
+	if method == MethodUserPassword {
+		e = d.authenticate(c)
+		if e != nil {
+			return
+		}
+	}
+
+	request, e := appendAddr([]byte{Version, CmdConnect, 0}, host, port)
+	if e != nil {
+		return
+	}
+	_, e = c.Write(request)
+	if e != nil {
+		return
+	}
+	reply, _, _, e := readRequest(c)
+	if e == nil && reply != ReplySucceeded {
+		e = &ReplyError{
+			Reply: reply,
+		}
+	}
+	return
+}
+
+// authenticate sends the username and password, RFC 1929.
+func (d *Dialer) authenticate(c net.Conn) (e error) {
+	user, password := d.opts.user, d.opts.password
+	if len(user) == 0 || len(user) > 255 || len(password) == 0 || len(password) > 255 {
+		e = ErrAuth
+		return
+	}
+	b := make([]byte, 0, 3+len(user)+len(password))
+	b = append(b, userPasswordVersion, byte(len(user)))
+	b = append(b, user...)
+	b = append(b, byte(len(password)))
+	b = append(b, password...)
+	_, e = c.Write(b)
+	if e != nil {
+		return
+	}
+	_, e = io.ReadFull(c, b[:2])
+	if e != nil {
+		return
+	} else if b[1] != 0 {
+		e = ErrAuth
+	}
+	return
+}
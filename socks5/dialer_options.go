@@ -0,0 +1,49 @@
+package socks5
+
+import (
+	"net"
+
+	"github.com/powerpuffpenguin/vnet"
+)
+
+var defaultDialerOptions = dialerOptions{
+	forward: &net.Dialer{},
+}
+
+type dialerOptions struct {
+	forward  vnet.Dialer
+	user     string
+	password string
+	auth     bool
+}
+type DialerOption interface {
+	apply(*dialerOptions)
+}
+type funcDialerOption struct {
+	f func(*dialerOptions)
+}
+
+func (fdo *funcDialerOption) apply(do *dialerOptions) {
+	fdo.f(do)
+}
+func newDialerOption(f func(*dialerOptions)) *funcDialerOption {
+	return &funcDialerOption{
+		f: f,
+	}
+}
+
+// WithDialerForward sets the dialer used to reach the server, by default a net.Dialer.
+func WithDialerForward(d vnet.Dialer) DialerOption {
+	return newDialerOption(func(o *dialerOptions) {
+		o.forward = d
+	})
+}
+
+// WithDialerAuth authenticates to the server with a username and password.
+func WithDialerAuth(user, password string) DialerOption {
+	return newDialerOption(func(o *dialerOptions) {
+		o.user = user
+		o.password = password
+		o.auth = true
+	})
+}
@@ -0,0 +1,47 @@
+package socks5
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/powerpuffpenguin/vnet/errs"
+)
+
+var ErrProtocol = errors.New(`socks5 protocol error`)
+var ErrAuth = errors.New(`socks5 authentication failed`)
+
+// ErrNoAcceptableMethods is returned by dials when the server accepts none of the offered authentication methods.
+var ErrNoAcceptableMethods = errors.New(`socks5 no acceptable authentication methods`)
+
+// protocolError returns an *errs.ProtocolError that matches ErrProtocol.
+func protocolError(event uint8, format string, a ...interface{}) error {
+	return &errs.ProtocolError{
+		Err:     ErrProtocol,
+		Version: Version,
+		Event:   event,
+		Msg:     fmt.Sprintf(format, a...),
+	}
+}
+
+var replyText = map[uint8]string{
+	ReplyGeneralFailure:       `general SOCKS server failure`,
+	ReplyNotAllowed:           `connection not allowed by ruleset`,
+	ReplyNetworkUnreachable:   `network unreachable`,
+	ReplyHostUnreachable:      `host unreachable`,
+	ReplyConnectionRefused:    `connection refused`,
+	ReplyTTLExpired:           `TTL expired`,
+	ReplyCommandNotSupported:  `command not supported`,
+	ReplyAddrTypeNotSupported: `address type not supported`,
+}
+
+// ReplyError is returned by dials when the server fails the request.
+type ReplyError struct {
+	Reply uint8
+}
+
+func (e *ReplyError) Error() string {
+	if s, ok := replyText[e.Reply]; ok {
+		return `socks5 ` + s
+	}
+	return fmt.Sprintf(`socks5 unknown reply %v`, e.Reply)
+}
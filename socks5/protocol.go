@@ -0,0 +1,192 @@
+// Package socks5 implements a SOCKS5 server serving any net.Listener and a client vnet.Dialer, RFC 1928 and RFC 1929.
+package socks5
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+)
+
+// Version is the SOCKS protocol version, RFC 1928.
+const Version = uint8(5)
+
+// authentication methods
+const (
+	MethodNoAuth       = uint8(0)
+	MethodUserPassword = uint8(2)
+	MethodNoAcceptable = uint8(0xff)
+)
+
+// userPasswordVersion is the version of the username/password subnegotiation, RFC 1929.
+const userPasswordVersion = uint8(1)
+
+// commands
+const (
+	CmdConnect      = uint8(1)
+	CmdBind         = uint8(2)
+	CmdUDPAssociate = uint8(3)
+)
+
+// address types
+const (
+	atypIPv4   = uint8(1)
+	atypDomain = uint8(3)
+	atypIPv6   = uint8(4)
+)
+
+// replies
+const (
+	ReplySucceeded            = uint8(0)
+	ReplyGeneralFailure       = uint8(1)
+	ReplyNotAllowed           = uint8(2)
+	ReplyNetworkUnreachable   = uint8(3)
+	ReplyHostUnreachable      = uint8(4)
+	ReplyConnectionRefused    = uint8(5)
+	ReplyTTLExpired           = uint8(6)
+	ReplyCommandNotSupported  = uint8(7)
+	ReplyAddrTypeNotSupported = uint8(8)
+)
+
+// splitAddr splits host:port.
+func splitAddr(addr string) (host string, port uint16, e error) {
+	host, s, e := net.SplitHostPort(addr)
+	if e != nil {
+		return
+	}
+	p, e := strconv.ParseUint(s, 10, 16)
+	if e != nil {
+		e = fmt.Errorf(`invalid port %q`, s)
+		return
+	}
+	port = uint16(p)
+	return
+}
+
+// appendAddr appends the address type, address and port of host:port.
+func appendAddr(b []byte, host string, port uint16) ([]byte, error) {
+	if ip, e := netip.ParseAddr(host); e == nil {
+		ip = ip.Unmap()
+		if ip.Is4() {
+			b = append(b, atypIPv4)
+		} else {
+			b = append(b, atypIPv6)
+		}
+		b = append(b, ip.AsSlice()...)
+	} else if len(host) == 0 || len(host) > 255 {
+		return nil, fmt.Errorf(`invalid host %q`, host)
+	} else {
+		b = append(b, atypDomain, byte(len(host)))
+		b = append(b, host...)
+	}
+	return binary.BigEndian.AppendUint16(b, port), nil
+}
+
+// appendNetAddr appends addr if it is a TCP or UDP address, 0.0.0.0:0 otherwise.
+func appendNetAddr(b []byte, addr net.Addr) []byte {
+	var ap netip.AddrPort
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ap = addr.AddrPort()
+	case *net.UDPAddr:
+		ap = addr.AddrPort()
+	}
+	if !ap.IsValid() {
+		return append(b, atypIPv4, 0, 0, 0, 0, 0, 0)
+	}
+	b, _ = appendAddr(b, ap.Addr().String(), ap.Port())
+	return b
+}
+
+// readAddr reads an address type, address and port.
+func readAddr(r io.Reader) (host string, port uint16, e error) {
+	var b [1 + 255 + 2]byte
+	_, e = io.ReadFull(r, b[:1])
+	if e != nil {
+		return
+	}
+	// start is where the address begins, n its length
+	start, n := 1, 0
+	switch b[0] {
+	case atypIPv4:
+		n = net.IPv4len
+	case atypIPv6:
+		n = net.IPv6len
+	case atypDomain:
+		_, e = io.ReadFull(r, b[1:2])
+		if e != nil {
+			return
+		}
+		start, n = 2, int(b[1])
+	default:
+		e = protocolError(b[0], `unknown address type %v`, b[0])
+		return
+	}
+	_, e = io.ReadFull(r, b[start:start+n+2])
+	if e != nil {
+		return
+	}
+	host, port, _, e = parseAddr(b[:start+n+2])
+	return
+}
+
+// parseAddr parses an address type, address and port at the start of b, n is their length.
+func parseAddr(b []byte) (host string, port uint16, n int, e error) {
+	if len(b) < 1 {
+		e = protocolError(0, `missing address`)
+		return
+	}
+	switch b[0] {
+	case atypIPv4:
+		n = 1 + net.IPv4len
+	case atypIPv6:
+		n = 1 + net.IPv6len
+	case atypDomain:
+		if len(b) < 2 || b[1] == 0 {
+			e = protocolError(b[0], `invalid domain`)
+			return
+		}
+		n = 2 + int(b[1])
+	default:
+		e = protocolError(b[0], `unknown address type %v`, b[0])
+		return
+	}
+	if len(b) < n+2 {
+		e = protocolError(b[0], `address too short`)
+		return
+	}
+	switch b[0] {
+	case atypIPv4, atypIPv6:
+		ip, _ := netip.AddrFromSlice(b[1:n])
+		host = ip.String()
+	default:
+		host = string(b[2:n])
+	}
+	port = binary.BigEndian.Uint16(b[n:])
+	n += 2
+	return
+}
+
+// readRequest reads the request or reply following the greeting, code is the command or the reply.
+func readRequest(r io.Reader) (code uint8, host string, port uint16, e error) {
+	var b [3]byte
+	_, e = io.ReadFull(r, b[:])
+	if e != nil {
+		return
+	} else if b[0] != Version {
+		e = protocolError(0, `unknown version %v`, b[0])
+		return
+	}
+	code = b[1]
+	host, port, e = readAddr(r)
+	return
+}
+
+// writeReply writes a reply with the bound address addr.
+func writeReply(w io.Writer, reply uint8, addr net.Addr) (e error) {
+	b := appendNetAddr([]byte{Version, reply, 0}, addr)
+	_, e = w.Write(b)
+	return
+}
@@ -0,0 +1,92 @@
+package socks5
+
+import (
+	"net/netip"
+	"strings"
+)
+
+// Request is what a client asks the server for.
+type Request struct {
+	// Command is CmdConnect, or CmdUDPAssociate for each datagram of an association.
+	Command uint8
+	// User is the authenticated user, empty without authentication.
+	User string
+	// Host is the target host name or IP, Port its port.
+	Host string
+	Port uint16
+}
+
+// Rule allows the requests it matches, an empty field matches anything.
+type Rule struct {
+	Commands []uint8
+	Users    []string
+	// Hosts are host names, *.example.com wildcards matching the subdomains of example.com,
+	// IPs or CIDR prefixes matching the targets given as IP.
+	Hosts []string
+	Ports []uint16
+}
+
+// Match reports whether r allows req.
+func (r *Rule) Match(req *Request) bool {
+	if !some(len(r.Commands), func(i int) bool { return r.Commands[i] == req.Command }) ||
+		!some(len(r.Users), func(i int) bool { return r.Users[i] == req.User }) ||
+		!some(len(r.Ports), func(i int) bool { return r.Ports[i] == req.Port }) {
+		return false
+	} else if len(r.Hosts) == 0 {
+		return true
+	}
+	ip, e := netip.ParseAddr(req.Host)
+	isIP := e == nil
+	if isIP {
+		ip = ip.Unmap()
+	}
+	for _, host := range r.Hosts {
+		if isIP {
+			if prefix, e := netip.ParsePrefix(host); e == nil {
+				if prefix.Contains(ip) {
+					return true
+				}
+				continue
+			} else if addr, e := netip.ParseAddr(host); e == nil {
+				if addr.Unmap() == ip {
+					return true
+				}
+				continue
+			}
+		}
+		if strings.HasPrefix(host, `*.`) {
+			if strings.HasSuffix(strings.ToLower(req.Host), strings.ToLower(host[1:])) {
+				return true
+			}
+		} else if strings.EqualFold(host, req.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+// some reports whether f holds for one of the n elements of a field, an empty field matches anything.
+func some(n int, f func(i int) bool) bool {
+	if n == 0 {
+		return true
+	}
+	for i := 0; i < n; i++ {
+		if f(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed reports whether one of rules allows req, no rules allow everything.
+func allowed(rules []Rule, req *Request) bool {
+	if len(rules) == 0 {
+		return true
+	}
+	for i := range rules {
+		if rules[i].Match(req) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,308 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/powerpuffpenguin/vnet"
+	"github.com/powerpuffpenguin/vnet/logger"
+	"github.com/powerpuffpenguin/vnet/proxy"
+)
+
+// errNotAllowed is logged when the rules deny a request.
+var errNotAllowed = errors.New(`not allowed by the rules`)
+
+// errTooManyTargets is logged when an association drops a datagram to a new target.
+var errTooManyTargets = errors.New(`too many udp targets`)
+
+// errNotPacketConn is logged when the dialer returns a stream conn for a udp target.
+var errNotPacketConn = errors.New(`dialer returned no packet conn for udp`)
+
+// Server is a SOCKS5 server, it serves CONNECT and, if enabled, UDP ASSOCIATE on any net.Listener.
+type Server struct {
+	opts serverOptions
+
+	conns     map[net.Conn]struct{}
+	listeners map[net.Listener]struct{}
+
+	close <-chan struct{}
+	done  uint32
+	m     sync.Mutex
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewServer(opt ...ServerOption) *Server {
+	opts := defaultServerOptions
+	for _, o := range opt {
+		o.apply(&opts)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Server{
+		opts:      opts,
+		conns:     make(map[net.Conn]struct{}),
+		listeners: make(map[net.Listener]struct{}),
+		close:     ctx.Done(),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+}
+
+// Close closes the server, all listeners passed to Serve and all client conns.
+func (s *Server) Close() (e error) {
+	if atomic.LoadUint32(&s.done) == 0 {
+		s.m.Lock()
+		defer s.m.Unlock()
+		if s.done == 0 {
+			defer atomic.StoreUint32(&s.done, 1)
+			s.cancel()
+			for l := range s.listeners {
+				l.Close()
+			}
+			for c := range s.conns {
+				c.Close()
+			}
+			s.conns = nil
+			s.listeners = nil
+			return
+		}
+	}
+	e = vnet.ErrClosed
+	return
+}
+
+// Serve accepts clients on l until the server or l is closed.
+func (s *Server) Serve(l net.Listener) error {
+	s.m.Lock()
+	if s.done != 0 {
+		s.m.Unlock()
+		return vnet.ErrClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.m.Unlock()
+
+	var tempDelay time.Duration // how long to sleep on accept failure
+	for {
+		c, e := l.Accept()
+		if e != nil {
+			select {
+			case <-s.close:
+				return vnet.ErrClosed
+			default:
+			}
+			if ne, ok := e.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				s.log(logger.LevelWarn, `accept failed, retrying`, nil, e, `addr`, l.Addr(), `delay`, tempDelay)
+				time.Sleep(tempDelay)
+				continue
+			}
+			s.m.Lock()
+			if s.done == 0 {
+				delete(s.listeners, l)
+			}
+			s.m.Unlock()
+			return e
+		}
+		tempDelay = 0
+		go s.onAccept(c)
+	}
+}
+func (s *Server) onAccept(c net.Conn) {
+	if !s.track(c) {
+		return
+	}
+	defer s.untrack(c)
+	if s.opts.timeout > 0 {
+		c.SetDeadline(time.Now().Add(s.opts.timeout))
+	}
+	user, e := s.authenticate(c)
+	if e != nil {
+		s.log(logger.LevelDebug, `authentication failed`, c, e)
+		return
+	}
+	cmd, host, port, e := readRequest(c)
+	if e != nil {
+		s.log(logger.LevelDebug, `request failed`, c, e)
+		return
+	}
+	switch cmd {
+	case CmdConnect:
+		s.connect(c, user, host, port)
+	case CmdUDPAssociate:
+		if s.opts.udp != nil {
+			s.associate(c, user, host, port)
+			break
+		}
+		fallthrough
+	default:
+		writeReply(c, ReplyCommandNotSupported, nil)
+		s.log(logger.LevelDebug, `command not supported`, c, nil, `command`, cmd)
+	}
+}
+func (s *Server) track(c net.Conn) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.done != 0 {
+		c.Close()
+		return false
+	}
+	s.conns[c] = struct{}{}
+	return true
+}
+func (s *Server) untrack(c net.Conn) {
+	c.Close()
+	s.m.Lock()
+	if s.done == 0 {
+		delete(s.conns, c)
+	}
+	s.m.Unlock()
+}
+
+// authenticate negotiates the method offered by the client that the server requires,
+// it returns the user if the client authenticated with a username and password.
+func (s *Server) authenticate(c net.Conn) (user string, e error) {
+	var b [256]byte
+	_, e = io.ReadFull(c, b[:2])
+	if e != nil {
+		return
+	} else if b[0] != Version {
+		e = protocolError(0, `unknown version %v`, b[0])
+		return
+	}
+	methods := b[:b[1]]
+	_, e = io.ReadFull(c, methods)
+	if e != nil {
+		return
+	}
+	method := MethodNoAuth
+	if s.opts.auth != nil {
+		method = MethodUserPassword
+	}
+	offered := false
+	for _, m := range methods {
+		if m == method {
+			offered = true
+			break
+		}
+	}
+	if !offered {
+		c.Write([]byte{Version, MethodNoAcceptable})
+		e = ErrNoAcceptableMethods
+		return
+	}
+	_, e = c.Write([]byte{Version, method})
+	if e != nil || method == MethodNoAuth {
+		return
+	}
+
+	// RFC 1929: version(1) ulen(1) user plen(1) password
+	_, e = io.ReadFull(c, b[:2])
+	if e != nil {
+		return
+	} else if b[0] != userPasswordVersion {
+		e = protocolError(MethodUserPassword, `unknown username/password version %v`, b[0])
+		return
+	}
+	ulen := int(b[1])
+	// the user and the length of the password
+	_, e = io.ReadFull(c, b[:ulen+1])
+	if e != nil {
+		return
+	}
+	user = string(b[:ulen])
+	plen := int(b[ulen])
+	_, e = io.ReadFull(c, b[:plen])
+	if e != nil {
+		return
+	}
+	password := string(b[:plen])
+	if !s.opts.auth(user, password) {
+		c.Write([]byte{userPasswordVersion, 1})
+		e = ErrAuth
+		return
+	}
+	_, e = c.Write([]byte{userPasswordVersion, 0})
+	return
+}
+
+// connect dials the target and joins it with the client.
+func (s *Server) connect(c net.Conn, user, host string, port uint16) {
+	addr := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	if !allowed(s.opts.rules, &Request{
+		Command: CmdConnect,
+		User:    user,
+		Host:    host,
+		Port:    port,
+	}) {
+		writeReply(c, ReplyNotAllowed, nil)
+		s.log(logger.LevelInfo, `connect denied`, c, errNotAllowed, `user`, user, `target`, addr)
+		return
+	}
+	ctx := vnet.NewProxyContext(s.ctx, c.RemoteAddr(), c.LocalAddr())
+	if s.opts.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.opts.timeout)
+		defer cancel()
+	}
+	target, e := s.opts.dialer.DialContext(ctx, `tcp`, addr)
+	if e != nil {
+		writeReply(c, replyCode(e), nil)
+		s.log(logger.LevelWarn, `connect failed`, c, e, `user`, user, `target`, addr)
+		return
+	}
+	e = writeReply(c, ReplySucceeded, target.LocalAddr())
+	if e != nil {
+		target.Close()
+		return
+	}
+	c.SetDeadline(time.Time{})
+	proxy.Join(c, target, proxy.WithIdleTimeout(s.opts.idleTimeout))
+}
+
+// replyCode returns the reply describing why a dial failed.
+func replyCode(e error) uint8 {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(e, syscall.ECONNREFUSED):
+		return ReplyConnectionRefused
+	case errors.Is(e, syscall.ENETUNREACH):
+		return ReplyNetworkUnreachable
+	case errors.Is(e, syscall.EHOSTUNREACH) || errors.As(e, &dnsErr):
+		return ReplyHostUnreachable
+	case errors.Is(e, context.DeadlineExceeded) || errors.Is(e, os.ErrDeadlineExceeded):
+		return ReplyTTLExpired
+	}
+	return ReplyGeneralFailure
+}
+
+// log logs msg with the addresses of c and err if not nil, followed by keyvals.
+func (s *Server) log(level logger.Level, msg string, c net.Conn, err error, keyvals ...interface{}) {
+	l := s.opts.logger
+	if !l.Enabled(level) {
+		return
+	}
+	kv := make([]interface{}, 0, 6+len(keyvals))
+	if c != nil {
+		kv = append(kv, `local`, c.LocalAddr(), `remote`, c.RemoteAddr())
+	}
+	if err != nil {
+		kv = append(kv, `err`, err)
+	}
+	l.Log(level, msg, append(kv, keyvals...)...)
+}
@@ -0,0 +1,94 @@
+package socks5
+
+import (
+	"net"
+	"time"
+
+	"github.com/powerpuffpenguin/vnet"
+	"github.com/powerpuffpenguin/vnet/logger"
+)
+
+var defaultServerOptions = serverOptions{
+	timeout: time.Second * 75,
+	dialer:  &net.Dialer{},
+	logger:  logger.Discard,
+}
+
+type serverOptions struct {
+	timeout     time.Duration
+	idleTimeout time.Duration
+	dialer      vnet.Dialer
+	auth        func(user, password string) bool
+	rules       []Rule
+	udp         net.IP
+	logger      logger.Logger
+}
+type ServerOption interface {
+	apply(*serverOptions)
+}
+type funcServerOption struct {
+	f func(*serverOptions)
+}
+
+func (fdo *funcServerOption) apply(do *serverOptions) {
+	fdo.f(do)
+}
+func newServerOption(f func(*serverOptions)) *funcServerOption {
+	return &funcServerOption{
+		f: f,
+	}
+}
+
+// WithServerTimeout sets how long the server waits for a client to authenticate and send its request,
+// and for the target to be dialed.
+func WithServerTimeout(timeout time.Duration) ServerOption {
+	return newServerOption(func(o *serverOptions) {
+		o.timeout = timeout
+	})
+}
+
+// WithServerIdleTimeout closes the conns and UDP associations that moved no byte for timeout, timeout < 1 never times out.
+func WithServerIdleTimeout(timeout time.Duration) ServerOption {
+	return newServerOption(func(o *serverOptions) {
+		o.idleTimeout = timeout
+	})
+}
+
+// WithServerDialer sets the dialer of the CONNECT targets and of the UDP ASSOCIATE targets with network udp,
+// by default a net.Dialer. d must dial the address it is given: a reverse.Dialer ignores it and always reaches
+// the same service behind an agent, which must then forward by address itself, so rather serve SOCKS5 on the agent.
+// UDP targets are dropped unless d returns a net.PacketConn, which keeps the boundaries of the datagrams.
+func WithServerDialer(d vnet.Dialer) ServerOption {
+	return newServerOption(func(o *serverOptions) {
+		o.dialer = d
+	})
+}
+
+// WithServerAuth requires clients to authenticate with a username and password that auth accepts.
+func WithServerAuth(auth func(user, password string) bool) ServerOption {
+	return newServerOption(func(o *serverOptions) {
+		o.auth = auth
+	})
+}
+
+// WithServerRules only allows the requests matching one of rules.
+func WithServerRules(rules ...Rule) ServerOption {
+	return newServerOption(func(o *serverOptions) {
+		o.rules = rules
+	})
+}
+
+// WithServerUDP enables UDP ASSOCIATE, the datagrams of the clients are relayed by UDP sockets bound to ip.
+// UDP ASSOCIATE is disabled by default, as the listener the server serves may not be on an IP network.
+func WithServerUDP(ip net.IP) ServerOption {
+	return newServerOption(func(o *serverOptions) {
+		o.udp = ip
+	})
+}
+
+// WithServerLogger logs the requests that fail.
+func WithServerLogger(l logger.Logger) ServerOption {
+	return newServerOption(func(o *serverOptions) {
+		o.logger = l
+	})
+}
@@ -0,0 +1,250 @@
+package socks5_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/powerpuffpenguin/vnet"
+	"github.com/powerpuffpenguin/vnet/socks5"
+)
+
+func echoTCP(t *testing.T) net.Listener {
+	t.Helper()
+	l, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	go func() {
+		for {
+			c, e := l.Accept()
+			if e != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return l
+}
+func TestConnect(t *testing.T) {
+	echo := echoTCP(t)
+	defer echo.Close()
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+
+	// the server serves a pipe listener
+	pipe := vnet.ListenPipe()
+	srv := socks5.NewServer(
+		socks5.WithServerAuth(func(user, password string) bool {
+			return user == `dev` && password == `secret`
+		}),
+		socks5.WithServerRules(socks5.Rule{
+			Users: []string{`dev`},
+			Hosts: []string{`127.0.0.0/8`},
+		}),
+	)
+	defer srv.Close()
+	go srv.Serve(pipe)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	d := socks5.NewDialer(`pipe`, ``, socks5.WithDialerForward(pipe), socks5.WithDialerAuth(`dev`, `secret`))
+	c, e := d.DialContext(ctx, `tcp`, echo.Addr().String())
+	if e != nil {
+		t.Fatal(e)
+	}
+	c.Write([]byte(`hello`))
+	b := make([]byte, 5)
+	_, e = io.ReadFull(c, b)
+	c.Close()
+	if e != nil || string(b) != `hello` {
+		t.Fatal(string(b), e)
+	}
+
+	// denied by the rules
+	_, e = d.DialContext(ctx, `tcp`, net.JoinHostPort(`localhost`, port))
+	var re *socks5.ReplyError
+	if !errors.As(e, &re) || re.Reply != socks5.ReplyNotAllowed {
+		t.Fatalf("expect not allowed, got %v", e)
+	}
+
+	// refused by the target
+	closed, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	closed.Close()
+	_, e = d.DialContext(ctx, `tcp`, closed.Addr().String())
+	if !errors.As(e, &re) || re.Reply != socks5.ReplyConnectionRefused {
+		t.Fatalf("expect connection refused, got %v", e)
+	}
+
+	// wrong password
+	d = socks5.NewDialer(`pipe`, ``, socks5.WithDialerForward(pipe), socks5.WithDialerAuth(`dev`, `guess`))
+	_, e = d.DialContext(ctx, `tcp`, echo.Addr().String())
+	if !errors.Is(e, socks5.ErrAuth) {
+		t.Fatalf("expect auth failed, got %v", e)
+	}
+
+	// no credentials
+	d = socks5.NewDialer(`pipe`, ``, socks5.WithDialerForward(pipe))
+	_, e = d.DialContext(ctx, `tcp`, echo.Addr().String())
+	if !errors.Is(e, socks5.ErrNoAcceptableMethods) {
+		t.Fatalf("expect no acceptable methods, got %v", e)
+	}
+}
+
+// associate sends UDP ASSOCIATE to the server at addr and returns the control conn and a UDP conn to the relay.
+func associate(t *testing.T, addr net.Addr) (c net.Conn, uc *net.UDPConn) {
+	c, e := net.Dial(`tcp`, addr.String())
+	if e != nil {
+		t.Fatal(e)
+	}
+	c.SetDeadline(time.Now().Add(time.Second * 5))
+	// greeting without authentication, then UDP ASSOCIATE from an unknown address
+	c.Write([]byte{5, 1, 0, 5, 3, 0, 1, 0, 0, 0, 0, 0, 0})
+	b := make([]byte, 2+10)
+	_, e = io.ReadFull(c, b)
+	if e != nil {
+		t.Fatal(e)
+	} else if !bytes.Equal(b[:5], []byte{5, 0, 5, 0, 0}) || b[5] != 1 {
+		t.Fatalf("unexpected reply %v", b)
+	}
+	relay := &net.UDPAddr{IP: net.IP(b[6:10]), Port: int(binary.BigEndian.Uint16(b[10:]))}
+
+	uc, e = net.DialUDP(`udp`, nil, relay)
+	if e != nil {
+		t.Fatal(e)
+	}
+	uc.SetDeadline(time.Now().Add(time.Second * 5))
+	return
+}
+
+// udpDatagram returns a datagram to target carrying payload, and the length of its header.
+func udpDatagram(target *net.UDPAddr, payload string) (datagram []byte, header int) {
+	datagram = append([]byte{0, 0, 0, 1}, target.IP.To4()...)
+	datagram = binary.BigEndian.AppendUint16(datagram, uint16(target.Port))
+	header = len(datagram)
+	datagram = append(datagram, payload...)
+	return
+}
+func TestUDPAssociate(t *testing.T) {
+	echo, e := net.ListenUDP(`udp`, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer echo.Close()
+	go func() {
+		b := make([]byte, 1500)
+		for {
+			n, addr, e := echo.ReadFrom(b)
+			if e != nil {
+				return
+			}
+			echo.WriteTo(b[:n], addr)
+		}
+	}()
+	l, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	srv := socks5.NewServer(socks5.WithServerUDP(net.IPv4(127, 0, 0, 1)))
+	defer srv.Close()
+	go srv.Serve(l)
+
+	c, uc := associate(t, l.Addr())
+	defer c.Close()
+	defer uc.Close()
+	datagram, header := udpDatagram(echo.LocalAddr().(*net.UDPAddr), `ping`)
+	_, e = uc.Write(datagram)
+	if e != nil {
+		t.Fatal(e)
+	}
+	reply := make([]byte, 1500)
+	n, e := uc.Read(reply)
+	if e != nil {
+		t.Fatal(e)
+	} else if !bytes.Equal(reply[:n], datagram) {
+		t.Fatalf("unexpected reply %v, header %v", reply[:n], datagram[:header])
+	}
+}
+
+// streamDialer returns one end of a pipe, a conn that doesn't keep datagram boundaries.
+type streamDialer struct {
+	peers chan net.Conn
+}
+
+func (d *streamDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+func (d *streamDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	c0, c1 := net.Pipe()
+	d.peers <- c1
+	return c0, nil
+}
+func TestUDPStreamDialer(t *testing.T) {
+	l, e := net.Listen(`tcp`, `127.0.0.1:0`)
+	if e != nil {
+		t.Fatal(e)
+	}
+	dialer := &streamDialer{peers: make(chan net.Conn, 1)}
+	srv := socks5.NewServer(
+		socks5.WithServerUDP(net.IPv4(127, 0, 0, 1)),
+		socks5.WithServerDialer(dialer),
+	)
+	defer srv.Close()
+	go srv.Serve(l)
+
+	c, uc := associate(t, l.Addr())
+	defer c.Close()
+	defer uc.Close()
+	datagram, _ := udpDatagram(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}, `ping`)
+	_, e = uc.Write(datagram)
+	if e != nil {
+		t.Fatal(e)
+	}
+	// the stream is closed at once instead of carrying the datagram
+	var peer net.Conn
+	select {
+	case peer = <-dialer.peers:
+	case <-time.After(time.Second * 5):
+		t.Fatal("not dialed")
+	}
+	peer.SetDeadline(time.Now().Add(time.Second * 5))
+	_, e = peer.Read(make([]byte, 4))
+	if e != io.EOF {
+		t.Fatalf("expect io.EOF, got %v", e)
+	}
+}
+func TestRule(t *testing.T) {
+	rule := socks5.Rule{
+		Commands: []uint8{socks5.CmdConnect},
+		Hosts:    []string{`*.example.com`, `intranet`, `10.0.0.0/8`, `192.0.2.1`},
+		Ports:    []uint16{80, 443},
+	}
+	for _, test := range []struct {
+		req   socks5.Request
+		match bool
+	}{
+		{socks5.Request{Command: socks5.CmdConnect, Host: `www.example.com`, Port: 443}, true},
+		{socks5.Request{Command: socks5.CmdConnect, Host: `WWW.Example.COM`, Port: 80}, true},
+		{socks5.Request{Command: socks5.CmdConnect, Host: `example.com`, Port: 80}, false},
+		{socks5.Request{Command: socks5.CmdConnect, Host: `intranet`, Port: 80}, true},
+		{socks5.Request{Command: socks5.CmdConnect, Host: `10.1.2.3`, Port: 80}, true},
+		{socks5.Request{Command: socks5.CmdConnect, Host: `192.0.2.1`, Port: 80}, true},
+		{socks5.Request{Command: socks5.CmdConnect, Host: `192.0.2.2`, Port: 80}, false},
+		{socks5.Request{Command: socks5.CmdConnect, Host: `10.1.2.3`, Port: 22}, false},
+		{socks5.Request{Command: socks5.CmdUDPAssociate, Host: `10.1.2.3`, Port: 80}, false},
+	} {
+		if rule.Match(&test.req) != test.match {
+			t.Fatalf("%+v expect %v", test.req, test.match)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package socks5
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/powerpuffpenguin/vnet/logger"
+)
+
+// maxUDPTargets is the most targets an association keeps conns to, datagrams to more targets are dropped.
+const maxUDPTargets = 1024
+
+// association relays the datagrams of a client for as long as its control conn stays open.
+type association struct {
+	s    *Server
+	c    net.Conn
+	pc   *net.UDPConn
+	user string
+	// ip and port restrict the source of the client datagrams when valid and not zero
+	ip   netip.Addr
+	port uint16
+
+	m sync.Mutex
+	// client is the source of the first datagram accepted, the only one accepted afterwards
+	client  *net.UDPAddr
+	targets map[string]net.Conn
+	closed  bool
+}
+
+// associate relays the datagrams of the client until c is closed.
+// host and port are where the client says it sends datagrams from, zero if it does not know.
+func (s *Server) associate(c net.Conn, user, host string, port uint16) {
+	pc, e := net.ListenUDP(`udp`, &net.UDPAddr{IP: s.opts.udp})
+	if e != nil {
+		writeReply(c, ReplyGeneralFailure, nil)
+		s.log(logger.LevelWarn, `udp associate failed`, c, e)
+		return
+	}
+	a := &association{
+		s:       s,
+		c:       c,
+		pc:      pc,
+		user:    user,
+		port:    port,
+		targets: make(map[string]net.Conn),
+	}
+	if ip, e := netip.ParseAddr(host); e == nil && !ip.IsUnspecified() {
+		a.ip = ip.Unmap()
+	} else if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		a.ip = addr.AddrPort().Addr().Unmap()
+	}
+	e = writeReply(c, ReplySucceeded, pc.LocalAddr())
+	if e != nil {
+		pc.Close()
+		return
+	}
+	c.SetDeadline(time.Time{})
+	go a.serve()
+	// the association ends with the control conn
+	io.Copy(io.Discard, c)
+	a.close()
+}
+func (a *association) close() {
+	a.m.Lock()
+	a.closed = true
+	targets := a.targets
+	a.targets = nil
+	a.m.Unlock()
+	a.pc.Close()
+	for _, t := range targets {
+		t.Close()
+	}
+}
+
+// serve sends the datagrams of the client to their targets.
+// Datagram: reserved(2) fragment(1) address type, address and port, data
+func (a *association) serve() {
+	b := make([]byte, 64*1024)
+	for {
+		n, from, e := a.pc.ReadFromUDP(b)
+		if e != nil {
+			return
+		} else if n < 3 || b[0] != 0 || b[1] != 0 || b[2] != 0 || !a.accepts(from) {
+			// fragments are not supported and dropped
+			continue
+		}
+		host, port, l, e := parseAddr(b[3:n])
+		if e != nil {
+			continue
+		}
+		t, e := a.target(host, port)
+		if e != nil {
+			a.s.log(logger.LevelDebug, `udp datagram dropped`, a.c, e, `user`, a.user, `target`, net.JoinHostPort(host, strconv.Itoa(int(port))))
+			continue
+		}
+		if a.s.opts.idleTimeout > 0 {
+			t.SetReadDeadline(time.Now().Add(a.s.opts.idleTimeout))
+		}
+		t.Write(b[3+l : n])
+	}
+}
+
+// accepts reports whether a datagram from addr comes from the client.
+func (a *association) accepts(from *net.UDPAddr) bool {
+	ap := from.AddrPort()
+	a.m.Lock()
+	defer a.m.Unlock()
+	if a.client != nil {
+		return ap == a.client.AddrPort()
+	} else if a.ip.IsValid() && ap.Addr().Unmap() != a.ip ||
+		a.port != 0 && ap.Port() != a.port {
+		return false
+	}
+	a.client = from
+	return true
+}
+
+// target returns the conn to host:port, dialing it if needed.
+func (a *association) target(host string, port uint16) (t net.Conn, e error) {
+	addr := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	a.m.Lock()
+	t, ok := a.targets[addr]
+	full := len(a.targets) >= maxUDPTargets
+	a.m.Unlock()
+	if ok {
+		return
+	} else if full {
+		e = errTooManyTargets
+		return
+	} else if !allowed(a.s.opts.rules, &Request{
+		Command: CmdUDPAssociate,
+		User:    a.user,
+		Host:    host,
+		Port:    port,
+	}) {
+		e = errNotAllowed
+		return
+	}
+	ctx := a.s.ctx
+	if a.s.opts.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.s.opts.timeout)
+		defer cancel()
+	}
+	t, e = a.s.opts.dialer.DialContext(ctx, `udp`, addr)
+	if e != nil {
+		return
+	}
+	if _, ok := t.(net.PacketConn); !ok {
+		// a stream would merge the datagrams
+		t.Close()
+		t = nil
+		e = errNotPacketConn
+		return
+	}
+	a.m.Lock()
+	if a.closed {
+		a.m.Unlock()
+		t.Close()
+		e = net.ErrClosed
+		return
+	}
+	a.targets[addr] = t
+	a.m.Unlock()
+	go a.reply(addr, host, port, t)
+	return
+}
+
+// reply sends the datagrams of a target to the client until the target is idle or the association is closed.
+func (a *association) reply(addr, host string, port uint16, t net.Conn) {
+	header := []byte{0, 0, 0}
+	if ua, ok := t.RemoteAddr().(*net.UDPAddr); ok {
+		header = appendNetAddr(header, ua)
+	} else {
+		header, _ = appendAddr(header, host, port)
+	}
+	b := make([]byte, len(header)+64*1024)
+	copy(b, header)
+	for {
+		if a.s.opts.idleTimeout > 0 {
+			t.SetReadDeadline(time.Now().Add(a.s.opts.idleTimeout))
+		}
+		n, e := t.Read(b[len(header):])
+		if e != nil {
+			break
+		}
+		a.m.Lock()
+		client := a.client
+		a.m.Unlock()
+		if client != nil {
+			a.pc.WriteToUDP(b[:len(header)+n], client)
+		}
+	}
+	a.m.Lock()
+	if a.targets[addr] == t {
+		delete(a.targets, addr)
+	}
+	a.m.Unlock()
+	t.Close()
+}
@@ -0,0 +1,104 @@
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"sync"
+	"time"
+)
+
+// SpanData is a span recorded by Recorder.
+type SpanData struct {
+	Name string
+	SpanContext
+	// Parent is the span context of the parent span, invalid if the span is a root.
+	Parent     SpanContext
+	Start      time.Time
+	End        time.Time
+	Attributes []Attribute
+	Err        error
+}
+
+// Attribute returns the value of the attribute key, nil if it is not set.
+func (s *SpanData) Attribute(key string) interface{} {
+	for i := len(s.Attributes) - 1; i >= 0; i-- {
+		if s.Attributes[i].Key == key {
+			return s.Attributes[i].Value
+		}
+	}
+	return nil
+}
+
+// Recorder is a Tracer keeping the ended spans in memory, to test what is traced.
+// Spans are children of the span context held by the context passed to Start.
+type Recorder struct {
+	m     sync.Mutex
+	spans []SpanData
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+func (r *Recorder) Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	s := &recordedSpan{
+		r: r,
+		data: SpanData{
+			Name:       name,
+			Start:      time.Now(),
+			Attributes: append([]Attribute(nil), attrs...),
+		},
+	}
+	if parent, ok := SpanContextFromContext(ctx); ok && parent.IsValid() {
+		s.data.Parent = parent
+		s.data.TraceID = parent.TraceID
+	} else {
+		rand.Read(s.data.TraceID[:])
+	}
+	rand.Read(s.data.SpanID[:])
+	return ContextWithSpanContext(ctx, s.data.SpanContext), s
+}
+
+// Spans returns the spans ended so far, in the order they ended.
+func (r *Recorder) Spans() []SpanData {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return append([]SpanData(nil), r.spans...)
+}
+
+// Reset forgets the spans ended so far.
+func (r *Recorder) Reset() {
+	r.m.Lock()
+	r.spans = nil
+	r.m.Unlock()
+}
+
+type recordedSpan struct {
+	r     *Recorder
+	m     sync.Mutex
+	data  SpanData
+	ended bool
+}
+
+func (s *recordedSpan) SetAttributes(attrs ...Attribute) {
+	s.m.Lock()
+	if !s.ended {
+		s.data.Attributes = append(s.data.Attributes, attrs...)
+	}
+	s.m.Unlock()
+}
+func (s *recordedSpan) End(err error) {
+	s.m.Lock()
+	if s.ended {
+		s.m.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	s.data.Err = err
+	data := s.data
+	s.m.Unlock()
+
+	s.r.m.Lock()
+	s.r.spans = append(s.r.spans, data)
+	s.r.m.Unlock()
+}
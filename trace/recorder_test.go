@@ -0,0 +1,52 @@
+package trace_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/powerpuffpenguin/vnet/trace"
+)
+
+func TestRecorder(t *testing.T) {
+	r := trace.NewRecorder()
+	parent := trace.SpanContext{
+		TraceID: [16]byte{1},
+		SpanID:  [8]byte{2},
+	}
+	ctx := trace.ContextWithSpanContext(context.Background(), parent)
+	ctx, span := r.Start(ctx, `dial`, trace.String(`k`, `v`))
+	_, child := r.Start(ctx, `wait`)
+	child.SetAttributes(trace.String(`k`, `child`))
+	child.End(nil)
+	e := errors.New(`failed`)
+	span.End(e)
+	span.End(nil)
+
+	spans := r.Spans()
+	if len(spans) != 2 {
+		t.Fatalf("expect 2 spans, got %v", spans)
+	}
+	wait, dial := spans[0], spans[1]
+	if wait.Name != `wait` || dial.Name != `dial` {
+		t.Fatalf("unexpected spans %v", spans)
+	} else if dial.TraceID != parent.TraceID || dial.Parent != parent || dial.Err != e {
+		t.Fatalf("unexpected dial span %+v", dial)
+	} else if wait.TraceID != parent.TraceID || wait.Parent != dial.SpanContext || wait.Err != nil {
+		t.Fatalf("unexpected wait span %+v", wait)
+	} else if wait.Attribute(`k`) != `child` || dial.Attribute(`k`) != `v` || dial.Attribute(`none`) != nil {
+		t.Fatalf("unexpected attributes %v %v", wait.Attributes, dial.Attributes)
+	} else if dial.End.Before(dial.Start) {
+		t.Fatalf("unexpected times %+v", dial)
+	}
+
+	_, root := r.Start(context.Background(), `root`)
+	root.End(nil)
+	if spans := r.Spans(); !spans[2].SpanContext.IsValid() || spans[2].Parent.IsValid() {
+		t.Fatalf("unexpected root %+v", spans[2])
+	}
+	r.Reset()
+	if len(r.Spans()) != 0 {
+		t.Fatal("expect no span after reset")
+	}
+}
@@ -0,0 +1,92 @@
+// Package trace is the small tracing interface through which vnet reports the phases of its dials.
+//
+// It follows the OpenTelemetry model: a Tracer starts spans as children of the span found in the context,
+// so a Tracer adapting an OpenTelemetry tracer nests vnet spans in the traces of its callers.
+// Recorder keeps spans in memory for tests.
+package trace
+
+import (
+	"context"
+	"fmt"
+)
+
+// Attribute is a key/value pair describing a span.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+func (a Attribute) String() string {
+	return fmt.Sprintf(`%s=%v`, a.Key, a.Value)
+}
+
+// String returns a string attribute.
+func String(key, value string) Attribute {
+	return Attribute{
+		Key:   key,
+		Value: value,
+	}
+}
+
+// Attribute keys set by vnet.
+const (
+	// AgentID identifies the agent, by its public key in hex or by its IP.
+	AgentID = `vnet.agent.id`
+	// PeerAddr is the remote address of the conn.
+	PeerAddr = `net.peer.addr`
+	// Selector is the selector of the dial.
+	Selector = `vnet.selector`
+)
+
+// Tracer starts spans.
+type Tracer interface {
+	// Start starts a span named name, child of the span in ctx if any,
+	// it returns a context holding the new span.
+	Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span)
+}
+
+// Span is an operation being traced.
+type Span interface {
+	// SetAttributes adds attributes to the span.
+	SetAttributes(attrs ...Attribute)
+	// End ends the span, err is the error that ended the operation, nil if it succeeded.
+	End(err error)
+}
+
+// Discard is a Tracer whose spans are dropped.
+var Discard Tracer = discard{}
+
+type discard struct{}
+
+func (discard) Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	return ctx, nop{}
+}
+
+type nop struct{}
+
+func (nop) SetAttributes(attrs ...Attribute) {}
+func (nop) End(err error)                    {}
+
+// SpanContext identifies a span within a trace, as the W3C trace context does.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+}
+
+// IsValid reports whether sc identifies a span.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+type spanContextKey struct{}
+
+// ContextWithSpanContext returns a copy of ctx holding sc, to continue a trace received from another process.
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// SpanContextFromContext returns the span context held by ctx.
+func SpanContextFromContext(ctx context.Context) (sc SpanContext, ok bool) {
+	sc, ok = ctx.Value(spanContextKey{}).(SpanContext)
+	return
+}
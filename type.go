@@ -9,3 +9,11 @@ type Dialer interface {
 	Dial(network, addr string) (net.Conn, error)
 	DialContext(ctx context.Context, network, addr string) (conn net.Conn, e error)
 }
+
+// Listener is a net.Listener whose Accept can be canceled per call.
+type Listener interface {
+	net.Listener
+	// AcceptContext waits for and returns the next connection to the listener,
+	// or returns ctx.Err() if ctx is done first. The listener itself stays open.
+	AcceptContext(ctx context.Context) (net.Conn, error)
+}